@@ -0,0 +1,837 @@
+// Imgmeta shows and edits the metadata of PNG, JPEG and GIF images
+// without re-encoding them.
+//
+// Usage:
+//
+//	imgmeta [flags] file...
+//
+// With no editing flags imgmeta prints the metadata of each file. With
+// editing flags it rewrites each file with the modified metadata,
+// either to the file named by -o or, with -w, in place. Images are
+// read as deferred images and written back unchanged, so the pixel
+// data in the output is bit-identical to the input.
+//
+// Individual EXIF tags and XMP properties can be set and deleted.
+// EXIF tags are named as in the metadata package's EXIFFields table,
+// such as Artist or GPSLatitude, or as an IFD and tag number, such as
+// exif:0xa430, where the IFD is one of image, exif or gps. XMP
+// properties are named with one of the prefixes in the metadata
+// package's XMPNamespaces table, such as dc:title. IPTC datasets in a
+// JPEG's APP13 segment are named as in the metadata package's
+// IPTCDatasets table, such as Caption-Abstract, or by their record and
+// dataset numbers, such as 2:120; only the application record can be
+// edited. The whole EXIF block, XMP packet or IPTC data can also be
+// stripped, and XMP can be replaced with a packet read from a file.
+// GIF and JPEG comments can be added and deleted.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/gif"
+	"github.com/drswork/image/jpeg"
+	"github.com/drswork/image/metadata"
+	"github.com/drswork/image/png"
+)
+
+// JPEG APPn segment tags, which are followed by a NUL byte.
+const (
+	exifTag = "Exif"
+	xmpTag  = "http://ns.adobe.com/xap/1.0/"
+	iptcTag = "Photoshop 3.0"
+)
+
+// exifIFDs maps the IFD names used on the command line to the IFDs.
+var exifIFDs = map[string]metadata.EXIFIFD{
+	"image": metadata.EXIFImageIFD,
+	"exif":  metadata.EXIFPhotoIFD,
+	"gps":   metadata.EXIFGPSIFD,
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// edits holds the metadata changes requested on the command line.
+type edits struct {
+	setText        stringList
+	deleteText     stringList
+	setEXIF        stringList
+	deleteEXIF     stringList
+	setXMP         stringList
+	deleteXMP      stringList
+	setIPTC        stringList
+	deleteIPTC     stringList
+	addComment     stringList
+	deleteComments bool
+	xmpFile        string
+	stripXMP       bool
+	stripEXIF      bool
+	stripIPTC      bool
+	iccFile        string
+	iccName        string
+	stripICC       bool
+
+	// xmp and icc hold the contents of xmpFile and iccFile.
+	xmp []byte
+	icc []byte
+
+	// exif, xmpProps and iptc hold the parsed EXIF, XMP and IPTC field
+	// edits, in the order they're applied.
+	exif     []exifEdit
+	xmpProps []xmpEdit
+	iptc     []iptcEdit
+}
+
+// exifEdit sets an EXIF tag to value, or deletes it if del is set.
+type exifEdit struct {
+	field metadata.EXIFField
+	value string
+	del   bool
+}
+
+// xmpEdit sets an XMP property to value, or deletes it if del is set.
+type xmpEdit struct {
+	name  xml.Name
+	value string
+	del   bool
+}
+
+// iptcEdit sets an IPTC dataset to value, or deletes it if del is
+// set.
+type iptcEdit struct {
+	dataset metadata.IPTCDataset
+	value   string
+	del     bool
+}
+
+// requested reports whether any edits were requested.
+func (e *edits) requested() bool {
+	return len(e.setText) > 0 || len(e.deleteText) > 0 || len(e.addComment) > 0 ||
+		len(e.setEXIF) > 0 || len(e.deleteEXIF) > 0 || len(e.setXMP) > 0 ||
+		len(e.deleteXMP) > 0 || len(e.setIPTC) > 0 || len(e.deleteIPTC) > 0 ||
+		e.deleteComments || e.xmpFile != "" || e.stripXMP || e.stripEXIF ||
+		e.stripIPTC || e.iccFile != "" || e.stripICC
+}
+
+func main() {
+	var e edits
+	flag.Var(&e.setText, "set-text", "set the PNG text entry `key=value`")
+	flag.Var(&e.deleteText, "delete-text", "delete the PNG text entry `key`")
+	flag.Var(&e.setEXIF, "set-exif", "set the EXIF tag `name=value`")
+	flag.Var(&e.deleteEXIF, "delete-exif", "delete the EXIF tag `name`")
+	flag.Var(&e.setXMP, "set-xmp", "set the XMP property `prefix:name=value`")
+	flag.Var(&e.deleteXMP, "delete-xmp", "delete the XMP property `prefix:name`")
+	flag.Var(&e.setIPTC, "set-iptc", "set the JPEG IPTC dataset `name=value`")
+	flag.Var(&e.deleteIPTC, "delete-iptc", "delete the JPEG IPTC dataset `name`")
+	flag.Var(&e.addComment, "add-comment", "add a GIF or JPEG `comment`")
+	flag.BoolVar(&e.deleteComments, "delete-comments", false, "delete all GIF and JPEG comments")
+	flag.StringVar(&e.xmpFile, "xmp", "", "replace the XMP packet with the contents of `file`")
+	flag.BoolVar(&e.stripXMP, "strip-xmp", false, "remove the XMP packet")
+	flag.BoolVar(&e.stripEXIF, "strip-exif", false, "remove the EXIF data")
+	flag.BoolVar(&e.stripIPTC, "strip-iptc", false, "remove the IPTC data")
+	flag.StringVar(&e.iccFile, "icc", "", "embed the ICC color profile in `file`")
+	flag.StringVar(&e.iccName, "icc-name", "ICC Profile", "the `name` of the embedded PNG ICC profile")
+	flag.BoolVar(&e.stripICC, "strip-icc", false, "remove the ICC color profile")
+	out := flag.String("o", "", "write the edited image to `file`")
+	inPlace := flag.Bool("w", false, "edit the images in place")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: imgmeta [flags] file...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := e.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "imgmeta: %v\n", err)
+		os.Exit(2)
+	}
+	if e.requested() {
+		switch {
+		case *out != "" && *inPlace:
+			fmt.Fprintf(os.Stderr, "imgmeta: -o and -w can't be used together\n")
+			os.Exit(2)
+		case *out != "" && len(files) > 1:
+			fmt.Fprintf(os.Stderr, "imgmeta: -o can only be used with a single file\n")
+			os.Exit(2)
+		case *out == "" && !*inPlace:
+			fmt.Fprintf(os.Stderr, "imgmeta: editing needs -o or -w\n")
+			os.Exit(2)
+		}
+	}
+
+	ctx := context.Background()
+	status := 0
+	for _, fn := range files {
+		var err error
+		if e.requested() {
+			dst := *out
+			if *inPlace {
+				dst = fn
+			}
+			err = editFile(ctx, fn, dst, &e)
+		} else {
+			err = showFile(ctx, os.Stdout, fn)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "imgmeta: %s: %v\n", fn, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// load checks the requested edits for consistency and reads any
+// files they refer to.
+func (e *edits) load() error {
+	if e.xmpFile != "" && e.stripXMP {
+		return errors.New("-xmp and -strip-xmp can't be used together")
+	}
+	if e.iccFile != "" && e.stripICC {
+		return errors.New("-icc and -strip-icc can't be used together")
+	}
+	if e.stripEXIF && (len(e.setEXIF) > 0 || len(e.deleteEXIF) > 0) {
+		return errors.New("-strip-exif can't be used with -set-exif or -delete-exif")
+	}
+	if e.stripXMP && (len(e.setXMP) > 0 || len(e.deleteXMP) > 0) {
+		return errors.New("-strip-xmp can't be used with -set-xmp or -delete-xmp")
+	}
+	if e.stripIPTC && (len(e.setIPTC) > 0 || len(e.deleteIPTC) > 0) {
+		return errors.New("-strip-iptc can't be used with -set-iptc or -delete-iptc")
+	}
+	for _, kv := range e.setText {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("-set-text %q isn't of the form key=value", kv)
+		}
+	}
+	for _, n := range e.deleteEXIF {
+		f, err := parseEXIFField(n)
+		if err != nil {
+			return err
+		}
+		e.exif = append(e.exif, exifEdit{field: f, del: true})
+	}
+	for _, kv := range e.setEXIF {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return fmt.Errorf("-set-exif %q isn't of the form name=value", kv)
+		}
+		f, err := parseEXIFField(kv[:i])
+		if err != nil {
+			return err
+		}
+		e.exif = append(e.exif, exifEdit{field: f, value: kv[i+1:]})
+	}
+	for _, n := range e.deleteXMP {
+		name, err := parseXMPName(n)
+		if err != nil {
+			return err
+		}
+		e.xmpProps = append(e.xmpProps, xmpEdit{name: name, del: true})
+	}
+	for _, kv := range e.setXMP {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return fmt.Errorf("-set-xmp %q isn't of the form prefix:name=value", kv)
+		}
+		name, err := parseXMPName(kv[:i])
+		if err != nil {
+			return err
+		}
+		e.xmpProps = append(e.xmpProps, xmpEdit{name: name, value: kv[i+1:]})
+	}
+	for _, n := range e.deleteIPTC {
+		d, err := parseIPTCDataset(n)
+		if err != nil {
+			return err
+		}
+		e.iptc = append(e.iptc, iptcEdit{dataset: d, del: true})
+	}
+	for _, kv := range e.setIPTC {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return fmt.Errorf("-set-iptc %q isn't of the form name=value", kv)
+		}
+		d, err := parseIPTCDataset(kv[:i])
+		if err != nil {
+			return err
+		}
+		e.iptc = append(e.iptc, iptcEdit{dataset: d, value: kv[i+1:]})
+	}
+	var err error
+	if e.xmpFile != "" {
+		if e.xmp, err = ioutil.ReadFile(e.xmpFile); err != nil {
+			return err
+		}
+	}
+	if e.iccFile != "" {
+		if e.icc, err = ioutil.ReadFile(e.iccFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseEXIFField returns the EXIF tag with the given name, which is
+// either in metadata.EXIFFields or an IFD name and tag number
+// separated by a colon.
+func parseEXIFField(name string) (metadata.EXIFField, error) {
+	if f, ok := metadata.EXIFFields[name]; ok {
+		return f, nil
+	}
+	i := strings.Index(name, ":")
+	if i < 0 {
+		return metadata.EXIFField{}, fmt.Errorf("unknown EXIF tag %q", name)
+	}
+	ifd, ok := exifIFDs[name[:i]]
+	if !ok {
+		return metadata.EXIFField{}, fmt.Errorf("unknown EXIF IFD %q", name[:i])
+	}
+	tag, err := strconv.ParseUint(name[i+1:], 0, 16)
+	if err != nil {
+		return metadata.EXIFField{}, fmt.Errorf("bad EXIF tag number %q", name[i+1:])
+	}
+	return metadata.EXIFField{IFD: ifd, Tag: uint16(tag)}, nil
+}
+
+// parseXMPName returns the XMP property with the given prefixed name.
+func parseXMPName(name string) (xml.Name, error) {
+	i := strings.Index(name, ":")
+	if i < 0 {
+		return xml.Name{}, fmt.Errorf("XMP property %q has no prefix", name)
+	}
+	ns, ok := metadata.XMPNamespaces[name[:i]]
+	if !ok {
+		return xml.Name{}, fmt.Errorf("unknown XMP prefix %q", name[:i])
+	}
+	return xml.Name{Space: ns, Local: name[i+1:]}, nil
+}
+
+// parseIPTCDataset returns the IPTC dataset with the given name, which
+// is either in metadata.IPTCDatasets or a record and dataset number
+// separated by a colon.
+func parseIPTCDataset(name string) (metadata.IPTCDataset, error) {
+	if d, ok := metadata.IPTCDatasets[name]; ok {
+		return d, nil
+	}
+	i := strings.Index(name, ":")
+	if i < 0 {
+		return metadata.IPTCDataset{}, fmt.Errorf("unknown IPTC dataset %q", name)
+	}
+	r, err := strconv.ParseUint(name[:i], 10, 8)
+	if err != nil {
+		return metadata.IPTCDataset{}, fmt.Errorf("bad IPTC record number %q", name[:i])
+	}
+	d, err := strconv.ParseUint(name[i+1:], 10, 8)
+	if err != nil {
+		return metadata.IPTCDataset{}, fmt.Errorf("bad IPTC dataset number %q", name[i+1:])
+	}
+	return metadata.IPTCDataset{Record: uint8(r), Dataset: uint8(d)}, nil
+}
+
+// editEXIF applies the EXIF field edits to b, a TIFF format EXIF
+// block.
+func (e *edits) editEXIF(b []byte) ([]byte, error) {
+	var err error
+	for _, x := range e.exif {
+		if x.del {
+			b, err = metadata.DeleteEXIFField(b, x.field.IFD, x.field.Tag)
+		} else {
+			b, err = metadata.SetEXIFField(b, x.field, x.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// editXMP applies the XMP property edits to the packet x.
+func (e *edits) editXMP(x string) (string, error) {
+	var err error
+	for _, p := range e.xmpProps {
+		if p.del {
+			x, err = metadata.DeleteXMPProperty(x, p.name)
+		} else {
+			x, err = metadata.SetXMPProperty(x, p.name, p.value)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return x, nil
+}
+
+// editIPTC applies the IPTC dataset edits to b, a Photoshop image
+// resource block.
+func (e *edits) editIPTC(b []byte) ([]byte, error) {
+	var err error
+	for _, x := range e.iptc {
+		if x.del {
+			b, err = metadata.DeleteIPTCDataset(b, x.dataset)
+		} else {
+			b, err = metadata.SetIPTCDataset(b, x.dataset, x.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// decode reads the image in fn, deferring the decoding of both the
+// image data and the metadata.
+func decode(ctx context.Context, fn string) (image.Image, image.Metadata, string, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return image.DecodeWithOptions(ctx, bytes.NewReader(b), image.DataDecodeOptions{
+		DecodeImage:    image.DeferData,
+		DecodeMetadata: image.DeferData,
+	})
+}
+
+// showFile prints the metadata of the image in fn to w.
+func showFile(ctx context.Context, w io.Writer, fn string) error {
+	m, md, format, err := decode(ctx, fn)
+	if err != nil {
+		return err
+	}
+	b := m.Bounds()
+	fmt.Fprintf(w, "%s: %s, %dx%d\n", fn, format, b.Dx(), b.Dy())
+
+	switch md := md.(type) {
+	case *png.Metadata:
+		showPNG(w, md)
+	case *jpeg.Metadata:
+		showJPEG(w, md)
+	case *gif.Metadata:
+		showGIF(w, md)
+	}
+	return nil
+}
+
+func showPNG(w io.Writer, m *png.Metadata) {
+	for _, t := range m.Text {
+		fmt.Fprintf(w, "  Text %q (%v): %q\n", t.Key, t.EntryType, t.Value)
+	}
+	if name, p := m.RawICC(); p != nil {
+		fmt.Fprintf(w, "  ICC profile %q: %d bytes\n", name, len(p))
+	}
+	for _, p := range m.SuggestedPalettes {
+		fmt.Fprintf(w, "  Suggested palette %q: %d colors, %d-bit\n", p.Name, len(p.Entries), p.SampleDepth)
+	}
+	for _, c := range m.UnknownChunks {
+		fmt.Fprintf(w, "  Chunk %s (%v): %d bytes\n", c.Type, c.Position, len(c.Data))
+	}
+	if x := m.RawEXIF(); x != nil {
+		fmt.Fprintf(w, "  EXIF: %d bytes\n", len(x))
+	}
+	if x := m.RawXMP(); x != "" {
+		fmt.Fprintf(w, "  XMP: %d bytes\n", len(x))
+	}
+	if m.LastModified != nil {
+		fmt.Fprintf(w, "  Last modified: %v\n", *m.LastModified)
+	}
+	if m.Gamma != nil {
+		fmt.Fprintf(w, "  Gamma: %v\n", *m.Gamma)
+	}
+	if m.Chroma != nil {
+		fmt.Fprintf(w, "  Chroma: %v\n", *m.Chroma)
+	}
+	if m.SRGBIntent != nil {
+		fmt.Fprintf(w, "  sRGB intent: %v\n", *m.SRGBIntent)
+	}
+	if m.CodingPoints != nil {
+		fmt.Fprintf(w, "  Coding points: %v\n", *m.CodingPoints)
+	}
+	if m.MasteringDisplay != nil {
+		fmt.Fprintf(w, "  Mastering display: %v\n", *m.MasteringDisplay)
+	}
+	if m.ContentLightLevel != nil {
+		fmt.Fprintf(w, "  Content light level: %v\n", *m.ContentLightLevel)
+	}
+	if m.SignificantBits != nil {
+		fmt.Fprintf(w, "  Significant bits: %v\n", *m.SignificantBits)
+	}
+	if m.Background != nil {
+		fmt.Fprintf(w, "  Background: %v\n", *m.Background)
+	}
+	if m.Dimension != nil {
+		fmt.Fprintf(w, "  Dimension: %v\n", *m.Dimension)
+	}
+	if m.Histogram != nil {
+		fmt.Fprintf(w, "  Histogram: %d entries\n", len(m.Histogram))
+	}
+}
+
+func showJPEG(w io.Writer, m *jpeg.Metadata) {
+	fmt.Fprintf(w, "  JFIF version %v, density %dx%d %v\n", m.Version, m.XDensity, m.YDensity, m.Units)
+	for _, c := range m.Comments {
+		fmt.Fprintf(w, "  Comment: %q\n", c)
+	}
+	if m.Thumbnail != nil {
+		fmt.Fprintf(w, "  Thumbnail: %dx%d\n", m.XThumbnail, m.YThumbnail)
+	}
+	if p := m.RawICC(); p != nil {
+		fmt.Fprintf(w, "  ICC profile: %d bytes\n", len(p))
+	}
+	for n := 0; n < 16; n++ {
+		for _, s := range m.AppSegments(n) {
+			desc := segmentTag(s)
+			switch desc {
+			case exifTag:
+				desc = "EXIF"
+			case xmpTag:
+				desc = "XMP"
+			case iptcTag:
+				desc = "IPTC"
+			default:
+				desc = fmt.Sprintf("%q", desc)
+			}
+			fmt.Fprintf(w, "  APP%d %s: %d bytes\n", n, desc, len(s))
+		}
+	}
+}
+
+func showGIF(w io.Writer, m *gif.Metadata) {
+	for _, c := range m.Comments {
+		fmt.Fprintf(w, "  Comment: %q\n", c)
+	}
+	for k, x := range m.Extensions {
+		fmt.Fprintf(w, "  Application extension %q: %d bytes\n", k, len(x.Body))
+	}
+}
+
+// segmentTag returns the identifying tag at the start of a JPEG APPn
+// segment payload.
+func segmentTag(s []byte) string {
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		return string(s[:i])
+	}
+	return ""
+}
+
+// removeSegments returns segs without the segments tagged with tag.
+func removeSegments(segs [][]byte, tag string) [][]byte {
+	var r [][]byte
+	for _, s := range segs {
+		if segmentTag(s) != tag {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// findSegment returns the index of the first segment in segs tagged
+// with tag, and its payload after the tag's header, or -1 and nil if
+// there isn't one. EXIF segments have two NUL bytes after the tag and
+// others one.
+func findSegment(segs [][]byte, tag string) (int, []byte) {
+	for i, s := range segs {
+		if segmentTag(s) != tag {
+			continue
+		}
+		n := len(tag) + 1
+		if tag == exifTag {
+			n++
+		}
+		if n > len(s) {
+			n = len(s)
+		}
+		return i, s[n:]
+	}
+	return -1, nil
+}
+
+// replaceSegment sets the payload of segment i of segs, or of a new
+// segment if i is -1, to header followed by b. A nil b removes the
+// segment.
+func replaceSegment(segs [][]byte, i int, header string, b []byte) ([][]byte, error) {
+	if b == nil {
+		if i >= 0 {
+			segs = append(segs[:i:i], segs[i+1:]...)
+		}
+		return segs, nil
+	}
+	s := append([]byte(header), b...)
+	// A segment's length, including the two length bytes, must fit in
+	// 16 bits.
+	if len(s) > 0xffff-2 {
+		return nil, fmt.Errorf("%d bytes of data is too large for a JPEG segment", len(s))
+	}
+	if i < 0 {
+		return append(segs, s), nil
+	}
+	segs = append([][]byte(nil), segs...)
+	segs[i] = s
+	return segs, nil
+}
+
+// editFile applies the edits in e to the image in src and writes the
+// result to dst. If dst is the same as src the file is replaced
+// atomically.
+func editFile(ctx context.Context, src, dst string, e *edits) error {
+	m, md, format, err := decode(ctx, src)
+	if err != nil {
+		return err
+	}
+	// Only a deferred image is written back without being re-encoded.
+	if _, ok := m.(image.Deferred); !ok {
+		return fmt.Errorf("%s image data can't be passed through unchanged", format)
+	}
+
+	switch md := md.(type) {
+	case *png.Metadata:
+		err = e.applyPNG(md)
+	case *jpeg.Metadata:
+		err = e.applyJPEG(md)
+	case *gif.Metadata:
+		err = e.applyGIF(md)
+	default:
+		err = fmt.Errorf("can't edit %s metadata", format)
+	}
+	if err != nil {
+		return err
+	}
+	opt, ok := md.(image.WriteOption)
+	if !ok {
+		return fmt.Errorf("can't write %s metadata", format)
+	}
+
+	var buf bytes.Buffer
+	if err := image.EncodeWithOptions(ctx, &buf, format, m, opt); err != nil {
+		return err
+	}
+	return writeFile(dst, buf.Bytes(), src)
+}
+
+func (e *edits) applyPNG(m *png.Metadata) error {
+	if len(e.addComment) > 0 || e.deleteComments {
+		return errors.New("comments are only supported for gif and jpeg images")
+	}
+	if e.stripIPTC || len(e.iptc) > 0 {
+		return errors.New("IPTC data is only supported for jpeg images")
+	}
+	for _, k := range e.deleteText {
+		var text []*png.TextEntry
+		for _, t := range m.Text {
+			if t.Key != k {
+				text = append(text, t)
+			}
+		}
+		m.Text = text
+	}
+	for _, kv := range e.setText {
+		i := strings.Index(kv, "=")
+		setText(m, kv[:i], kv[i+1:])
+	}
+	if e.stripEXIF {
+		m.SetEXIF(nil)
+	}
+	if e.stripXMP {
+		m.SetRawXMP("")
+	}
+	if e.xmp != nil {
+		m.SetRawXMP(string(e.xmp))
+	}
+	if len(e.exif) > 0 {
+		x, err := e.editEXIF(m.RawEXIF())
+		if err != nil {
+			return err
+		}
+		m.SetRawEXIF(x)
+	}
+	if len(e.xmpProps) > 0 {
+		x, err := e.editXMP(m.RawXMP())
+		if err != nil {
+			return err
+		}
+		m.SetRawXMP(x)
+	}
+	if e.stripICC {
+		m.SetRawICC("", nil)
+	}
+	if e.icc != nil {
+		m.SetRawICC(e.iccName, e.icc)
+	}
+	return nil
+}
+
+// setText sets the value of the text entry with key k to v, adding an
+// entry if there isn't one already.
+func setText(m *png.Metadata, k, v string) {
+	et := png.EtText
+	if !isLatin1(v) {
+		et = png.EtItext
+	}
+	for _, t := range m.Text {
+		if t.Key == k {
+			t.Value = v
+			if et == png.EtItext {
+				t.EntryType = et
+			}
+			return
+		}
+	}
+	m.Text = append(m.Text, &png.TextEntry{Key: k, Value: v, EntryType: et})
+}
+
+// isLatin1 reports whether s can be stored in an uncompressed PNG
+// text entry.
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r > 0xff || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *edits) applyJPEG(m *jpeg.Metadata) error {
+	if len(e.setText) > 0 || len(e.deleteText) > 0 {
+		return errors.New("text entries are only supported for png images")
+	}
+	for _, c := range e.addComment {
+		// A COM segment's length, including the two length bytes, must
+		// fit in 16 bits.
+		if len(c) > 0xffff-2 {
+			return fmt.Errorf("%d byte comment is too large for a JPEG segment", len(c))
+		}
+	}
+	if e.deleteComments {
+		m.Comments = nil
+	}
+	m.Comments = append(m.Comments, e.addComment...)
+	app1 := m.AppSegments(1)
+	if e.stripEXIF {
+		app1 = removeSegments(app1, exifTag)
+	}
+	if e.stripXMP || e.xmp != nil {
+		app1 = removeSegments(app1, xmpTag)
+	}
+	if e.xmp != nil {
+		app1 = append(app1, append([]byte(xmpTag+"\x00"), e.xmp...))
+	}
+	if len(e.exif) > 0 {
+		i, b := findSegment(app1, exifTag)
+		x, err := e.editEXIF(b)
+		if err != nil {
+			return err
+		}
+		if app1, err = replaceSegment(app1, i, exifTag+"\x00\x00", x); err != nil {
+			return err
+		}
+	}
+	if len(e.xmpProps) > 0 {
+		i, b := findSegment(app1, xmpTag)
+		x, err := e.editXMP(string(b))
+		if err != nil {
+			return err
+		}
+		var xb []byte
+		if x != "" {
+			xb = []byte(x)
+		}
+		if app1, err = replaceSegment(app1, i, xmpTag+"\x00", xb); err != nil {
+			return err
+		}
+	}
+	m.SetAppSegments(1, app1)
+	if e.stripIPTC {
+		m.SetAppSegments(13, removeSegments(m.AppSegments(13), iptcTag))
+	}
+	if len(e.iptc) > 0 {
+		app13 := m.AppSegments(13)
+		i, b := findSegment(app13, iptcTag)
+		x, err := e.editIPTC(b)
+		if err != nil {
+			return err
+		}
+		if app13, err = replaceSegment(app13, i, iptcTag+"\x00", x); err != nil {
+			return err
+		}
+		m.SetAppSegments(13, app13)
+	}
+	if e.stripICC {
+		m.SetRawICC(nil)
+	}
+	if e.icc != nil {
+		m.SetRawICC(e.icc)
+	}
+	return nil
+}
+
+func (e *edits) applyGIF(m *gif.Metadata) error {
+	switch {
+	case len(e.setText) > 0 || len(e.deleteText) > 0:
+		return errors.New("text entries are only supported for png images")
+	case e.xmp != nil || e.stripXMP || e.stripEXIF || e.stripIPTC || len(e.exif) > 0 || len(e.xmpProps) > 0 || len(e.iptc) > 0:
+		return errors.New("EXIF, XMP and IPTC data aren't supported for gif images")
+	case e.icc != nil || e.stripICC:
+		return errors.New("ICC profiles aren't supported for gif images")
+	}
+	if e.deleteComments {
+		m.Comments = nil
+	}
+	m.Comments = append(m.Comments, e.addComment...)
+	return nil
+}
+
+// writeFile writes data to dst with the same permissions as src. The
+// data is written to a temporary file in the same directory first and
+// then renamed, so dst is never left partially written.
+func writeFile(dst string, data []byte, src string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image/jpeg"
+	"github.com/drswork/image/png"
+)
+
+// idat returns the concatenated contents of a PNG file's IDAT chunks.
+func idat(b []byte) []byte {
+	var data []byte
+	for b = b[8:]; len(b) >= 12; {
+		n := int(binary.BigEndian.Uint32(b))
+		if string(b[4:8]) == "IDAT" {
+			data = append(data, b[8:8+n]...)
+		}
+		b = b[12+n:]
+	}
+	return data
+}
+
+func TestEditFileInPlace(t *testing.T) {
+	ctx := context.TODO()
+	orig, err := ioutil.ReadFile("../../testdata/kauaii_1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "imgmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "test.png")
+	if err := ioutil.WriteFile(fn, orig, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &edits{
+		setText:  stringList{"Author=Someone"},
+		stripICC: true,
+		xmp:      []byte("<x:xmpmeta/>"),
+	}
+	if err := editFile(ctx, fn, fn, e); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idat(got), idat(orig)) {
+		t.Error("image data changed")
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("got mode %v, %v; want %v", fi.Mode().Perm(), err, os.FileMode(0640))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %d files in the directory, want 1", len(files))
+	}
+
+	_, md, _, err := decode(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := md.(*png.Metadata)
+	if len(m.Text) != 1 || m.Text[0].Key != "Author" || m.Text[0].Value != "Someone" {
+		t.Errorf("got text entries %v", m.Text)
+	}
+	if _, p := m.RawICC(); p != nil {
+		t.Error("ICC profile wasn't removed")
+	}
+	if x := m.RawXMP(); x != "<x:xmpmeta/>" {
+		t.Errorf("got XMP %q", x)
+	}
+}
+
+func TestEditFields(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "imgmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &edits{
+		setEXIF:   stringList{"Artist=Someone", "GPSLatitude=37/1,46/1,2953/100", "exif:0xa430=Owner"},
+		deleteXMP: stringList{"xmp:CreatorTool"},
+		setXMP:    stringList{"dc:title=A title"},
+	}
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"kauaii_1.png", "kauaii_1.jpeg"} {
+		src := "../../testdata/" + fn
+		dst := filepath.Join(dir, fn)
+		if err := editFile(ctx, src, dst, e); err != nil {
+			t.Fatal(fn, err)
+		}
+		_, md, _, err := decode(ctx, dst)
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		var exif []byte
+		var xmp string
+		switch m := md.(type) {
+		case *png.Metadata:
+			exif, xmp = m.RawEXIF(), m.RawXMP()
+		case *jpeg.Metadata:
+			_, exif = findSegment(m.AppSegments(1), exifTag)
+			_, x := findSegment(m.AppSegments(1), xmpTag)
+			xmp = string(x)
+		}
+		for _, want := range []string{"Someone\x00", "Owner\x00"} {
+			if !bytes.Contains(exif, []byte(want)) {
+				t.Errorf("%s: EXIF data is missing %q", fn, want)
+			}
+		}
+		if !strings.Contains(xmp, `<rdf:li xml:lang="x-default">A title</rdf:li>`) || strings.Contains(xmp, "CreatorTool") {
+			t.Errorf("%s: got XMP %q", fn, xmp)
+		}
+	}
+
+	for _, bad := range []*edits{
+		{setEXIF: stringList{"NoSuchTag=1"}},
+		{setEXIF: stringList{"image:0x0100=1"}},
+		{deleteXMP: stringList{"nosuchprefix:x"}},
+		{setXMP: stringList{"dc:title"}},
+		{stripEXIF: true, deleteEXIF: stringList{"Artist"}},
+	} {
+		if err := bad.load(); err != nil {
+			continue
+		}
+		if err := editFile(ctx, "../../testdata/kauaii_1.png", filepath.Join(dir, "bad.png"), bad); err == nil {
+			t.Errorf("edits %+v succeeded", bad)
+		}
+	}
+}
+
+func TestEditJPEGIPTCAndComments(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "imgmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "test.jpeg")
+
+	e := &edits{
+		setIPTC:    stringList{"Caption-Abstract=A caption", "2:25=keyword"},
+		addComment: stringList{"A comment"},
+	}
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := editFile(ctx, "../../testdata/kauaii_1.jpeg", dst, e); err != nil {
+		t.Fatal(err)
+	}
+	_, md, _, err := decode(ctx, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := md.(*jpeg.Metadata)
+	_, iptc := findSegment(m.AppSegments(13), iptcTag)
+	for _, want := range []string{"\x1c\x02\x78\x00\x09A caption", "\x1c\x02\x19\x00\x07keyword"} {
+		if !bytes.Contains(iptc, []byte(want)) {
+			t.Errorf("IPTC data %q is missing %q", iptc, want)
+		}
+	}
+	if len(m.Comments) == 0 || m.Comments[len(m.Comments)-1] != "A comment" {
+		t.Errorf("got comments %q", m.Comments)
+	}
+
+	e = &edits{
+		deleteIPTC:     stringList{"Caption-Abstract", "Keywords"},
+		deleteComments: true,
+	}
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := editFile(ctx, dst, dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if _, md, _, err = decode(ctx, dst); err != nil {
+		t.Fatal(err)
+	}
+	m = md.(*jpeg.Metadata)
+	_, iptc = findSegment(m.AppSegments(13), iptcTag)
+	if bytes.Contains(iptc, []byte("A caption")) || bytes.Contains(iptc, []byte("keyword")) {
+		t.Errorf("deleted datasets are still in the IPTC data %q", iptc)
+	}
+	if len(m.Comments) != 0 {
+		t.Errorf("got comments %q after deleting them", m.Comments)
+	}
+
+	for _, bad := range []*edits{
+		{setIPTC: stringList{"NoSuchDataset=1"}},
+		{setIPTC: stringList{"1:90=x"}},
+		{stripIPTC: true, deleteIPTC: stringList{"City"}},
+	} {
+		if err := bad.load(); err != nil {
+			continue
+		}
+		if err := editFile(ctx, "../../testdata/kauaii_1.jpeg", filepath.Join(dir, "bad.jpeg"), bad); err == nil {
+			t.Errorf("edits %+v succeeded", bad)
+		}
+	}
+	e = &edits{setIPTC: stringList{"City=Paris"}}
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := editFile(ctx, "../../testdata/kauaii_1.png", filepath.Join(dir, "bad.png"), e); err == nil {
+		t.Error("IPTC edit of a PNG succeeded")
+	}
+}
@@ -0,0 +1,32 @@
+package image
+
+import (
+	"context"
+)
+
+// Deferred is an image whose pixel data may not have been decoded
+// yet. Codecs return a Deferred image when image decoding is deferred
+// with DataDecodeOptions, which lets the image be passed back to the
+// codec's encoder without being decoded and re-encoded.
+//
+// Bounds and ColorModel are answered from the image header and never
+// force the image data to be decoded. At decodes the image data on
+// first use, but has no way to report a decoding failure, so code that
+// cares about errors should call Instantiate first.
+type Deferred interface {
+	Image
+	// Instantiate decodes the image data, if that hasn't already been
+	// done, and returns the decoded image.
+	Instantiate(ctx context.Context, opts ...ReadOption) (Image, error)
+	// IsInstantiated reports whether the image data has been decoded.
+	IsInstantiated() bool
+}
+
+// Instantiate returns the decoded form of m. If m is a Deferred image
+// then its image data is decoded, otherwise m is returned as-is.
+func Instantiate(ctx context.Context, m Image, opts ...ReadOption) (Image, error) {
+	if d, ok := m.(Deferred); ok {
+		return d.Instantiate(ctx, opts...)
+	}
+	return m, nil
+}
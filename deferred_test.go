@@ -0,0 +1,110 @@
+package image_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/drswork/image"
+
+	_ "github.com/drswork/image/gif"
+	_ "github.com/drswork/image/jpeg"
+	_ "github.com/drswork/image/png"
+)
+
+func TestDeferred(t *testing.T) {
+	ctx := context.TODO()
+	for _, fn := range []string{
+		"testdata/video-001.png",
+		"testdata/video-001.jpeg",
+		"testdata/video-001.cmyk.jpeg",
+		"testdata/video-001.gif",
+		"testdata/video-005.gray.png",
+	} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _, err := image.DecodeImage(ctx, bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			continue
+		}
+
+		m, _, _, err := image.DecodeWithOptions(ctx, bytes.NewReader(b), image.DataDecodeOptions{
+			DecodeImage:    image.DeferData,
+			DecodeMetadata: image.DiscardData,
+		})
+		if err != nil {
+			t.Errorf("%s: deferred decode: %v", fn, err)
+			continue
+		}
+		d, ok := m.(image.Deferred)
+		if !ok {
+			t.Errorf("%s: %T does not implement image.Deferred", fn, m)
+			continue
+		}
+
+		// The header values must be available without decoding.
+		if got := d.Bounds(); got != want.Bounds() {
+			t.Errorf("%s: got bounds %v, want %v", fn, got, want.Bounds())
+		}
+		if got := d.ColorModel(); !reflect.DeepEqual(got, want.ColorModel()) {
+			t.Errorf("%s: got color model %v, want %v", fn, got, want.ColorModel())
+		}
+		if d.IsInstantiated() {
+			t.Errorf("%s: instantiated before any pixels were accessed", fn)
+		}
+
+		got, err := image.Instantiate(ctx, d)
+		if err != nil {
+			t.Errorf("%s: instantiate: %v", fn, err)
+			continue
+		}
+		if !d.IsInstantiated() {
+			t.Errorf("%s: not instantiated after Instantiate", fn)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: instantiated image differs from decoded image", fn)
+		}
+	}
+}
+
+func TestDeferredInstantiateError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, fn := range []string{
+		"testdata/video-001.png",
+		"testdata/video-001.jpeg",
+		"testdata/video-001.gif",
+	} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, _, _, err := image.DecodeWithOptions(context.TODO(), bytes.NewReader(b), image.DataDecodeOptions{
+			DecodeImage:    image.DeferData,
+			DecodeMetadata: image.DiscardData,
+		})
+		if err != nil {
+			t.Errorf("%s: deferred decode: %v", fn, err)
+			continue
+		}
+		if _, err := image.Instantiate(ctx, m); err == nil {
+			t.Errorf("%s: instantiate with a cancelled context succeeded", fn)
+		}
+		if m.(image.Deferred).IsInstantiated() {
+			t.Errorf("%s: instantiated despite error", fn)
+		}
+	}
+}
+
+func TestInstantiateNonDeferred(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 1, 1))
+	got, err := image.Instantiate(context.TODO(), m)
+	if err != nil || got != image.Image(m) {
+		t.Errorf("got (%v, %v), want the image unchanged", got, err)
+	}
+}
@@ -0,0 +1,48 @@
+package image_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/drswork/image"
+
+	_ "github.com/drswork/image/gif"
+	_ "github.com/drswork/image/jpeg"
+	_ "github.com/drswork/image/png"
+)
+
+func TestEncodeWithOptions(t *testing.T) {
+	ctx := context.TODO()
+	src, _, err := decode("testdata/video-001.png")
+	if err != nil {
+		t.Fatalf("Unable to read test image: %v", err)
+	}
+
+	for _, f := range []string{"png", "jpeg", "gif"} {
+		var b bytes.Buffer
+		if err := image.EncodeWithOptions(ctx, &b, f, src); err != nil {
+			t.Errorf("%s: encode failed: %v", f, err)
+			continue
+		}
+		m, name, err := image.DecodeImage(ctx, &b)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", f, err)
+			continue
+		}
+		if name != f {
+			t.Errorf("%s: decoded as format %q", f, name)
+		}
+		if got, want := m.Bounds(), src.Bounds(); got != want {
+			t.Errorf("%s: got bounds %v want %v", f, got, want)
+		}
+	}
+}
+
+func TestEncodeWithOptionsUnknownFormat(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 1, 1))
+	var b bytes.Buffer
+	if err := image.EncodeWithOptions(context.TODO(), &b, "bmp", m); err != image.ErrFormat {
+		t.Errorf("got error %v, want %v", err, image.ErrFormat)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -26,11 +27,56 @@ type format struct {
 	decode      func(context.Context, io.Reader, ...ReadOption) (Image, Metadata, error)
 }
 
-// Formats is the list of registered formats.
-var (
+// An encoder holds an image format's name and how to encode it.
+type encoder struct {
+	name   string
+	encode func(context.Context, io.Writer, Image, ...WriteOption) error
+}
+
+// A FormatInfo describes a registered image format: its name, its
+// canonical MIME type, and the file extensions commonly used for it.
+type FormatInfo struct {
+	// Name is the format name used during format registration, such
+	// as "png".
+	Name string
+	// MIMEType is the canonical MIME type for the format, such as
+	// "image/png". It is empty if no MIME type has been registered.
+	MIMEType string
+	// Extensions holds the common file extensions for the format,
+	// lower case and including the leading dot, such as ".png". The
+	// first extension is the preferred one.
+	Extensions []string
+}
+
+// A Registry holds a set of image formats that can be decoded and
+// encoded. Each registry is independent of every other registry, so
+// code that only wants to accept a limited set of image formats can
+// build its own registry without being affected by whatever formats
+// other packages in the program happen to register.
+//
+// The zero value is an empty registry ready to use. A Registry must
+// not be copied after first use.
+type Registry struct {
+	// formats is the list of registered formats.
 	formatsMu     sync.Mutex
 	atomicFormats atomic.Value
-)
+	// encoders is the list of registered encoders.
+	encodersMu     sync.Mutex
+	atomicEncoders atomic.Value
+	// infos is the list of registered MIME types and extensions.
+	infosMu     sync.Mutex
+	atomicInfos atomic.Value
+}
+
+// NewRegistry returns a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry is the registry used by the package-level
+// registration, decoding, and encoding functions. Codec packages
+// register themselves here in their init functions.
+var DefaultRegistry = NewRegistry()
 
 // RegisterFormat registers an image format for use by Decode.
 // Name is the name of the format, like "jpeg" or "png".
@@ -42,6 +88,15 @@ var (
 // This function is deprecated, and should only be used by image
 // format decoders that don't support metadata decoding.
 func RegisterFormat(name, magic string, decode func(io.Reader) (Image, error), decodeConfig func(io.Reader) (Config, error)) {
+	DefaultRegistry.RegisterFormat(name, magic, decode, decodeConfig)
+}
+
+// RegisterFormat registers an image format with the registry. See the
+// package-level RegisterFormat function for details.
+//
+// This method is deprecated, and should only be used by image
+// format decoders that don't support metadata decoding.
+func (r *Registry) RegisterFormat(name, magic string, decode func(io.Reader) (Image, error), decodeConfig func(io.Reader) (Config, error)) {
 
 	// Create a function suitable for RegisterFormatExtended.
 	f := func(_ context.Context, r io.Reader, o ...ReadOption) (Image, Metadata, error) {
@@ -89,7 +144,7 @@ func RegisterFormat(name, magic string, decode func(io.Reader) (Image, error), d
 
 	}
 	// Register our constructed decoding function.
-	RegisterFormatExtended(name, magic, f)
+	r.RegisterFormatExtended(name, magic, f)
 }
 
 // RegisterFormatExtended registers an image format for use by Decode.
@@ -99,10 +154,200 @@ func RegisterFormat(name, magic string, decode func(io.Reader) (Image, error), d
 // Decode is the function that decodes the encoded image, its
 // metadata, and its configuration information.
 func RegisterFormatExtended(name, magic string, decode func(context.Context, io.Reader, ...ReadOption) (Image, Metadata, error)) {
-	formatsMu.Lock()
-	formats, _ := atomicFormats.Load().([]format)
-	atomicFormats.Store(append(formats, format{name, magic, decode}))
-	formatsMu.Unlock()
+	DefaultRegistry.RegisterFormatExtended(name, magic, decode)
+}
+
+// RegisterFormatExtended registers an image format with the
+// registry. See the package-level RegisterFormatExtended function for
+// details.
+func (r *Registry) RegisterFormatExtended(name, magic string, decode func(context.Context, io.Reader, ...ReadOption) (Image, Metadata, error)) {
+	r.formatsMu.Lock()
+	formats, _ := r.atomicFormats.Load().([]format)
+	r.atomicFormats.Store(append(formats, format{name, magic, decode}))
+	r.formatsMu.Unlock()
+}
+
+// RegisterEncoder registers an image format encoder for use by
+// EncodeWithOptions. Name is the name of the format, like "jpeg" or
+// "png", and should match the name the format's decoder was
+// registered with. Encode is the function that encodes an image and
+// any metadata passed to it as a write option.
+//
+// If more than one encoder is registered under the same name then
+// the most recently registered one is used.
+func RegisterEncoder(name string, encode func(context.Context, io.Writer, Image, ...WriteOption) error) {
+	DefaultRegistry.RegisterEncoder(name, encode)
+}
+
+// RegisterEncoder registers an image format encoder with the
+// registry. See the package-level RegisterEncoder function for
+// details.
+func (r *Registry) RegisterEncoder(name string, encode func(context.Context, io.Writer, Image, ...WriteOption) error) {
+	r.encodersMu.Lock()
+	encoders, _ := r.atomicEncoders.Load().([]encoder)
+	r.atomicEncoders.Store(append(encoders, encoder{name, encode}))
+	r.encodersMu.Unlock()
+}
+
+// Formats returns the names of the formats that have a decoder or an
+// encoder registered with the registry, in registration order.
+func (r *Registry) Formats() []string {
+	var names []string
+	seen := map[string]bool{}
+	formats, _ := r.atomicFormats.Load().([]format)
+	for _, f := range formats {
+		if !seen[f.name] {
+			seen[f.name] = true
+			names = append(names, f.name)
+		}
+	}
+	encoders, _ := r.atomicEncoders.Load().([]encoder)
+	for _, e := range encoders {
+		if !seen[e.name] {
+			seen[e.name] = true
+			names = append(names, e.name)
+		}
+	}
+	return names
+}
+
+// Subset returns a new registry holding only the decoders and
+// encoders registered with r under the given format names. Formats
+// registered with r afterwards are not added to the new registry.
+//
+// For example, a program that only wants to accept PNG and JPEG files
+// can decode with DefaultRegistry.Subset("png", "jpeg") regardless of
+// what other codec packages have been linked in.
+func (r *Registry) Subset(names ...string) *Registry {
+	want := map[string]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+	nr := NewRegistry()
+	formats, _ := r.atomicFormats.Load().([]format)
+	for _, f := range formats {
+		if want[f.name] {
+			nr.RegisterFormatExtended(f.name, f.magic, f.decode)
+		}
+	}
+	encoders, _ := r.atomicEncoders.Load().([]encoder)
+	for _, e := range encoders {
+		if want[e.name] {
+			nr.RegisterEncoder(e.name, e.encode)
+		}
+	}
+	infos, _ := r.atomicInfos.Load().([]FormatInfo)
+	for _, fi := range infos {
+		if want[fi.Name] {
+			nr.RegisterMIMEType(fi.Name, fi.MIMEType, fi.Extensions...)
+		}
+	}
+	return nr
+}
+
+// RegisterMIMEType registers the canonical MIME type and the common
+// file extensions for the named image format, for use by
+// DetectFormat, FormatByMIMEType, and FormatByExtension. Codec
+// packages typically call it from their init function alongside
+// RegisterFormatExtended.
+//
+// Extensions may be given with or without their leading dot, and are
+// matched without regard to case.
+func RegisterMIMEType(name, mimeType string, extensions ...string) {
+	DefaultRegistry.RegisterMIMEType(name, mimeType, extensions...)
+}
+
+// RegisterMIMEType registers the canonical MIME type and the common
+// file extensions for the named image format with the registry.
+func (r *Registry) RegisterMIMEType(name, mimeType string, extensions ...string) {
+	fi := FormatInfo{Name: name, MIMEType: mimeType}
+	for _, ext := range extensions {
+		fi.Extensions = append(fi.Extensions, normalizeExtension(ext))
+	}
+	r.infosMu.Lock()
+	infos, _ := r.atomicInfos.Load().([]FormatInfo)
+	r.atomicInfos.Store(append(infos, fi))
+	r.infosMu.Unlock()
+}
+
+// formatInfo returns the most recently registered FormatInfo for the
+// named format. If none has been registered only the name is filled
+// in.
+func (r *Registry) formatInfo(name string) FormatInfo {
+	infos, _ := r.atomicInfos.Load().([]FormatInfo)
+	for i := len(infos) - 1; i >= 0; i-- {
+		if infos[i].Name == name {
+			return infos[i]
+		}
+	}
+	return FormatInfo{Name: name}
+}
+
+// FormatByMIMEType returns the registered format for the given MIME
+// type. Any parameters following the media type, such as
+// "; charset=binary", are ignored.
+func FormatByMIMEType(mimeType string) (FormatInfo, bool) {
+	return DefaultRegistry.FormatByMIMEType(mimeType)
+}
+
+// FormatByMIMEType returns the format registered with the registry
+// for the given MIME type.
+func (r *Registry) FormatByMIMEType(mimeType string) (FormatInfo, bool) {
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	mimeType = strings.TrimSpace(mimeType)
+	infos, _ := r.atomicInfos.Load().([]FormatInfo)
+	for i := len(infos) - 1; i >= 0; i-- {
+		if infos[i].MIMEType != "" && strings.EqualFold(infos[i].MIMEType, mimeType) {
+			return infos[i], true
+		}
+	}
+	return FormatInfo{}, false
+}
+
+// FormatByExtension returns the registered format for the given file
+// extension. The extension may be given with or without its leading
+// dot, and is matched without regard to case.
+func FormatByExtension(ext string) (FormatInfo, bool) {
+	return DefaultRegistry.FormatByExtension(ext)
+}
+
+// FormatByExtension returns the format registered with the registry
+// for the given file extension.
+func (r *Registry) FormatByExtension(ext string) (FormatInfo, bool) {
+	ext = normalizeExtension(ext)
+	infos, _ := r.atomicInfos.Load().([]FormatInfo)
+	for i := len(infos) - 1; i >= 0; i-- {
+		for _, e := range infos[i].Extensions {
+			if e == ext {
+				return infos[i], true
+			}
+		}
+	}
+	return FormatInfo{}, false
+}
+
+// normalizeExtension lower cases ext and adds a leading dot if it
+// doesn't have one.
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// findEncoder returns the most recently registered encoder for the
+// named format.
+func (r *Registry) findEncoder(name string) encoder {
+	encoders, _ := r.atomicEncoders.Load().([]encoder)
+	for i := len(encoders) - 1; i >= 0; i-- {
+		if encoders[i].name == name {
+			return encoders[i]
+		}
+	}
+	return encoder{}
 }
 
 // A reader is an io.Reader that can also peek ahead.
@@ -119,6 +364,28 @@ func asReader(r io.Reader) reader {
 	return bufio.NewReader(r)
 }
 
+// DetectFormat determines the format of r's data by peeking at its
+// magic bytes, without decoding anything. The returned reader yields
+// the complete stream, including the bytes examined, and must be used
+// in place of r for any further reading.
+//
+// ErrFormat is returned if the data doesn't match any registered
+// format.
+func DetectFormat(r io.Reader) (FormatInfo, io.Reader, error) {
+	return DefaultRegistry.DetectFormat(r)
+}
+
+// DetectFormat determines the format of rd's data from the formats
+// registered with the registry.
+func (r *Registry) DetectFormat(rd io.Reader) (FormatInfo, io.Reader, error) {
+	rr := asReader(rd)
+	f := r.sniff(rr)
+	if f.decode == nil {
+		return FormatInfo{}, rr, ErrFormat
+	}
+	return r.formatInfo(f.name), rr, nil
+}
+
 // Match reports whether magic matches b. Magic may contain "?" wildcards.
 func match(magic string, b []byte) bool {
 	if len(magic) != len(b) {
@@ -132,11 +399,11 @@ func match(magic string, b []byte) bool {
 	return true
 }
 
-// Sniff determines the format of r's data.
-func sniff(r reader) format {
-	formats, _ := atomicFormats.Load().([]format)
+// Sniff determines the format of rr's data.
+func (r *Registry) sniff(rr reader) format {
+	formats, _ := r.atomicFormats.Load().([]format)
 	for _, f := range formats {
-		b, err := r.Peek(len(f.magic))
+		b, err := rr.Peek(len(f.magic))
 		if err == nil && match(f.magic, b) {
 			return f
 		}
@@ -203,6 +470,10 @@ type LimitOptions struct {
 	// can take. Images with metadata larger than this will throw an
 	// error.
 	MaxMetadataSize int
+	// MaxFrames is the maximum number of frames an animated image can
+	// have. Images with more frames than this will throw an error. Zero
+	// means there's no limit.
+	MaxFrames int
 }
 
 // IsImageReadOption is a no-op function which exists to satisfy the
@@ -302,12 +573,41 @@ type WriteOption interface {
 	IsImageWriteOption()
 }
 
+// EncodeWithOptions writes the image m to w in the named format. The
+// format name is the one used during encoder registration, which is
+// typically done by an init function in the codec-specific package.
+// The options are passed through to the format's encoder untouched,
+// so format-specific options and metadata may be given along with
+// the core image package's write options.
+//
+// ErrFormat is returned if no encoder has been registered for the
+// format.
+func EncodeWithOptions(ctx context.Context, w io.Writer, formatName string, m Image, opts ...WriteOption) error {
+	return DefaultRegistry.EncodeWithOptions(ctx, w, formatName, m, opts...)
+}
+
+// EncodeWithOptions writes the image m to w in the named format,
+// using the encoders registered with the registry.
+func (r *Registry) EncodeWithOptions(ctx context.Context, w io.Writer, formatName string, m Image, opts ...WriteOption) error {
+	e := r.findEncoder(formatName)
+	if e.encode == nil {
+		return ErrFormat
+	}
+	return e.encode(ctx, w, m, opts...)
+}
+
 // Decode decodes an image that has been encoded in a registered format.
 // The string returned is the format name used during format registration.
 // Format registration is typically done by an init function in the codec-
 // specific package. (DEPRECATED)
 func Decode(r io.Reader) (Image, string, error) {
-	i, _, t, err := DecodeWithOptions(context.TODO(), r, DataDecodeOptions{DecodeData, DiscardData})
+	return DefaultRegistry.Decode(r)
+}
+
+// Decode decodes an image that has been encoded in a format
+// registered with the registry. (DEPRECATED)
+func (r *Registry) Decode(rd io.Reader) (Image, string, error) {
+	i, _, t, err := r.DecodeWithOptions(context.TODO(), rd, DataDecodeOptions{DecodeData, DiscardData})
 	return i, t, err
 }
 
@@ -316,8 +616,15 @@ func Decode(r io.Reader) (Image, string, error) {
 // during format registration. Format registration is typically done
 // by an init function in the codec-specific package.
 func DecodeWithOptions(ctx context.Context, r io.Reader, opts ...ReadOption) (Image, Metadata, string, error) {
-	rr := asReader(r)
-	f := sniff(rr)
+	return DefaultRegistry.DecodeWithOptions(ctx, r, opts...)
+}
+
+// DecodeWithOptions decodes an image in a format registered with the
+// registry, along with its metadata. Data in formats that haven't
+// been registered with the registry is rejected with ErrFormat.
+func (r *Registry) DecodeWithOptions(ctx context.Context, rd io.Reader, opts ...ReadOption) (Image, Metadata, string, error) {
+	rr := asReader(rd)
+	f := r.sniff(rr)
 	if f.decode == nil {
 		return nil, nil, "", ErrFormat
 	}
@@ -331,8 +638,14 @@ func DecodeWithOptions(ctx context.Context, r io.Reader, opts ...ReadOption) (Im
 // Format registration is typically done by an init function in the codec-
 // specific package.
 func DecodeImage(ctx context.Context, r io.Reader, opts ...ReadOption) (Image, string, error) {
+	return DefaultRegistry.DecodeImage(ctx, r, opts...)
+}
+
+// DecodeImage decodes an image that has been encoded in a format
+// registered with the registry.
+func (r *Registry) DecodeImage(ctx context.Context, rd io.Reader, opts ...ReadOption) (Image, string, error) {
 	opts = append(opts, DataDecodeOptions{DecodeData, DiscardData})
-	i, _, t, err := DecodeWithOptions(ctx, r, opts...)
+	i, _, t, err := r.DecodeWithOptions(ctx, rd, opts...)
 	return i, t, err
 }
 
@@ -345,8 +658,14 @@ func DecodeImage(ctx context.Context, r io.Reader, opts ...ReadOption) (Image, s
 // it's more efficient to call DecodeWithOption and extract both
 // simiultaneously.
 func DecodeMetadata(ctx context.Context, r io.Reader, opts ...ReadOption) (Metadata, string, error) {
+	return DefaultRegistry.DecodeMetadata(ctx, r, opts...)
+}
+
+// DecodeMetadata decodes the metadata for an image that has been
+// encoded in a format registered with the registry.
+func (r *Registry) DecodeMetadata(ctx context.Context, rd io.Reader, opts ...ReadOption) (Metadata, string, error) {
 	opts = append(opts, DataDecodeOptions{DiscardData, DecodeData})
-	_, m, t, err := DecodeWithOptions(ctx, r, opts...)
+	_, m, t, err := r.DecodeWithOptions(ctx, rd, opts...)
 	return m, t, err
 
 }
@@ -360,8 +679,21 @@ func DecodeMetadata(ctx context.Context, r io.Reader, opts ...ReadOption) (Metad
 // DecodeMetadata and extract the info you need from the metadata
 // returned.
 func DecodeConfig(r io.Reader) (Config, string, error) {
-	rr := asReader(r)
-	f := sniff(rr)
+	return DefaultRegistry.DecodeConfig(r)
+}
+
+// DecodeConfig decodes the color model and dimensions of an image
+// that has been encoded in a format registered with the registry.
+//
+// This method has been deprecated; use DecodeWithOptions or
+// DecodeMetadata and extract the info you need from the metadata
+// returned.
+func (r *Registry) DecodeConfig(rd io.Reader) (Config, string, error) {
+	rr := asReader(rd)
+	f := r.sniff(rr)
+	if f.decode == nil {
+		return Config{}, "", ErrFormat
+	}
 	_, m, err := f.decode(context.TODO(), rr, DataDecodeOptions{DiscardData, DeferData})
 	if err != nil {
 		return Config{}, "", err
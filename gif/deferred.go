@@ -0,0 +1,230 @@
+package gif
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// Deferred holds a GIF image that hasn't yet been decompressed. It
+// proxies the standard image functions for the first frame, and will
+// decompress the underlying cached image data either when Instantiate
+// or InstantiateAll is explicitly called or when one of the standard
+// image methods are invoked.
+//
+// If a deferred image is passed to Encode or EncodeExtended then all
+// of its frames will be written out as they were read in, without
+// being re-quantized or re-compressed.
+type Deferred struct {
+	lsd              []byte          // cached logical screen descriptor
+	globalColorTable []byte          // cached global color table, if any
+	frames           []deferredFrame // cached frames, in file order
+	loopCount        int
+	img              image.Image
+
+	// bounds and model are those of the first frame, filled in from
+	// its image descriptor and color table.
+	bounds image.Rectangle
+	model  color.Model
+}
+
+var _ image.Deferred = (*Deferred)(nil)
+
+// deferredFrame holds the raw blocks that make up a single frame.
+type deferredFrame struct {
+	gce        []byte // graphic control extension, if any
+	descriptor []byte // image descriptor, including the separator
+	colorTable []byte // local color table, if any
+	data       []byte // LZW minimum code size and the data sub-blocks
+}
+
+// ColorModel returns the image's color model, which is known from the
+// image header without decoding the image data.
+func (d *Deferred) ColorModel() color.Model {
+	return d.model
+}
+
+// Bounds returns the image's bounds, which are known from the image
+// header without decoding the image data.
+func (d *Deferred) Bounds() image.Rectangle {
+	return d.bounds
+}
+
+// At returns the color of the pixel at (x, y), decoding the image data
+// first if necessary. Decoding errors can't be reported here, so At
+// returns nil if decoding fails; call Instantiate to get the error.
+func (d *Deferred) At(x, y int) color.Color {
+	if d.img == nil {
+		i, err := d.Instantiate(context.TODO())
+		if err != nil {
+			return nil
+		}
+		d.img = i
+	}
+	return d.img.At(x, y)
+}
+
+// IsInstantiated reports whether the first frame of the image has
+// been decompressed.
+func (d *Deferred) IsInstantiated() bool {
+	return d.img != nil
+}
+
+// Instantiate decompresses the first frame of the image and returns
+// it. The decoded frame is cached, so later calls are cheap.
+func (i *Deferred) Instantiate(ctx context.Context, opts ...image.ReadOption) (image.Image, error) {
+	if i.img != nil {
+		return i.img, nil
+	}
+	d, err := i.decode(ctx, i.frames[:1], false)
+	if err != nil {
+		return nil, err
+	}
+	i.img = d.image[0]
+	return i.img, nil
+}
+
+// InstantiateAll decompresses every frame of the image, returning
+// them along with their timing information just as DecodeAll does.
+func (i *Deferred) InstantiateAll(ctx context.Context, opts ...image.ReadOption) (*GIF, error) {
+	d, err := i.decode(ctx, i.frames, true)
+	if err != nil {
+		return nil, err
+	}
+	return &GIF{
+		Image:     d.image,
+		LoopCount: i.loopCount,
+		Delay:     d.delay,
+		Disposal:  d.disposal,
+		Config: image.Config{
+			ColorModel: d.globalColorTable,
+			Width:      d.width,
+			Height:     d.height,
+		},
+		BackgroundIndex: d.backgroundIndex,
+	}, nil
+}
+
+// decode rebuilds a GIF stream holding the passed-in frames and
+// decodes it.
+func (i *Deferred) decode(ctx context.Context, frames []deferredFrame, keepAllFrames bool) (*decoder, error) {
+	var b bytes.Buffer
+	b.WriteString("GIF89a")
+	b.Write(i.lsd)
+	b.Write(i.globalColorTable)
+	for _, f := range frames {
+		b.Write(f.gce)
+		b.Write(f.descriptor)
+		b.Write(f.colorTable)
+		b.Write(f.data)
+	}
+	b.WriteByte(sTrailer)
+
+	d := &decoder{
+		metadata: &Metadata{},
+	}
+	if err := d.decode(ctx, &b, false, keepAllFrames, true, false); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// deferImageDescriptor reads an image descriptor, any local color
+// table, and the LZW-compressed image data that follows it, and
+// caches them rather than decompressing the image.
+func (d *decoder) deferImageDescriptor(ctx context.Context) error {
+	if err := readFull(ctx, d.r, d.tmp[:9]); err != nil {
+		return fmt.Errorf("gif: can't read image descriptor: %s", err)
+	}
+	left := int(d.tmp[0]) + int(d.tmp[1])<<8
+	top := int(d.tmp[2]) + int(d.tmp[3])<<8
+	width := int(d.tmp[4]) + int(d.tmp[5])<<8
+	height := int(d.tmp[6]) + int(d.tmp[7])<<8
+	if left+width > d.width || top+height > d.height {
+		return errors.New("gif: frame bounds larger than image bounds")
+	}
+
+	f := deferredFrame{
+		gce:        d.deferredGCE,
+		descriptor: append([]byte{sImageDescriptor}, d.tmp[:9]...),
+	}
+	d.deferredGCE = nil
+
+	if fields := d.tmp[8]; fields&fColorTable != 0 {
+		f.colorTable = make([]byte, 3*(1<<(1+uint(fields&fColorTableBitsMask))))
+		if err := readFull(ctx, d.r, f.colorTable); err != nil {
+			return fmt.Errorf("gif: reading color table: %s", err)
+		}
+	} else if d.globalColorTable == nil {
+		return errors.New("gif: no color table")
+	}
+	if len(d.deferred.frames) == 0 {
+		var local color.Palette
+		if f.colorTable != nil {
+			local = decodeColorTable(f.colorTable)
+		}
+		d.deferred.bounds = image.Rect(left, top, left+width, top+height)
+		d.deferred.model = d.framePalette(local)
+	}
+
+	litWidth, err := readByte(d.r)
+	if err != nil {
+		return fmt.Errorf("gif: reading image data: %v", err)
+	}
+	if litWidth < 2 || litWidth > 8 {
+		return fmt.Errorf("gif: pixel size in decode out of range: %d", litWidth)
+	}
+	f.data = []byte{litWidth}
+	for {
+		n, err := d.readBlock(ctx)
+		if err != nil {
+			return fmt.Errorf("gif: reading image data: %v", err)
+		}
+		f.data = append(f.data, byte(n))
+		if n == 0 {
+			break
+		}
+		f.data = append(f.data, d.tmp[:n]...)
+	}
+	d.deferred.frames = append(d.deferred.frames, f)
+
+	// The graphic control extension only applies to the frame that
+	// follows it.
+	d.delayTime = 0
+	d.hasTransparentIndex = false
+	return nil
+}
+
+// writeDeferred writes out a deferred image's cached blocks,
+// unchanged, along with any metadata.
+func writeDeferred(w io.Writer, di *Deferred, m *Metadata) error {
+	e := encoder{metadata: m}
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+
+	e.write([]byte("GIF89a"))
+	e.write(di.lsd)
+	e.write(di.globalColorTable)
+	if len(di.frames) > 1 {
+		e.writeLoopCount(di.loopCount)
+	}
+	e.writeMetadata()
+	for _, f := range di.frames {
+		e.write(f.gce)
+		e.write(f.descriptor)
+		e.write(f.colorTable)
+		e.write(f.data)
+	}
+	e.writeByte(sTrailer)
+	e.flush()
+	return e.err
+}
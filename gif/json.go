@@ -0,0 +1,103 @@
+package gif
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/drswork/image/metadata"
+)
+
+// jsonMetadata is the JSON representation of Metadata.
+type jsonMetadata struct {
+	Format     string            `json:"format"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	ColorModel string            `json:"colorModel,omitempty"`
+	Comments   []string          `json:"comments,omitempty"`
+	Extensions []jsonExtension   `json:"extensions,omitempty"`
+	XMP        *metadata.XMPData `json:"xmp,omitempty"`
+}
+
+// jsonExtension is the JSON representation of an application
+// extension.
+type jsonExtension struct {
+	ID       string `json:"id"`
+	AuthCode string `json:"authCode"`
+	Body     []byte `json:"body"`
+}
+
+// MarshalJSON encodes the metadata as a JSON object of the form
+//
+//	{
+//	  "format": "gif",
+//	  "width": 640,
+//	  "height": 480,
+//	  "colorModel": "Paletted",
+//	  "comments": ["A comment"],
+//	  "extensions": [{"id": "NETSCAPE", "authCode": "2.0", "body": "AQAA"}],
+//	  "xmp": {"raw": "<?xpacket ...", "decoded": {...}}
+//	}
+//
+// Fields for data that isn't in the image are left out. Application
+// extensions are sorted by id, with their bodies base64 encoded. The
+// XMP data, from the "XMP Data" application extension, is listed
+// separately in its raw form, or its decoded form if it's already been
+// decoded, as described by metadata.XMPData.
+// Marshalling doesn't change the metadata.
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	j := jsonMetadata{
+		Format:     "gif",
+		Width:      m.Width,
+		Height:     m.Height,
+		ColorModel: metadata.ColorModelName(m.ColorModel),
+		Comments:   m.Comments,
+		XMP:        metadata.NewXMPData(m.rawXmp, m.xmp),
+	}
+	ids := make([]string, 0, len(m.Extensions))
+	for id := range m.Extensions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		x := m.Extensions[id]
+		j.Extensions = append(j.Extensions, jsonExtension{ID: id, AuthCode: x.AuthCode, Body: x.Body})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes metadata in the form written by MarshalJSON,
+// replacing the contents of m. The result can be passed to
+// EncodeExtended. Where both the raw and decoded forms of XMP data are
+// given the raw form is used.
+func (m *Metadata) UnmarshalJSON(b []byte) error {
+	var j jsonMetadata
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Format != "" && j.Format != "gif" {
+		return fmt.Errorf("Can't read %q metadata as gif metadata", j.Format)
+	}
+
+	n := Metadata{
+		Width:      j.Width,
+		Height:     j.Height,
+		ColorModel: metadata.ColorModelByName(j.ColorModel),
+		Comments:   j.Comments,
+	}
+	for _, x := range j.Extensions {
+		if n.Extensions == nil {
+			n.Extensions = make(map[string]*Extension)
+		}
+		n.Extensions[x.ID] = &Extension{x.AuthCode, x.Body}
+	}
+	if j.XMP != nil {
+		if j.XMP.Raw != "" {
+			n.rawXmp = &j.XMP.Raw
+		} else {
+			n.xmp = j.XMP.Decoded
+		}
+	}
+	*m = n
+	return nil
+}
@@ -0,0 +1,65 @@
+package gif
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+	"github.com/drswork/image/color/palette"
+)
+
+func TestMetadataJSONRoundTrip(t *testing.T) {
+	ctx := context.TODO()
+	xmp := "<x:xmpmeta xmlns:x='adobe:ns:meta/'></x:xmpmeta>"
+	meta := &Metadata{
+		Width:      4,
+		Height:     4,
+		ColorModel: color.Palette(palette.Plan9),
+		Comments:   []string{"one", "two"},
+		Extensions: map[string]*Extension{
+			"EXAMPLE2": {AuthCode: "1.0", Body: []byte("second")},
+			"EXAMPLE1": {AuthCode: "1.0", Body: []byte("first")},
+		},
+		rawXmp: &xmp,
+	}
+	j0, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"format":"gif","width":4,"height":4,"colorModel":"Paletted","comments":["one","two"],` +
+		`"extensions":[{"id":"EXAMPLE1","authCode":"1.0","body":"Zmlyc3Q="},{"id":"EXAMPLE2","authCode":"1.0","body":"c2Vjb25k"}],` +
+		`"xmp":{"raw":"\u003cx:xmpmeta xmlns:x='adobe:ns:meta/'\u003e\u003c/x:xmpmeta\u003e"}}`
+	if string(j0) != want {
+		t.Errorf("got JSON\n%s\nwant\n%s", j0, want)
+	}
+
+	var meta1 Metadata
+	if err := json.Unmarshal(j0, &meta1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta1.Extensions, meta.Extensions) || *meta1.rawXmp != xmp {
+		t.Errorf("got %+v, want %+v", meta1, meta)
+	}
+	var b bytes.Buffer
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	if err := EncodeExtended(ctx, &b, m, &meta1); err != nil {
+		t.Fatal(err)
+	}
+	_, md, err := DecodeExtended(ctx, &b, image.DataDecodeOptions{image.DecodeData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The XMP packet is written to, and read back from, an XMP
+	// application extension.
+	j1, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j1) != want {
+		t.Errorf("got JSON after writing the image\n%s\nwant\n%s", j1, want)
+	}
+}
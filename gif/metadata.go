@@ -1,8 +1,11 @@
 package gif
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/drswork/image"
 	"github.com/drswork/image/color"
@@ -37,6 +40,8 @@ type Metadata struct {
 
 // Extension holds the contents of an extension.
 type Extension struct {
+	// AuthCode is the application authentication code, at most 3
+	// bytes. Shorter codes are padded with NULs when written.
 	AuthCode string
 	Body     []byte
 }
@@ -88,6 +93,59 @@ func (m *Metadata) SetXMP(x *metadata.XMP) {
 	m.rawXmp = nil
 }
 
+// RawXMP returns the undecoded XMP packet associated with the
+// metadata object. It returns the empty string if there is no XMP
+// packet, or if the packet has already been decoded.
+func (m *Metadata) RawXMP() string {
+	if m.rawXmp == nil {
+		return ""
+	}
+	return *m.rawXmp
+}
+
+// SetRawXMP replaces the XMP information associated with the metadata
+// object with the undecoded XMP packet x. Passing the empty string
+// removes the XMP information.
+func (m *Metadata) SetRawXMP(x string) {
+	m.xmp = nil
+	m.xmpDecodeErr = nil
+	m.rawXmp = nil
+	if x != "" {
+		m.rawXmp = &x
+	}
+}
+
+// The XMP application extension holds the XMP packet directly after
+// the application identifier rather than in data sub-blocks. It's
+// followed by a magic trailer, 0x01 and then the bytes 0xff down to
+// 0x00, which makes a decoder that reads the packet as sub-blocks
+// skip to the block terminator.
+const (
+	xmpAppID    = "XMP Data"
+	xmpAuthCode = "XMP"
+)
+
+// xmpTrailer returns the XMP application extension's magic trailer.
+func xmpTrailer() []byte {
+	t := make([]byte, 257)
+	t[0] = 1
+	for i := 1; i < len(t); i++ {
+		t[i] = byte(256 - i)
+	}
+	return t
+}
+
+// xmpPacket returns the XMP packet in raw, the contents of an XMP
+// application extension's sub-blocks with their size bytes, and
+// whether it was found.
+func xmpPacket(raw []byte) (string, bool) {
+	i := bytes.LastIndex(raw, []byte{0x01, 0xff, 0xfe})
+	if i < 0 || !bytes.HasPrefix(xmpTrailer(), raw[i:]) {
+		return "", false
+	}
+	return string(raw[:i]), true
+}
+
 // readComment reads a comment from the image and saves it.
 func (d *decoder) readComment(ctx context.Context) error {
 	c := []byte{}
@@ -97,7 +155,10 @@ func (d *decoder) readComment(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-
+		// Read the blocks until we get an end-of-block block
+		if n == 0 {
+			break
+		}
 		c = append(c, d.tmp[:n]...)
 	}
 
@@ -122,10 +183,14 @@ func (d *decoder) readApplication(ctx context.Context) error {
 	appId := string(d.tmp[0:8])
 	// The auth code is the rest of the block. Should be 3 bytes but
 	// apparently sometimes is less because standards are for chumps.
-	authCode := string(d.tmp[8:b])
+	// The encoder pads short codes with NULs, so drop any padding.
+	authCode := strings.TrimRight(string(d.tmp[8:b]), "\x00")
 
-	// Read in all the sub-block data
+	// Read in all the sub-block data. The raw data, including the
+	// sub-block sizes, is kept for an XMP packet.
+	isXMP := appId == xmpAppID && authCode == xmpAuthCode
 	c := []byte{}
+	var raw []byte
 	for {
 		n, err := d.readBlock(ctx)
 		if err != nil {
@@ -136,6 +201,24 @@ func (d *decoder) readApplication(ctx context.Context) error {
 			break
 		}
 		c = append(c, d.tmp[:n]...)
+		if isXMP {
+			raw = append(append(raw, byte(n)), d.tmp[:n]...)
+		}
+	}
+
+	if isXMP {
+		if x, ok := xmpPacket(raw); ok {
+			// Reading the packet as sub-blocks can stop on the
+			// trailer's last byte rather than on the block terminator
+			// after it, which is then still to be read.
+			if len(raw)-len(x) < len(xmpTrailer()) {
+				if _, err := readByte(d.r); err != nil {
+					return fmt.Errorf("gif: reading XMP extension: %v", err)
+				}
+			}
+			d.metadata.rawXmp = &x
+			return nil
+		}
 	}
 
 	switch appId {
@@ -165,3 +248,34 @@ func (d *decoder) readApplication(ctx context.Context) error {
 	return nil
 
 }
+
+// strip returns a copy of the metadata without the data that s says
+// should be removed, recording each removal in s.
+func (m *Metadata) strip(s *image.StripMetadata) *Metadata {
+	c := *m
+	if s.Strips(image.MetadataComments) {
+		for range c.Comments {
+			s.Record(image.MetadataComments, "GIF comment")
+		}
+		c.Comments = nil
+	}
+	if c.rawXmp != nil {
+		x := metadata.StripXMP(*c.rawXmp, s)
+		c.rawXmp = nil
+		if x != "" {
+			c.rawXmp = &x
+		}
+	}
+	if s.Strips(image.MetadataOther) {
+		ids := make([]string, 0, len(c.Extensions))
+		for id := range c.Extensions {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s.Record(image.MetadataOther, fmt.Sprintf("GIF application extension %q", id))
+		}
+		c.Extensions = nil
+	}
+	return &c
+}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/drswork/image"
 	"github.com/drswork/image/color"
+	"github.com/drswork/image/metadata"
 )
 
 var (
@@ -128,6 +129,12 @@ type decoder struct {
 
 	// Metadata
 	metadata *Metadata
+
+	// deferred holds the cached frames when decompression of the image
+	// has been deferred. deferredGCE holds the graphic control
+	// extension for the next deferred frame.
+	deferred    *Deferred
+	deferredGCE []byte
 }
 
 // blockReader parses the block structure of GIF image data, which comprises
@@ -273,12 +280,17 @@ func (d *decoder) decode(ctx context.Context, r io.Reader, configOnly, keepAllFr
 			}
 
 		case sImageDescriptor:
-			if err = d.readImageDescriptor(ctx, keepAllFrames); err != nil {
+			if d.deferred != nil {
+				err = d.deferImageDescriptor(ctx)
+			} else {
+				err = d.readImageDescriptor(ctx, keepAllFrames)
+			}
+			if err != nil {
 				return err
 			}
 
 		case sTrailer:
-			if len(d.image) == 0 {
+			if len(d.image) == 0 && (d.deferred == nil || len(d.deferred.frames) == 0) {
 				return fmt.Errorf("gif: missing image data")
 			}
 			return nil
@@ -300,12 +312,18 @@ func (d *decoder) readHeaderAndScreenDescriptor(ctx context.Context) error {
 	}
 	d.width = int(d.tmp[6]) + int(d.tmp[7])<<8
 	d.height = int(d.tmp[8]) + int(d.tmp[9])<<8
+	if d.deferred != nil {
+		d.deferred.lsd = append([]byte(nil), d.tmp[6:13]...)
+	}
 	if fields := d.tmp[10]; fields&fColorTable != 0 {
 		d.backgroundIndex = d.tmp[11]
 		// readColorTable overwrites the contents of d.tmp, but that's OK.
 		if d.globalColorTable, err = d.readColorTable(ctx, fields); err != nil {
 			return err
 		}
+		if d.deferred != nil {
+			d.deferred.globalColorTable = append([]byte(nil), d.tmp[:3*len(d.globalColorTable)]...)
+		}
 	}
 	// d.tmp[12] is the Pixel Aspect Ratio, which is ignored.
 	return nil
@@ -317,12 +335,50 @@ func (d *decoder) readColorTable(ctx context.Context, fields byte) (color.Palett
 	if err != nil {
 		return nil, fmt.Errorf("gif: reading color table: %s", err)
 	}
-	j, p := 0, make(color.Palette, n)
+	return decodeColorTable(d.tmp[:3*n]), nil
+}
+
+// decodeColorTable converts the raw bytes of a color table to a
+// palette.
+func decodeColorTable(b []byte) color.Palette {
+	j, p := 0, make(color.Palette, len(b)/3)
 	for i := range p {
-		p[i] = color.RGBA{d.tmp[j+0], d.tmp[j+1], d.tmp[j+2], 0xFF}
+		p[i] = color.RGBA{b[j+0], b[j+1], b[j+2], 0xFF}
 		j += 3
 	}
-	return p, nil
+	return p
+}
+
+// framePalette returns the palette for a frame, given its local color
+// table, if any, with the graphic control extension's transparent
+// index applied.
+func (d *decoder) framePalette(local color.Palette) color.Palette {
+	p := local
+	if p == nil {
+		p = d.globalColorTable
+	}
+	if !d.hasTransparentIndex {
+		return p
+	}
+	if local == nil {
+		// Clone the global color table.
+		p = append(color.Palette(nil), d.globalColorTable...)
+	}
+	if ti := int(d.transparentIndex); ti < len(p) {
+		p[ti] = color.RGBA{}
+	} else {
+		// The transparentIndex is out of range, which is an error
+		// according to the spec, but Firefox and Google Chrome
+		// seem OK with this, so we enlarge the palette with
+		// transparent colors. See golang.org/issue/15059.
+		np := make(color.Palette, ti+1)
+		copy(np, p)
+		for i := len(p); i < len(np); i++ {
+			np[i] = color.RGBA{}
+		}
+		p = np
+	}
+	return p
 }
 
 func (d *decoder) readExtension(ctx context.Context) error {
@@ -378,6 +434,9 @@ func (d *decoder) readGraphicControl(ctx context.Context) error {
 	if d.tmp[5] != 0 {
 		return fmt.Errorf("gif: invalid graphic control extension block terminator: %d", d.tmp[5])
 	}
+	if d.deferred != nil {
+		d.deferredGCE = append([]byte{sExtension, eGraphicControl}, d.tmp[:6]...)
+	}
 	return nil
 }
 
@@ -386,38 +445,16 @@ func (d *decoder) readImageDescriptor(ctx context.Context, keepAllFrames bool) e
 	if err != nil {
 		return err
 	}
-	useLocalColorTable := d.imageFields&fColorTable != 0
-	if useLocalColorTable {
-		m.Palette, err = d.readColorTable(ctx, d.imageFields)
+	var local color.Palette
+	if d.imageFields&fColorTable != 0 {
+		local, err = d.readColorTable(ctx, d.imageFields)
 		if err != nil {
 			return err
 		}
-	} else {
-		if d.globalColorTable == nil {
-			return errors.New("gif: no color table")
-		}
-		m.Palette = d.globalColorTable
-	}
-	if d.hasTransparentIndex {
-		if !useLocalColorTable {
-			// Clone the global color table.
-			m.Palette = append(color.Palette(nil), d.globalColorTable...)
-		}
-		if ti := int(d.transparentIndex); ti < len(m.Palette) {
-			m.Palette[ti] = color.RGBA{}
-		} else {
-			// The transparentIndex is out of range, which is an error
-			// according to the spec, but Firefox and Google Chrome
-			// seem OK with this, so we enlarge the palette with
-			// transparent colors. See golang.org/issue/15059.
-			p := make(color.Palette, ti+1)
-			copy(p, m.Palette)
-			for i := len(m.Palette); i < len(p); i++ {
-				p[i] = color.RGBA{}
-			}
-			m.Palette = p
-		}
+	} else if d.globalColorTable == nil {
+		return errors.New("gif: no color table")
 	}
+	m.Palette = d.framePalette(local)
 	litWidth, err := readByte(d.r)
 	if err != nil {
 		return fmt.Errorf("gif: reading image data: %v", err)
@@ -587,10 +624,6 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 		return nil, nil, nil
 	}
 
-	if opt.DecodeImage == image.DeferData {
-		return nil, nil, errors.New("Image parsing may not be deferred")
-	}
-
 	if opt.DecodeImage == image.DefaultDecodeOption {
 		opt.DecodeImage = image.DecodeData
 	}
@@ -609,6 +642,9 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 
 	var d decoder
 	d.metadata = &Metadata{}
+	if opt.DecodeImage == image.DeferData {
+		d.deferred = &Deferred{}
+	}
 
 	if err := d.decode(ctx, r, false, false, parseImage, parseMetadata); err != nil {
 		return nil, nil, err
@@ -620,13 +656,19 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 
 	// We read in all the metadata without decoding the expensive
 	// stuff. If the user wanted it decoded now then go decode it.
-	if opt.DecodeMetadata == image.DecodeData {
+	// The XMP packet is only decoded if there's a decoder to do it.
+	// Without one the raw packet is kept, and is available from RawXMP.
+	if opt.DecodeMetadata == image.DecodeData && metadata.XMPDecoderRegistered() {
 		_, err := d.metadata.XMP(ctx, opts...)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
+	if d.deferred != nil {
+		d.deferred.loopCount = d.loopCount
+		return d.deferred, d.metadata, nil
+	}
 	return d.image[0], d.metadata, nil
 }
 
@@ -675,6 +717,7 @@ type GIF struct {
 // and timing information.
 func DecodeAll(r io.Reader) (*GIF, error) {
 	var d decoder
+	d.metadata = &Metadata{}
 	if err := d.decode(context.TODO(), r, false, true, true, false); err != nil {
 		return nil, err
 	}
@@ -709,4 +752,5 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 
 func init() {
 	image.RegisterFormatExtended("gif", "GIF8?a", DecodeExtended)
+	image.RegisterMIMEType("gif", "image/gif", ".gif")
 }
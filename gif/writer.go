@@ -8,8 +8,12 @@ import (
 	"bufio"
 	"bytes"
 	"compress/lzw"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/drswork/image"
 	"github.com/drswork/image/color"
@@ -55,6 +59,8 @@ type encoder struct {
 	err error
 	// g is a reference to the data that is being encoded.
 	g GIF
+	// metadata holds the metadata to write out, if any.
+	metadata *Metadata
 	// globalCT is the size in bytes of the global color table.
 	globalCT int
 	// buf is a scratch buffer. It must be at least 256 for the blockWriter.
@@ -179,22 +185,113 @@ func (e *encoder) writeHeader() {
 	}
 
 	// Add animation info if necessary.
-	if len(e.g.Image) > 1 && e.g.LoopCount >= 0 {
-		e.buf[0] = 0x21 // Extension Introducer.
-		e.buf[1] = 0xff // Application Label.
+	if len(e.g.Image) > 1 {
+		e.writeLoopCount(e.g.LoopCount)
+	}
+}
+
+// writeLoopCount writes the NETSCAPE2.0 application extension holding
+// the animation loop count. Nothing is written for a negative loop
+// count.
+func (e *encoder) writeLoopCount(loopCount int) {
+	if e.err != nil || loopCount < 0 {
+		return
+	}
+	e.buf[0] = 0x21 // Extension Introducer.
+	e.buf[1] = 0xff // Application Label.
+	e.buf[2] = 0x0b // Block Size.
+	e.write(e.buf[:3])
+	_, err := io.WriteString(e.w, "NETSCAPE2.0") // Application Identifier.
+	if err != nil && e.err == nil {
+		e.err = err
+		return
+	}
+	e.buf[0] = 0x03 // Block Size.
+	e.buf[1] = 0x01 // Sub-block Index.
+	writeUint16(e.buf[2:4], uint16(loopCount))
+	e.buf[4] = 0x00 // Block Terminator.
+	e.write(e.buf[:5])
+}
+
+// writeMetadata writes out the comment and application extension
+// blocks held in the metadata, if there is any.
+func (e *encoder) writeMetadata() {
+	if e.err != nil || e.metadata == nil {
+		return
+	}
+
+	for _, c := range e.metadata.Comments {
+		e.buf[0] = sExtension
+		e.buf[1] = eComment
+		e.write(e.buf[:2])
+		e.writeBlocks([]byte(c))
+	}
+
+	// Write the extensions out in a stable order.
+	ids := make([]string, 0, len(e.metadata.Extensions))
+	for id := range e.metadata.Extensions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		x := e.metadata.Extensions[id]
+		if len(id) != 8 || len(x.AuthCode) > 3 {
+			e.err = fmt.Errorf("gif: invalid application extension %q/%q", id, x.AuthCode)
+			return
+		}
+		e.buf[0] = sExtension
+		e.buf[1] = eApplication
 		e.buf[2] = 0x0b // Block Size.
 		e.write(e.buf[:3])
-		_, err := io.WriteString(e.w, "NETSCAPE2.0") // Application Identifier.
-		if err != nil && e.err == nil {
-			e.err = err
+		if e.err != nil {
 			return
 		}
-		e.buf[0] = 0x03 // Block Size.
-		e.buf[1] = 0x01 // Sub-block Index.
-		writeUint16(e.buf[2:4], uint16(e.g.LoopCount))
-		e.buf[4] = 0x00 // Block Terminator.
-		e.write(e.buf[:5])
+		// The block is always 11 bytes, so a short auth code is padded
+		// out with NULs.
+		_, e.err = io.WriteString(e.w, id+(x.AuthCode + "\x00\x00\x00")[:3])
+		e.writeBlocks(x.Body)
 	}
+	e.writeXMP()
+}
+
+// writeXMP writes out the raw XMP packet held in the metadata, if
+// there is one, as an XMP application extension.
+func (e *encoder) writeXMP() {
+	if e.err != nil || e.metadata.rawXmp == nil {
+		return
+	}
+	x := *e.metadata.rawXmp
+	// A NUL byte would end the extension early for decoders that read
+	// the packet as sub-blocks.
+	if strings.IndexByte(x, 0) >= 0 {
+		e.err = errors.New("gif: XMP packet contains a NUL byte")
+		return
+	}
+	e.buf[0] = sExtension
+	e.buf[1] = eApplication
+	e.buf[2] = 0x0b // Block Size.
+	e.write(e.buf[:3])
+	if e.err != nil {
+		return
+	}
+	_, e.err = io.WriteString(e.w, xmpAppID+xmpAuthCode+x)
+	e.write(xmpTrailer())
+	e.writeByte(0x00) // Block Terminator.
+}
+
+// writeBlocks writes b out as a series of data sub-blocks followed by
+// a block terminator.
+func (e *encoder) writeBlocks(b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > 255 {
+			n = 255
+		}
+		e.writeByte(byte(n))
+		e.write(b[:n])
+		b = b[n:]
+	}
+	e.writeByte(0x00) // Block Terminator.
 }
 
 func encodeColorTable(dst []byte, p color.Palette, size int) (int, error) {
@@ -371,6 +468,12 @@ type Options struct {
 // EncodeAll writes the images in g to w in GIF format with the
 // given loop count and delay between frames.
 func EncodeAll(w io.Writer, g *GIF) error {
+	return encodeAll(w, g, nil)
+}
+
+// encodeAll writes the images in g, along with any metadata, to w in
+// GIF format.
+func encodeAll(w io.Writer, g *GIF, m *Metadata) error {
 	if len(g.Image) == 0 {
 		return errors.New("gif: must provide at least one image")
 	}
@@ -379,7 +482,7 @@ func EncodeAll(w io.Writer, g *GIF) error {
 		return errors.New("gif: mismatched image and delay lengths")
 	}
 
-	e := encoder{g: *g}
+	e := encoder{g: *g, metadata: m}
 	// The GIF.Disposal, GIF.Config and GIF.BackgroundIndex fields were added
 	// in Go 1.5. Valid Go 1.4 code, such as when the Disposal field is omitted
 	// in a GIF struct literal, should still produce valid GIFs.
@@ -403,6 +506,7 @@ func EncodeAll(w io.Writer, g *GIF) error {
 	}
 
 	e.writeHeader()
+	e.writeMetadata()
 	for i, pm := range g.Image {
 		disposal := uint8(0)
 		if g.Disposal != nil {
@@ -421,21 +525,72 @@ func (_ *Options) IsImageWriteOption() {
 
 // Encode writes the Image m to w in GIF format.
 func Encode(w io.Writer, m image.Image, o *Options) error {
+	return EncodeExtended(context.TODO(), w, m, o)
+}
+
+// EncodeExtended writes the Image m to w in GIF format. It accepts a
+// *Options to control the palette conversion and a *Metadata holding
+// comments and application extensions to write out with the image.
+func EncodeExtended(ctx context.Context, w io.Writer, m image.Image, opts ...image.WriteOption) error {
+	var metadata *Metadata
+	var o *Options
+	var strip *image.StripMetadata
+
+	for _, opt := range opts {
+		switch do := opt.(type) {
+		case *Options:
+			if o != nil {
+				return fmt.Errorf("gif: multiple options specified")
+			}
+			o = do
+		case *Metadata:
+			if metadata != nil {
+				return fmt.Errorf("gif: multiple metadata specified")
+			}
+			metadata = do
+		case *image.StripMetadata:
+			strip = do
+		default:
+			return fmt.Errorf("gif: unknown write option of type %T given", opt)
+		}
+	}
+
+	// A decoded XMP packet is encoded first, since it's written, and
+	// stripped, as text.
+	if metadata != nil && metadata.xmp != nil {
+		x, err := metadata.xmp.Encode(ctx)
+		if err != nil {
+			return err
+		}
+		c := *metadata
+		c.xmp, c.rawXmp = nil, &x
+		metadata = &c
+	}
+	if metadata != nil && strip != nil {
+		metadata = metadata.strip(strip)
+	}
+
+	// Deferred images are written back out as they were read, so the
+	// palette conversion options don't apply.
+	if di, ok := m.(*Deferred); ok {
+		return writeDeferred(w, di, metadata)
+	}
+
 	// Check for bounds and size restrictions.
 	b := m.Bounds()
 	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
 		return errors.New("gif: image is too large to encode")
 	}
 
-	opts := Options{}
+	options := Options{}
 	if o != nil {
-		opts = *o
+		options = *o
 	}
-	if opts.NumColors < 1 || 256 < opts.NumColors {
-		opts.NumColors = 256
+	if options.NumColors < 1 || 256 < options.NumColors {
+		options.NumColors = 256
 	}
-	if opts.Drawer == nil {
-		opts.Drawer = draw.FloydSteinberg
+	if options.Drawer == nil {
+		options.Drawer = draw.FloydSteinberg
 	}
 
 	pm, _ := m.(*image.Paletted)
@@ -449,16 +604,16 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 			}
 		}
 	}
-	if pm == nil || len(pm.Palette) > opts.NumColors {
+	if pm == nil || len(pm.Palette) > options.NumColors {
 		// Set pm to be a palettedized copy of m, including its bounds, which
 		// might not start at (0, 0).
 		//
 		// TODO: Pick a better sub-sample of the Plan 9 palette.
-		pm = image.NewPaletted(b, palette.Plan9[:opts.NumColors])
-		if opts.Quantizer != nil {
-			pm.Palette = opts.Quantizer.Quantize(make(color.Palette, 0, opts.NumColors), m)
+		pm = image.NewPaletted(b, palette.Plan9[:options.NumColors])
+		if options.Quantizer != nil {
+			pm.Palette = options.Quantizer.Quantize(make(color.Palette, 0, options.NumColors), m)
 		}
-		opts.Drawer.Draw(pm, b, m, b.Min)
+		options.Drawer.Draw(pm, b, m, b.Min)
 	}
 
 	// When calling Encode instead of EncodeAll, the single-frame image is
@@ -470,7 +625,7 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 		pm = &dup
 	}
 
-	return EncodeAll(w, &GIF{
+	return encodeAll(w, &GIF{
 		Image: []*image.Paletted{pm},
 		Delay: []int{0},
 		Config: image.Config{
@@ -478,5 +633,9 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 			Width:      b.Dx(),
 			Height:     b.Dy(),
 		},
-	})
+	}, metadata)
+}
+
+func init() {
+	image.RegisterEncoder("gif", EncodeExtended)
 }
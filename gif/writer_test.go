@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/drswork/image"
@@ -306,6 +307,63 @@ func TestEncodeMismatchDelay(t *testing.T) {
 	}
 }
 
+func TestEncodeMetadata(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewPaletted(image.Rect(0, 0, 5, 5), palette.Plan9)
+	md := &Metadata{
+		Comments: []string{"a comment", string(bytes.Repeat([]byte("x"), 600))},
+		Extensions: map[string]*Extension{
+			"ExampleA": {AuthCode: "1.0", Body: []byte("some extension data")},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeExtended(ctx, &buf, m, md); err != nil {
+		t.Fatalf("EncodeExtended: %v", err)
+	}
+	_, rm, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{image.DecodeData, image.DecodeData})
+	if err != nil {
+		t.Fatalf("DecodeExtended: %v", err)
+	}
+	got := rm.(*Metadata)
+	if !reflect.DeepEqual(got.Comments, md.Comments) {
+		t.Errorf("comments: got %q, want %q", got.Comments, md.Comments)
+	}
+	if !reflect.DeepEqual(got.Extensions, md.Extensions) {
+		t.Errorf("extensions: got %v, want %v", got.Extensions, md.Extensions)
+	}
+}
+
+func TestEncodeShortAuthCode(t *testing.T) {
+	ctx := context.TODO()
+	// A GIF with a 10 byte application extension block, whose auth
+	// code is only 2 bytes long.
+	b := []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x01\x01\x01" +
+		"!\xff\nExampleA12\x04data\x00" +
+		",\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02\x4c\x01\x00;")
+	for _, o := range []image.DecodingOption{image.DecodeData, image.DeferData} {
+		m, md, err := DecodeExtended(ctx, bytes.NewReader(b), image.DataDecodeOptions{DecodeImage: o, DecodeMetadata: image.DecodeData})
+		if err != nil {
+			t.Fatalf("DecodeExtended: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, m, md.(*Metadata)); err != nil {
+			t.Fatalf("EncodeExtended: %v", err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("!\xff\x0bExampleA12\x00\x04data\x00")) {
+			t.Errorf("decoding option %v: auth code wasn't padded to an 11 byte block", o)
+		}
+		_, got, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{DecodeImage: image.DiscardData, DecodeMetadata: image.DecodeData})
+		if err != nil {
+			t.Fatalf("DecodeExtended: %v", err)
+		}
+		want := map[string]*Extension{"ExampleA": {AuthCode: "12", Body: []byte("data")}}
+		if x := got.(*Metadata).Extensions; !reflect.DeepEqual(x, want) {
+			t.Errorf("decoding option %v: got extensions %v, want %v", o, x, want)
+		}
+	}
+}
+
 func TestEncodeZeroGIF(t *testing.T) {
 	if err := EncodeAll(ioutil.Discard, &GIF{}); err == nil {
 		t.Error("expected error from providing empty gif")
@@ -715,3 +773,228 @@ func BenchmarkQuantizedEncode(b *testing.B) {
 		Encode(ioutil.Discard, img, nil)
 	}
 }
+
+func TestWriteDeferred(t *testing.T) {
+	ctx := context.TODO()
+	first, err := readGIF("../testdata/video-001.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []*image.Paletted{first.Image[0]}
+	for _, p := range []color.Palette{
+		palette.Plan9,
+		{color.RGBA{0x00, 0x00, 0x00, 0x00}, color.RGBA{0xff, 0x00, 0x00, 0xff}},
+	} {
+		m := image.NewPaletted(image.Rect(10, 10, 40, 30), p)
+		for i := range m.Pix {
+			m.Pix[i] = uint8(rand.Intn(len(p)))
+		}
+		frames = append(frames, m)
+	}
+	g := &GIF{
+		Image:     frames,
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{DisposalNone, DisposalBackground, DisposalPrevious},
+		LoopCount: 3,
+	}
+	var orig bytes.Buffer
+	if err := EncodeAll(&orig, g); err != nil {
+		t.Fatalf("EncodeAll: %v", err)
+	}
+	want, err := DecodeAll(bytes.NewReader(orig.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+
+	m, md, err := DecodeExtended(ctx, bytes.NewReader(orig.Bytes()), image.DataDecodeOptions{
+		DecodeImage:    image.DeferData,
+		DecodeMetadata: image.DeferData,
+	})
+	if err != nil {
+		t.Fatalf("deferred DecodeExtended: %v", err)
+	}
+	di, ok := m.(*Deferred)
+	if !ok {
+		t.Fatalf("got image type %T, want *Deferred", m)
+	}
+	meta := md.(*Metadata)
+	meta.Comments = append(meta.Comments, "Copyright test")
+
+	var buf bytes.Buffer
+	if err := EncodeExtended(ctx, &buf, di, meta); err != nil {
+		t.Fatalf("EncodeExtended: %v", err)
+	}
+
+	// The compressed frame data must have been passed through
+	// untouched.
+	for i, f := range di.frames {
+		if !bytes.Contains(buf.Bytes(), f.data) {
+			t.Errorf("frame %d: image data not written unchanged", i)
+		}
+	}
+
+	got, err := DecodeAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeAll after encode: %v", err)
+	}
+	_, gotMeta, err := DecodeExtended(ctx, bytes.NewReader(buf.Bytes()), image.DataDecodeOptions{
+		DecodeImage:    image.DiscardData,
+		DecodeMetadata: image.DecodeData,
+	})
+	if err != nil {
+		t.Fatalf("DecodeExtended after encode: %v", err)
+	}
+	if c := gotMeta.(*Metadata).Comments; !reflect.DeepEqual(c, []string{"Copyright test"}) {
+		t.Errorf("got comments %q", c)
+	}
+
+	all, err := di.InstantiateAll(ctx)
+	if err != nil {
+		t.Fatalf("InstantiateAll: %v", err)
+	}
+	for name, g := range map[string]*GIF{"re-encoded": got, "instantiated": all} {
+		if !reflect.DeepEqual(g.Delay, want.Delay) || !reflect.DeepEqual(g.Disposal, want.Disposal) || g.LoopCount != want.LoopCount {
+			t.Errorf("%s: got timing %v %v %v, want %v %v %v", name, g.Delay, g.Disposal, g.LoopCount, want.Delay, want.Disposal, want.LoopCount)
+		}
+		if len(g.Image) != len(want.Image) {
+			t.Errorf("%s: got %d frames, want %d", name, len(g.Image), len(want.Image))
+			continue
+		}
+		for i := range g.Image {
+			if !reflect.DeepEqual(g.Image[i], want.Image[i]) {
+				t.Errorf("%s: frame %d differs", name, i)
+			}
+		}
+	}
+
+	inst, err := di.Instantiate(ctx)
+	if err != nil {
+		t.Fatalf("Instantiate: %v", err)
+	}
+	if !reflect.DeepEqual(inst, want.Image[0]) {
+		t.Errorf("instantiated first frame differs")
+	}
+}
+
+func TestWriteStripMetadata(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	meta := &Metadata{
+		Comments:   []string{"one", "two"},
+		Extensions: map[string]*Extension{"EXAMPLE1": {AuthCode: "1.0", Body: []byte("body")}},
+	}
+	for _, tc := range []struct {
+		s            *image.StripMetadata
+		wantComments int
+		wantExts     int
+		wantRemoved  int
+	}{
+		{&image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataComments}}, 0, 1, 2},
+		{&image.StripMetadata{Allow: []image.MetadataCategory{image.MetadataComments}}, 2, 0, 1},
+	} {
+		removed := 0
+		tc.s.Report = func(image.StrippedMetadata) { removed++ }
+		var b bytes.Buffer
+		if err := EncodeExtended(ctx, &b, m, meta, tc.s); err != nil {
+			t.Fatal(err)
+		}
+		_, md, err := DecodeExtended(ctx, &b, image.DataDecodeOptions{image.DecodeData, image.DecodeData})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := md.(*Metadata)
+		if len(got.Comments) != tc.wantComments || len(got.Extensions) != tc.wantExts {
+			t.Errorf("%+v: got %d comments and %d extensions, want %d and %d", tc.s, len(got.Comments), len(got.Extensions), tc.wantComments, tc.wantExts)
+		}
+		if removed != tc.wantRemoved {
+			t.Errorf("%+v: got %d removals, want %d", tc.s, removed, tc.wantRemoved)
+		}
+	}
+}
+
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    exif:GPSLatitude="SECRET-LAT">
+   <dc:creator>
+    <rdf:Seq><rdf:li>SECRET-NAME</rdf:li></rdf:Seq>
+   </dc:creator>
+   <dc:title>Title</dc:title>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func TestEncodeXMP(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	// Padding the packet moves where a sub-block reader lands in the
+	// magic trailer, including onto its last byte.
+	for pad := 0; pad < 300; pad++ {
+		x := strings.Replace(testXMP, `end="w"`, `end="w"`+strings.Repeat(" ", pad), 1)
+		md := &Metadata{Comments: []string{"after"}}
+		md.SetRawXMP(x)
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, m, md); err != nil {
+			t.Fatalf("pad %d: EncodeExtended: %v", pad, err)
+		}
+		if !bytes.Contains(buf.Bytes(), append([]byte("!\xff\x0bXMP DataXMP"+x), append(xmpTrailer(), 0)...)) {
+			t.Fatalf("pad %d: XMP application extension wasn't written", pad)
+		}
+		_, got, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{DecodeImage: image.DecodeData, DecodeMetadata: image.DecodeData})
+		if err != nil {
+			t.Fatalf("pad %d: DecodeExtended: %v", pad, err)
+		}
+		g := got.(*Metadata)
+		if g.RawXMP() != x || len(g.Extensions) != 0 {
+			t.Errorf("pad %d: got XMP %q and extensions %v", pad, g.RawXMP(), g.Extensions)
+		}
+	}
+
+	md := &Metadata{}
+	md.SetRawXMP("bad\x00packet")
+	if err := EncodeExtended(ctx, ioutil.Discard, m, md); err == nil {
+		t.Error("XMP packet with a NUL byte was written")
+	}
+}
+
+func TestWriteStripXMP(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	md := &Metadata{}
+	md.SetRawXMP(testXMP)
+	for _, tc := range []struct {
+		s       *image.StripMetadata
+		want    []string
+		wantXMP bool
+	}{
+		{&image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataGPS, image.MetadataOwner}}, []string{"Title"}, true},
+		{&image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataOther}}, []string{"SECRET-LAT", "SECRET-NAME"}, true},
+		{&image.StripMetadata{Allow: []image.MetadataCategory{image.MetadataComments}}, nil, false},
+	} {
+		var b bytes.Buffer
+		if err := EncodeExtended(ctx, &b, m, md, tc.s); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := DecodeExtended(ctx, &b, image.DataDecodeOptions{DecodeImage: image.DiscardData, DecodeMetadata: image.DecodeData})
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := got.(*Metadata).RawXMP()
+		if (x != "") != tc.wantXMP {
+			t.Errorf("%+v: got XMP %q", tc.s, x)
+		}
+		for _, s := range []string{"SECRET-LAT", "SECRET-NAME", "Title"} {
+			want := false
+			for _, w := range tc.want {
+				want = want || w == s
+			}
+			if strings.Contains(x, s) != want {
+				t.Errorf("%+v: XMP %q has %s: %v, want %v", tc.s, x, s, !want, want)
+			}
+		}
+	}
+}
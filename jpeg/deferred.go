@@ -0,0 +1,207 @@
+package jpeg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// Deferred holds a JPEG image that hasn't yet been decoded. It proxies
+// the standard image functions, and will decode the underlying cached
+// image data either when Instantiate is explicitly called or when one
+// of the standard image methods are invoked.
+//
+// If a deferred image is passed to Encode or EncodeExtended then it
+// will write out the same image data as was read in, without
+// re-encoding it, so no generation loss occurs.
+type Deferred struct {
+	jfif     []byte   // cached JFIF APP0 segment
+	adobe    []byte   // cached Adobe APP14 segment
+	segments [][]byte // cached DQT, DHT, SOF, DRI and SOS segments, in file order
+	img      image.Image
+
+	// bounds and model are filled in from the image header.
+	bounds image.Rectangle
+	model  color.Model
+}
+
+var _ image.Deferred = (*Deferred)(nil)
+
+// ColorModel returns the image's color model, which is known from the
+// image header without decoding the image data.
+func (d *Deferred) ColorModel() color.Model {
+	return d.model
+}
+
+// Bounds returns the image's bounds, which are known from the image
+// header without decoding the image data.
+func (d *Deferred) Bounds() image.Rectangle {
+	return d.bounds
+}
+
+// At returns the color of the pixel at (x, y), decoding the image data
+// first if necessary. Decoding errors can't be reported here, so At
+// returns nil if decoding fails; call Instantiate to get the error.
+func (d *Deferred) At(x, y int) color.Color {
+	if d.img == nil {
+		i, err := d.Instantiate(context.TODO())
+		if err != nil {
+			return nil
+		}
+		d.img = i
+	}
+	return d.img.At(x, y)
+}
+
+// IsInstantiated reports whether the image data has been decoded.
+func (d *Deferred) IsInstantiated() bool {
+	return d.img != nil
+}
+
+// Instantiate decodes the cached image data and returns the decoded
+// image. The decoded image is cached, so later calls are cheap.
+func (i *Deferred) Instantiate(ctx context.Context, opts ...image.ReadOption) (image.Image, error) {
+	if i.img != nil {
+		return i.img, nil
+	}
+
+	// Rebuild a minimal JPEG stream from the cached segments. The JFIF
+	// and Adobe segments are included because they determine how the
+	// color components are interpreted.
+	var b bytes.Buffer
+	b.Write([]byte{0xff, soiMarker})
+	b.Write(i.jfif)
+	b.Write(i.adobe)
+	for _, s := range i.segments {
+		b.Write(s)
+	}
+	b.Write([]byte{0xff, eoiMarker})
+
+	d := &decoder{
+		metadata: &Metadata{},
+	}
+	img, err := d.decode(ctx, &b, true, false)
+	if err != nil {
+		return nil, err
+	}
+	i.img = img
+	return img, nil
+}
+
+// rawSegment returns a complete marker segment, including the marker
+// and length, holding the passed-in segment payload.
+func rawSegment(marker byte, payload []byte) []byte {
+	n := len(payload) + 2
+	seg := make([]byte, 4, 4+len(payload))
+	seg[0], seg[1], seg[2], seg[3] = 0xff, marker, byte(n>>8), byte(n)
+	return append(seg, payload...)
+}
+
+// deferSegment reads the n byte payload of an image data segment and
+// caches it, rather than processing it. The frame header is still
+// parsed so that the image dimensions are known, and a scan header
+// is cached along with the entropy-coded data that follows it.
+func (d *decoder) deferSegment(ctx context.Context, marker byte, n int) error {
+	var payload []byte
+	switch marker {
+	case sof0Marker, sof1Marker, sof2Marker:
+		if err := d.processSOF(ctx, n); err != nil {
+			return err
+		}
+		payload = append(payload, d.tmp[:n]...)
+	default:
+		payload = make([]byte, n)
+		if err := d.readFull(ctx, payload); err != nil {
+			return err
+		}
+	}
+	seg := rawSegment(marker, payload)
+	if marker == sosMarker {
+		data, err := d.readEntropyData(ctx)
+		if err != nil {
+			return err
+		}
+		seg = append(seg, data...)
+	}
+	d.deferred.segments = append(d.deferred.segments, seg)
+	return nil
+}
+
+// readEntropyData reads the entropy-coded data following a scan
+// header, up to but not including the next marker that isn't a RSTn
+// marker. The data is returned as-is, with any byte stuffing intact.
+func (d *decoder) readEntropyData(ctx context.Context) ([]byte, error) {
+	var data []byte
+	for {
+		x, err := d.readByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if x != 0xff {
+			data = append(data, x)
+			continue
+		}
+		y, err := d.readByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if y == 0x00 || rst0Marker <= y && y <= rst7Marker {
+			data = append(data, x, y)
+			continue
+		}
+		// That's the start of the next marker, so give both bytes
+		// back. The buffer always holds at least the last 2 bytes
+		// read, so this is safe.
+		d.bytes.i -= 2
+		d.bytes.nUnreadable = 0
+		return data, nil
+	}
+}
+
+// writeDeferred writes out a deferred image's cached segments,
+// unchanged, along with any metadata segments. The only exception is
+// the JFIF segment's thumbnail, which is removed if s says so.
+func writeDeferred(ctx context.Context, w io.Writer, di *Deferred, m *Metadata, s *image.StripMetadata) error {
+	var e encoder
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	e.write([]byte{0xff, soiMarker})
+	// The JFIF segment must immediately follow the SOI marker.
+	jfif := di.jfif
+	if len(jfif) > 18 && s.Strips(image.MetadataThumbnail) {
+		// Drop the thumbnail data after the 14 byte fixed part of the
+		// payload, and zero its dimensions.
+		p := append([]byte(nil), jfif[4:18]...)
+		p[12], p[13] = 0, 0
+		jfif = rawSegment(app0Marker, p)
+		if m == nil || !m.thumbnailStripped {
+			s.Record(image.MetadataThumbnail, "JFIF thumbnail")
+		}
+	}
+	e.write(jfif)
+	if m != nil {
+		e.writeUnknownApp(ctx, m)
+		e.writeICC(ctx, m)
+		e.writeComments(m)
+	}
+	e.write(di.adobe)
+	for _, s := range di.segments {
+		e.write(s)
+	}
+	e.write([]byte{0xff, eoiMarker})
+	e.flush()
+	return e.err
+}
@@ -0,0 +1,196 @@
+package jpeg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/drswork/image/metadata"
+)
+
+// jsonMetadata is the JSON representation of Metadata.
+type jsonMetadata struct {
+	Format      string             `json:"format"`
+	Width       int                `json:"width"`
+	Height      int                `json:"height"`
+	ColorModel  string             `json:"colorModel,omitempty"`
+	Version     string             `json:"version,omitempty"`
+	Units       string             `json:"units,omitempty"`
+	XDensity    uint16             `json:"xDensity,omitempty"`
+	YDensity    uint16             `json:"yDensity,omitempty"`
+	Thumbnail   *jsonThumbnail     `json:"thumbnail,omitempty"`
+	Comments    []string           `json:"comments,omitempty"`
+	EXIF        *metadata.EXIFData `json:"exif,omitempty"`
+	XMP         *metadata.XMPData  `json:"xmp,omitempty"`
+	ICC         *metadata.ICCData  `json:"icc,omitempty"`
+	AppSegments []jsonAppSegment   `json:"appSegments,omitempty"`
+}
+
+// jsonThumbnail is the JSON representation of the JFIF thumbnail.
+type jsonThumbnail struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// jsonAppSegment is the JSON representation of an APPn segment.
+type jsonAppSegment struct {
+	App  int    `json:"app"`
+	Data []byte `json:"data"`
+}
+
+// jsonUnits maps JFIF density units to their JSON names.
+var jsonUnits = map[Units]string{
+	0: "none",
+	1: "dpi",
+	2: "dpcm",
+}
+
+// exifPrefix starts the payload of an APP1 EXIF segment.
+const exifPrefix = exifMetadata + "\x00\x00"
+
+// MarshalJSON encodes the metadata as a JSON object of the form
+//
+//	{
+//	  "format": "jpeg",
+//	  "width": 640,
+//	  "height": 480,
+//	  "colorModel": "YCbCr",
+//	  "version": "1.01",
+//	  "units": "dpi",
+//	  "xDensity": 72,
+//	  "yDensity": 72,
+//	  "thumbnail": {"width": 16, "height": 12},
+//	  "comments": ["A comment"],
+//	  "exif": {"raw": "TU0AKg...", "decoded": {...}},
+//	  "xmp": {"raw": "<?xpacket ...", "decoded": {...}},
+//	  "icc": {"raw": "AAAMSExp...", "decoded": {...}},
+//	  "appSegments": [{"app": 13, "data": "UGhvdG9zaG9w..."}]
+//	}
+//
+// Fields for data that isn't in the image are left out. The version,
+// units and densities come from the JFIF segment, and units are
+// "none", "dpi" or "dpcm". The thumbnail is informational, and is
+// ignored by UnmarshalJSON. The colorModel names are those used by
+// metadata.ColorModelName. The EXIF and XMP data come from the first
+// APP1 segment of each type, and are included along with the ICC
+// profile in their raw form, or their decoded form if they've already
+// been decoded, as described by metadata.EXIFData, metadata.XMPData
+// and metadata.ICCData. All other APPn segments are listed in
+// appSegments, with their payloads base64 encoded.
+// Marshalling doesn't change the metadata.
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	j := jsonMetadata{
+		Format:     "jpeg",
+		Width:      m.Width,
+		Height:     m.Height,
+		ColorModel: metadata.ColorModelName(m.ColorModel),
+		Comments:   m.Comments,
+		ICC:        metadata.NewICCData("", m.rawIcc, m.icc),
+	}
+	if m.Version != 0 {
+		j.Version = m.Version.String()
+		j.Units = jsonUnits[m.Units]
+		j.XDensity = m.XDensity
+		j.YDensity = m.YDensity
+	}
+	if m.XThumbnail != 0 && m.YThumbnail != 0 {
+		j.Thumbnail = &jsonThumbnail{Width: int(m.XThumbnail), Height: int(m.YThumbnail)}
+	}
+
+	rawExif, rawXmp := m.rawExif, m.rawXmp
+	for n := 0; n < 16; n++ {
+		for _, s := range m.AppSegments(n) {
+			switch {
+			case n == 1 && rawExif == nil && bytes.HasPrefix(s, []byte(exifPrefix)):
+				rawExif = s[len(exifPrefix):]
+			case n == 1 && rawXmp == nil && bytes.HasPrefix(s, []byte(xmpMetadata+"\x00")):
+				x := string(s[len(xmpMetadata)+1:])
+				rawXmp = &x
+			default:
+				j.AppSegments = append(j.AppSegments, jsonAppSegment{App: n, Data: s})
+			}
+		}
+	}
+	j.EXIF = metadata.NewEXIFData(rawExif, m.exif)
+	j.XMP = metadata.NewXMPData(rawXmp, m.xmp)
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes metadata in the form written by MarshalJSON,
+// replacing the contents of m. The result can be passed to
+// EncodeExtended. Raw EXIF and XMP data is stored in APP1 segments,
+// ahead of any APP1 segments listed in appSegments, and decoded EXIF
+// and XMP data is encoded into APP1 segments by EncodeExtended, which
+// fails if there's no encoder registered for it. Where both the raw
+// and decoded forms of EXIF, XMP or ICC data are given the raw form is
+// used.
+func (m *Metadata) UnmarshalJSON(b []byte) error {
+	var j jsonMetadata
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Format != "" && j.Format != "jpeg" {
+		return fmt.Errorf("Can't read %q metadata as jpeg metadata", j.Format)
+	}
+
+	n := Metadata{
+		Width:      j.Width,
+		Height:     j.Height,
+		ColorModel: metadata.ColorModelByName(j.ColorModel),
+		XDensity:   j.XDensity,
+		YDensity:   j.YDensity,
+		Comments:   j.Comments,
+	}
+	if j.Version != "" {
+		var major, minor uint16
+		if _, err := fmt.Sscanf(j.Version, "%d.%d", &major, &minor); err != nil {
+			return fmt.Errorf("Invalid JFIF version %q", j.Version)
+		}
+		n.Version = Version(major<<8 | minor)
+	}
+	if j.Units != "" {
+		found := false
+		for u, name := range jsonUnits {
+			if name == j.Units {
+				n.Units, found = u, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown JFIF units %q", j.Units)
+		}
+	}
+
+	var app1 [][]byte
+	if j.EXIF != nil {
+		if j.EXIF.Raw != nil {
+			app1 = append(app1, append([]byte(exifPrefix), j.EXIF.Raw...))
+		} else {
+			n.exif = j.EXIF.Decoded
+		}
+	}
+	if j.XMP != nil {
+		if j.XMP.Raw != "" {
+			app1 = append(app1, append([]byte(xmpMetadata+"\x00"), j.XMP.Raw...))
+		} else {
+			n.xmp = j.XMP.Decoded
+		}
+	}
+	if app1 != nil {
+		n.SetAppSegments(1, app1)
+	}
+	for _, s := range j.AppSegments {
+		if s.App < 0 || s.App > 15 {
+			return fmt.Errorf("Invalid APP segment number %d", s.App)
+		}
+		n.SetAppSegments(s.App, append(n.AppSegments(s.App), s.Data))
+	}
+	if j.ICC != nil {
+		if j.ICC.Raw != nil {
+			n.rawIcc = j.ICC.Raw
+		} else {
+			n.icc = j.ICC.Decoded
+		}
+	}
+	*m = n
+	return nil
+}
@@ -0,0 +1,134 @@
+package jpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/metadata"
+)
+
+func TestMetadataJSONRoundTrip(t *testing.T) {
+	ctx := context.TODO()
+	b, err := ioutil.ReadFile("../testdata/kauaii_1.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := image.DataDecodeOptions{DecodeImage: image.DeferData, DecodeMetadata: image.DeferData}
+	m, md, err := DecodeExtended(ctx, bytes.NewReader(b), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	meta.Comments = []string{"a comment"}
+
+	j0, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{`"format":"jpeg"`, `"version":"1.`, `"comments":`, `"exif":{"raw":`, `"xmp":{"raw":`, `"appSegments":[{"app":13,`} {
+		if !strings.Contains(string(j0), k) {
+			t.Errorf("JSON is missing %s: %s", k, j0)
+		}
+	}
+
+	var meta1 Metadata
+	if err := json.Unmarshal(j0, &meta1); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeExtended(ctx, &buf, m, &meta1); err != nil {
+		t.Fatal(err)
+	}
+	_, md2, err := DecodeExtended(ctx, &buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := md2.(*Metadata)
+	// The thumbnail isn't written back.
+	got.XThumbnail, got.YThumbnail = meta.XThumbnail, meta.YThumbnail
+	j1, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(j0, j1) {
+		t.Errorf("JSON changed after a round trip:\n%s\n%s", j0, j1)
+	}
+
+	if err := json.Unmarshal([]byte(`{"appSegments":[{"app":16,"data":""}]}`), &meta1); err == nil {
+		t.Error("APP16 segment was accepted")
+	}
+}
+
+func TestMetadataJSONDecoded(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewGray(image.Rect(0, 0, 8, 8))
+	var md Metadata
+	if err := json.Unmarshal([]byte(`{"exif":{"decoded":{}},"xmp":{"decoded":{}}}`), &md); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeExtended(ctx, ioutil.Discard, m, &md); err == nil {
+		t.Error("decoded EXIF and XMP data was written without an encoder")
+	}
+
+	const tiff, packet = "MM\x00*\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00", "<x:xmpmeta/>"
+	metadata.RegisterEXIFEncoder(func(context.Context, *metadata.EXIF, bool, ...image.WriteOption) ([]byte, error) {
+		return []byte(tiff), nil
+	})
+	metadata.RegisterXMPEncoder(func(context.Context, *metadata.XMP, ...image.WriteOption) (string, error) {
+		return packet, nil
+	})
+	defer metadata.RegisterEXIFEncoder(nil)
+	defer metadata.RegisterXMPEncoder(nil)
+
+	// The decoded data replaces the image's own EXIF and XMP segments.
+	b, err := ioutil.ReadFile("../testdata/kauaii_1.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := image.DataDecodeOptions{DecodeImage: image.DeferData, DecodeMetadata: image.DeferData}
+	dm, dmd, err := DecodeExtended(ctx, bytes.NewReader(b), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		m  image.Image
+		md *Metadata
+	}{
+		{m, &md},
+		{dm, dmd.(*Metadata)},
+	} {
+		tc.md.SetEXIF(&metadata.EXIF{})
+		tc.md.SetXMP(&metadata.XMP{})
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, tc.m, tc.md); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := DecodeExtended(ctx, &buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exif, xmp int
+		for _, s := range got.(*Metadata).AppSegments(1) {
+			switch {
+			case bytes.HasPrefix(s, []byte(exifPrefix)):
+				exif++
+				if string(s[len(exifPrefix):]) != tiff {
+					t.Errorf("got EXIF segment %q", s)
+				}
+			case bytes.HasPrefix(s, []byte(xmpMetadata+"\x00")):
+				xmp++
+				if string(s[len(xmpMetadata)+1:]) != packet {
+					t.Errorf("got XMP segment %q", s)
+				}
+			}
+		}
+		if exif != 1 || xmp != 1 {
+			t.Errorf("got %d EXIF and %d XMP segments, want 1 of each", exif, xmp)
+		}
+	}
+}
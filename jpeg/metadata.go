@@ -100,8 +100,17 @@ type Metadata struct {
 	// YThumbnail is the y dimension of the thumbnail image
 	YThumbnail uint8
 
+	// Comments holds the contents of any COM segments.
+	Comments []string
+
 	// appX holds all the unknown chunks of data in APPx segments.
 	appX map[uint8][][]byte
+
+	// thumbnailStripped is set on a stripped copy of the metadata if
+	// its JFIF thumbnail was removed, so that the removal of the
+	// thumbnail in a deferred image's JFIF segment isn't reported
+	// twice.
+	thumbnailStripped bool
 }
 
 type Units uint8
@@ -152,7 +161,12 @@ func (m *Metadata) EXIF(ctx context.Context, opt ...image.ReadOption) (*metadata
 		return nil, m.exifDecodeErr
 	}
 	if m.rawExif != nil {
-		x, err := metadata.DecodeEXIF(ctx, m.rawExif, true, opt...)
+		isBigEndian, err := metadata.EXIFByteOrder(m.rawExif)
+		if err != nil {
+			m.exifDecodeErr = err
+			return nil, err
+		}
+		x, err := metadata.DecodeEXIF(ctx, m.rawExif, isBigEndian, opt...)
 		if err != nil {
 			m.exifDecodeErr = err
 			return nil, err
@@ -230,6 +244,45 @@ func (m *Metadata) SetIcc(i *metadata.ICC) {
 	m.rawIcc = nil
 }
 
+// RawICC returns the undecoded ICC color profile, reassembled from
+// the APP2 segments it was stored in. It returns nil if the image has
+// no ICC profile, or if the profile has already been decoded.
+func (m *Metadata) RawICC() []byte {
+	return m.rawIcc
+}
+
+// SetRawICC replaces the ICC color profile associated with the
+// metadata object with the undecoded profile p. Passing nil removes
+// the ICC profile.
+func (m *Metadata) SetRawICC(p []byte) {
+	m.icc = nil
+	m.iccDecodeErr = nil
+	m.rawIcc = p
+}
+
+// AppSegments returns the payloads of the APPn segments, for n
+// between 0 and 15, that weren't otherwise understood by the decoder,
+// in file order. This includes the EXIF and XMP APP1 segments and the
+// Photoshop (IPTC) APP13 segment. Each payload starts with the
+// segment's identifying tag and excludes the marker and length.
+func (m *Metadata) AppSegments(n int) [][]byte {
+	return m.appX[byte(app0Marker+n)]
+}
+
+// SetAppSegments replaces the payloads of the APPn segments that will
+// be written out with the image. Passing nil removes them.
+func (m *Metadata) SetAppSegments(n int, segs [][]byte) {
+	k := byte(app0Marker + n)
+	if len(segs) == 0 {
+		delete(m.appX, k)
+		return
+	}
+	if m.appX == nil {
+		m.appX = make(map[byte][][]byte)
+	}
+	m.appX[k] = segs
+}
+
 func (d *decoder) processApp0(ctx context.Context, n int, opts ...image.ReadOption) error {
 	buf := make([]byte, n)
 	err := d.readFull(ctx, buf)
@@ -243,6 +296,9 @@ func (d *decoder) processApp0(ctx context.Context, n int, opts ...image.ReadOpti
 	switch tag {
 	case jfifMetadata:
 		d.jfif = true
+		if d.deferred != nil {
+			d.deferred.jfif = rawSegment(app0Marker, buf)
+		}
 		if len(buf) <= 5 {
 			return nil
 		}
@@ -367,6 +423,9 @@ func (d *decoder) processApp14(ctx context.Context, n int) error {
 	case adobeMetadata:
 		d.adobeTransformValid = true
 		d.adobeTransform = buf[11]
+		if d.deferred != nil {
+			d.deferred.adobe = rawSegment(app14Marker, buf)
+		}
 	default:
 		// This is an APP14 chunk we don't understand, so just save it.
 		d.saveAppN(ctx, app14Marker, buf)
@@ -384,6 +443,16 @@ func (d *decoder) saveAppN(ctx context.Context, n byte, buf []byte, opts ...imag
 
 }
 
+// processCOM saves the contents of a COM segment.
+func (d *decoder) processCOM(ctx context.Context, n int) error {
+	buf := make([]byte, n)
+	if err := d.readFull(ctx, buf); err != nil {
+		return err
+	}
+	d.metadata.Comments = append(d.metadata.Comments, string(buf))
+	return nil
+}
+
 func (d *decoder) processUnknownApp(ctx context.Context, app byte, n int, opts ...image.ReadOption) error {
 	buf := make([]byte, n)
 	err := d.readFull(ctx, buf)
@@ -397,12 +466,167 @@ func (d *decoder) processUnknownApp(ctx context.Context, app byte, n int, opts .
 
 }
 
+// strip returns a copy of the metadata without the data that s says
+// should be removed, recording each removal in s.
+func (m *Metadata) strip(s *image.StripMetadata) *Metadata {
+	c := *m
+
+	c.appX = nil
+	for k := byte(app0Marker); k <= app15Marker; k++ {
+		for _, seg := range m.appX[k] {
+			seg = stripAppSegment(k, seg, s)
+			if seg == nil {
+				continue
+			}
+			if c.appX == nil {
+				c.appX = make(map[byte][][]byte)
+			}
+			c.appX[k] = append(c.appX[k], seg)
+		}
+	}
+
+	if s.Strips(image.MetadataColorProfile) {
+		if c.icc != nil || c.rawIcc != nil {
+			s.Record(image.MetadataColorProfile, "JPEG ICC profile")
+		}
+		c.icc, c.rawIcc = nil, nil
+	}
+	if s.Strips(image.MetadataThumbnail) {
+		if c.Thumbnail != nil || c.XThumbnail != 0 || c.YThumbnail != 0 {
+			s.Record(image.MetadataThumbnail, "JFIF thumbnail")
+			c.thumbnailStripped = true
+		}
+		c.Thumbnail, c.XThumbnail, c.YThumbnail = nil, 0, 0
+	}
+	if s.Strips(image.MetadataComments) {
+		for range c.Comments {
+			s.Record(image.MetadataComments, "JPEG COM segment")
+		}
+		c.Comments = nil
+	}
+	return &c
+}
+
+// stripAppSegment returns the APPn segment payload seg without the
+// data that s says should be removed, or nil if the whole segment
+// should be removed.
+func stripAppSegment(marker byte, seg []byte, s *image.StripMetadata) []byte {
+	tag := ""
+	if off := bytes.IndexByte(seg, 0); off != -1 {
+		tag = string(seg[:off])
+	}
+	n := marker - app0Marker
+
+	switch {
+	case marker == app0Marker && tag == jfifExtensionMetadata:
+		if s.Strips(image.MetadataThumbnail) {
+			s.Record(image.MetadataThumbnail, "JPEG JFXX thumbnail")
+			return nil
+		}
+		return seg
+	case marker == app1Marker && tag == exifMetadata && len(seg) >= 6:
+		x := metadata.StripEXIF(seg[6:], s)
+		if x == nil {
+			return nil
+		}
+		return append(append([]byte(nil), seg[:6]...), x...)
+	case marker == app1Marker && tag == xmpMetadata:
+		x := metadata.StripXMP(string(seg[len(tag)+1:]), s)
+		if x == "" {
+			return nil
+		}
+		return append([]byte(tag+"\x00"), x...)
+	}
+
+	if s.Strips(image.MetadataOther) {
+		desc := fmt.Sprintf("JPEG APP%d segment %q", n, tag)
+		if marker == app13Marker && tag == photoshopMetadata {
+			desc = "JPEG APP13 IPTC segment"
+		}
+		s.Record(image.MetadataOther, desc)
+		return nil
+	}
+	return seg
+}
+
+// encodeDecoded returns a copy of m with its decoded EXIF and XMP data,
+// if there is any, encoded into APP1 segments. These replace the
+// first APP1 segment of the same type, and any others of that type
+// are dropped.
+func (m *Metadata) encodeDecoded(ctx context.Context) (*Metadata, error) {
+	if m.exif == nil && m.xmp == nil {
+		return m, nil
+	}
+	c := *m
+	var exif, xmp []byte
+	if m.exif != nil {
+		b, err := m.exif.Encode(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		exif = append([]byte(exifMetadata+"\x00\x00"), b...)
+		c.exif = nil
+	}
+	if m.xmp != nil {
+		x, err := m.xmp.Encode(ctx)
+		if err != nil {
+			return nil, err
+		}
+		xmp = append([]byte(xmpMetadata+"\x00"), x...)
+		c.xmp = nil
+	}
+
+	// Once the new data has taken a segment's place it's set to an
+	// empty slice, so further segments of that type are dropped.
+	var app1 [][]byte
+	for _, seg := range m.appX[app1Marker] {
+		tag := ""
+		if off := bytes.IndexByte(seg, 0); off != -1 {
+			tag = string(seg[:off])
+		}
+		switch {
+		case tag == exifMetadata && exif != nil:
+			seg, exif = exif, []byte{}
+		case tag == xmpMetadata && xmp != nil:
+			seg, xmp = xmp, []byte{}
+		}
+		if len(seg) != 0 {
+			app1 = append(app1, seg)
+		}
+	}
+	// Data without a segment to replace goes in front of the others.
+	for _, seg := range [][]byte{xmp, exif} {
+		if len(seg) != 0 {
+			app1 = append([][]byte{seg}, app1...)
+		}
+	}
+	c.appX = make(map[byte][][]byte, len(m.appX))
+	for k, v := range m.appX {
+		c.appX[k] = v
+	}
+	c.appX[app1Marker] = app1
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func (m *Metadata) validate() error {
 
 	// Check to see if there are any APPx segments registered to write
 	// out. If so we make sure that they're valid as best we can, which
 	// means we check to make sure they're actually APP entries, and
 	// that their size will fit in a single segment.
+	if len(m.rawIcc) > maxICCSegmentData*255 {
+		return fmt.Errorf("ICC profile is %v bytes, larger than %v maximum", len(m.rawIcc), maxICCSegmentData*255)
+	}
+
+	for i, c := range m.Comments {
+		if len(c) > maxSegmentSize {
+			return fmt.Errorf("Comment %v is %v bytes, larger than %v maximum", i, len(c), maxSegmentSize)
+		}
+	}
+
 	if m.appX != nil {
 		for k, v := range m.appX {
 			if k < app0Marker || k > app15Marker {
@@ -168,6 +168,10 @@ type decoder struct {
 	tmp        [2 * blockSize]byte
 
 	metadata *Metadata
+	// deferred holds the cached image data when decoding of the image
+	// has been deferred. When set, image data segments are cached
+	// rather than decoded.
+	deferred *Deferred
 }
 
 // fill fills up the d.bytes.buf buffer from the underlying io.Reader. It
@@ -592,6 +596,16 @@ func (d *decoder) decode(ctx context.Context, r io.Reader, decodeImage, decodeMe
 			return nil, FormatError("short segment length")
 		}
 
+		if d.deferred != nil {
+			switch marker {
+			case sof0Marker, sof1Marker, sof2Marker, dhtMarker, dqtMarker, sosMarker, driMarker:
+				if err := d.deferSegment(ctx, marker, n); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
 		switch marker {
 		case sof0Marker, sof1Marker, sof2Marker:
 			d.baseline = marker == sof0Marker
@@ -636,7 +650,7 @@ func (d *decoder) decode(ctx context.Context, r io.Reader, decodeImage, decodeMe
 				// Got an APPx segment we dont understand, so just save it.
 				d.processUnknownApp(ctx, marker, n)
 			} else if marker == comMarker {
-				err = d.ignore(ctx, n)
+				err = d.processCOM(ctx, n)
 			} else if marker < 0xc0 { // See Table B.1 "Marker code assignments".
 				err = FormatError("unknown marker")
 			} else {
@@ -648,6 +662,15 @@ func (d *decoder) decode(ctx context.Context, r io.Reader, decodeImage, decodeMe
 		}
 	}
 
+	if d.deferred != nil {
+		for _, seg := range d.deferred.segments {
+			if seg[1] == sosMarker {
+				return d.deferred, nil
+			}
+		}
+		return nil, FormatError("missing SOS marker")
+	}
+
 	if d.progressive {
 		if err := d.reconstructProgressiveImage(); err != nil {
 			return nil, err
@@ -788,10 +811,6 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 		return nil, nil, nil
 	}
 
-	if opt.DecodeImage == image.DeferData {
-		return nil, nil, errors.New("Image parsing may not be deferred")
-	}
-
 	if opt.DecodeImage == image.DefaultDecodeOption {
 		opt.DecodeImage = image.DecodeData
 	}
@@ -810,6 +829,9 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 
 	var d decoder
 	d.metadata = &Metadata{}
+	if opt.DecodeImage == image.DeferData {
+		d.deferred = &Deferred{}
+	}
 
 	img, err := d.decode(ctx, r, parseImage, parseMetadata)
 	if err != nil {
@@ -829,6 +851,10 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 	case 4:
 		d.metadata.ColorModel = color.CMYKModel
 	}
+	if d.deferred != nil {
+		d.deferred.bounds = image.Rect(0, 0, d.width, d.height)
+		d.deferred.model = d.metadata.ColorModel
+	}
 
 	if opt.DecodeMetadata == image.DecodeData {
 		_, err := d.metadata.EXIF(ctx, opts...)
@@ -873,4 +899,6 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 
 func init() {
 	image.RegisterFormatExtended("jpeg", "\xff\xd8", DecodeExtended)
+	image.RegisterMIMEType("jpeg", "image/jpeg", ".jpg", ".jpeg", ".jpe", ".jfif")
+	image.RegisterEncoder("jpeg", EncodeExtended)
 }
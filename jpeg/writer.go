@@ -580,7 +580,7 @@ func (e *encoder) writeUnknownApp(ctx context.Context, m *Metadata) {
 		}
 
 		for _, i := range v {
-			e.writeMarkerHeader(k, len(i))
+			e.writeMarkerHeader(k, len(i)+2)
 			if e.err != nil {
 				return
 			}
@@ -592,6 +592,55 @@ func (e *encoder) writeUnknownApp(ctx context.Context, m *Metadata) {
 	}
 }
 
+// writeComments writes out any comments as COM segments.
+func (e *encoder) writeComments(m *Metadata) {
+	for _, c := range m.Comments {
+		if e.err != nil {
+			return
+		}
+		e.writeMarkerHeader(comMarker, len(c)+2)
+		e.write([]byte(c))
+	}
+}
+
+// maxICCSegmentData is the largest amount of ICC profile data that
+// fits in a single APP2 segment, after the tag and sequence bytes.
+const maxICCSegmentData = maxSegmentSize - len(iccMetadata) - 3
+
+// writeICC writes out the ICC color profile, if there is one, split
+// across as many APP2 segments as it needs.
+func (e *encoder) writeICC(ctx context.Context, m *Metadata) {
+	if e.err != nil {
+		return
+	}
+
+	p := m.rawIcc
+	if m.icc != nil {
+		p, e.err = m.icc.Encode(ctx)
+		if e.err != nil {
+			return
+		}
+	}
+	if len(p) == 0 {
+		return
+	}
+
+	count := (len(p) + maxICCSegmentData - 1) / maxICCSegmentData
+	for i := 0; i < count; i++ {
+		chunk := p[i*maxICCSegmentData:]
+		if len(chunk) > maxICCSegmentData {
+			chunk = chunk[:maxICCSegmentData]
+		}
+		e.writeMarkerHeader(app2Marker, len(iccMetadata)+3+len(chunk)+2)
+		e.write([]byte(iccMetadata))
+		e.write([]byte{0, byte(i + 1), byte(count)})
+		e.write(chunk)
+		if e.err != nil {
+			return
+		}
+	}
+}
+
 // DefaultQuality is the default quality encoding parameter.
 const DefaultQuality = 75
 
@@ -614,6 +663,7 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 func EncodeExtended(ctx context.Context, w io.Writer, m image.Image, opts ...image.WriteOption) error {
 	var metadata *Metadata
 	var o *Options
+	var strip *image.StripMetadata
 
 	for _, opt := range opts {
 
@@ -631,11 +681,31 @@ func EncodeExtended(ctx context.Context, w io.Writer, m image.Image, opts ...ima
 			if err := metadata.validate(); err != nil {
 				return err
 			}
+		case *image.StripMetadata:
+			strip = do
 		default:
 			log.Printf("Unknown write type %T passed", opt)
 		}
 	}
 
+	// Decoded EXIF and XMP data is encoded first, so that it's written,
+	// and stripped, like the segments read from an image.
+	if metadata != nil {
+		var err error
+		if metadata, err = metadata.encodeDecoded(ctx); err != nil {
+			return err
+		}
+	}
+	if metadata != nil && strip != nil {
+		metadata = metadata.strip(strip)
+	}
+
+	// Deferred images are written back out as they were read, so the
+	// quality option doesn't apply.
+	if di, ok := m.(*Deferred); ok {
+		return writeDeferred(ctx, w, di, metadata, strip)
+	}
+
 	b := m.Bounds()
 	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
 		return errors.New("jpeg: image is too large to encode")
@@ -687,8 +757,10 @@ func EncodeExtended(ctx context.Context, w io.Writer, m image.Image, opts ...ima
 	e.buf[0] = 0xff
 	e.buf[1] = 0xd8
 	e.write(e.buf[:2])
-	if metadata != nil && metadata.appX != nil {
+	if metadata != nil {
 		e.writeUnknownApp(ctx, metadata)
+		e.writeICC(ctx, metadata)
+		e.writeComments(metadata)
 	}
 	// Write the quantization tables.
 	e.writeDQT()
@@ -292,3 +292,209 @@ func BenchmarkEncodeYCbCr(b *testing.B) {
 		Encode(ioutil.Discard, img, options)
 	}
 }
+
+func TestWriteDeferred(t *testing.T) {
+	ctx := context.TODO()
+	for _, fn := range []string{
+		"../testdata/video-001.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.cmyk.jpeg",
+		"../testdata/video-001.rgb.jpeg",
+		"../testdata/video-001.q50.420.jpeg",
+		"../testdata/video-005.gray.q50.progressive.jpeg",
+		"../testdata/video-001.separate.dc.progression.jpeg",
+	} {
+		want, err := decodeFile(fn)
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, md, err := DecodeExtended(ctx, bytes.NewReader(b), image.DataDecodeOptions{
+			DecodeImage:    image.DeferData,
+			DecodeMetadata: image.DeferData,
+		})
+		if err != nil {
+			t.Errorf("%s: deferred decode: %v", fn, err)
+			continue
+		}
+		di, ok := m.(*Deferred)
+		if !ok {
+			t.Errorf("%s: got image type %T, want *Deferred", fn, m)
+			continue
+		}
+
+		// Add a metadata segment that wasn't in the original file.
+		meta := md.(*Metadata)
+		meta.appX = map[uint8][][]byte{app13Marker: {[]byte("Copyright\x00test")}}
+
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, di, meta); err != nil {
+			t.Errorf("%s: encode: %v", fn, err)
+			continue
+		}
+
+		// The entropy-coded data must have been passed through
+		// untouched.
+		for _, seg := range di.segments {
+			if !bytes.Contains(buf.Bytes(), seg) {
+				t.Errorf("%s: segment %#02x not written unchanged", fn, seg[1])
+			}
+		}
+
+		got, gotMeta, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{
+			DecodeImage:    image.DecodeData,
+			DecodeMetadata: image.DeferData,
+		})
+		if err != nil {
+			t.Errorf("%s: decode after encode: %v", fn, err)
+			continue
+		}
+		if got.Bounds() != want.Bounds() || averageDelta(got, want) != 0 {
+			t.Errorf("%s: re-encoded image differs from the original", fn)
+		}
+		if v := gotMeta.(*Metadata).appX[app13Marker]; len(v) != 1 || string(v[0]) != "Copyright\x00test" {
+			t.Errorf("%s: got APP13 segments %q", fn, v)
+		}
+
+		// Instantiating the deferred image must give the same result
+		// as decoding it directly.
+		inst, err := di.Instantiate(ctx)
+		if err != nil {
+			t.Errorf("%s: instantiate: %v", fn, err)
+			continue
+		}
+		if inst.Bounds() != want.Bounds() || averageDelta(inst, want) != 0 {
+			t.Errorf("%s: instantiated image differs from the original", fn)
+		}
+	}
+}
+
+func TestWriteICC(t *testing.T) {
+	ctx := context.TODO()
+	b, err := ioutil.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{100, maxICCSegmentData, maxICCSegmentData + 1, 3*maxICCSegmentData + 7} {
+		m, md, err := DecodeExtended(ctx, bytes.NewReader(b), image.DataDecodeOptions{
+			DecodeImage:    image.DeferData,
+			DecodeMetadata: image.DeferData,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		profile := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(profile)
+		meta := md.(*Metadata)
+		meta.SetRawICC(profile)
+
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, m, meta); err != nil {
+			t.Errorf("%d byte profile: encode: %v", n, err)
+			continue
+		}
+		_, gotMeta, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{
+			DecodeImage:    image.DeferData,
+			DecodeMetadata: image.DeferData,
+		})
+		if err != nil {
+			t.Errorf("%d byte profile: decode: %v", n, err)
+			continue
+		}
+		if got := gotMeta.(*Metadata).RawICC(); !bytes.Equal(got, profile) {
+			t.Errorf("%d byte profile: got %d bytes back, or contents differ", n, len(got))
+		}
+	}
+}
+
+func TestWriteStripMetadata(t *testing.T) {
+	ctx := context.TODO()
+	b, err := ioutil.ReadFile("../testdata/kauaii_1.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, md, err := DecodeExtended(ctx, bytes.NewReader(b), image.DataDecodeOptions{
+		DecodeImage:    image.DeferData,
+		DecodeMetadata: image.DeferData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	meta.Comments = []string{"a comment"}
+
+	s := &image.StripMetadata{
+		Allow: []image.MetadataCategory{image.MetadataOrientation, image.MetadataColorProfile},
+	}
+	var removed []image.StrippedMetadata
+	s.Report = func(r image.StrippedMetadata) { removed = append(removed, r) }
+	var buf bytes.Buffer
+	if err := EncodeExtended(ctx, &buf, m, meta, s); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) == 0 {
+		t.Error("nothing reported as removed")
+	}
+	if len(meta.Comments) != 1 || len(meta.AppSegments(13)) != 1 {
+		t.Error("the metadata passed in was modified")
+	}
+
+	_, gotMeta, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{
+		DecodeImage:    image.DeferData,
+		DecodeMetadata: image.DeferData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := gotMeta.(*Metadata)
+	if got.Comments != nil {
+		t.Errorf("got comments %q, want none", got.Comments)
+	}
+	if got.AppSegments(13) != nil {
+		t.Error("IPTC segment wasn't removed")
+	}
+	if !bytes.Equal(got.RawICC(), meta.RawICC()) {
+		t.Error("ICC profile wasn't kept")
+	}
+	// The EXIF segment is kept, as it holds the orientation.
+	if app1 := got.AppSegments(1); len(app1) != 1 || !bytes.HasPrefix(app1[0], []byte("Exif\x00\x00")) {
+		t.Errorf("got %d APP1 segments, want just the EXIF one", len(app1))
+	}
+
+	// The JFIF thumbnail is reported whether or not the image is
+	// deferred, and only once.
+	thumb := &Metadata{Thumbnail: image.NewRGBA(image.Rect(0, 0, 1, 1)), XThumbnail: 1, YThumbnail: 1}
+	s = &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataThumbnail}}
+	for _, img := range []image.Image{m, image.NewGray(image.Rect(0, 0, 8, 8))} {
+		removed = nil
+		s.Report = func(r image.StrippedMetadata) { removed = append(removed, r) }
+		if err := EncodeExtended(ctx, ioutil.Discard, img, thumb, s); err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 1 || removed[0].Category != image.MetadataThumbnail {
+			t.Errorf("%T: got removals %v, want the thumbnail", img, removed)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewGray(image.Rect(0, 0, 8, 8))
+	var buf bytes.Buffer
+	want := []string{"first", "second comment"}
+	if err := EncodeExtended(ctx, &buf, m, &Metadata{Comments: want}); err != nil {
+		t.Fatal(err)
+	}
+	_, md, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{image.DecodeData, image.DecodeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md.(*Metadata).Comments; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got comments %q, want %q", got, want)
+	}
+}
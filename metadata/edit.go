@@ -0,0 +1,513 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// EXIFIFD identifies an IFD in a TIFF format EXIF block.
+type EXIFIFD int
+
+const (
+	// EXIFImageIFD is IFD0, which holds the tags describing the main
+	// image.
+	EXIFImageIFD EXIFIFD = iota
+	// EXIFPhotoIFD is the Exif IFD, which holds the tags describing
+	// how the photo was taken.
+	EXIFPhotoIFD
+	// EXIFGPSIFD is the GPS IFD.
+	EXIFGPSIFD
+)
+
+// TIFF field types.
+const (
+	exifByte      = 1
+	exifASCII     = 2
+	exifShort     = 3
+	exifLong      = 4
+	exifRational  = 5
+	exifUndefined = 7
+)
+
+// EXIFField identifies an EXIF tag.
+type EXIFField struct {
+	IFD EXIFIFD
+	Tag uint16
+	// Type is the TIFF field type of the tag's value: 1 for BYTE, 2
+	// for ASCII, 3 for SHORT, 4 for LONG, 5 for RATIONAL or 7 for
+	// UNDEFINED. If it's 0, the type of the existing value is used, or
+	// ASCII if there isn't one.
+	Type uint16
+}
+
+// EXIFFields maps the names of commonly edited EXIF tags to their
+// fields.
+var EXIFFields = map[string]EXIFField{
+	"ImageDescription":   {EXIFImageIFD, 0x010e, exifASCII},
+	"Make":               {EXIFImageIFD, 0x010f, exifASCII},
+	"Model":              {EXIFImageIFD, 0x0110, exifASCII},
+	"Orientation":        {EXIFImageIFD, 0x0112, exifShort},
+	"Software":           {EXIFImageIFD, 0x0131, exifASCII},
+	"DateTime":           {EXIFImageIFD, 0x0132, exifASCII},
+	"Artist":             {EXIFImageIFD, 0x013b, exifASCII},
+	"Copyright":          {EXIFImageIFD, 0x8298, exifASCII},
+	"CameraSerialNumber": {EXIFImageIFD, 0xc62f, exifASCII},
+	"DateTimeOriginal":   {EXIFPhotoIFD, 0x9003, exifASCII},
+	"DateTimeDigitized":  {EXIFPhotoIFD, 0x9004, exifASCII},
+	"MakerNote":          {EXIFPhotoIFD, 0x927c, exifUndefined},
+	"ImageUniqueID":      {EXIFPhotoIFD, 0xa420, exifASCII},
+	"CameraOwnerName":    {EXIFPhotoIFD, 0xa430, exifASCII},
+	"BodySerialNumber":   {EXIFPhotoIFD, 0xa431, exifASCII},
+	"LensMake":           {EXIFPhotoIFD, 0xa433, exifASCII},
+	"LensModel":          {EXIFPhotoIFD, 0xa434, exifASCII},
+	"LensSerialNumber":   {EXIFPhotoIFD, 0xa435, exifASCII},
+	"GPSLatitudeRef":     {EXIFGPSIFD, 0x0001, exifASCII},
+	"GPSLatitude":        {EXIFGPSIFD, 0x0002, exifRational},
+	"GPSLongitudeRef":    {EXIFGPSIFD, 0x0003, exifASCII},
+	"GPSLongitude":       {EXIFGPSIFD, 0x0004, exifRational},
+	"GPSAltitudeRef":     {EXIFGPSIFD, 0x0005, exifByte},
+	"GPSAltitude":        {EXIFGPSIFD, 0x0006, exifRational},
+	"GPSTimeStamp":       {EXIFGPSIFD, 0x0007, exifRational},
+	"GPSDateStamp":       {EXIFGPSIFD, 0x001d, exifASCII},
+}
+
+// emptyEXIF is a big-endian TIFF header followed by an empty IFD0.
+const emptyEXIF = "MM\x00*\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00"
+
+// SetEXIFField returns a copy of b, a TIFF format EXIF block, with the
+// tag f set to v. ASCII and UNDEFINED values are used as they are, and
+// other values are comma separated lists of numbers, with RATIONAL
+// numbers written as n/d. The IFD the tag goes in is added if there
+// isn't one. New data is added to the end of the block so the offsets
+// in the rest of it stay valid, and replaced data is zeroed. A new
+// block is created if b is nil.
+func SetEXIFField(b []byte, f EXIFField, v string) ([]byte, error) {
+	if err := checkEXIFField(f.IFD, f.Tag); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		b = []byte(emptyEXIF)
+	}
+	e := &exifStripper{b: append([]byte(nil), b...)}
+	if err := e.header(); err != nil {
+		return nil, err
+	}
+	loc, err := e.ifdPointer(f.IFD, true)
+	if err != nil {
+		return nil, err
+	}
+	typ := f.Type
+	if typ == 0 {
+		typ = exifASCII
+		if p, err := e.find(loc, f.Tag); err != nil {
+			return nil, err
+		} else if p != 0 {
+			typ = e.order.Uint16(e.b[p+2:])
+		}
+	}
+	count, value, err := encodeEXIFValue(e.order, typ, v)
+	if err != nil {
+		return nil, fmt.Errorf("EXIF tag %#04x: %v", f.Tag, err)
+	}
+	if err := e.setEntry(loc, f.Tag, typ, count, value); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+// DeleteEXIFField returns a copy of b, a TIFF format EXIF block,
+// without the given tag. Its data is zeroed in place.
+func DeleteEXIFField(b []byte, ifd EXIFIFD, tag uint16) ([]byte, error) {
+	if err := checkEXIFField(ifd, tag); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	e := &exifStripper{b: append([]byte(nil), b...)}
+	if err := e.header(); err != nil {
+		return nil, err
+	}
+	loc, err := e.ifdPointer(ifd, false)
+	if err != nil || loc == 0 {
+		return e.b, err
+	}
+	if err := e.deleteEntry(loc, tag); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+// checkEXIFField checks that a tag can be edited.
+func checkEXIFField(ifd EXIFIFD, tag uint16) error {
+	switch ifd {
+	case EXIFImageIFD, EXIFPhotoIFD:
+		if exifStructuralTags[tag] || tag == tagGPSIFD {
+			return fmt.Errorf("EXIF tag %#04x describes the block's layout and can't be edited", tag)
+		}
+	case EXIFGPSIFD:
+	default:
+		return fmt.Errorf("invalid EXIF IFD %d", ifd)
+	}
+	return nil
+}
+
+// encodeEXIFValue returns the count and encoded bytes of the value v
+// of a field of type typ.
+func encodeEXIFValue(order binary.ByteOrder, typ uint16, v string) (uint32, []byte, error) {
+	switch typ {
+	case exifASCII:
+		return uint32(len(v) + 1), append([]byte(v), 0), nil
+	case exifUndefined:
+		return uint32(len(v)), []byte(v), nil
+	}
+
+	var b []byte
+	fields := strings.Split(v, ",")
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		switch typ {
+		case exifByte:
+			n, err := strconv.ParseUint(f, 0, 8)
+			if err != nil {
+				return 0, nil, err
+			}
+			b = append(b, byte(n))
+		case exifShort:
+			n, err := strconv.ParseUint(f, 0, 16)
+			if err != nil {
+				return 0, nil, err
+			}
+			b = append(b, 0, 0)
+			order.PutUint16(b[len(b)-2:], uint16(n))
+		case exifLong:
+			n, err := strconv.ParseUint(f, 0, 32)
+			if err != nil {
+				return 0, nil, err
+			}
+			b = append(b, 0, 0, 0, 0)
+			order.PutUint32(b[len(b)-4:], uint32(n))
+		case exifRational:
+			num, den := f, "1"
+			if i := strings.Index(f, "/"); i >= 0 {
+				num, den = f[:i], f[i+1:]
+			}
+			n, err := strconv.ParseUint(num, 10, 32)
+			if err != nil {
+				return 0, nil, err
+			}
+			d, err := strconv.ParseUint(den, 10, 32)
+			if err != nil {
+				return 0, nil, err
+			}
+			b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+			order.PutUint32(b[len(b)-8:], uint32(n))
+			order.PutUint32(b[len(b)-4:], uint32(d))
+		default:
+			return 0, nil, fmt.Errorf("unsupported field type %d", typ)
+		}
+	}
+	return uint32(len(fields)), b, nil
+}
+
+// ifdPointer returns the location in the block of the offset of the
+// given IFD, or 0 if the IFD doesn't exist. If create is set, a
+// missing IFD is added.
+func (e *exifStripper) ifdPointer(ifd EXIFIFD, create bool) (uint32, error) {
+	if ifd == EXIFImageIFD {
+		return 4, nil
+	}
+	tag := uint16(tagExifIFD)
+	if ifd == EXIFGPSIFD {
+		tag = tagGPSIFD
+	}
+	p, err := e.find(4, tag)
+	if err != nil {
+		return 0, err
+	}
+	if p == 0 {
+		if !create {
+			return 0, nil
+		}
+		off, err := e.appendData(make([]byte, 6))
+		if err != nil {
+			return 0, err
+		}
+		var v [4]byte
+		e.order.PutUint32(v[:], off)
+		if err := e.setEntry(4, tag, exifLong, 1, v[:]); err != nil {
+			return 0, err
+		}
+		return e.ifdPointer(ifd, false)
+	}
+	if typ := e.order.Uint16(e.b[p+2:]); (typ != exifLong && typ != 13) || e.order.Uint32(e.b[p+4:]) != 1 {
+		return 0, errBadEXIF
+	}
+	return p + 8, nil
+}
+
+// find returns the location in the block of the entry for tag in the
+// IFD whose offset is stored at loc, or 0 if there isn't one.
+func (e *exifStripper) find(loc uint32, tag uint16) (uint32, error) {
+	off := e.order.Uint32(e.b[loc:])
+	n, err := e.ifdLen(off)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		p := off + 2 + 12*uint32(i)
+		if e.order.Uint16(e.b[p:]) == tag {
+			return p, nil
+		}
+	}
+	return 0, nil
+}
+
+// appendData adds data to the end of the block, at the even offset
+// TIFF requires, and returns its offset.
+func (e *exifStripper) appendData(data []byte) (uint32, error) {
+	if len(e.b)%2 != 0 {
+		e.b = append(e.b, 0)
+	}
+	off := len(e.b)
+	if uint64(off)+uint64(len(data)) > math.MaxUint32 {
+		return 0, errors.New("EXIF data is too large")
+	}
+	e.b = append(e.b, data...)
+	return uint32(off), nil
+}
+
+// setEntry sets the entry for tag in the IFD whose offset is stored at
+// loc. Adding an entry moves the IFD to the end of the block, as
+// there's no room for it in place.
+func (e *exifStripper) setEntry(loc uint32, tag, typ uint16, count uint32, value []byte) error {
+	entry := make([]byte, 12)
+	e.order.PutUint16(entry, tag)
+	e.order.PutUint16(entry[2:], typ)
+	e.order.PutUint32(entry[4:], count)
+	if len(value) <= 4 {
+		copy(entry[8:], value)
+	} else {
+		off, err := e.appendData(value)
+		if err != nil {
+			return err
+		}
+		e.order.PutUint32(entry[8:], off)
+	}
+
+	p, err := e.find(loc, tag)
+	if err != nil {
+		return err
+	}
+	if p != 0 {
+		if err := e.eraseEntry(e.b[p : p+12]); err != nil {
+			return err
+		}
+		copy(e.b[p:], entry)
+		return nil
+	}
+
+	// Write a copy of the IFD with the entry added in tag order.
+	off := e.order.Uint32(e.b[loc:])
+	n, err := e.ifdLen(off)
+	if err != nil {
+		return err
+	}
+	if n == math.MaxUint16 {
+		return errors.New("too many EXIF tags")
+	}
+	ifd := make([]byte, 2+12*(n+1)+4)
+	e.order.PutUint16(ifd, uint16(n+1))
+	q := 2
+	for i := 0; i < n; i++ {
+		old := e.b[off+2+12*uint32(i):][:12]
+		if entry != nil && e.order.Uint16(old) > tag {
+			copy(ifd[q:], entry)
+			q += 12
+			entry = nil
+		}
+		copy(ifd[q:], old)
+		q += 12
+	}
+	copy(ifd[q:], entry)
+	copy(ifd[len(ifd)-4:], e.b[off+2+12*uint32(n):][:4])
+	newOff, err := e.appendData(ifd)
+	if err != nil {
+		return err
+	}
+	e.zero(off, 2+12*uint32(n)+4)
+	e.order.PutUint32(e.b[loc:], newOff)
+	return nil
+}
+
+// deleteEntry removes the entry for tag from the IFD whose offset is
+// stored at loc, if there is one.
+func (e *exifStripper) deleteEntry(loc uint32, tag uint16) error {
+	p, err := e.find(loc, tag)
+	if err != nil || p == 0 {
+		return err
+	}
+	if err := e.eraseEntry(e.b[p : p+12]); err != nil {
+		return err
+	}
+	off := e.order.Uint32(e.b[loc:])
+	n := uint32(e.order.Uint16(e.b[off:]))
+	end := off + 2 + 12*n + 4
+	copy(e.b[p:], e.b[p+12:end])
+	e.zero(end-12, 12)
+	e.order.PutUint16(e.b[off:], uint16(n-1))
+	return nil
+}
+
+// XMPNamespaces maps the usual prefixes of common XMP namespaces to
+// the namespaces.
+var XMPNamespaces = map[string]string{
+	"aux":          auxNS,
+	"dc":           dcNS,
+	"exif":         exifNS,
+	"exifEX":       exifEXNS,
+	"Iptc4xmpCore": iptcCoreNS,
+	"Iptc4xmpExt":  iptcExtNS,
+	"photoshop":    photoshopNS,
+	"tiff":         tiffNS,
+	"xmp":          xmpNS,
+	"xmpRights":    xmpRightsNS,
+}
+
+// xmpArrays holds the kind of RDF array used for the values of XMP
+// properties that aren't simple.
+var xmpArrays = map[xml.Name]string{
+	{Space: dcNS, Local: "creator"}:                       "Seq",
+	{Space: dcNS, Local: "description"}:                   "Alt",
+	{Space: dcNS, Local: "rights"}:                        "Alt",
+	{Space: dcNS, Local: "subject"}:                       "Bag",
+	{Space: dcNS, Local: "title"}:                         "Alt",
+	{Space: xmpRightsNS, Local: "Owner"}:                  "Bag",
+	{Space: xmpRightsNS, Local: "UsageTerms"}:             "Alt",
+	{Space: photoshopNS, Local: "SupplementalCategories"}: "Bag",
+}
+
+// emptyXMP is an XMP packet with no properties.
+const emptyXMP = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+// SetXMPProperty returns a copy of the XMP packet x with the property
+// name, whose Space is the namespace, set to v. An existing property
+// keeps its place in the packet, and if its value is an RDF array the
+// array is replaced by one holding just v. A new property is added to
+// the first top-level rdf:Description. A new packet is created if x is
+// empty.
+func SetXMPProperty(x string, name xml.Name, v string) (string, error) {
+	if x == "" {
+		x = emptyXMP
+	}
+	p, err := parseXMP(x)
+	if err != nil {
+		return "", err
+	}
+	var edits []xmpEdit
+	found := false
+	for _, pr := range p.props {
+		switch {
+		case pr.name != name:
+		case found:
+			edits = append(edits, p.cut(pr))
+		case pr.attr:
+			found = true
+			a := p.x[pr.span.start:pr.span.end]
+			ws := a[:len(a)-len(strings.TrimLeft(a, " \t\r\n"))]
+			edits = append(edits, xmpEdit{pr.span, fmt.Sprintf(`%s%s:%s="%s"`, ws, pr.prefix, name.Local, xmlEscape(v))})
+		default:
+			found = true
+			edits = append(edits, xmpEdit{pr.span, p.element(pr.prefix, name, pr.array, v)})
+		}
+	}
+	if !found {
+		if p.desc.start < 0 {
+			return "", errors.New("XMP packet has no rdf:Description")
+		}
+		el := p.element("", name, xmpArrays[name], v)
+		if p.descEnd < 0 {
+			// Turn the empty element into a start and end tag.
+			edits = append(edits, xmpEdit{span{p.desc.end - 2, p.desc.end}, ">" + el + "</" + p.descName + ">"})
+		} else {
+			indent := p.x[:p.descEnd]
+			indent = indent[len(strings.TrimRight(indent, " \t")):]
+			edits = append(edits, xmpEdit{span{p.descEnd, p.descEnd}, " " + el + "\n" + indent})
+		}
+	}
+	return p.apply(edits), nil
+}
+
+// DeleteXMPProperty returns a copy of the XMP packet x without the
+// property name, whose Space is the namespace. The empty string is
+// returned if no properties remain.
+func DeleteXMPProperty(x string, name xml.Name) (string, error) {
+	if x == "" {
+		return "", nil
+	}
+	p, err := parseXMP(x)
+	if err != nil {
+		return "", err
+	}
+	var edits []xmpEdit
+	for _, pr := range p.props {
+		if pr.name == name {
+			edits = append(edits, p.cut(pr))
+		}
+	}
+	if len(edits) == len(p.props) {
+		return "", nil
+	}
+	return p.apply(edits), nil
+}
+
+// element returns a property element setting name to v, holding v in
+// an RDF array of the given kind if it isn't empty. The element
+// declares the namespaces it needs that aren't already in scope.
+func (p *xmpPacket) element(prefix string, name xml.Name, array, v string) string {
+	if prefix == "" {
+		prefix = "ns"
+		for k, ns := range XMPNamespaces {
+			if ns == name.Space {
+				prefix = k
+			}
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s:%s", prefix, name.Local)
+	if p.prefixes[prefix] != name.Space {
+		fmt.Fprintf(&b, ` xmlns:%s="%s"`, prefix, xmlEscape(name.Space))
+	}
+	if array != "" && p.prefixes["rdf"] != rdfNS {
+		fmt.Fprintf(&b, ` xmlns:rdf="%s"`, rdfNS)
+	}
+	b.WriteString(">")
+	switch array {
+	case "Alt":
+		fmt.Fprintf(&b, `<rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt>`, xmlEscape(v))
+	case "Bag", "Seq":
+		fmt.Fprintf(&b, "<rdf:%s><rdf:li>%s</rdf:li></rdf:%[1]s>", array, xmlEscape(v))
+	default:
+		b.WriteString(xmlEscape(v))
+	}
+	fmt.Fprintf(&b, "</%s:%s>", prefix, name.Local)
+	return b.String()
+}
+
+// xmlEscape escapes s for use in XML text or a quoted attribute.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,174 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+)
+
+// exifValue returns the raw value of tag in the given IFD of b, and
+// whether it's there.
+func exifValue(t *testing.T, b []byte, ifd EXIFIFD, tag uint16) ([]byte, bool) {
+	e := &exifStripper{b: b}
+	if err := e.header(); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := e.ifdPointer(ifd, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc == 0 {
+		return nil, false
+	}
+	p, err := e.find(loc, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == 0 {
+		return nil, false
+	}
+	off, size, external, err := e.value(b[p : p+12])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !external {
+		return b[p+8 : p+8+size], true
+	}
+	return b[off : off+size], true
+}
+
+func TestEXIFFields(t *testing.T) {
+	orig := testTIFF()
+	b, err := SetEXIFField(orig, EXIFFields["Artist"], "Someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := exifValue(t, b, EXIFImageIFD, 0x013b); string(v) != "Someone\x00" {
+		t.Errorf("got artist %q", v)
+	}
+	if bytes.Contains(b, []byte("SECRET-ARTIST")) {
+		t.Error("replaced artist wasn't zeroed")
+	}
+
+	// New tags, including one in a new IFD.
+	b, err = SetEXIFField(b, EXIFFields["Copyright"], "(c) Someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = SetEXIFField(b, EXIFFields["GPSAltitude"], "1500/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = SetEXIFField(b, EXIFField{IFD: EXIFPhotoIFD, Tag: 0xa431}, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := exifValue(t, b, EXIFImageIFD, 0x8298); string(v) != "(c) Someone\x00" {
+		t.Errorf("got copyright %q", v)
+	}
+	if v, _ := exifValue(t, b, EXIFGPSIFD, 0x0006); !bytes.Equal(v, []byte{220, 5, 0, 0, 10, 0, 0, 0}) {
+		t.Errorf("got altitude %v", v)
+	}
+	if v, _ := exifValue(t, b, EXIFPhotoIFD, 0xa431); string(v) != "1234\x00" {
+		t.Errorf("got serial number %q", v)
+	}
+	if v, _ := exifValue(t, b, EXIFImageIFD, 0x0112); !bytes.Equal(v, []byte{6, 0}) {
+		t.Errorf("orientation changed to %v", v)
+	}
+
+	b, err = DeleteEXIFField(b, EXIFPhotoIFD, 0x927c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := exifValue(t, b, EXIFPhotoIFD, 0x927c); ok {
+		t.Error("maker note wasn't deleted")
+	}
+	if bytes.Contains(b, []byte("SECRET-MAKERNOTE")) {
+		t.Error("deleted maker note wasn't zeroed")
+	}
+
+	// The thumbnail is untouched, and the result can still be walked.
+	if !bytes.Contains(b, []byte("SECRET-THUMBNAIL-DATA")) {
+		t.Error("thumbnail was lost")
+	}
+	s := &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataThumbnail}}
+	if StripEXIF(b, s) == nil {
+		t.Error("edited EXIF data doesn't parse")
+	}
+
+	if _, err := SetEXIFField(orig, EXIFField{IFD: EXIFImageIFD, Tag: 0x0100}, "1"); err == nil {
+		t.Error("setting the image width succeeded")
+	}
+	if _, err := SetEXIFField(orig, EXIFFields["Orientation"], "x"); err == nil {
+		t.Error("setting a bad orientation succeeded")
+	}
+
+	// A new block.
+	b, err = SetEXIFField(nil, EXIFFields["LensModel"], "Lens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := exifValue(t, b, EXIFPhotoIFD, 0xa434); string(v) != "Lens\x00" {
+		t.Errorf("got lens model %q", v)
+	}
+}
+
+func TestXMPProperties(t *testing.T) {
+	title := xml.Name{Space: dcNS, Local: "title"}
+	tool := xml.Name{Space: xmpNS, Local: "CreatorTool"}
+	rating := xml.Name{Space: xmpNS, Local: "Rating"}
+	creator := xml.Name{Space: dcNS, Local: "creator"}
+
+	x, err := SetXMPProperty(testXMP, title, "A <new> title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, err = SetXMPProperty(x, tool, "Other & tool"); err != nil {
+		t.Fatal(err)
+	}
+	if x, err = SetXMPProperty(x, rating, "5"); err != nil {
+		t.Fatal(err)
+	}
+	if x, err = SetXMPProperty(x, creator, "Someone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<dc:title>A &lt;new&gt; title</dc:title>",
+		"\n    xmp:CreatorTool=\"Other &amp; tool\">",
+		"<xmp:Rating>5</xmp:Rating>\n  </rdf:Description>",
+		"<rdf:Seq><rdf:li>Someone</rdf:li></rdf:Seq>",
+		"\x00",
+	} {
+		if !strings.Contains(x, want) {
+			t.Errorf("edited XMP is missing %q:\n%s", want, x)
+		}
+	}
+	if strings.Contains(x, "SECRET-NAME") {
+		t.Errorf("old creator is still there:\n%s", x)
+	}
+	if err := xml.Unmarshal([]byte(strings.TrimRight(x, "\x00")), new(struct{})); err != nil {
+		t.Errorf("edited XMP isn't valid XML: %v", err)
+	}
+
+	if x, err = DeleteXMPProperty(x, title); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(x, "dc:title") {
+		t.Errorf("title wasn't deleted:\n%s", x)
+	}
+
+	// A new packet.
+	x, err = SetXMPProperty("", title, "Title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(x, `<rdf:Alt><rdf:li xml:lang="x-default">Title</rdf:li></rdf:Alt></dc:title></rdf:Description>`) {
+		t.Errorf("got new packet:\n%s", x)
+	}
+	if x, err = DeleteXMPProperty(x, title); err != nil || x != "" {
+		t.Errorf("deleting the only property gave %q, %v", x, err)
+	}
+}
@@ -3,6 +3,7 @@ package metadata
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/drswork/image"
@@ -14,6 +15,12 @@ func RegisterEXIFDecoder(d func(context.Context, []byte, bool, ...image.ReadOpti
 	exifDecoder = d
 }
 
+// EXIFDecoderRegistered reports whether an EXIF decoder has been
+// registered, usually by importing the metadata/exif package.
+func EXIFDecoderRegistered() bool {
+	return exifDecoder != nil
+}
+
 var exifEncoder func(context.Context, *EXIF, bool, ...image.WriteOption) ([]byte, error)
 
 func RegisterEXIFEncoder(e func(context.Context, *EXIF, bool, ...image.WriteOption) ([]byte, error)) {
@@ -21,39 +28,57 @@ func RegisterEXIFEncoder(e func(context.Context, *EXIF, bool, ...image.WriteOpti
 }
 
 type Rational struct {
-	Numerator   uint32
-	Denomenator uint32
+	Numerator   uint32 `json:"numerator,omitempty"`
+	Denomenator uint32 `json:"denominator,omitempty"`
 }
 
 type EXIF struct {
-	ImageWidth                uint32         // 256
-	ImageHeight               uint32         // 257
-	BitsPerSample             [3]uint16      // 258
-	Compression               uint16         // 259
-	PhotometricInterpretation uint16         // 262
-	Orientation               uint16         // 274
-	SamplesPerPixel           uint16         // 277
-	PlanarConfiguration       uint16         // 284
-	YCbCrSubsampling          [2]uint16      // 530
-	YCbCrPositioning          uint16         // 531
-	XResolution               Rational       // 282
-	YResolution               Rational       // 283
-	ResolutionUnit            uint16         // 296
-	TransferFunction          [3][256]uint16 // 301
-	WhitePoint                [2]Rational    // 318
-	PrimaryChromaticities     [6]Rational    // 319
-	YCbCrCoefficient          [3]Rational    // 529
-	ReferenceBlackWhite       [6]Rational    // 532
-	DateTime                  *time.Time     // 306
-	ImageDescription          string         // 270
-	Make                      string         // 271
-	Model                     string         // 272
-	Software                  string         // 305
-	Artist                    string         // 315
-	Copyright                 string         // 33432
+	ImageWidth                uint32         `json:"imageWidth,omitempty"`                // 256
+	ImageHeight               uint32         `json:"imageHeight,omitempty"`               // 257
+	BitsPerSample             [3]uint16      `json:"bitsPerSample,omitempty"`             // 258
+	Compression               uint16         `json:"compression,omitempty"`               // 259
+	PhotometricInterpretation uint16         `json:"photometricInterpretation,omitempty"` // 262
+	Orientation               uint16         `json:"orientation,omitempty"`               // 274
+	SamplesPerPixel           uint16         `json:"samplesPerPixel,omitempty"`           // 277
+	PlanarConfiguration       uint16         `json:"planarConfiguration,omitempty"`       // 284
+	YCbCrSubsampling          [2]uint16      `json:"yCbCrSubsampling,omitempty"`          // 530
+	YCbCrPositioning          uint16         `json:"yCbCrPositioning,omitempty"`          // 531
+	XResolution               Rational       `json:"xResolution,omitempty"`               // 282
+	YResolution               Rational       `json:"yResolution,omitempty"`               // 283
+	ResolutionUnit            uint16         `json:"resolutionUnit,omitempty"`            // 296
+	TransferFunction          [3][256]uint16 `json:"transferFunction,omitempty"`          // 301
+	WhitePoint                [2]Rational    `json:"whitePoint,omitempty"`                // 318
+	PrimaryChromaticities     [6]Rational    `json:"primaryChromaticities,omitempty"`     // 319
+	YCbCrCoefficient          [3]Rational    `json:"yCbCrCoefficient,omitempty"`          // 529
+	ReferenceBlackWhite       [6]Rational    `json:"referenceBlackWhite,omitempty"`       // 532
+	DateTime                  *time.Time     `json:"dateTime,omitempty"`                  // 306
+	ImageDescription          string         `json:"imageDescription,omitempty"`          // 270
+	Make                      string         `json:"make,omitempty"`                      // 271
+	Model                     string         `json:"model,omitempty"`                     // 272
+	Software                  string         `json:"software,omitempty"`                  // 305
+	Artist                    string         `json:"artist,omitempty"`                    // 315
+	Copyright                 string         `json:"copyright,omitempty"`                 // 33432
+
+}
 
+// EXIFByteOrder reports whether the TIFF format EXIF block b is
+// big-endian, from the byte order mark in its header.
+func EXIFByteOrder(b []byte) (isBigEndian bool, err error) {
+	if len(b) < 4 {
+		return false, errors.New("EXIF block too short")
+	}
+	switch string(b[:4]) {
+	case "II*\x00":
+		return false, nil
+	case "MM\x00*":
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid exif prefix %v", b[:4])
 }
 
+// DecodeEXIF decodes the TIFF format EXIF block b, including its
+// header, using the registered decoder. isBigEndian is the block's
+// byte order, as returned by EXIFByteOrder.
 func DecodeEXIF(ctx context.Context, b []byte, isBigEndian bool, opt ...image.ReadOption) (*EXIF, error) {
 	if exifDecoder == nil {
 		return nil, errors.New("No registered EXIF decoder")
@@ -61,6 +86,8 @@ func DecodeEXIF(ctx context.Context, b []byte, isBigEndian bool, opt ...image.Re
 	return exifDecoder(ctx, b, isBigEndian, opt...)
 }
 
+// Encode encodes x as a TIFF format EXIF block, including its header,
+// using the registered encoder.
 func (x *EXIF) Encode(ctx context.Context, isBigEndian bool, opt ...image.WriteOption) ([]byte, error) {
 	if exifEncoder == nil {
 		return nil, errors.New("No registered EXIF encoder")
@@ -0,0 +1,25 @@
+package exif
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/png"
+)
+
+func TestDecodeMetadataError(t *testing.T) {
+	f, err := os.Open("../../png/testdata/glep.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, _, err = png.DecodeExtended(context.TODO(), f, image.DataDecodeOptions{
+		DecodeImage:    image.DiscardData,
+		DecodeMetadata: image.DecodeData,
+	})
+	if err != errNotImplemented {
+		t.Errorf("got error %v, want %v", err, errNotImplemented)
+	}
+}
@@ -25,66 +25,66 @@ func RegisterICCEncoder(e func(context.Context, *ICC, ...image.WriteOption) ([]b
 // S15Fixed16 holds a signed 32 bit fixed point number, with 1 sign
 // bit, 15 integer bits, and 16 fractional bits.
 type S15Fixed16 struct {
-	Integer  int16
-	Fraction uint16
+	Integer  int16  `json:"integer,omitempty"`
+	Fraction uint16 `json:"fraction,omitempty"`
 }
 
 // U16Fixed16 holds an unsigned 32 bit fixed point number with 16
 // integer bits and 16 fractional bits.
 type U16Fixed16 struct {
-	Integer  uint16
-	Fraction uint16
+	Integer  uint16 `json:"integer,omitempty"`
+	Fraction uint16 `json:"fraction,omitempty"`
 }
 
 // U8Fixed8 holds an unsigned 16 bit fixed point number, with 8
 // integer bits and 8 fraction bits.
 type U8Fixed8 struct {
 	// Integer holds the unsigned 8 bit integer portion of the number.
-	Integer uint8
+	Integer uint8 `json:"integer,omitempty"`
 	// Fraction holds the 8 bit fractional portion of the number.
-	Fraction uint8
+	Fraction uint8 `json:"fraction,omitempty"`
 }
 
 // Response16 holds an iCC response16Number.
 type Response16 struct {
 	// Interval holds the interval value
-	Interval uint16
+	Interval uint16 `json:"interval,omitempty"`
 	// Measurement holds the measurement value.
-	Measurement S15Fixed16
+	Measurement S15Fixed16 `json:"measurement,omitempty"`
 }
 
 // XYZ number holds a CIE XYZ tristimulus value.
 type XYZNumber struct {
-	X S15Fixed16
-	Y S15Fixed16
-	Z S15Fixed16
+	X S15Fixed16 `json:"x,omitempty"`
+	Y S15Fixed16 `json:"y,omitempty"`
+	Z S15Fixed16 `json:"z,omitempty"`
 }
 
 // ProfileVersion holds a BCD encoded profile version number.
 type ProfileVersion struct {
 	// Major holds a BCD encoded major version number.
-	Major uint8
+	Major uint8 `json:"major,omitempty"`
 	// Minor holds a BCD encoded minor and patch number. The first digit
 	// is the minor version while the second is the patch level.
-	Minor uint8
+	Minor uint8 `json:"minor,omitempty"`
 }
 
 // ICC holds an ICC color profile.
 type ICC struct {
-	CMMTypeSignature                 uint32
-	ProfileVersion                   ProfileVersion
-	ProfileClassSignature            uint32
-	ColorSpace                       uint32
-	ProfileConnectionSpace           uint32
-	ProfileCreationTime              time.Time
-	PrimaryPlatformSignature         uint32
-	CMMFlags                         uint32
-	DeviceManufacturer               uint32
-	DeviceModel                      uint32
-	DeviceAttributes                 uint32
-	RenderingIntent                  uint32
-	ProfileConnectionSpaceIlluminant XYZNumber
-	ProfileCreatorSignature          uint32
+	CMMTypeSignature                 uint32         `json:"cmmTypeSignature,omitempty"`
+	ProfileVersion                   ProfileVersion `json:"profileVersion,omitempty"`
+	ProfileClassSignature            uint32         `json:"profileClassSignature,omitempty"`
+	ColorSpace                       uint32         `json:"colorSpace,omitempty"`
+	ProfileConnectionSpace           uint32         `json:"profileConnectionSpace,omitempty"`
+	ProfileCreationTime              time.Time      `json:"profileCreationTime,omitempty"`
+	PrimaryPlatformSignature         uint32         `json:"primaryPlatformSignature,omitempty"`
+	CMMFlags                         uint32         `json:"cmmFlags,omitempty"`
+	DeviceManufacturer               uint32         `json:"deviceManufacturer,omitempty"`
+	DeviceModel                      uint32         `json:"deviceModel,omitempty"`
+	DeviceAttributes                 uint32         `json:"deviceAttributes,omitempty"`
+	RenderingIntent                  uint32         `json:"renderingIntent,omitempty"`
+	ProfileConnectionSpaceIlluminant XYZNumber      `json:"profileConnectionSpaceIlluminant,omitempty"`
+	ProfileCreatorSignature          uint32         `json:"profileCreatorSignature,omitempty"`
 }
 
 func DecodeICC(ctx context.Context, b []byte, opt ...image.ReadOption) (*ICC, error) {
@@ -5,6 +5,8 @@ package icc
 
 import (
 	"context"
+	"errors"
+
 	"github.com/drswork/image"
 	"github.com/drswork/image/metadata"
 )
@@ -14,12 +16,17 @@ func init() {
 	metadata.RegisterICCEncoder(Encode)
 }
 
+// errNotImplemented is returned until ICC decoding and encoding are
+// written, so that importing the package doesn't make reading or
+// writing metadata panic.
+var errNotImplemented = errors.New("icc: not implemented")
+
 // Decode decodes ICC color profiles.
 func Decode(ctx context.Context, b []byte, opt ...image.ReadOption) (*metadata.ICC, error) {
-	panic("Not implemented")
+	return nil, errNotImplemented
 }
 
 // Encode encodes ICC color profiles.
 func Encode(ctx context.Context, i *metadata.ICC, opt ...image.WriteOption) ([]byte, error) {
-	panic("Not implemented")
+	return nil, errNotImplemented
 }
@@ -0,0 +1,363 @@
+package metadata
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// IPTCDataset identifies an IPTC IIM dataset by its record and dataset
+// numbers, such as 2:120 for the caption.
+type IPTCDataset struct {
+	Record  uint8
+	Dataset uint8
+}
+
+// IPTCDatasets maps the names of commonly edited datasets in the IPTC
+// application record to their numbers.
+var IPTCDatasets = map[string]IPTCDataset{
+	"ObjectName":                    {2, 5},
+	"Category":                      {2, 15},
+	"Keywords":                      {2, 25},
+	"SpecialInstructions":           {2, 40},
+	"DateCreated":                   {2, 55},
+	"TimeCreated":                   {2, 60},
+	"By-line":                       {2, 80},
+	"By-lineTitle":                  {2, 85},
+	"City":                          {2, 90},
+	"Sub-location":                  {2, 92},
+	"Province-State":                {2, 95},
+	"Country-PrimaryLocationCode":   {2, 100},
+	"Country-PrimaryLocationName":   {2, 101},
+	"OriginalTransmissionReference": {2, 103},
+	"Headline":                      {2, 105},
+	"Credit":                        {2, 110},
+	"Source":                        {2, 115},
+	"CopyrightNotice":               {2, 116},
+	"Contact":                       {2, 118},
+	"Caption-Abstract":              {2, 120},
+	"Writer-Editor":                 {2, 122},
+}
+
+// Photoshop image resource IDs.
+const (
+	psIPTC       = 0x0404
+	psIPTCDigest = 0x0425
+)
+
+var (
+	// iptcVersion is the 2:00 record version dataset, which starts
+	// the application record.
+	iptcVersion = IPTCDataset{2, 0}
+	// iptcCharset is the 1:90 coded character set dataset.
+	iptcCharset = IPTCDataset{1, 90}
+)
+
+// iptcUTF8 is the ISO 2022 escape sequence that marks IPTC data as
+// UTF-8.
+const iptcUTF8 = "\x1b%G"
+
+// psResource is an image resource in a Photoshop resource block.
+type psResource struct {
+	id uint16
+	// start and end are the offsets of the resource in the block,
+	// including its padding, and hdr is the offset of its size.
+	start, hdr, end int
+	data            []byte
+}
+
+// parsePhotoshop splits b, the contents of a JPEG APP13 segment after
+// its "Photoshop 3.0" tag, into its image resources.
+func parsePhotoshop(b []byte) ([]psResource, error) {
+	var rs []psResource
+	for p := 0; p < len(b); {
+		if len(b)-p < 8 || string(b[p:p+4]) != "8BIM" {
+			return nil, errors.New("bad Photoshop image resource")
+		}
+		// The name is a Pascal string padded to an even length.
+		n := 1 + int(b[p+6])
+		q := p + 6 + n + n%2
+		if q+4 > len(b) {
+			return nil, errors.New("truncated Photoshop image resource")
+		}
+		size := uint64(binary.BigEndian.Uint32(b[q:]))
+		if size > uint64(len(b)-q-4) {
+			return nil, errors.New("truncated Photoshop image resource")
+		}
+		end := q + 4 + int(size)
+		r := psResource{id: binary.BigEndian.Uint16(b[p+4:]), start: p, hdr: q, data: b[q+4 : end]}
+		// The data is padded to an even length too, though the padding
+		// is sometimes missing from the last resource.
+		if size%2 != 0 && end < len(b) {
+			end++
+		}
+		r.end = end
+		rs = append(rs, r)
+		p = end
+	}
+	return rs, nil
+}
+
+// setPhotoshopResource returns a copy of the resource block b, whose
+// resources are rs, with the data of resource id replaced by data. The
+// resource is added if there isn't one, and removed if data is nil.
+func setPhotoshopResource(b []byte, rs []psResource, id uint16, data []byte) []byte {
+	var hdr []byte
+	start, end := len(b), len(b)
+	for _, r := range rs {
+		if r.id == id {
+			hdr, start, end = b[r.start:r.hdr], r.start, r.end
+			break
+		}
+	}
+	out := append([]byte(nil), b[:start]...)
+	if data != nil {
+		if hdr == nil {
+			// A resource with an empty name.
+			hdr = []byte{'8', 'B', 'I', 'M', byte(id >> 8), byte(id), 0, 0}
+		}
+		out = append(out, hdr...)
+		out = append(out, byte(len(data)>>24), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+		out = append(out, data...)
+		if len(data)%2 != 0 {
+			out = append(out, 0)
+		}
+	}
+	return append(out, b[end:]...)
+}
+
+// iimDataset is a dataset in IPTC IIM data, with raw holding its
+// encoded form.
+type iimDataset struct {
+	IPTCDataset
+	raw   []byte
+	value []byte
+}
+
+// parseIIM splits b, IPTC IIM data, into its datasets.
+func parseIIM(b []byte) ([]iimDataset, error) {
+	var ds []iimDataset
+	for p := 0; p < len(b); {
+		if b[p] != 0x1c {
+			// Some writers pad the data with NULs.
+			for _, c := range b[p:] {
+				if c != 0 {
+					return nil, errors.New("bad IPTC dataset marker")
+				}
+			}
+			break
+		}
+		if len(b)-p < 5 {
+			return nil, errors.New("truncated IPTC dataset")
+		}
+		q := p + 5
+		size := uint64(binary.BigEndian.Uint16(b[p+3:]))
+		if size&0x8000 != 0 {
+			// An extended dataset, whose size is held in the given
+			// number of following bytes.
+			n := int(size & 0x7fff)
+			if n > 4 || q+n > len(b) {
+				return nil, errors.New("bad IPTC extended dataset size")
+			}
+			size = 0
+			for _, c := range b[q : q+n] {
+				size = size<<8 | uint64(c)
+			}
+			q += n
+		}
+		if size > uint64(len(b)-q) {
+			return nil, errors.New("truncated IPTC dataset")
+		}
+		end := q + int(size)
+		ds = append(ds, iimDataset{IPTCDataset{b[p+1], b[p+2]}, b[p:end], b[q:end]})
+		p = end
+	}
+	return ds, nil
+}
+
+// newIIMDataset returns the dataset d set to v, which must be shorter
+// than 32KiB.
+func newIIMDataset(d IPTCDataset, v []byte) iimDataset {
+	raw := append([]byte{0x1c, d.Record, d.Dataset, byte(len(v) >> 8), byte(len(v))}, v...)
+	return iimDataset{d, raw, raw[5:]}
+}
+
+// less reports whether d sorts before e.
+func (d IPTCDataset) less(e IPTCDataset) bool {
+	return d.Record < e.Record || d.Record == e.Record && d.Dataset < e.Dataset
+}
+
+// insertIIM returns ds with n added before the first dataset that
+// sorts after it.
+func insertIIM(ds []iimDataset, n iimDataset) []iimDataset {
+	i := 0
+	for i < len(ds) && !n.less(ds[i].IPTCDataset) {
+		i++
+	}
+	return append(ds[:i:i], append([]iimDataset{n}, ds[i:]...)...)
+}
+
+// SetIPTCDataset returns a copy of b, a Photoshop image resource block
+// as held in a JPEG APP13 segment after its "Photoshop 3.0" tag, with
+// the IPTC dataset d set to v. An existing dataset keeps its place,
+// and any repeats of it, such as further keywords, are removed. A new
+// dataset is added in dataset number order. Values that aren't ASCII
+// are stored as UTF-8, which is recorded in the 1:90 coded character
+// set dataset. A new block is created if b is nil.
+func SetIPTCDataset(b []byte, d IPTCDataset, v string) ([]byte, error) {
+	if err := checkIPTCDataset(d); err != nil {
+		return nil, err
+	}
+	if len(v) > 0x7fff {
+		return nil, fmt.Errorf("IPTC dataset %d:%d value is too long", d.Record, d.Dataset)
+	}
+	rs, err := parsePhotoshop(b)
+	if err != nil {
+		return nil, err
+	}
+	var iim []byte
+	for _, r := range rs {
+		if r.id == psIPTC {
+			iim = r.data
+			break
+		}
+	}
+	ds, err := parseIIM(iim)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isASCII([]byte(v)) {
+		if ds, err = setIPTCUTF8(ds); err != nil {
+			return nil, err
+		}
+	}
+	n := newIIMDataset(d, []byte(v))
+	var out []iimDataset
+	found, record := false, false
+	for _, x := range ds {
+		record = record || x.Record == d.Record
+		switch {
+		case x.IPTCDataset != d:
+			out = append(out, x)
+		case !found:
+			found = true
+			out = append(out, n)
+		}
+	}
+	if !found {
+		if !record {
+			out = insertIIM(out, newIIMDataset(iptcVersion, []byte{0, 4}))
+		}
+		out = insertIIM(out, n)
+	}
+	return setIIM(b, rs, out), nil
+}
+
+// DeleteIPTCDataset returns a copy of b, a Photoshop image resource
+// block as held in a JPEG APP13 segment after its "Photoshop 3.0" tag,
+// without any IPTC d datasets. The IPTC resource is removed if it has
+// no other datasets, and nil is returned if no resources remain.
+func DeleteIPTCDataset(b []byte, d IPTCDataset) ([]byte, error) {
+	if err := checkIPTCDataset(d); err != nil {
+		return nil, err
+	}
+	rs, err := parsePhotoshop(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		if r.id != psIPTC {
+			continue
+		}
+		ds, err := parseIIM(r.data)
+		if err != nil {
+			return nil, err
+		}
+		var out []iimDataset
+		empty := true
+		for _, x := range ds {
+			if x.IPTCDataset == d {
+				continue
+			}
+			out = append(out, x)
+			if x.IPTCDataset != iptcVersion && x.IPTCDataset != iptcCharset {
+				empty = false
+			}
+		}
+		if empty {
+			out = nil
+		}
+		b = setIIM(b, rs, out)
+		break
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// checkIPTCDataset checks that a dataset can be edited.
+func checkIPTCDataset(d IPTCDataset) error {
+	if d.Record != 2 || d.Dataset == 0 {
+		return fmt.Errorf("IPTC dataset %d:%d can't be edited, only application record datasets can", d.Record, d.Dataset)
+	}
+	return nil
+}
+
+// setIPTCUTF8 returns ds with its coded character set set to UTF-8.
+// Existing values that aren't ASCII are in an unknown character set,
+// so they can't be relabelled.
+func setIPTCUTF8(ds []iimDataset) ([]iimDataset, error) {
+	for _, x := range ds {
+		if x.IPTCDataset == iptcCharset {
+			if string(x.value) != iptcUTF8 {
+				return nil, errors.New("IPTC data isn't UTF-8, so only ASCII values can be set")
+			}
+			return ds, nil
+		}
+	}
+	for _, x := range ds {
+		if x.Record == 2 && !isASCII(x.value) {
+			return nil, errors.New("IPTC data has no character set, so only ASCII values can be set")
+		}
+	}
+	return insertIIM(ds, newIIMDataset(iptcCharset, []byte(iptcUTF8))), nil
+}
+
+// setIIM returns a copy of the resource block b, whose resources are
+// rs, with its IPTC data replaced by the datasets ds, or removed if ds
+// is empty. An IPTC digest resource is updated to match.
+func setIIM(b []byte, rs []psResource, ds []iimDataset) []byte {
+	var iim []byte
+	for _, x := range ds {
+		iim = append(iim, x.raw...)
+	}
+	b = setPhotoshopResource(b, rs, psIPTC, iim)
+	for _, r := range rs {
+		if r.id != psIPTCDigest {
+			continue
+		}
+		var digest []byte
+		if iim != nil {
+			sum := md5.Sum(iim)
+			digest = sum[:]
+		}
+		// The block has changed, so find the digest again.
+		rs, _ = parsePhotoshop(b)
+		b = setPhotoshopResource(b, rs, psIPTCDigest, digest)
+		break
+	}
+	return b
+}
+
+// isASCII reports whether b only holds ASCII characters.
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"testing"
+)
+
+// psBlock returns a Photoshop image resource block holding a
+// resolution resource, IPTC data made of the given datasets and an
+// IPTC digest.
+func psBlock(ds ...iimDataset) []byte {
+	var iim []byte
+	for _, d := range ds {
+		iim = append(iim, d.raw...)
+	}
+	b := setPhotoshopResource(nil, nil, 0x03ed, make([]byte, 16))
+	rs, _ := parsePhotoshop(b)
+	b = setPhotoshopResource(b, rs, psIPTC, iim)
+	rs, _ = parsePhotoshop(b)
+	return setPhotoshopResource(b, rs, psIPTCDigest, make([]byte, 16))
+}
+
+// iptcDatasets returns the datasets in the IPTC data in the block b,
+// as record:dataset=value strings, and the block's resource IDs.
+func iptcDatasets(t *testing.T, b []byte) ([]string, []uint16) {
+	rs, err := parsePhotoshop(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var ids []uint16
+	for _, r := range rs {
+		ids = append(ids, r.id)
+		switch r.id {
+		case psIPTC:
+			ds, err := parseIIM(r.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range ds {
+				got = append(got, fmt.Sprintf("%d:%d=%s", d.Record, d.Dataset, d.value))
+			}
+		case psIPTCDigest:
+			var iim []byte
+			for _, r := range rs {
+				if r.id == psIPTC {
+					iim = r.data
+				}
+			}
+			if sum := md5.Sum(iim); !bytes.Equal(r.data, sum[:]) {
+				t.Errorf("IPTC digest %x doesn't match the data", r.data)
+			}
+		}
+	}
+	return got, ids
+}
+
+func TestIPTCDatasets(t *testing.T) {
+	orig := psBlock(
+		newIIMDataset(iptcVersion, []byte{0, 4}),
+		newIIMDataset(IPTCDatasets["Keywords"], []byte("cat")),
+		newIIMDataset(IPTCDatasets["Keywords"], []byte("dog")),
+		newIIMDataset(IPTCDatasets["Caption-Abstract"], []byte("SECRET")),
+	)
+	b, err := SetIPTCDataset(orig, IPTCDatasets["Caption-Abstract"], "A caption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = SetIPTCDataset(b, IPTCDatasets["Keywords"], "bird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = SetIPTCDataset(b, IPTCDatasets["City"], "Zürich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ids := iptcDatasets(t, b)
+	want := []string{"1:90=\x1b%G", "2:0=\x00\x04", "2:25=bird", "2:90=Zürich", "2:120=A caption"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got datasets %q, want %q", got, want)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint([]uint16{0x03ed, psIPTC, psIPTCDigest}) {
+		t.Errorf("got resources %#04x", ids)
+	}
+	if bytes.Contains(b, []byte("SECRET")) {
+		t.Error("replaced caption is still in the block")
+	}
+
+	// Deleting every dataset removes the IPTC data and its digest.
+	for _, n := range []string{"Keywords", "City", "Caption-Abstract"} {
+		if b, err = DeleteIPTCDataset(b, IPTCDatasets[n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, ids = iptcDatasets(t, b)
+	if len(got) != 0 || fmt.Sprint(ids) != fmt.Sprint([]uint16{0x03ed}) {
+		t.Errorf("got datasets %q and resources %#04x after deleting them all", got, ids)
+	}
+
+	// A new block.
+	b, err = SetIPTCDataset(nil, IPTCDatasets["By-line"], "Someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = iptcDatasets(t, b)
+	if want := []string{"2:0=\x00\x04", "2:80=Someone"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got datasets %q, want %q", got, want)
+	}
+	if b, err = DeleteIPTCDataset(b, IPTCDatasets["By-line"]); err != nil || b != nil {
+		t.Errorf("got %q, %v after deleting the only dataset, want nil", b, err)
+	}
+
+	// Non-ASCII values need the data to be UTF-8.
+	latin1 := psBlock(newIIMDataset(IPTCDatasets["City"], []byte("Z\xfcrich")))
+	if _, err := SetIPTCDataset(latin1, IPTCDatasets["Country-PrimaryLocationName"], "Schweiz"); err != nil {
+		t.Errorf("ASCII value: %v", err)
+	}
+	if _, err := SetIPTCDataset(latin1, IPTCDatasets["Country-PrimaryLocationName"], "Suïsse"); err == nil {
+		t.Error("UTF-8 value was added to data in another character set")
+	}
+
+	for _, d := range []IPTCDataset{iptcVersion, iptcCharset, {3, 10}} {
+		if _, err := SetIPTCDataset(orig, d, "x"); err == nil {
+			t.Errorf("dataset %d:%d was set", d.Record, d.Dataset)
+		}
+	}
+	for _, bad := range [][]byte{
+		[]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x10\x1c\x02"),
+		[]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x05\x1c\x02\x05\x00\x09\x00"),
+		[]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x06\x1c\x02\x05\x80\x09\x00"),
+		[]byte("XXXX\x04\x04\x00\x00\x00\x00\x00\x00"),
+	} {
+		if _, err := SetIPTCDataset(bad, IPTCDatasets["City"], "x"); err == nil {
+			t.Errorf("%q: malformed block accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package metadata
+
+import (
+	"github.com/drswork/image/color"
+)
+
+// EXIFData is the JSON representation of an image's EXIF metadata.
+// Raw holds the EXIF block as it's stored in the image, a TIFF format
+// block that's base64 encoded in JSON. Decoded holds its decoded form
+// instead if it's already been decoded, for example by the metadata's
+// EXIF method. When the JSON is read back in, Raw takes precedence
+// over Decoded.
+type EXIFData struct {
+	Raw     []byte `json:"raw,omitempty"`
+	Decoded *EXIF  `json:"decoded,omitempty"`
+}
+
+// NewEXIFData returns the JSON representation of EXIF metadata, given
+// either its raw or decoded form. The raw form isn't decoded, so
+// marshalling metadata never runs a decoder. It returns nil if
+// there's no EXIF metadata.
+func NewEXIFData(raw []byte, decoded *EXIF) *EXIFData {
+	if raw == nil && decoded == nil {
+		return nil
+	}
+	return &EXIFData{Raw: raw, Decoded: decoded}
+}
+
+// XMPData is the JSON representation of an image's XMP metadata. Raw
+// holds the XMP packet as it's stored in the image, and Decoded holds
+// its decoded form instead if it's already been decoded. When the
+// JSON is read back in, Raw takes precedence over Decoded.
+type XMPData struct {
+	Raw     string `json:"raw,omitempty"`
+	Decoded *XMP   `json:"decoded,omitempty"`
+}
+
+// NewXMPData returns the JSON representation of XMP metadata, given
+// either its raw or decoded form. The raw form isn't decoded. It
+// returns nil if there's no XMP metadata.
+func NewXMPData(raw *string, decoded *XMP) *XMPData {
+	if raw == nil && decoded == nil {
+		return nil
+	}
+	x := &XMPData{Decoded: decoded}
+	if raw != nil {
+		x.Raw = *raw
+	}
+	return x
+}
+
+// ICCData is the JSON representation of an image's ICC color
+// profile. Name holds the profile's name, for formats that store one.
+// Raw holds the profile as it's stored in the image, which is base64
+// encoded in JSON, and Decoded holds its decoded form instead if it's
+// already been decoded. When the JSON is read back in, Raw takes
+// precedence over Decoded.
+type ICCData struct {
+	Name    string `json:"name,omitempty"`
+	Raw     []byte `json:"raw,omitempty"`
+	Decoded *ICC   `json:"decoded,omitempty"`
+}
+
+// NewICCData returns the JSON representation of an ICC profile, given
+// either its raw or decoded form. The raw form isn't decoded. It
+// returns nil if there's no ICC profile.
+func NewICCData(name string, raw []byte, decoded *ICC) *ICCData {
+	if raw == nil && decoded == nil {
+		return nil
+	}
+	return &ICCData{Name: name, Raw: raw, Decoded: decoded}
+}
+
+// colorModels maps the standard color models to the names used for
+// them in JSON.
+var colorModels = []struct {
+	name  string
+	model color.Model
+}{
+	{"RGBA", color.RGBAModel},
+	{"RGBA64", color.RGBA64Model},
+	{"NRGBA", color.NRGBAModel},
+	{"NRGBA64", color.NRGBA64Model},
+	{"Alpha", color.AlphaModel},
+	{"Alpha16", color.Alpha16Model},
+	{"Gray", color.GrayModel},
+	{"Gray16", color.Gray16Model},
+	{"YCbCr", color.YCbCrModel},
+	{"NYCbCrA", color.NYCbCrAModel},
+	{"CMYK", color.CMYKModel},
+}
+
+// ColorModelName returns the name used in JSON for the color model m:
+// "Paletted" for a palette, the name of the color type for the
+// standard color models, such as "RGBA" or "Gray16", or the empty
+// string for any other model.
+func ColorModelName(m color.Model) string {
+	if _, ok := m.(color.Palette); ok {
+		return "Paletted"
+	}
+	for _, c := range colorModels {
+		if c.model == m {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// ColorModelByName returns the standard color model with the given
+// JSON name, or nil if there isn't one. Palettes aren't stored in
+// JSON, so "Paletted" also returns nil.
+func ColorModelByName(name string) color.Model {
+	for _, c := range colorModels {
+		if c.name == name {
+			return c.model
+		}
+	}
+	return nil
+}
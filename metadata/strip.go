@@ -0,0 +1,714 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/drswork/image"
+)
+
+// EXIF IFD kinds, which determine how the tags in an IFD are
+// interpreted.
+const (
+	ifd0 = iota
+	ifd1
+	exifIFD
+	interopIFD
+)
+
+// EXIF tags that point to other IFDs or to thumbnail data.
+const (
+	tagExifIFD         = 0x8769
+	tagGPSIFD          = 0x8825
+	tagInteropIFD      = 0xa005
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+)
+
+// exifTagCategories maps EXIF tags, by IFD kind, to the metadata
+// category they're in. Tags that aren't listed are in the
+// MetadataOther category.
+var exifTagCategories = map[int]map[uint16]image.MetadataCategory{
+	ifd0: {
+		0x0112: image.MetadataOrientation,   // Orientation
+		0x013b: image.MetadataOwner,         // Artist
+		0x9c9d: image.MetadataOwner,         // XPAuthor
+		0x8773: image.MetadataColorProfile,  // InterColorProfile
+		0xc62f: image.MetadataSerialNumbers, // CameraSerialNumber
+	},
+	exifIFD: {
+		0x927c: image.MetadataMakerNotes,    // MakerNote
+		0x9286: image.MetadataComments,      // UserComment
+		0xa001: image.MetadataColorProfile,  // ColorSpace
+		0xa430: image.MetadataOwner,         // CameraOwnerName
+		0xa431: image.MetadataSerialNumbers, // BodySerialNumber
+		0xa435: image.MetadataSerialNumbers, // LensSerialNumber
+	},
+}
+
+// exifStructuralTags lists the EXIF tags that describe the image
+// layout, which are never removed.
+var exifStructuralTags = map[uint16]bool{
+	0x0100: true, // ImageWidth
+	0x0101: true, // ImageLength
+	0x0102: true, // BitsPerSample
+	0x0103: true, // Compression
+	0x0106: true, // PhotometricInterpretation
+	0x0111: true, // StripOffsets
+	0x0115: true, // SamplesPerPixel
+	0x0116: true, // RowsPerStrip
+	0x0117: true, // StripByteCounts
+	0x011a: true, // XResolution
+	0x011b: true, // YResolution
+	0x011c: true, // PlanarConfiguration
+	0x0128: true, // ResolutionUnit
+	0x0201: true, // JPEGInterchangeFormat
+	0x0202: true, // JPEGInterchangeFormatLength
+	0x0211: true, // YCbCrCoefficients
+	0x0212: true, // YCbCrSubSampling
+	0x0213: true, // YCbCrPositioning
+	0x0214: true, // ReferenceBlackWhite
+	0x8769: true, // ExifIFDPointer
+	0x9000: true, // ExifVersion
+	0xa000: true, // FlashpixVersion
+	0xa002: true, // PixelXDimension
+	0xa003: true, // PixelYDimension
+	0xa005: true, // InteroperabilityIFDPointer
+}
+
+// exifTypeSizes holds the size, in bytes, of each TIFF field type.
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// exifStripper removes and edits tags in a TIFF format EXIF block.
+type exifStripper struct {
+	b       []byte
+	order   binary.ByteOrder
+	s       *image.StripMetadata
+	visited map[uint32]bool
+}
+
+var errBadEXIF = errors.New("invalid EXIF data")
+
+// StripEXIF removes the tags s says should be stripped from b, a TIFF
+// format EXIF block, and returns the result. Removed data is zeroed
+// in place rather than cut out, so the offsets in the rest of the
+// block stay valid. A nil result means the whole block should be
+// removed, which happens if it can't be parsed. Each removal is
+// recorded in s.
+func StripEXIF(b []byte, s *image.StripMetadata) []byte {
+	if !s.StripsAny() {
+		return b
+	}
+	e := &exifStripper{
+		b:       append([]byte(nil), b...),
+		s:       s,
+		visited: make(map[uint32]bool),
+	}
+	if err := e.strip(); err != nil {
+		s.Record(image.MetadataOther, "unparseable EXIF data")
+		return nil
+	}
+	return e.b
+}
+
+func (e *exifStripper) strip() error {
+	if err := e.header(); err != nil {
+		return err
+	}
+	return e.stripIFD(e.order.Uint32(e.b[4:]), ifd0)
+}
+
+// header checks the TIFF header and sets the block's byte order.
+func (e *exifStripper) header() error {
+	if len(e.b) < 8 {
+		return errBadEXIF
+	}
+	switch string(e.b[:4]) {
+	case "II*\x00":
+		e.order = binary.LittleEndian
+	case "MM\x00*":
+		e.order = binary.BigEndian
+	default:
+		return errBadEXIF
+	}
+	return nil
+}
+
+// entries returns the number of entries in the IFD at off, checking
+// that the IFD fits in the block and hasn't been seen before.
+func (e *exifStripper) entries(off uint32) (int, error) {
+	if e.visited[off] {
+		return 0, errBadEXIF
+	}
+	e.visited[off] = true
+	return e.ifdLen(off)
+}
+
+// ifdLen returns the number of entries in the IFD at off, checking
+// that the IFD fits in the block.
+func (e *exifStripper) ifdLen(off uint32) (int, error) {
+	if uint64(off)+2 > uint64(len(e.b)) {
+		return 0, errBadEXIF
+	}
+	n := int(e.order.Uint16(e.b[off:]))
+	if uint64(off)+2+12*uint64(n)+4 > uint64(len(e.b)) {
+		return 0, errBadEXIF
+	}
+	return n, nil
+}
+
+// value returns the location of an IFD entry's value, and whether it's
+// stored outside the entry.
+func (e *exifStripper) value(entry []byte) (off, size uint32, external bool, err error) {
+	// The size is worked out in 64 bits, as a large count would
+	// overflow 32.
+	n := uint64(exifTypeSizes[e.order.Uint16(entry[2:])]) * uint64(e.order.Uint32(entry[4:]))
+	if n > uint64(len(e.b)) {
+		return 0, 0, false, errBadEXIF
+	}
+	size = uint32(n)
+	if size <= 4 {
+		return 0, size, false, nil
+	}
+	off = e.order.Uint32(entry[8:])
+	if uint64(off)+n > uint64(len(e.b)) {
+		return 0, 0, false, errBadEXIF
+	}
+	return off, size, true, nil
+}
+
+// scalar returns the value of an IFD entry holding a single SHORT or
+// LONG, and whether it does.
+func (e *exifStripper) scalar(entry []byte) (uint32, bool) {
+	if e.order.Uint32(entry[4:]) != 1 {
+		return 0, false
+	}
+	switch e.order.Uint16(entry[2:]) {
+	case 3:
+		return uint32(e.order.Uint16(entry[8:])), true
+	case 4:
+		return e.order.Uint32(entry[8:]), true
+	}
+	return 0, false
+}
+
+// zero clears the n bytes at off.
+func (e *exifStripper) zero(off, n uint32) {
+	for i := off; i < off+n; i++ {
+		e.b[i] = 0
+	}
+}
+
+// stripIFD removes the tags that should be stripped from the IFD at
+// off, and from any IFDs it points to.
+func (e *exifStripper) stripIFD(off uint32, kind int) error {
+	n, err := e.entries(off)
+	if err != nil {
+		return err
+	}
+	var kept [][]byte
+	for i := 0; i < n; i++ {
+		entry := e.b[off+2+12*uint32(i) : off+2+12*uint32(i)+12]
+		tag := e.order.Uint16(entry)
+
+		switch {
+		case tag == tagGPSIFD && kind == ifd0:
+			if e.s.Strips(image.MetadataGPS) {
+				if err := e.eraseIFD(e.order.Uint32(entry[8:])); err != nil {
+					return err
+				}
+				e.s.Record(image.MetadataGPS, "EXIF GPS IFD")
+				continue
+			}
+		case tag == tagExifIFD && kind == ifd0:
+			if err := e.stripIFD(e.order.Uint32(entry[8:]), exifIFD); err != nil {
+				return err
+			}
+		case tag == tagInteropIFD && kind == exifIFD:
+			if err := e.stripIFD(e.order.Uint32(entry[8:]), interopIFD); err != nil {
+				return err
+			}
+		case exifStructuralTags[tag] || kind == interopIFD:
+			// Always kept.
+		default:
+			c, ok := exifTagCategories[kind][tag]
+			if !ok {
+				c = image.MetadataOther
+			}
+			if e.s.Strips(c) {
+				if err := e.eraseEntry(entry); err != nil {
+					return err
+				}
+				e.s.Record(c, fmt.Sprintf("EXIF tag %#04x", tag))
+				continue
+			}
+		}
+		kept = append(kept, append([]byte(nil), entry...))
+	}
+
+	// Compact the kept entries, moving the next IFD offset down after
+	// them and zeroing the space that's freed up.
+	next := e.order.Uint32(e.b[off+2+12*uint32(n):])
+	end := off + 2 + 12*uint32(n) + 4
+	e.order.PutUint16(e.b[off:], uint16(len(kept)))
+	p := off + 2
+	for _, k := range kept {
+		copy(e.b[p:], k)
+		p += 12
+	}
+	e.zero(p, end-p)
+
+	if kind == ifd0 && next != 0 {
+		if e.s.Strips(image.MetadataThumbnail) {
+			if err := e.eraseIFD(next); err != nil {
+				return err
+			}
+			e.s.Record(image.MetadataThumbnail, "EXIF thumbnail")
+			next = 0
+		} else if err := e.stripIFD(next, ifd1); err != nil {
+			return err
+		}
+	}
+	e.order.PutUint32(e.b[p:], next)
+	return nil
+}
+
+// eraseEntry zeroes an IFD entry's externally stored value.
+func (e *exifStripper) eraseEntry(entry []byte) error {
+	off, size, external, err := e.value(entry)
+	if err != nil {
+		return err
+	}
+	if external {
+		e.zero(off, size)
+	}
+	return nil
+}
+
+// eraseIFD zeroes the IFD at off, along with everything it points to.
+func (e *exifStripper) eraseIFD(off uint32) error {
+	n, err := e.entries(off)
+	if err != nil {
+		return err
+	}
+	var dataOff, dataLen []uint32
+	for i := 0; i < n; i++ {
+		entry := e.b[off+2+12*uint32(i) : off+2+12*uint32(i)+12]
+		switch e.order.Uint16(entry) {
+		case tagExifIFD, tagGPSIFD, tagInteropIFD:
+			if err := e.eraseIFD(e.order.Uint32(entry[8:])); err != nil {
+				return err
+			}
+		case tagJPEGOffset, tagStripOffsets:
+			if v, ok := e.scalar(entry); ok {
+				dataOff = append(dataOff, v)
+			}
+		case tagJPEGLength, tagStripByteCounts:
+			if v, ok := e.scalar(entry); ok {
+				dataLen = append(dataLen, v)
+			}
+		}
+		if err := e.eraseEntry(entry); err != nil {
+			return err
+		}
+	}
+	// Thumbnail image data. Only single strip thumbnails are handled,
+	// which is all that the EXIF spec allows for.
+	if len(dataOff) == 1 && len(dataLen) == 1 {
+		if uint64(dataOff[0])+uint64(dataLen[0]) > uint64(len(e.b)) {
+			return errBadEXIF
+		}
+		e.zero(dataOff[0], dataLen[0])
+	}
+	e.zero(off, 2+12*uint32(n)+4)
+	return nil
+}
+
+// StripEXIFFields returns a copy of x without the fields s says
+// should be stripped. Fields describing the image layout are always
+// kept.
+func StripEXIFFields(x *EXIF, s *image.StripMetadata) *EXIF {
+	c := *x
+	if s.Strips(image.MetadataOwner) && c.Artist != "" {
+		c.Artist = ""
+		s.Record(image.MetadataOwner, "EXIF Artist")
+	}
+	if s.Strips(image.MetadataOrientation) && c.Orientation != 0 {
+		c.Orientation = 0
+		s.Record(image.MetadataOrientation, "EXIF Orientation")
+	}
+	if s.Strips(image.MetadataOther) {
+		for _, f := range []*string{&c.ImageDescription, &c.Make, &c.Model, &c.Software, &c.Copyright} {
+			*f = ""
+		}
+		c.DateTime = nil
+		if c != *x {
+			s.Record(image.MetadataOther, "EXIF descriptive fields")
+		}
+	}
+	return &c
+}
+
+// XMP namespaces with properties that aren't in the MetadataOther
+// category.
+const (
+	rdfNS          = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xNS            = "adobe:ns:meta/"
+	xmlNS          = "http://www.w3.org/XML/1998/namespace"
+	exifNS         = "http://ns.adobe.com/exif/1.0/"
+	exifEXNS       = "http://cipa.jp/exif/1.0/"
+	auxNS          = "http://ns.adobe.com/exif/1.0/aux/"
+	tiffNS         = "http://ns.adobe.com/tiff/1.0/"
+	dcNS           = "http://purl.org/dc/elements/1.1/"
+	xmpNS          = "http://ns.adobe.com/xap/1.0/"
+	xmpRightsNS    = "http://ns.adobe.com/xap/1.0/rights/"
+	photoshopNS    = "http://ns.adobe.com/photoshop/1.0/"
+	iptcCoreNS     = "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+	iptcExtNS      = "http://iptc.org/std/Iptc4xmpExt/2008-02-29/"
+	xmlnsAttrSpace = "xmlns"
+)
+
+// xmpPropertyCategories maps XMP properties, by namespace and local
+// name, to their metadata category.
+var xmpPropertyCategories = map[string]map[string]image.MetadataCategory{
+	exifNS: {
+		"UserComment": image.MetadataComments,
+		"ColorSpace":  image.MetadataColorProfile,
+	},
+	exifEXNS: {
+		"BodySerialNumber": image.MetadataSerialNumbers,
+		"LensSerialNumber": image.MetadataSerialNumbers,
+		"CameraOwnerName":  image.MetadataOwner,
+	},
+	auxNS: {
+		"SerialNumber":     image.MetadataSerialNumbers,
+		"LensSerialNumber": image.MetadataSerialNumbers,
+		"OwnerName":        image.MetadataOwner,
+	},
+	tiffNS: {
+		"Orientation": image.MetadataOrientation,
+		"Artist":      image.MetadataOwner,
+	},
+	dcNS: {
+		"creator": image.MetadataOwner,
+	},
+	xmpNS: {
+		"Thumbnails": image.MetadataThumbnail,
+	},
+	xmpRightsNS: {
+		"Owner": image.MetadataOwner,
+	},
+	photoshopNS: {
+		"AuthorsPosition": image.MetadataOwner,
+		"CaptionWriter":   image.MetadataOwner,
+		"City":            image.MetadataGPS,
+		"State":           image.MetadataGPS,
+		"Country":         image.MetadataGPS,
+		"ICCProfile":      image.MetadataColorProfile,
+	},
+	iptcCoreNS: {
+		"CreatorContactInfo": image.MetadataOwner,
+		"Location":           image.MetadataGPS,
+		"CountryCode":        image.MetadataGPS,
+	},
+	iptcExtNS: {
+		"LocationCreated": image.MetadataGPS,
+		"LocationShown":   image.MetadataGPS,
+	},
+}
+
+// xmpCategory returns the metadata category of the XMP property with
+// the given namespace and local name.
+func xmpCategory(ns, local string) image.MetadataCategory {
+	if ns == exifNS && strings.HasPrefix(local, "GPS") {
+		return image.MetadataGPS
+	}
+	if c, ok := xmpPropertyCategories[ns][local]; ok {
+		return c
+	}
+	return image.MetadataOther
+}
+
+// xmpScope holds the namespace prefixes declared on an element.
+type xmpScope struct {
+	prefixes map[string]string
+	topLevel bool // a top-level rdf:Description, whose children are properties
+	rdf      bool // an rdf:RDF element
+}
+
+// span is a range of bytes in an XMP packet.
+type span struct {
+	start, end int64
+}
+
+// xmpProperty is a top-level property of an XMP packet.
+type xmpProperty struct {
+	// name holds the property's namespace and local name, and prefix
+	// the namespace prefix it's written with.
+	name   xml.Name
+	prefix string
+	// span holds the property element, or the attribute of an
+	// rdf:Description and the whitespace before it.
+	span span
+	attr bool
+	// array is "Alt", "Bag" or "Seq" if the property's value is an RDF
+	// array.
+	array string
+}
+
+// xmpPacket is a parsed XMP packet.
+type xmpPacket struct {
+	x       string // the packet, without any NUL padding
+	padding string
+	props   []xmpProperty
+
+	// desc holds the start tag of the first top-level rdf:Description,
+	// and descName its qualified name. descEnd is the offset of its
+	// end tag, or -1 if it's an empty element.
+	desc     span
+	descName string
+	descEnd  int64
+	// prefixes maps the namespace prefixes in scope at the first
+	// top-level rdf:Description to their namespaces.
+	prefixes map[string]string
+}
+
+// xmpEdit replaces a span of an XMP packet with text.
+type xmpEdit struct {
+	span
+	text string
+}
+
+// StripXMP removes the properties s says should be stripped from the
+// XMP packet x, and returns the result. The rest of the packet is
+// left as-is. The empty string is returned if no properties remain,
+// or if the packet can't be parsed. Each removal is recorded in s.
+func StripXMP(x string, s *image.StripMetadata) string {
+	if !s.StripsAny() || x == "" {
+		return x
+	}
+	r, kept, err := stripXMP(x, s)
+	if err != nil {
+		s.Record(image.MetadataOther, "unparseable XMP packet")
+		return ""
+	}
+	if !kept {
+		if r != x {
+			s.Record(image.MetadataOther, "empty XMP packet")
+		}
+		return ""
+	}
+	return r
+}
+
+func stripXMP(x string, s *image.StripMetadata) (string, bool, error) {
+	p, err := parseXMP(x)
+	if err != nil {
+		return "", false, err
+	}
+	var edits []xmpEdit
+	kept := false
+	for _, pr := range p.props {
+		c := xmpCategory(pr.name.Space, pr.name.Local)
+		if !s.Strips(c) {
+			kept = true
+			continue
+		}
+		edits = append(edits, p.cut(pr))
+		s.Record(c, fmt.Sprintf("XMP property %s:%s", pr.prefix, pr.name.Local))
+	}
+	return p.apply(edits), kept, nil
+}
+
+// parseXMP finds the top-level properties of the XMP packet x.
+func parseXMP(x string) (*xmpPacket, error) {
+	// Some writers pad the packet with NULs, which aren't valid XML.
+	p := &xmpPacket{x: strings.TrimRight(x, "\x00"), desc: span{-1, -1}, descEnd: -1}
+	p.padding = x[len(p.x):]
+	d := xml.NewDecoder(strings.NewReader(p.x))
+	var stack []xmpScope
+	descOpen := false
+
+	resolve := func(prefix string) string {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if ns, ok := stack[i].prefixes[prefix]; ok {
+				return ns
+			}
+		}
+		return ""
+	}
+
+	for {
+		start := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			scope := xmpScope{prefixes: make(map[string]string)}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == xmlnsAttrSpace:
+					scope.prefixes[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == xmlnsAttrSpace:
+					scope.prefixes[""] = a.Value
+				}
+			}
+			stack = append(stack, scope)
+			ns := resolve(t.Name.Space)
+			parent := xmpScope{}
+			if len(stack) > 1 {
+				parent = stack[len(stack)-2]
+			}
+
+			switch {
+			case parent.topLevel:
+				// A property element.
+				array, err := skipProperty(d, resolve)
+				if err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+				p.props = append(p.props, xmpProperty{
+					name:   xml.Name{Space: ns, Local: t.Name.Local},
+					prefix: t.Name.Space,
+					span:   span{start, d.InputOffset()},
+					array:  array,
+				})
+			case ns == rdfNS && t.Name.Local == "RDF":
+				stack[len(stack)-1].rdf = true
+			case ns == rdfNS && t.Name.Local == "Description" && parent.rdf:
+				stack[len(stack)-1].topLevel = true
+				tag := p.x[start:d.InputOffset()]
+				if p.desc.start < 0 {
+					p.desc = span{start, d.InputOffset()}
+					p.descName = t.Name.Space + ":" + t.Name.Local
+					if t.Name.Space == "" {
+						p.descName = t.Name.Local
+					}
+					p.prefixes = make(map[string]string)
+					for _, sc := range stack {
+						for k, v := range sc.prefixes {
+							p.prefixes[k] = v
+						}
+					}
+					descOpen = true
+				}
+				// Properties may also be given as attributes.
+				for _, a := range t.Attr {
+					ans := resolve(a.Name.Space)
+					if a.Name.Space == "" || a.Name.Space == xmlnsAttrSpace || ans == rdfNS || ans == xmlNS || ans == xNS {
+						continue
+					}
+					loc := xmpAttrRegexp(a.Name).FindStringIndex(tag)
+					if loc == nil {
+						return nil, errors.New("can't find XMP attribute")
+					}
+					p.props = append(p.props, xmpProperty{
+						name:   xml.Name{Space: ans, Local: a.Name.Local},
+						prefix: a.Name.Space,
+						span:   span{start + int64(loc[0]), start + int64(loc[1])},
+						attr:   true,
+					})
+				}
+			}
+		case xml.EndElement:
+			if descOpen && len(stack) > 0 && stack[len(stack)-1].topLevel {
+				if !strings.HasSuffix(p.x[:p.desc.end], "/>") {
+					p.descEnd = start
+				}
+				descOpen = false
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return p, nil
+}
+
+// cut returns the edit removing the property pr.
+func (p *xmpPacket) cut(pr xmpProperty) xmpEdit {
+	if pr.attr {
+		return xmpEdit{span: pr.span}
+	}
+	return xmpEdit{span: trimSpan(p.x, pr.span)}
+}
+
+// apply returns the packet with the given edits, which mustn't
+// overlap, made to it.
+func (p *xmpPacket) apply(edits []xmpEdit) string {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var b strings.Builder
+	var pos int64
+	for _, e := range edits {
+		b.WriteString(p.x[pos:e.start])
+		b.WriteString(e.text)
+		pos = e.end
+	}
+	b.WriteString(p.x[pos:])
+	b.WriteString(p.padding)
+	return b.String()
+}
+
+// skipProperty reads tokens up to and including the end of the
+// property element whose start was just read, and returns the kind of
+// RDF array the property's value is, if it is one.
+func skipProperty(d *xml.Decoder, resolve func(string) string) (string, error) {
+	array := ""
+	for depth := 1; depth > 0; {
+		tok, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 1 && resolve(t.Name.Space) == rdfNS {
+				switch t.Name.Local {
+				case "Alt", "Bag", "Seq":
+					array = t.Name.Local
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return array, nil
+}
+
+// trimSpan extends sp backwards over the indentation before it, so
+// that removing an element doesn't leave a blank line behind.
+func trimSpan(x string, sp span) span {
+	s := sp.start
+	for s > 0 && (x[s-1] == ' ' || x[s-1] == '\t') {
+		s--
+	}
+	if s > 0 && x[s-1] == '\n' {
+		sp.start = s - 1
+	}
+	return sp
+}
+
+// xmpAttrRegexp returns a regular expression matching the attribute
+// n, along with the whitespace before it, in a start tag.
+func xmpAttrRegexp(n xml.Name) *regexp.Regexp {
+	return regexp.MustCompile(`\s+` + regexp.QuoteMeta(n.Space+":"+n.Local) + `\s*=\s*("[^"]*"|'[^']*')`)
+}
@@ -0,0 +1,208 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+)
+
+// tiffEntry is an IFD entry for buildTIFF. Values longer than 4 bytes
+// are stored after the IFDs.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+	ifd      int // if non-zero, the entry points at this IFD
+}
+
+// buildTIFF builds a little-endian TIFF block from a list of IFDs. The
+// first IFD is IFD0, and if thumb is non-nil the second IFD is IFD1
+// and is given thumb as its JPEG thumbnail.
+func buildTIFF(ifds [][]tiffEntry, thumb []byte) []byte {
+	le := binary.LittleEndian
+	// Lay out the IFDs, then the external values.
+	offs := make([]uint32, len(ifds))
+	p := uint32(8)
+	for i, ifd := range ifds {
+		offs[i] = p
+		p += 2 + 12*uint32(len(ifd)) + 4
+	}
+	b := make([]byte, p)
+	copy(b, "II*\x00")
+	le.PutUint32(b[4:], 8)
+	for i, ifd := range ifds {
+		o := offs[i]
+		le.PutUint16(b[o:], uint16(len(ifd)))
+		for j, e := range ifd {
+			eo := o + 2 + 12*uint32(j)
+			le.PutUint16(b[eo:], e.tag)
+			le.PutUint16(b[eo+2:], e.typ)
+			le.PutUint32(b[eo+4:], e.count)
+			switch {
+			case e.ifd != 0:
+				le.PutUint32(b[eo+8:], offs[e.ifd])
+			case len(e.value) > 4:
+				le.PutUint32(b[eo+8:], uint32(len(b)))
+				b = append(b, e.value...)
+			default:
+				copy(b[eo+8:], e.value)
+			}
+		}
+		if i == 0 && thumb != nil {
+			le.PutUint32(b[o+2+12*uint32(len(ifd)):], offs[1])
+		}
+	}
+	if thumb != nil {
+		// Point IFD1's JPEG offset at the thumbnail data.
+		ifd1 := ifds[1]
+		for j, e := range ifd1 {
+			if e.tag == tagJPEGOffset {
+				le.PutUint32(b[offs[1]+2+12*uint32(j)+8:], uint32(len(b)))
+			}
+		}
+		b = append(b, thumb...)
+	}
+	return b
+}
+
+// report sets s to report its removals to the returned slice.
+func report(s *image.StripMetadata) *[]image.StrippedMetadata {
+	var r []image.StrippedMetadata
+	s.Report = func(m image.StrippedMetadata) { r = append(r, m) }
+	return &r
+}
+
+func testTIFF() []byte {
+	short := func(v uint16) []byte { return []byte{byte(v), byte(v >> 8), 0, 0} }
+	long := func(v uint32) []byte { return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)} }
+	ascii := func(s string) tiffEntry {
+		return tiffEntry{typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+	}
+	artist := ascii("SECRET-ARTIST")
+	artist.tag = 0x013b
+	serial := ascii("SECRET-SERIAL")
+	serial.tag = 0xa431
+	maker := tiffEntry{tag: 0x927c, typ: 7, count: 16, value: []byte("SECRET-MAKERNOTE")}
+	lat := tiffEntry{tag: 0x0002, typ: 5, count: 3, value: []byte("SECRET-LATITUDE-VALUE01")}
+	thumb := []byte("SECRET-THUMBNAIL-DATA")
+	return buildTIFF([][]tiffEntry{
+		{
+			{tag: 0x0112, typ: 3, count: 1, value: short(6)},
+			artist,
+			{tag: tagExifIFD, typ: 4, count: 1, ifd: 2},
+			{tag: tagGPSIFD, typ: 4, count: 1, ifd: 3},
+		},
+		{
+			{tag: 0x0103, typ: 3, count: 1, value: short(6)},
+			{tag: tagJPEGOffset, typ: 4, count: 1},
+			{tag: tagJPEGLength, typ: 4, count: 1, value: long(uint32(len(thumb)))},
+		},
+		{maker, serial},
+		{lat},
+	}, thumb)
+}
+
+func TestStripEXIF(t *testing.T) {
+	orig := testTIFF()
+	s := &image.StripMetadata{
+		Deny: []image.MetadataCategory{
+			image.MetadataGPS, image.MetadataMakerNotes, image.MetadataSerialNumbers,
+			image.MetadataOwner, image.MetadataThumbnail,
+		},
+	}
+	removed := report(s)
+	got := StripEXIF(orig, s)
+	if got == nil {
+		t.Fatalf("StripEXIF failed, removed %v", *removed)
+	}
+	if len(got) != len(orig) {
+		t.Errorf("got %d bytes, want %d", len(got), len(orig))
+	}
+	if bytes.Contains(got, []byte("SECRET")) {
+		t.Errorf("stripped data still holds secrets: %q", got)
+	}
+	if !bytes.Contains(orig, []byte("SECRET")) {
+		t.Error("original data was modified")
+	}
+	if len(*removed) != 5 {
+		t.Errorf("got removals %v, want 5", *removed)
+	}
+
+	// The result must still parse, and the orientation must be kept.
+	s2 := &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataOrientation}}
+	removed = report(s2)
+	if StripEXIF(got, s2) == nil {
+		t.Fatalf("stripped data doesn't parse: %v", *removed)
+	}
+	if len(*removed) != 1 || (*removed)[0].Category != image.MetadataOrientation {
+		t.Errorf("got removals %v, want just the orientation", *removed)
+	}
+
+	// Malformed data is removed entirely.
+	s3 := &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataGPS}}
+	if StripEXIF(orig[:20], s3) != nil {
+		t.Error("truncated EXIF data wasn't removed")
+	}
+
+	// A LONG count whose size overflows 32 bits, wrapping around to the
+	// maker note's real 16 bytes.
+	bad := append([]byte(nil), orig...)
+	i := bytes.Index(bad, []byte{0x7c, 0x92, 7, 0, 16, 0, 0, 0})
+	copy(bad[i+2:], []byte{4, 0, 4, 0, 0, 0x40})
+	s4 := &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataMakerNotes}}
+	if StripEXIF(bad, s4) != nil {
+		t.Error("EXIF data with an overflowing value size wasn't removed")
+	}
+}
+
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    exif:GPSLatitude="SECRET-LAT"
+    tiff:Orientation="6"
+    xmp:CreatorTool="Tool">
+   <exif:GPSLongitude>SECRET-LON</exif:GPSLongitude>
+   <dc:creator>
+    <rdf:Seq><rdf:li>SECRET-NAME</rdf:li></rdf:Seq>
+   </dc:creator>
+   <dc:title>Title</dc:title>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>` + "\x00"
+
+func TestStripXMP(t *testing.T) {
+	s := &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataGPS, image.MetadataOwner}}
+	removed := report(s)
+	got := StripXMP(testXMP, s)
+	if strings.Contains(got, "SECRET") {
+		t.Errorf("stripped XMP still holds secrets:\n%s", got)
+	}
+	for _, want := range []string{`tiff:Orientation="6"`, `xmp:CreatorTool="Tool"`, "<dc:title>Title</dc:title>", "\x00"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("stripped XMP is missing %q:\n%s", want, got)
+		}
+	}
+	if len(*removed) != 3 {
+		t.Errorf("got removals %v, want 3", *removed)
+	}
+
+	// Removing every property removes the whole packet.
+	s = &image.StripMetadata{Allow: []image.MetadataCategory{image.MetadataColorProfile}}
+	if got := StripXMP(testXMP, s); got != "" {
+		t.Errorf("got XMP %q, want none", got)
+	}
+
+	s = &image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataGPS}}
+	if got := StripXMP("<x:xmpmeta", s); got != "" {
+		t.Errorf("got XMP %q for a malformed packet, want none", got)
+	}
+}
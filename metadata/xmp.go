@@ -14,6 +14,12 @@ func RegisterXMPDecoder(d func(context.Context, string, ...image.ReadOption) (*X
 	xmpDecoder = d
 }
 
+// XMPDecoderRegistered reports whether an XMP decoder has been
+// registered, usually by importing the metadata/xmp package.
+func XMPDecoderRegistered() bool {
+	return xmpDecoder != nil
+}
+
 var xmpEncoder func(context.Context, *XMP, ...image.WriteOption) (string, error)
 
 func RegisterXMPEncoder(e func(context.Context, *XMP, ...image.WriteOption) (string, error)) {
@@ -21,47 +27,47 @@ func RegisterXMPEncoder(e func(context.Context, *XMP, ...image.WriteOption) (str
 }
 
 type LanguageAlternative struct {
-	Language string
-	Text     string
+	Language string `json:"language,omitempty"`
+	Text     string `json:"text,omitempty"`
 }
 
 // Things in the Dublin Core namespace
 type Core struct {
-	Contributor []string
-	Coverage    string
-	Creator     []string
-	Date        []time.Time
-	Description []LanguageAlternative
-	Format      string // this is the mime type
-	Identifier  string
-	Language    []string // Really locales
-	Publisher   []string
-	Relation    []string
-	Rights      []LanguageAlternative
-	Source      string
-	Subject     []string
-	Title       []LanguageAlternative
-	Type        []string
+	Contributor []string              `json:"contributor,omitempty"`
+	Coverage    string                `json:"coverage,omitempty"`
+	Creator     []string              `json:"creator,omitempty"`
+	Date        []time.Time           `json:"date,omitempty"`
+	Description []LanguageAlternative `json:"description,omitempty"`
+	Format      string                `json:"format,omitempty"` // this is the mime type
+	Identifier  string                `json:"identifier,omitempty"`
+	Language    []string              `json:"language,omitempty"` // Really locales
+	Publisher   []string              `json:"publisher,omitempty"`
+	Relation    []string              `json:"relation,omitempty"`
+	Rights      []LanguageAlternative `json:"rights,omitempty"`
+	Source      string                `json:"source,omitempty"`
+	Subject     []string              `json:"subject,omitempty"`
+	Title       []LanguageAlternative `json:"title,omitempty"`
+	Type        []string              `json:"type,omitempty"`
 }
 
 // Things in the XMP namespace
 type XMPSpecific struct {
-	CreateDate   *time.Time
-	CreatorTool  string
-	Identifier   []string
-	Label        string
-	MetadataData *time.Time
-	ModifiedDate *time.Time
-	Rating       float64
+	CreateDate   *time.Time `json:"createDate,omitempty"`
+	CreatorTool  string     `json:"creatorTool,omitempty"`
+	Identifier   []string   `json:"identifier,omitempty"`
+	Label        string     `json:"label,omitempty"`
+	MetadataData *time.Time `json:"metadataDate,omitempty"`
+	ModifiedDate *time.Time `json:"modifiedDate,omitempty"`
+	Rating       float64    `json:"rating,omitempty"`
 }
 
 // Things in the XMP rights management namespace
 type XMPRights struct {
-	Certificate  string
-	Marked       *bool
-	Owner        []string
-	UsageTerms   []LanguageAlternative
-	WebStatement string
+	Certificate  string                `json:"certificate,omitempty"`
+	Marked       *bool                 `json:"marked,omitempty"`
+	Owner        []string              `json:"owner,omitempty"`
+	UsageTerms   []LanguageAlternative `json:"usageTerms,omitempty"`
+	WebStatement string                `json:"webStatement,omitempty"`
 }
 
 // These three are placeholders and should be fixed later
@@ -71,25 +77,25 @@ type RenditionClass string
 
 // Things in the XMP Media Management namespace
 type XMPMediaManagement struct {
-	DerivedFrom        ResourceRef
-	DocumentID         GUID
-	InstanceID         GUID
-	OriginalDocumentID GUID
-	RenditionClass     RenditionClass
-	RenditionParams    string
+	DerivedFrom        ResourceRef    `json:"derivedFrom,omitempty"`
+	DocumentID         GUID           `json:"documentID,omitempty"`
+	InstanceID         GUID           `json:"instanceID,omitempty"`
+	OriginalDocumentID GUID           `json:"originalDocumentID,omitempty"`
+	RenditionClass     RenditionClass `json:"renditionClass,omitempty"`
+	RenditionParams    string         `json:"renditionParams,omitempty"`
 }
 
 type XMPIDQ struct {
-	Scheme string
+	Scheme string `json:"scheme,omitempty"`
 }
 
 // XMP holds the XMP metadata. It's a collection of sub-types
 type XMP struct {
-	CoreProperties  *Core
-	Properties      *XMPSpecific
-	Rights          *XMPRights
-	MediaManagement *XMPMediaManagement
-	IDQ             *XMPIDQ
+	CoreProperties  *Core               `json:"coreProperties,omitempty"`
+	Properties      *XMPSpecific        `json:"properties,omitempty"`
+	Rights          *XMPRights          `json:"rights,omitempty"`
+	MediaManagement *XMPMediaManagement `json:"mediaManagement,omitempty"`
+	IDQ             *XMPIDQ             `json:"idq,omitempty"`
 }
 
 func DecodeXMP(ctx context.Context, b string, opt ...image.ReadOption) (*XMP, error) {
@@ -3,6 +3,7 @@ package xmp
 
 import (
 	"context"
+	"errors"
 
 	"github.com/drswork/image"
 	"github.com/drswork/image/metadata"
@@ -13,12 +14,17 @@ func init() {
 	metadata.RegisterXMPEncoder(Encode)
 }
 
+// errNotImplemented is returned until XMP decoding and encoding are
+// written, so that importing the package doesn't make reading or
+// writing metadata panic.
+var errNotImplemented = errors.New("xmp: not implemented")
+
 // Decode decodes XMP format metadata.
 func Decode(ctx context.Context, b string, opt ...image.ReadOption) (*metadata.XMP, error) {
-	panic("Not implemented")
+	return nil, errNotImplemented
 }
 
 // Encode encodes XMP format metadata.
 func Encode(ctx context.Context, x *metadata.XMP, opt ...image.WriteOption) (string, error) {
-	panic("Not implemented")
+	return "", errNotImplemented
 }
@@ -0,0 +1,52 @@
+package png
+
+import (
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// adam7Pass presents the pixels of m in one pass of Adam7 interlacing
+// as an image, with its bounds starting at (0, 0).
+type adam7Pass struct {
+	m    image.Image
+	p    interlaceScan
+	w, h int
+}
+
+// adam7Passes returns the non-empty passes of m's Adam7 interlacing,
+// in the order they're written.
+func adam7Passes(m image.Image) []image.Image {
+	b := m.Bounds()
+	var passes []image.Image
+	for _, p := range interlacing {
+		w := (b.Dx() - p.xOffset + p.xFactor - 1) / p.xFactor
+		h := (b.Dy() - p.yOffset + p.yFactor - 1) / p.yFactor
+		if w > 0 && h > 0 {
+			passes = append(passes, &adam7Pass{m, p, w, h})
+		}
+	}
+	return passes
+}
+
+func (a *adam7Pass) ColorModel() color.Model {
+	return a.m.ColorModel()
+}
+
+func (a *adam7Pass) Bounds() image.Rectangle {
+	return image.Rect(0, 0, a.w, a.h)
+}
+
+// point returns the point in the full image for (x, y) in the pass.
+func (a *adam7Pass) point(x, y int) (int, int) {
+	b := a.m.Bounds()
+	return b.Min.X + x*a.p.xFactor + a.p.xOffset, b.Min.Y + y*a.p.yFactor + a.p.yOffset
+}
+
+func (a *adam7Pass) At(x, y int) color.Color {
+	return a.m.At(a.point(x, y))
+}
+
+// ColorIndexAt is only called when the full image is paletted.
+func (a *adam7Pass) ColorIndexAt(x, y int) uint8 {
+	return a.m.(image.PalettedImage).ColorIndexAt(a.point(x, y))
+}
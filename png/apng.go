@@ -0,0 +1,462 @@
+package png
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// DisposeOp says how a frame's region of the canvas is treated before
+// the next frame is rendered.
+type DisposeOp uint8
+
+const (
+	// DisposeOpNone leaves the canvas as it is.
+	DisposeOpNone DisposeOp = 0
+	// DisposeOpBackground clears the frame's region to transparent
+	// black.
+	DisposeOpBackground DisposeOp = 1
+	// DisposeOpPrevious restores the frame's region to what it was
+	// before the frame was rendered.
+	DisposeOpPrevious DisposeOp = 2
+)
+
+// BlendOp says how a frame is combined with the canvas.
+type BlendOp uint8
+
+const (
+	// BlendOpSource replaces the frame's region of the canvas with
+	// the frame.
+	BlendOpSource BlendOp = 0
+	// BlendOpOver composites the frame over the canvas using its
+	// alpha channel.
+	BlendOpOver BlendOp = 1
+)
+
+// Frame is a single frame of an animated PNG.
+type Frame struct {
+	// Image holds the frame's pixels. Its bounds start at (0, 0).
+	Image image.Image
+	// XOffset and YOffset give the position of the frame on the
+	// canvas.
+	XOffset, YOffset int
+	// DelayNum and DelayDen give the time the frame is shown for, as a
+	// fraction of a second. A DelayDen of zero means hundredths of a
+	// second.
+	DelayNum, DelayDen uint16
+	// Dispose says how the frame is disposed of after being shown.
+	Dispose DisposeOp
+	// Blend says how the frame is drawn onto the canvas.
+	Blend BlendOp
+}
+
+// Delay returns the time the frame is shown for.
+func (f *Frame) Delay() time.Duration {
+	den := f.DelayDen
+	if den == 0 {
+		den = 100
+	}
+	return time.Duration(f.DelayNum) * time.Second / time.Duration(den)
+}
+
+// APNG represents the frames of an animated PNG.
+type APNG struct {
+	// Frames holds the frames of the animation, in order.
+	Frames []*Frame
+	// PlayCount is the number of times the animation is played. Zero
+	// means it loops forever.
+	PlayCount int
+	// Default is the image shown by decoders that don't support
+	// animation.
+	Default image.Image
+	// DefaultIsFrame is true if the default image is also the first
+	// frame of the animation. If it's false the default image isn't
+	// part of the animation.
+	DefaultIsFrame bool
+	// Config holds the color model and the size of the canvas.
+	Config image.Config
+}
+
+// apngDecoder holds the state used by DecodeAll while reading the
+// animation chunks.
+type apngDecoder struct {
+	anim      *APNG
+	limits    image.LimitOptions
+	numFrames int
+	// seq is the sequence number the next fcTL or fdAT chunk must
+	// have.
+	seq uint32
+	// frame is the frame whose fcTL chunk has been read but whose fdAT
+	// chunks haven't, and width and height are its size.
+	frame         *Frame
+	width, height int
+	// size is the number of bytes of decoded image data so far.
+	size int
+}
+
+// checkSequence checks the sequence number of an fcTL or fdAT chunk.
+func (a *apngDecoder) checkSequence(seq uint32) error {
+	if seq != a.seq {
+		return FormatError(fmt.Sprintf("APNG sequence number %d, want %d", seq, a.seq))
+	}
+	a.seq++
+	return nil
+}
+
+// reserve adds the size of a w by h image to the amount of image data
+// decoded, and checks it against the image size limit.
+func (a *apngDecoder) reserve(d *decoder, w, h int) error {
+	bpp := 1
+	switch d.imageColorModel() {
+	case color.Gray16Model:
+		bpp = 2
+	case color.RGBAModel, color.NRGBAModel:
+		bpp = 4
+	case color.RGBA64Model, color.NRGBA64Model:
+		bpp = 8
+	}
+	a.size += w * h * bpp
+	if a.limits.MaxImageSize > 0 && a.size > a.limits.MaxImageSize {
+		return fmt.Errorf("png: decoded animation larger than %d bytes", a.limits.MaxImageSize)
+	}
+	return nil
+}
+
+func (d *decoder) parseACTL(ctx context.Context, length uint32) error {
+	if length != 8 {
+		return FormatError("bad acTL length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:8])
+	a := d.apng
+	if a.numFrames != 0 {
+		return FormatError("multiple acTL chunks")
+	}
+	n := binary.BigEndian.Uint32(d.tmp[:4])
+	if n == 0 || n > 0x7fffffff {
+		return FormatError("invalid APNG frame count")
+	}
+	if a.limits.MaxFrames > 0 && int(n) > a.limits.MaxFrames {
+		return fmt.Errorf("png: animation has %d frames, more than the limit of %d", n, a.limits.MaxFrames)
+	}
+	a.numFrames = int(n)
+	a.anim.PlayCount = int(binary.BigEndian.Uint32(d.tmp[4:8]))
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parseFCTL(ctx context.Context, length uint32) error {
+	if length != 26 {
+		return FormatError("bad fcTL length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:26]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:26])
+	a := d.apng
+	if a.frame != nil {
+		return FormatError("missing fdAT chunk")
+	}
+	if err := a.checkSequence(binary.BigEndian.Uint32(d.tmp[0:4])); err != nil {
+		return err
+	}
+	if len(a.anim.Frames) == a.numFrames {
+		return FormatError("too many APNG frames")
+	}
+
+	w := binary.BigEndian.Uint32(d.tmp[4:8])
+	h := binary.BigEndian.Uint32(d.tmp[8:12])
+	x := binary.BigEndian.Uint32(d.tmp[12:16])
+	y := binary.BigEndian.Uint32(d.tmp[16:20])
+	if w == 0 || h == 0 || uint64(x)+uint64(w) > uint64(d.width) || uint64(y)+uint64(h) > uint64(d.height) {
+		return FormatError("fcTL frame outside the image")
+	}
+	f := &Frame{
+		XOffset:  int(x),
+		YOffset:  int(y),
+		DelayNum: binary.BigEndian.Uint16(d.tmp[20:22]),
+		DelayDen: binary.BigEndian.Uint16(d.tmp[22:24]),
+		Dispose:  DisposeOp(d.tmp[24]),
+		Blend:    BlendOp(d.tmp[25]),
+	}
+	if f.Dispose > DisposeOpPrevious {
+		return FormatError("invalid fcTL dispose op")
+	}
+	if f.Blend > BlendOpOver {
+		return FormatError("invalid fcTL blend op")
+	}
+
+	if d.stage < dsSeenIDAT {
+		// This frame's data is the default image.
+		if a.anim.DefaultIsFrame {
+			return FormatError("multiple fcTL chunks before IDAT")
+		}
+		if x != 0 || y != 0 || int(w) != d.width || int(h) != d.height {
+			return FormatError("default image frame doesn't cover the image")
+		}
+		a.anim.DefaultIsFrame = true
+	} else {
+		if err := a.reserve(d, int(w), int(h)); err != nil {
+			return err
+		}
+		a.frame = f
+		a.width, a.height = int(w), int(h)
+	}
+	a.anim.Frames = append(a.anim.Frames, f)
+	return d.verifyChecksum()
+}
+
+// readSequence reads the sequence number at the start of an fdAT
+// chunk.
+func (d *decoder) readSequence() error {
+	if d.idatLength < 4 {
+		return FormatError("bad fdAT length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:4])
+	d.idatLength -= 4
+	return d.apng.checkSequence(binary.BigEndian.Uint32(d.tmp[:4]))
+}
+
+// parseFDAT decodes a frame from the fdAT chunk and any fdAT chunks
+// that immediately follow it.
+func (d *decoder) parseFDAT(ctx context.Context, length uint32) error {
+	a := d.apng
+	f := a.frame
+	if f == nil {
+		return FormatError("fdAT chunk without fcTL chunk")
+	}
+	a.frame = nil
+
+	d.idatLength = length
+	d.inFDAT = true
+	defer func() { d.inFDAT = false }()
+	if err := d.readSequence(); err != nil {
+		return err
+	}
+	// The image data is read the same way as IDAT data, but with the
+	// frame's size.
+	width, height := d.width, d.height
+	d.width, d.height = a.width, a.height
+	img, err := d.decode(ctx)
+	d.width, d.height = width, height
+	if err != nil {
+		return err
+	}
+	f.Image = img
+	return d.verifyChecksum()
+}
+
+// DecodeAll reads a PNG image from r and returns all of its frames,
+// along with their timing and placement. The only option it accepts
+// is image.LimitOptions: MaxFrames limits the number of frames, and
+// MaxImageSize limits the total size of the decoded frames, including
+// the default image.
+//
+// A PNG that isn't animated is returned as a single frame animation
+// whose frame is the default image.
+func DecodeAll(ctx context.Context, r io.Reader, opts ...image.ReadOption) (*APNG, error) {
+	var limits image.LimitOptions
+	for _, o := range opts {
+		l, ok := o.(image.LimitOptions)
+		if !ok {
+			return nil, errors.New("Unknown read option type provided")
+		}
+		limits = l
+	}
+
+	d := &decoder{
+		r:        r,
+		crc:      crc32.NewIEEE(),
+		metadata: &Metadata{},
+		apng:     &apngDecoder{anim: &APNG{}, limits: limits},
+	}
+	if err := d.checkHeader(ctx); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	for d.stage != dsSeenIEND {
+		if err := d.parseChunk(ctx, image.DecodeData, true); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	a := d.apng
+	if a.frame != nil {
+		return nil, FormatError("missing fdAT chunk")
+	}
+	anim := a.anim
+	anim.Default = d.img
+	anim.Config = image.Config{
+		ColorModel: d.imageColorModel(),
+		Width:      d.width,
+		Height:     d.height,
+	}
+	switch {
+	case a.numFrames == 0:
+		anim.Frames = []*Frame{{Image: d.img}}
+		anim.DefaultIsFrame = true
+	case len(anim.Frames) != a.numFrames:
+		return nil, FormatError(fmt.Sprintf("got %d APNG frames, want %d", len(anim.Frames), a.numFrames))
+	case anim.DefaultIsFrame:
+		anim.Frames[0].Image = d.img
+	}
+	return anim, nil
+}
+
+// writeACTL writes an acTL chunk for an animation with n frames.
+func (e *encoder) writeACTL(n, plays int) {
+	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(n))
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(plays))
+	e.writeChunk(e.tmp[:8], "acTL")
+}
+
+// writeFCTL writes the fcTL chunk for f.
+func (e *encoder) writeFCTL(f *Frame) {
+	b := f.Image.Bounds()
+	binary.BigEndian.PutUint32(e.tmp[0:4], e.seq)
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(e.tmp[8:12], uint32(b.Dy()))
+	binary.BigEndian.PutUint32(e.tmp[12:16], uint32(f.XOffset))
+	binary.BigEndian.PutUint32(e.tmp[16:20], uint32(f.YOffset))
+	binary.BigEndian.PutUint16(e.tmp[20:22], f.DelayNum)
+	binary.BigEndian.PutUint16(e.tmp[22:24], f.DelayDen)
+	e.tmp[24] = byte(f.Dispose)
+	e.tmp[25] = byte(f.Blend)
+	e.seq++
+	e.writeChunk(e.tmp[:26], "fcTL")
+}
+
+// checkAnimation checks that the frames of a fit on its canvas and
+// returns the default image.
+func checkAnimation(a *APNG) (image.Image, error) {
+	if len(a.Frames) == 0 {
+		return nil, errors.New("png: no frames to encode")
+	}
+	if len(a.Frames) > 0x7fffffff {
+		return nil, errors.New("png: too many frames to encode")
+	}
+	def := a.Default
+	if a.DefaultIsFrame {
+		def = a.Frames[0].Image
+	}
+	if def == nil {
+		return nil, errors.New("png: no default image")
+	}
+	if err := checkImageSize(def); err != nil {
+		return nil, err
+	}
+	canvas := image.Rect(0, 0, def.Bounds().Dx(), def.Bounds().Dy())
+	for i, f := range a.Frames {
+		if f.Image == nil {
+			return nil, fmt.Errorf("png: frame %d has no image", i)
+		}
+		r := f.Image.Bounds()
+		r = r.Sub(r.Min).Add(image.Pt(f.XOffset, f.YOffset))
+		if r.Empty() || !r.In(canvas) {
+			return nil, fmt.Errorf("png: frame %d at %v is outside the image", i, r)
+		}
+		if i == 0 && r != canvas {
+			return nil, errors.New("png: first frame doesn't cover the image")
+		}
+		if f.Dispose > DisposeOpPrevious || f.Blend > BlendOpOver {
+			return nil, fmt.Errorf("png: frame %d has an invalid dispose or blend op", i)
+		}
+	}
+	return def, nil
+}
+
+// EncodeAll writes the frames of an animated PNG to w. It takes the
+// same options as EncodeExtended, so metadata can be written along
+// with the animation. Unknown chunks in the metadata are only written
+// if they're safe to copy.
+func EncodeAll(ctx context.Context, w io.Writer, a *APNG, opts ...image.WriteOption) error {
+	var e Encoder
+	return e.EncodeAll(ctx, w, a, opts...)
+}
+
+// EncodeAll writes the frames of an animated PNG to w. The canvas is
+// the size of the default image, which is the first frame if
+// a.DefaultIsFrame is set and a.Default otherwise, and the first frame
+// has to cover all of it. The frames are placed at their offsets,
+// ignoring the origin of their images' bounds. All frames and the
+// default image are written with the same color type, which is
+// paletted only if they share a palette. a.Config is ignored.
+func (enc *Encoder) EncodeAll(ctx context.Context, w io.Writer, a *APNG, opts ...image.WriteOption) error {
+	enc, metadata, err := enc.parseWriteOptions(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	def, err := checkAnimation(a)
+	if err != nil {
+		return err
+	}
+	if max := enc.limits.MaxFrames; max > 0 && len(a.Frames) > max {
+		return fmt.Errorf("png: animation has more than %d frames", max)
+	}
+
+	e := enc.getEncoder()
+	defer enc.putEncoder(e)
+	e.setWriter(w)
+	e.m = def
+
+	ms := []image.Image{def}
+	for _, f := range a.Frames {
+		ms = append(ms, f.Image)
+	}
+	pal := e.setColorType(ms...)
+	ms, pal, metadata = e.optimize(ms, pal, metadata)
+	e.m = ms[0]
+
+	_, e.err = io.WriteString(e.w, pngHeader)
+	e.writeIHDR(e.m.Bounds())
+	e.writeACTL(len(a.Frames), a.PlayCount)
+	e.writeMetadata(ctx, metadata, opts...)
+	e.writeUnknownChunks(metadata, ChunkBeforePLTE, true)
+	if pal != nil {
+		e.writePLTEAndTRNS(pal)
+	}
+	e.writeTRNSKey()
+	e.maybeWriteBKGD(metadata, pal)
+	e.maybeWriteHIST(metadata)
+	e.writeUnknownChunks(metadata, ChunkBeforeIDAT, true)
+
+	frames := a.Frames
+	if a.DefaultIsFrame {
+		e.writeFCTL(frames[0])
+		frames = frames[1:]
+	}
+	e.writeIDATs()
+
+	e.fdat = true
+	for i, f := range frames {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		e.writeFCTL(f)
+		e.m = ms[len(ms)-len(frames)+i]
+		e.writeIDATs()
+	}
+	e.fdat = false
+
+	e.writeUnknownChunks(metadata, ChunkAfterIDAT, true)
+	e.writeIEND()
+	return e.err
+}
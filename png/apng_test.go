@@ -0,0 +1,390 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// grayData returns the zlib compressed image data for a w by h 8 bit
+// grayscale image filled with v.
+func grayData(w, h int, v byte) []byte {
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	row := make([]byte, w+1)
+	for i := 1; i <= w; i++ {
+		row[i] = v
+	}
+	for y := 0; y < h; y++ {
+		z.Write(row)
+	}
+	z.Close()
+	return b.Bytes()
+}
+
+func acTL(frames, plays uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b[0:], frames)
+	binary.BigEndian.PutUint32(b[4:], plays)
+	return makeChunk("acTL", b)
+}
+
+func fcTL(seq, w, h, x, y uint32, num, den uint16, dispose DisposeOp, blend BlendOp) []byte {
+	b := make([]byte, 26)
+	for i, v := range []uint32{seq, w, h, x, y} {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	binary.BigEndian.PutUint16(b[20:], num)
+	binary.BigEndian.PutUint16(b[22:], den)
+	b[24], b[25] = byte(dispose), byte(blend)
+	return makeChunk("fcTL", b)
+}
+
+func fdAT(seq uint32, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(b, seq)
+	return makeChunk("fdAT", append(b, data...))
+}
+
+// buildAPNG returns a 4x4 8 bit grayscale PNG made of the given
+// chunks.
+func buildAPNG(chunks ...[]byte) []byte {
+	b := []byte(pngHeader)
+	b = append(b, makeChunk("IHDR", []byte{0, 0, 0, 4, 0, 0, 0, 4, 8, 0, 0, 0, 0})...)
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	return append(b, makeChunk("IEND", nil)...)
+}
+
+func TestDecodeAll(t *testing.T) {
+	ctx := context.TODO()
+	small := grayData(2, 2, 20)
+	b := buildAPNG(
+		acTL(3, 2),
+		fcTL(0, 4, 4, 0, 0, 1, 10, DisposeOpNone, BlendOpSource),
+		makeChunk("IDAT", grayData(4, 4, 10)),
+		fcTL(1, 2, 2, 1, 2, 0, 0, DisposeOpBackground, BlendOpOver),
+		fdAT(2, small[:5]),
+		fdAT(3, small[5:]),
+		fcTL(4, 4, 1, 0, 3, 3, 0, DisposeOpPrevious, BlendOpSource),
+		fdAT(5, grayData(4, 1, 30)),
+	)
+	a, err := DecodeAll(ctx, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PlayCount != 2 || !a.DefaultIsFrame || len(a.Frames) != 3 {
+		t.Fatalf("got play count %d, default is frame %v, %d frames, want 2, true, 3", a.PlayCount, a.DefaultIsFrame, len(a.Frames))
+	}
+	if a.Config.Width != 4 || a.Config.Height != 4 || a.Config.ColorModel != color.GrayModel {
+		t.Errorf("got config %+v", a.Config)
+	}
+	if a.Frames[0].Image != a.Default {
+		t.Error("first frame isn't the default image")
+	}
+	for i, want := range []struct {
+		x, y, w, h int
+		v          uint8
+		delay      time.Duration
+		dispose    DisposeOp
+		blend      BlendOp
+	}{
+		{0, 0, 4, 4, 10, 100 * time.Millisecond, DisposeOpNone, BlendOpSource},
+		{1, 2, 2, 2, 20, 0, DisposeOpBackground, BlendOpOver},
+		{0, 3, 4, 1, 30, 30 * time.Millisecond, DisposeOpPrevious, BlendOpSource},
+	} {
+		f := a.Frames[i]
+		if f.XOffset != want.x || f.YOffset != want.y || f.Image.Bounds() != image.Rect(0, 0, want.w, want.h) {
+			t.Errorf("frame %d: got offset (%d, %d) bounds %v", i, f.XOffset, f.YOffset, f.Image.Bounds())
+			continue
+		}
+		if got := f.Image.At(want.w-1, want.h-1).(color.Gray).Y; got != want.v {
+			t.Errorf("frame %d: got pixel %d, want %d", i, got, want.v)
+		}
+		if f.Delay() != want.delay || f.Dispose != want.dispose || f.Blend != want.blend {
+			t.Errorf("frame %d: got delay %v dispose %d blend %d", i, f.Delay(), f.Dispose, f.Blend)
+		}
+	}
+
+	// Decoders that don't read the animation just see the default
+	// image.
+	img, _, err := DecodeExtended(ctx, bytes.NewReader(b), image.OptionDecodeImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.At(3, 3).(color.Gray).Y; got != 10 {
+		t.Errorf("got default image pixel %d, want 10", got)
+	}
+}
+
+func TestDecodeAllDefaultNotFrame(t *testing.T) {
+	b := buildAPNG(
+		acTL(1, 0),
+		makeChunk("IDAT", grayData(4, 4, 10)),
+		fcTL(0, 4, 4, 0, 0, 1, 1, DisposeOpNone, BlendOpSource),
+		fdAT(1, grayData(4, 4, 20)),
+	)
+	a, err := DecodeAll(context.TODO(), bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.DefaultIsFrame || len(a.Frames) != 1 {
+		t.Fatalf("got default is frame %v, %d frames, want false, 1", a.DefaultIsFrame, len(a.Frames))
+	}
+	if got := a.Frames[0].Image.At(0, 0).(color.Gray).Y; got != 20 {
+		t.Errorf("got frame pixel %d, want 20", got)
+	}
+	if got := a.Default.At(0, 0).(color.Gray).Y; got != 10 {
+		t.Errorf("got default image pixel %d, want 10", got)
+	}
+}
+
+func TestDecodeAllStatic(t *testing.T) {
+	a, err := DecodeAll(context.TODO(), bytes.NewReader(buildAPNG(makeChunk("IDAT", grayData(4, 4, 10)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.DefaultIsFrame || len(a.Frames) != 1 || a.Frames[0].Image != a.Default {
+		t.Errorf("got %+v, want the default image as the only frame", a)
+	}
+}
+
+func TestDecodeAllErrors(t *testing.T) {
+	idat := makeChunk("IDAT", grayData(4, 4, 10))
+	frame := grayData(2, 2, 20)
+	for _, tc := range []struct {
+		desc   string
+		b      []byte
+		limits image.LimitOptions
+		want   string
+	}{
+		{
+			"too many frames",
+			buildAPNG(acTL(1000000, 0), idat),
+			image.LimitOptions{MaxFrames: 100},
+			"limit",
+		},
+		{
+			"too much image data",
+			buildAPNG(acTL(2, 0), idat, fcTL(0, 4, 4, 0, 0, 0, 0, 0, 0), fdAT(1, grayData(4, 4, 1))),
+			image.LimitOptions{MaxImageSize: 20},
+			"larger than",
+		},
+		{
+			"bad sequence number",
+			buildAPNG(acTL(1, 0), idat, fcTL(0, 2, 2, 0, 0, 0, 0, 0, 0), fdAT(2, frame)),
+			image.LimitOptions{},
+			"sequence",
+		},
+		{
+			"frame outside image",
+			buildAPNG(acTL(1, 0), idat, fcTL(0, 2, 2, 3, 0, 0, 0, 0, 0), fdAT(1, frame)),
+			image.LimitOptions{},
+			"outside",
+		},
+		{
+			"missing frame",
+			buildAPNG(acTL(2, 0), idat, fcTL(0, 2, 2, 0, 0, 0, 0, 0, 0), fdAT(1, frame)),
+			image.LimitOptions{},
+			"want 2",
+		},
+		{
+			"missing fdAT",
+			buildAPNG(acTL(1, 0), idat, fcTL(0, 2, 2, 0, 0, 0, 0, 0, 0)),
+			image.LimitOptions{},
+			"missing fdAT",
+		},
+		{
+			"bad default frame",
+			buildAPNG(acTL(1, 0), fcTL(0, 2, 2, 0, 0, 0, 0, 0, 0), idat),
+			image.LimitOptions{},
+			"default image",
+		},
+		{
+			"bad blend op",
+			buildAPNG(acTL(1, 0), idat, fcTL(0, 2, 2, 0, 0, 0, 0, 0, 2), fdAT(1, frame)),
+			image.LimitOptions{},
+			"blend",
+		},
+	} {
+		_, err := DecodeAll(context.TODO(), bytes.NewReader(tc.b), tc.limits)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tc.desc, err, tc.want)
+		}
+	}
+}
+
+// fill returns a w by h NRGBA image filled with c.
+func fill(w, h int, c color.NRGBA) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(m.Pix); i += 4 {
+		m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return m
+}
+
+func TestEncodeDeferredAPNG(t *testing.T) {
+	ctx := context.TODO()
+	b := buildAPNG(
+		acTL(2, 0),
+		fcTL(0, 4, 4, 0, 0, 1, 10, DisposeOpNone, BlendOpSource),
+		makeChunk("IDAT", grayData(4, 4, 10)),
+		fcTL(1, 2, 2, 1, 2, 0, 0, DisposeOpBackground, BlendOpOver),
+		fdAT(2, grayData(2, 2, 20)),
+	)
+	img, md, err := DecodeExtended(ctx, bytes.NewReader(b), image.DataDecodeOptions{
+		DecodeImage:    image.DeferData,
+		DecodeMetadata: image.DeferData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	var buf bytes.Buffer
+	if err := EncodeExtended(ctx, &buf, img, meta); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Error("re-encoded deferred APNG differs from the original")
+	}
+	a, err := DecodeAll(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 2 || !a.DefaultIsFrame {
+		t.Errorf("got %d frames, default is frame %v, want 2, true", len(a.Frames), a.DefaultIsFrame)
+	}
+
+	// The animation chunks don't match any other image.
+	if err := EncodeExtended(ctx, ioutil.Discard, fill(4, 4, color.NRGBA{A: 0xff}), meta); err == nil {
+		t.Error("APNG chunks written with a decoded image")
+	}
+}
+
+func TestEncodeAll(t *testing.T) {
+	ctx := context.TODO()
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	green := color.NRGBA{0, 0xff, 0, 0x80}
+	a := &APNG{
+		Frames: []*Frame{
+			{Image: fill(8, 6, red), DelayNum: 1, DelayDen: 10},
+			{Image: fill(3, 2, green), XOffset: 4, YOffset: 3, DelayNum: 5, Dispose: DisposeOpBackground, Blend: BlendOpOver},
+			// The origin of a frame's bounds is ignored.
+			{Image: fill(8, 6, red).SubImage(image.Rect(2, 2, 4, 4)), XOffset: 6, Dispose: DisposeOpPrevious},
+		},
+		PlayCount:      3,
+		DefaultIsFrame: true,
+	}
+	lm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	meta := &Metadata{
+		Text:         []*TextEntry{{Key: "Title", Value: "Animation", EntryType: EtText}},
+		LastModified: &lm,
+	}
+	meta.SetRawICC("ICC Profile", []byte("not really a profile"))
+
+	var b bytes.Buffer
+	if err := EncodeAll(ctx, &b, a, meta); err != nil {
+		t.Fatal(err)
+	}
+	names := strings.Join(chunkNames(b.Bytes()), " ")
+	if want := "IHDR acTL tIME iCCP tEXt fcTL IDAT fcTL fdAT fcTL fdAT IEND"; names != want {
+		t.Errorf("got chunks %s, want %s", names, want)
+	}
+
+	got, err := DecodeAll(ctx, bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PlayCount != 3 || !got.DefaultIsFrame || len(got.Frames) != 3 {
+		t.Fatalf("got play count %d, default is frame %v, %d frames", got.PlayCount, got.DefaultIsFrame, len(got.Frames))
+	}
+	for i, f := range a.Frames {
+		g := got.Frames[i]
+		if g.XOffset != f.XOffset || g.YOffset != f.YOffset || g.DelayNum != f.DelayNum || g.DelayDen != f.DelayDen || g.Dispose != f.Dispose || g.Blend != f.Blend {
+			t.Errorf("frame %d: got %+v, want %+v", i, g, f)
+		}
+		if g.Image.Bounds().Size() != f.Image.Bounds().Size() {
+			t.Errorf("frame %d: got size %v, want %v", i, g.Image.Bounds().Size(), f.Image.Bounds().Size())
+			continue
+		}
+		want := color.NRGBAModel.Convert(f.Image.At(f.Image.Bounds().Min.X, f.Image.Bounds().Min.Y))
+		if c := color.NRGBAModel.Convert(g.Image.At(0, 0)); c != want {
+			t.Errorf("frame %d: got color %v, want %v", i, c, want)
+		}
+	}
+
+	_, md, err := DecodeExtended(ctx, bytes.NewReader(b.Bytes()), image.DataDecodeOptions{image.DecodeData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm := md.(*Metadata)
+	if len(gm.Text) != 1 || gm.LastModified == nil || !gm.LastModified.Equal(lm) {
+		t.Errorf("got text %v, last modified %v", gm.Text, gm.LastModified)
+	}
+	if name, p := gm.RawICC(); name != "ICC Profile" || string(p) != "not really a profile" {
+		t.Errorf("got ICC profile %q %q", name, p)
+	}
+}
+
+func TestEncodeAllSeparateDefault(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	frame := func(i uint8) *image.Paletted {
+		m := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+		for j := range m.Pix {
+			m.Pix[j] = i
+		}
+		return m
+	}
+	a := &APNG{
+		Default: frame(0),
+		Frames:  []*Frame{{Image: frame(1)}, {Image: frame(0)}},
+	}
+	var b bytes.Buffer
+	if err := EncodeAll(context.TODO(), &b, a); err != nil {
+		t.Fatal(err)
+	}
+	if want := "IHDR acTL PLTE IDAT fcTL fdAT fcTL fdAT IEND"; strings.Join(chunkNames(b.Bytes()), " ") != want {
+		t.Errorf("got chunks %v, want %s", chunkNames(b.Bytes()), want)
+	}
+	got, err := DecodeAll(context.TODO(), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DefaultIsFrame || len(got.Frames) != 2 {
+		t.Fatalf("got default is frame %v, %d frames, want false, 2", got.DefaultIsFrame, len(got.Frames))
+	}
+	if i := got.Default.(*image.Paletted).ColorIndexAt(0, 0); i != 0 {
+		t.Errorf("got default color index %d, want 0", i)
+	}
+	if i := got.Frames[0].Image.(*image.Paletted).ColorIndexAt(0, 0); i != 1 {
+		t.Errorf("got first frame color index %d, want 1", i)
+	}
+}
+
+func TestEncodeAllErrors(t *testing.T) {
+	m := fill(4, 4, color.NRGBA{0, 0, 0, 0xff})
+	small := fill(2, 2, color.NRGBA{0, 0, 0, 0xff})
+	for _, tc := range []struct {
+		desc string
+		a    *APNG
+	}{
+		{"no frames", &APNG{Default: m}},
+		{"no default", &APNG{Frames: []*Frame{{Image: m}}}},
+		{"first frame too small", &APNG{Frames: []*Frame{{Image: small}}, Default: m}},
+		{"frame outside", &APNG{Frames: []*Frame{{Image: m}, {Image: small, XOffset: 3}}, DefaultIsFrame: true}},
+		{"bad dispose op", &APNG{Frames: []*Frame{{Image: m, Dispose: 3}}, DefaultIsFrame: true}},
+	} {
+		if err := EncodeAll(context.TODO(), ioutil.Discard, tc.a); err == nil {
+			t.Errorf("%s: got nil error", tc.desc)
+		}
+	}
+}
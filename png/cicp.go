@@ -0,0 +1,230 @@
+package png
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// cicpPrimaries holds the red, green, blue and white point
+// chromaticities of the color primaries the decoder can convert.
+var cicpPrimaries = map[uint8][4][2]float64{
+	PrimariesBT709:     {{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}, {0.3127, 0.3290}},
+	PrimariesBT2020:    {{0.708, 0.292}, {0.170, 0.797}, {0.131, 0.046}, {0.3127, 0.3290}},
+	PrimariesDisplayP3: {{0.680, 0.320}, {0.265, 0.690}, {0.150, 0.060}, {0.3127, 0.3290}},
+}
+
+// defaultPeak is the luminance, in cd/m², shown as white for a PQ
+// image that has neither a cLLi nor an mDCv chunk.
+const defaultPeak = 1000
+
+type mat3 [3][3]float64
+
+func (a mat3) mul(b mat3) mat3 {
+	var c mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				c[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return c
+}
+
+func (a mat3) apply(v [3]float64) [3]float64 {
+	var r [3]float64
+	for i := 0; i < 3; i++ {
+		r[i] = a[i][0]*v[0] + a[i][1]*v[1] + a[i][2]*v[2]
+	}
+	return r
+}
+
+func (a mat3) inverse() mat3 {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	var r mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// The cofactor of a[j][i], for the transposed adjugate.
+			r1, r2 := (j+1)%3, (j+2)%3
+			c1, c2 := (i+1)%3, (i+2)%3
+			r[i][j] = (a[r1][c1]*a[r2][c2] - a[r1][c2]*a[r2][c1]) / det
+		}
+	}
+	return r
+}
+
+// rgbToXYZ returns the matrix converting linear RGB with the given
+// primaries and white point to CIE XYZ.
+func rgbToXYZ(p [4][2]float64) mat3 {
+	var m mat3
+	for i := 0; i < 3; i++ {
+		x, y := p[i][0], p[i][1]
+		m[0][i], m[1][i], m[2][i] = x/y, 1, (1-x-y)/y
+	}
+	wx, wy := p[3][0], p[3][1]
+	s := m.inverse().apply([3]float64{wx / wy, 1, (1 - wx - wy) / wy})
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] *= s[j]
+		}
+	}
+	return m
+}
+
+// Constants for the PQ (SMPTE ST 2084) transfer function.
+const (
+	pqM1 = 2610.0 / 16384
+	pqM2 = 2523.0 / 4096 * 128
+	pqC1 = 3424.0 / 4096
+	pqC2 = 2413.0 / 4096 * 32
+	pqC3 = 2392.0 / 4096 * 32
+)
+
+// Constants for the HLG (ARIB STD-B67) transfer function.
+const (
+	hlgA = 0.17883277
+	hlgB = 0.28466892
+	hlgC = 0.55991073
+)
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// transferFuncs returns the functions converting samples with the
+// given transfer function to linear light, relative to white, and
+// back. PQ samples are scaled so peak cd/m² is white.
+func transferFuncs(tf uint8, peak float64) (toLinear, fromLinear func(float64) float64, ok bool) {
+	switch tf {
+	case TransferBT709, 6, 14, 15:
+		return func(v float64) float64 {
+				if v < 0.081 {
+					return v / 4.5
+				}
+				return math.Pow((v+0.099)/1.099, 1/0.45)
+			}, func(v float64) float64 {
+				if v < 0.018 {
+					return v * 4.5
+				}
+				return 1.099*math.Pow(v, 0.45) - 0.099
+			}, true
+	case TransferLinear:
+		return func(v float64) float64 { return v }, func(v float64) float64 { return v }, true
+	case TransferSRGB:
+		return srgbToLinear, linearToSRGB, true
+	case TransferPQ:
+		return func(v float64) float64 {
+				p := math.Pow(v, 1/pqM2)
+				return math.Pow(math.Max(p-pqC1, 0)/(pqC2-pqC3*p), 1/pqM1) * 10000 / peak
+			}, func(v float64) float64 {
+				p := math.Pow(math.Max(v, 0)*peak/10000, pqM1)
+				return math.Pow((pqC1+pqC2*p)/(1+pqC3*p), pqM2)
+			}, true
+	case TransferHLG:
+		return func(v float64) float64 {
+				if v <= 0.5 {
+					return v * v / 3
+				}
+				return (math.Exp((v-hlgC)/hlgA) + hlgB) / 12
+			}, func(v float64) float64 {
+				if v <= 1.0/12 {
+					return math.Sqrt(3 * v)
+				}
+				return hlgA*math.Log(12*v-hlgB) + hlgC
+			}, true
+	}
+	return nil, nil, false
+}
+
+// peakLuminance returns the luminance, in cd/m², that a PQ image is
+// scaled to show as white: the brightest pixel from the cLLi chunk,
+// or the mastering display's maximum from the mDCv chunk.
+func (m *Metadata) peakLuminance() float64 {
+	if cl := m.ContentLightLevel; cl != nil && cl.MaxCLL > 0 {
+		return float64(cl.MaxCLL) / 10000
+	}
+	if md := m.MasteringDisplay; md != nil && md.MaxLuminance > 0 {
+		return float64(md.MaxLuminance) / 10000
+	}
+	return defaultPeak
+}
+
+// transformColors converts img from the color space given by the
+// metadata's cICP chunk to sRGB, or from sRGB to that color space if
+// reverse is set. Colors outside the destination gamut are clipped.
+func (m *Metadata) transformColors(img image.Image, reverse bool) (image.Image, error) {
+	cp := m.CodingPoints
+	prim, ok := cicpPrimaries[cp.ColorPrimaries]
+	if !ok {
+		return nil, UnsupportedError("cICP color primaries " + strconv.Itoa(int(cp.ColorPrimaries)))
+	}
+	toLinear, fromLinear, ok := transferFuncs(cp.TransferFunction, m.peakLuminance())
+	if !ok {
+		return nil, UnsupportedError("cICP transfer function " + strconv.Itoa(int(cp.TransferFunction)))
+	}
+	mat := rgbToXYZ(cicpPrimaries[PrimariesBT709]).inverse().mul(rgbToXYZ(prim))
+	if reverse {
+		mat = mat.inverse()
+	}
+
+	// Narrow range samples run from 16 to 235, scaled up to the
+	// sample's bit depth.
+	offset, scale := 0.0, 1.0
+	if !cp.FullRange {
+		depth := 8
+		if m.depth == 16 {
+			depth = 16
+		}
+		max := float64(int(1)<<uint(depth) - 1)
+		offset, scale = 16*float64(int(1)<<uint(depth-8))/max, 219*float64(int(1)<<uint(depth-8))/max
+	}
+
+	// Source samples are 16 bits, so their conversion to linear light
+	// is looked up in a table.
+	decode, encode := toLinear, linearToSRGB
+	if reverse {
+		decode, encode = srgbToLinear, fromLinear
+	}
+	lut := make([]float64, 1<<16)
+	for i := range lut {
+		v := float64(i) / 0xffff
+		if !reverse {
+			v = (v - offset) / scale
+		}
+		lut[i] = decode(math.Min(math.Max(v, 0), 1))
+	}
+
+	b := img.Bounds()
+	out := image.NewNRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			l := mat.apply([3]float64{lut[c.R], lut[c.G], lut[c.B]})
+			var s [3]uint16
+			for i, v := range l {
+				v = encode(math.Min(math.Max(v, 0), 1))
+				if reverse {
+					v = v*scale + offset
+				}
+				s[i] = uint16(math.Min(math.Max(v, 0), 1)*0xffff + 0.5)
+			}
+			out.SetNRGBA64(x, y, color.NRGBA64{s[0], s[1], s[2], c.A})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,152 @@
+package png
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+func TestHDRChunks(t *testing.T) {
+	ctx := context.Background()
+	md := &Metadata{
+		CodingPoints: &CodingPoints{ColorPrimaries: PrimariesBT2020, TransferFunction: TransferPQ, FullRange: true},
+		MasteringDisplay: &MasteringDisplay{
+			RedX: 35400, RedY: 14600, GreenX: 8500, GreenY: 39850, BlueX: 6550, BlueY: 2300,
+			WhiteX: 15635, WhiteY: 16450, MaxLuminance: 10000000, MinLuminance: 1,
+		},
+		ContentLightLevel: &ContentLightLevel{MaxCLL: 10000000, MaxFALL: 4000000},
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.White})
+	var b bytes.Buffer
+	if err := EncodeExtended(ctx, &b, m, md); err != nil {
+		t.Fatal(err)
+	}
+	// The chunks have to come before PLTE.
+	plte := bytes.Index(b.Bytes(), []byte("PLTE"))
+	for _, c := range []string{"cICP", "mDCv", "cLLi"} {
+		if i := bytes.Index(b.Bytes(), []byte(c)); i < 0 || i > plte {
+			t.Errorf("%s chunk at %d, PLTE at %d", c, i, plte)
+		}
+	}
+	_, got, err := DecodeExtended(ctx, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diffMetadata(md, got.(*Metadata)); err != nil {
+		t.Error(err)
+	}
+
+	md.CodingPoints.MatrixCoefficients = 1
+	if err := EncodeExtended(ctx, &b, m, md); err == nil {
+		t.Error("non-RGB matrix coefficients were accepted")
+	}
+}
+
+// decodeTransformed writes a 16 bit image with the given pixels and
+// metadata, and reads it back with a color transform.
+func decodeTransformed(t *testing.T, md *Metadata, transform image.TransformOption, cs ...color.RGBA64) []color.NRGBA64 {
+	ctx := context.Background()
+	m := image.NewRGBA64(image.Rect(0, 0, len(cs), 1))
+	for i, c := range cs {
+		m.SetRGBA64(i, 0, c)
+	}
+	var b bytes.Buffer
+	if err := EncodeExtended(ctx, &b, m, md); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := DecodeExtended(ctx, &b, image.ImageTransformOptions{ColorTransform: transform})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []color.NRGBA64
+	for i := range cs {
+		out = append(out, got.At(i, 0).(color.NRGBA64))
+	}
+	return out
+}
+
+// near reports whether two samples are within rounding errors of each
+// other.
+func near(a, b uint16) bool {
+	d := int(a) - int(b)
+	return d >= -8 && d <= 8
+}
+
+func TestColorTransform(t *testing.T) {
+	cicp := func(p, tf uint8, full bool) *Metadata {
+		return &Metadata{CodingPoints: &CodingPoints{ColorPrimaries: p, TransferFunction: tf, FullRange: full}}
+	}
+	white := color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}
+	black := color.RGBA64{0, 0, 0, 0xffff}
+	c := color.RGBA64{0x1234, 0x8000, 0xfedc, 0xffff}
+
+	// sRGB is unchanged.
+	got := decodeTransformed(t, cicp(PrimariesBT709, TransferSRGB, true), image.ForwardImageTransform, c)
+	if !near(got[0].R, c.R) || !near(got[0].G, c.G) || !near(got[0].B, c.B) {
+		t.Errorf("sRGB changed %v to %v", c, got[0])
+	}
+
+	// Narrow range samples run from 16 to 235, scaled to 16 bits.
+	n16 := uint16(16 << 8)
+	n235 := uint16(235 << 8)
+	got = decodeTransformed(t, cicp(PrimariesBT709, TransferSRGB, false), image.ForwardImageTransform,
+		color.RGBA64{n16, n16, n16, 0xffff}, color.RGBA64{n235, n235, n235, 0xffff})
+	if got[0] != (color.NRGBA64{0, 0, 0, 0xffff}) || got[1] != (color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff}) {
+		t.Errorf("narrow range black and white read as %v", got)
+	}
+
+	// A PQ image's white is its brightest pixel from cLLi, or the
+	// mastering display's peak from mDCv.
+	peak := color.RGBA64{0xc100, 0xc100, 0xc100, 0xffff} // Just over 1000 cd/m².
+	md := cicp(PrimariesBT2020, TransferPQ, true)
+	md.ContentLightLevel = &ContentLightLevel{MaxCLL: 10000000}
+	got = decodeTransformed(t, md, image.ForwardImageTransform, peak, black)
+	if !near(got[0].G, 0xffff) || got[1].G != 0 {
+		t.Errorf("PQ peak and black read as %v", got)
+	}
+	md.ContentLightLevel = nil
+	md.MasteringDisplay = &MasteringDisplay{MaxLuminance: 40000000}
+	got = decodeTransformed(t, md, image.ForwardImageTransform, peak)
+	if got[0].G > 0xc000 {
+		t.Errorf("1000 cd/m² on a 4000 cd/m² display read as %v", got[0])
+	}
+
+	// Reversing the transform gets back the original colors.
+	for _, md := range []*Metadata{
+		cicp(PrimariesDisplayP3, TransferSRGB, true),
+		cicp(PrimariesBT2020, TransferHLG, true),
+		cicp(PrimariesBT2020, TransferBT709, true),
+	} {
+		fwd := decodeTransformed(t, md, image.ReverseImageTransform, c, white)
+		var cs []color.RGBA64
+		for _, f := range fwd {
+			cs = append(cs, color.RGBA64{f.R, f.G, f.B, f.A})
+		}
+		got := decodeTransformed(t, md, image.ForwardImageTransform, cs...)
+		if !near(got[0].R, c.R) || !near(got[0].G, c.G) || !near(got[0].B, c.B) || got[1] != (color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff}) {
+			t.Errorf("%v: %v went to %v and back to %v", md.CodingPoints, c, fwd[0], got[0])
+		}
+	}
+
+	if _, _, err := DecodeExtended(context.Background(), bytes.NewReader(nil), image.ImageTransformOptions{}, image.OptionDecodeImage); err == nil {
+		t.Error("empty input was accepted")
+	}
+	var b bytes.Buffer
+	if err := EncodeExtended(context.Background(), &b, image.NewGray(image.Rect(0, 0, 1, 1)), cicp(2, TransferSRGB, true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeExtended(context.Background(), &b, image.ImageTransformOptions{ColorTransform: image.ForwardImageTransform}); err == nil {
+		t.Error("unknown color primaries were converted")
+	}
+	b.Reset()
+	if err := EncodeExtended(context.Background(), &b, image.NewGray(image.Rect(0, 0, 1, 1)), cicp(PrimariesBT709, TransferSRGB, true)); err != nil {
+		t.Fatal(err)
+	}
+	deferred := image.DataDecodeOptions{DecodeImage: image.DeferData, DecodeMetadata: image.DecodeData}
+	if _, _, err := DecodeExtended(context.Background(), &b, deferred, image.ImageTransformOptions{ColorTransform: image.ForwardImageTransform}); err == nil {
+		t.Error("deferred image data was converted")
+	}
+}
@@ -17,35 +17,34 @@ import (
 // If a deferred image is passed to Encode or EncodeExtended then it
 // will write out the same image contents as were read in.
 type Deferred struct {
-	ihdr []byte // Cached IHDR chunk
-	plte []byte // cached PLTE chunk
-	trns []byte // cached tRNS chunk
-	idat []byte // cached IDAT chunk.
+	ihdr []byte   // Cached IHDR chunk
+	plte []byte   // cached PLTE chunk
+	trns []byte   // cached tRNS chunk
+	idat [][]byte // cached IDAT chunk data, one entry per chunk
 	img  image.Image
+
+	// bounds and model are filled in from the image header.
+	bounds image.Rectangle
+	model  color.Model
 }
 
+var _ image.Deferred = (*Deferred)(nil)
+
+// ColorModel returns the image's color model, which is known from the
+// image header without decoding the image data.
 func (d *Deferred) ColorModel() color.Model {
-	if d.img == nil {
-		i, err := d.Instantiate(context.TODO())
-		if err != nil {
-			return nil
-		}
-		d.img = i
-	}
-	return d.img.ColorModel()
+	return d.model
 }
 
+// Bounds returns the image's bounds, which are known from the image
+// header without decoding the image data.
 func (d *Deferred) Bounds() image.Rectangle {
-	if d.img == nil {
-		i, err := d.Instantiate(context.TODO())
-		if err != nil {
-			return image.Rectangle{image.Point{-1, -1}, image.Point{-1, -1}}
-		}
-		d.img = i
-	}
-	return d.img.Bounds()
+	return d.bounds
 }
 
+// At returns the color of the pixel at (x, y), decoding the image data
+// first if necessary. Decoding errors can't be reported here, so At
+// returns nil if decoding fails; call Instantiate to get the error.
 func (d *Deferred) At(x, y int) color.Color {
 	if d.img == nil {
 		i, err := d.Instantiate(context.TODO())
@@ -57,10 +56,23 @@ func (d *Deferred) At(x, y int) color.Color {
 	return d.img.At(x, y)
 }
 
+// IsInstantiated reports whether the image data has been decoded.
+func (d *Deferred) IsInstantiated() bool {
+	return d.img != nil
+}
+
+// Instantiate decodes the cached image data and returns the decoded
+// image. The decoded image is cached, so later calls are cheap.
 func (i *Deferred) Instantiate(ctx context.Context, opts ...image.ReadOption) (image.Image, error) {
 	if i.img != nil {
 		return i.img, nil
 	}
+	// Check and see if our context was cancelled or expired.
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
 
 	// Create a new decoder
 	d := &decoder{
@@ -90,11 +102,14 @@ func (i *Deferred) Instantiate(ctx context.Context, opts ...image.ReadOption) (i
 		}
 	}
 
-	// To start we'll only work right with single idat chunks.
+	// The IDAT chunks together hold a single zlib stream, so merge
+	// them into one chunk for decoding.
 	if len(i.idat) != 0 {
+		idat := append(bytes.Join(i.idat, nil), 0, 0, 0, 0)
+		fixChecksum(idat)
 		d.crc = crc32.NewIEEE()
-		d.r = bytes.NewReader(i.idat)
-		if err = d.parseIDAT(ctx, uint32(chunklen(i.idat))); err != nil {
+		d.r = bytes.NewReader(idat)
+		if err = d.parseIDAT(ctx, uint32(chunklen(idat))); err != nil {
 			return nil, err
 		}
 	}
@@ -122,3 +137,18 @@ func fixChecksum(b []byte) {
 	b[len(b)-2] = byte(cs & 0xff00 >> 8)
 	b[len(b)-1] = byte(cs & 0xff)
 }
+
+// deferIDAT reads the data of an IDAT chunk, and caches it on the
+// deferred image being decoded.
+func (d *decoder) deferIDAT(ctx context.Context, length uint32) error {
+	b, err := readData(ctx, d, length, false)
+	if err != nil {
+		return err
+	}
+	if err := d.verifyChecksum(); err != nil {
+		return err
+	}
+	di := d.img.(*Deferred)
+	di.idat = append(di.idat, b)
+	return nil
+}
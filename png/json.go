@@ -0,0 +1,268 @@
+package png
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/drswork/image/color"
+	"github.com/drswork/image/metadata"
+)
+
+// jsonMetadata is the JSON representation of Metadata.
+type jsonMetadata struct {
+	Format          string             `json:"format"`
+	Width           int                `json:"width"`
+	Height          int                `json:"height"`
+	ColorModel      string             `json:"colorModel,omitempty"`
+	Text            []jsonText         `json:"text,omitempty"`
+	LastModified    *time.Time         `json:"lastModified,omitempty"`
+	Chroma          *Chroma            `json:"chroma,omitempty"`
+	Gamma           *uint32            `json:"gamma,omitempty"`
+	SRGBIntent      *SRGBIntent        `json:"srgbIntent,omitempty"`
+	CodingPoints    *CodingPoints      `json:"codingPoints,omitempty"`
+	Mastering       *MasteringDisplay  `json:"masteringDisplay,omitempty"`
+	LightLevel      *ContentLightLevel `json:"contentLightLevel,omitempty"`
+	SignificantBits *SignificantBits   `json:"significantBits,omitempty"`
+	Background      *Background        `json:"background,omitempty"`
+	Dimension       *Dimension         `json:"dimension,omitempty"`
+	Histogram       []uint16           `json:"histogram,omitempty"`
+	EXIF            *metadata.EXIFData `json:"exif,omitempty"`
+	XMP             *metadata.XMPData  `json:"xmp,omitempty"`
+	ICC             *metadata.ICCData  `json:"icc,omitempty"`
+	Palettes        []jsonPalette      `json:"suggestedPalettes,omitempty"`
+	UnknownChunks   []jsonChunk        `json:"unknownChunks,omitempty"`
+}
+
+// jsonText is the JSON representation of a TextEntry.
+type jsonText struct {
+	Key           string `json:"key"`
+	Value         string `json:"value"`
+	Type          string `json:"type"`
+	LanguageTag   string `json:"languageTag,omitempty"`
+	TranslatedKey string `json:"translatedKey,omitempty"`
+}
+
+// jsonPalette is the JSON representation of a SuggestedPalette.
+type jsonPalette struct {
+	Name        string             `json:"name"`
+	SampleDepth int                `json:"sampleDepth"`
+	Entries     []jsonPaletteEntry `json:"entries"`
+}
+
+// jsonPaletteEntry is the JSON representation of a
+// SuggestedPaletteEntry.
+type jsonPaletteEntry struct {
+	Red       uint16 `json:"red"`
+	Green     uint16 `json:"green"`
+	Blue      uint16 `json:"blue"`
+	Alpha     uint16 `json:"alpha"`
+	Frequency uint16 `json:"frequency"`
+}
+
+// jsonChunk is the JSON representation of an UnknownChunk.
+type jsonChunk struct {
+	Type     string `json:"type"`
+	Data     []byte `json:"data"`
+	Position string `json:"position"`
+}
+
+// jsonChunkPositions maps chunk positions to their JSON names.
+var jsonChunkPositions = map[ChunkPosition]string{
+	ChunkBeforePLTE: "beforePLTE",
+	ChunkBeforeIDAT: "beforeIDAT",
+	ChunkAfterIDAT:  "afterIDAT",
+}
+
+// jsonTextTypes maps text entry types to their JSON names.
+var jsonTextTypes = map[TextType]string{
+	EtText:  "text",
+	EtZtext: "ztext",
+	EtItext: "itext",
+}
+
+// MarshalJSON encodes the metadata as a JSON object of the form
+//
+//	{
+//	  "format": "png",
+//	  "width": 640,
+//	  "height": 480,
+//	  "colorModel": "NRGBA",
+//	  "text": [{"key": "Title", "value": "A title", "type": "text"}],
+//	  "lastModified": "2019-01-14T11:04:56Z",
+//	  "chroma": {"whiteX": 31270, "whiteY": 32900, ...},
+//	  "gamma": 45455,
+//	  "srgbIntent": 0,
+//	  "codingPoints": {"colorPrimaries": 9, "transferFunction": 16, ...},
+//	  "masteringDisplay": {"redX": 35400, ..., "maxLuminance": 10000000, ...},
+//	  "contentLightLevel": {"maxCLL": 10000000, "maxFALL": 4000000},
+//	  "significantBits": {"red": 8, "green": 8, ...},
+//	  "background": {"grey": 0, "red": 255, ...},
+//	  "dimension": {"x": 2835, "y": 2835, "unit": 1},
+//	  "histogram": [12, 0, 3, ...],
+//	  "exif": {"raw": "TU0AKg...", "decoded": {...}},
+//	  "xmp": {"raw": "<?xpacket ...", "decoded": {...}},
+//	  "icc": {"name": "ICC Profile", "raw": "AAAMSExp...", "decoded": {...}},
+//	  "suggestedPalettes": [{"name": "six", "sampleDepth": 16, "entries": [{"red": 65535, ..., "frequency": 65535}]}],
+//	  "unknownChunks": [{"type": "iDOT", "data": "AAAAAg...", "position": "beforeIDAT"}]
+//	}
+//
+// Fields for data that isn't in the image are left out. Text entry
+// types are "text", "ztext" or "itext", for tEXt, zTXt and iTXt
+// chunks. The colorModel names are those used by
+// metadata.ColorModelName. The EXIF, XMP and ICC data is included in
+// its raw form, or its decoded form if it's already been decoded, as
+// described by metadata.EXIFData, metadata.XMPData and
+// metadata.ICCData. Suggested palette colors are non-premultiplied
+// 16-bit values whatever the palette's sample depth. Unknown chunks
+// have their contents base64 encoded, and a position of "beforePLTE",
+// "beforeIDAT" or "afterIDAT".
+// Marshalling doesn't change the metadata.
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	j := jsonMetadata{
+		Format:          "png",
+		Width:           m.Width,
+		Height:          m.Height,
+		ColorModel:      metadata.ColorModelName(m.ColorModel),
+		LastModified:    m.LastModified,
+		Chroma:          m.Chroma,
+		Gamma:           m.Gamma,
+		SRGBIntent:      m.SRGBIntent,
+		CodingPoints:    m.CodingPoints,
+		Mastering:       m.MasteringDisplay,
+		LightLevel:      m.ContentLightLevel,
+		SignificantBits: m.SignificantBits,
+		Background:      m.Background,
+		Dimension:       m.Dimension,
+		Histogram:       m.Histogram,
+		EXIF:            metadata.NewEXIFData(m.rawExif, m.exif),
+		XMP:             metadata.NewXMPData(m.rawXmp, m.xmp),
+		ICC:             metadata.NewICCData(m.iccName, m.rawIcc, m.icc),
+	}
+	for _, t := range m.Text {
+		j.Text = append(j.Text, jsonText{
+			Key:           t.Key,
+			Value:         t.Value,
+			Type:          jsonTextTypes[t.EntryType],
+			LanguageTag:   t.LanguageTag,
+			TranslatedKey: t.TranslatedKey,
+		})
+	}
+	for _, p := range m.SuggestedPalettes {
+		jp := jsonPalette{Name: p.Name, SampleDepth: p.SampleDepth}
+		for _, e := range p.Entries {
+			jp.Entries = append(jp.Entries, jsonPaletteEntry{
+				Red:       e.Color.R,
+				Green:     e.Color.G,
+				Blue:      e.Color.B,
+				Alpha:     e.Color.A,
+				Frequency: e.Frequency,
+			})
+		}
+		j.Palettes = append(j.Palettes, jp)
+	}
+	for _, c := range m.UnknownChunks {
+		j.UnknownChunks = append(j.UnknownChunks, jsonChunk{
+			Type:     c.Type,
+			Data:     c.Data,
+			Position: jsonChunkPositions[c.Position],
+		})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes metadata in the form written by MarshalJSON,
+// replacing the contents of m. The result can be passed to
+// EncodeExtended. Where both the raw and decoded forms of EXIF, XMP or
+// ICC data are given the raw form is used.
+func (m *Metadata) UnmarshalJSON(b []byte) error {
+	var j jsonMetadata
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Format != "" && j.Format != "png" {
+		return fmt.Errorf("Can't read %q metadata as png metadata", j.Format)
+	}
+
+	n := Metadata{
+		Width:             j.Width,
+		Height:            j.Height,
+		ColorModel:        metadata.ColorModelByName(j.ColorModel),
+		LastModified:      j.LastModified,
+		Chroma:            j.Chroma,
+		Gamma:             j.Gamma,
+		SRGBIntent:        j.SRGBIntent,
+		CodingPoints:      j.CodingPoints,
+		MasteringDisplay:  j.Mastering,
+		ContentLightLevel: j.LightLevel,
+		SignificantBits:   j.SignificantBits,
+		Background:        j.Background,
+		Dimension:         j.Dimension,
+		Histogram:         j.Histogram,
+	}
+	for _, t := range j.Text {
+		e := &TextEntry{
+			Key:           t.Key,
+			Value:         t.Value,
+			LanguageTag:   t.LanguageTag,
+			TranslatedKey: t.TranslatedKey,
+		}
+		found := false
+		for tt, name := range jsonTextTypes {
+			if name == t.Type {
+				e.EntryType, found = tt, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown text entry type %q", t.Type)
+		}
+		n.Text = append(n.Text, e)
+	}
+	for _, jp := range j.Palettes {
+		p := &SuggestedPalette{Name: jp.Name, SampleDepth: jp.SampleDepth}
+		for _, e := range jp.Entries {
+			p.Entries = append(p.Entries, SuggestedPaletteEntry{
+				Color:     color.NRGBA64{R: e.Red, G: e.Green, B: e.Blue, A: e.Alpha},
+				Frequency: e.Frequency,
+			})
+		}
+		n.SuggestedPalettes = append(n.SuggestedPalettes, p)
+	}
+	for _, c := range j.UnknownChunks {
+		u := &UnknownChunk{Type: c.Type, Data: c.Data}
+		found := false
+		for p, name := range jsonChunkPositions {
+			if name == c.Position {
+				u.Position, found = p, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown chunk position %q", c.Position)
+		}
+		n.UnknownChunks = append(n.UnknownChunks, u)
+	}
+	if j.EXIF != nil {
+		if j.EXIF.Raw != nil {
+			n.rawExif = j.EXIF.Raw
+		} else {
+			n.exif = j.EXIF.Decoded
+		}
+	}
+	if j.XMP != nil {
+		if j.XMP.Raw != "" {
+			n.rawXmp = &j.XMP.Raw
+		} else {
+			n.xmp = j.XMP.Decoded
+		}
+	}
+	if j.ICC != nil {
+		n.iccName = j.ICC.Name
+		if j.ICC.Raw != nil {
+			n.rawIcc = j.ICC.Raw
+		} else {
+			n.icc = j.ICC.Decoded
+		}
+	}
+	*m = n
+	return nil
+}
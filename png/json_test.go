@@ -0,0 +1,68 @@
+package png
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+func TestMetadataJSONRoundTrip(t *testing.T) {
+	ctx := context.TODO()
+	f, err := os.Open("../testdata/kauaii_1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, md, err := DecodeExtended(ctx, f, image.DataDecodeOptions{image.DeferData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	meta.Text = append(meta.Text, &TextEntry{Key: "Title", Value: "Kauaʻi", EntryType: EtItext, LanguageTag: "haw"})
+	meta.UnknownChunks = append(meta.UnknownChunks, &UnknownChunk{Type: "prVt", Data: []byte{1, 2, 3}, Position: ChunkAfterIDAT})
+	meta.CodingPoints = &CodingPoints{ColorPrimaries: PrimariesBT2020, TransferFunction: TransferPQ, FullRange: true}
+	meta.SuggestedPalettes = append(meta.SuggestedPalettes, &SuggestedPalette{Name: "one", SampleDepth: 8, Entries: []SuggestedPaletteEntry{{color.NRGBA64{0xffff, 0, 0, 0xffff}, 7}}})
+
+	j0, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{`"format":"png"`, `"width":`, `"text":`, `"xmp":{"raw":`, `"codingPoints":{"colorPrimaries":9,"transferFunction":16,"matrixCoefficients":0,"fullRange":true}`, `"icc":{"name":`, `"suggestedPalettes":[{"name":"one","sampleDepth":8,"entries":[{"red":65535,"green":0,"blue":0,"alpha":65535,"frequency":7}]}]`, `"unknownChunks":[{"type":"prVt","data":"AQID","position":"afterIDAT"}]`} {
+		if !strings.Contains(string(j0), k) {
+			t.Errorf("JSON is missing %s: %s", k, j0)
+		}
+	}
+
+	var meta1 Metadata
+	if err := json.Unmarshal(j0, &meta1); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := EncodeExtended(ctx, &b, m, &meta1); err != nil {
+		t.Fatal(err)
+	}
+	_, md2, err := DecodeExtended(ctx, &b, image.DataDecodeOptions{image.DeferData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j1, err := json.Marshal(md2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(j0, j1) {
+		t.Errorf("JSON changed after a round trip:\n%s\n%s", j0, j1)
+	}
+
+	if err := json.Unmarshal([]byte(`{"format":"jpeg"}`), &meta1); err == nil {
+		t.Error("jpeg metadata was accepted")
+	}
+	if err := json.Unmarshal([]byte(`{"text":[{"key":"a","value":"b","type":"bogus"}]}`), &meta1); err == nil {
+		t.Error("unknown text type was accepted")
+	}
+}
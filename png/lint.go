@@ -0,0 +1,595 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+// Severity says how serious a Finding is.
+type Severity int
+
+const (
+	// SeverityWarning marks something that's allowed but likely to
+	// cause trouble, such as data after the IEND chunk.
+	SeverityWarning Severity = iota
+	// SeverityError marks a violation of the PNG specification.
+	SeverityError
+)
+
+// String generates a human readable version of the severity.
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Finding is a problem found by Lint.
+type Finding struct {
+	// Offset is the byte offset in the file of the start of the chunk
+	// the problem is in, or of the problem itself if it isn't in a
+	// chunk.
+	Offset int64
+	// Chunk is the type of the chunk the problem is in, if any.
+	Chunk    string
+	Severity Severity
+	Message  string
+}
+
+// String generates a human readable version of the finding.
+func (f Finding) String() string {
+	if f.Chunk == "" {
+		return fmt.Sprintf("offset %d: %v: %s", f.Offset, f.Severity, f.Message)
+	}
+	return fmt.Sprintf("offset %d: %s: %v: %s", f.Offset, f.Chunk, f.Severity, f.Message)
+}
+
+// singularChunks are the chunks a PNG file can have at most one of.
+var singularChunks = map[string]bool{
+	"IHDR": true, "PLTE": true, "IEND": true, "cHRM": true, "gAMA": true,
+	"iCCP": true, "sBIT": true, "sRGB": true, "cICP": true, "mDCv": true,
+	"cLLi": true, "bKGD": true, "hIST": true, "tRNS": true, "pHYs": true,
+	"tIME": true, "eXIf": true, "acTL": true,
+}
+
+// beforePLTEChunks are the chunks that have to come before PLTE and
+// IDAT, and beforeIDATChunks those that only have to come before IDAT.
+var (
+	beforePLTEChunks = map[string]bool{
+		"cHRM": true, "gAMA": true, "iCCP": true, "sBIT": true, "sRGB": true,
+		"cICP": true, "mDCv": true, "cLLi": true,
+	}
+	beforeIDATChunks = map[string]bool{
+		"PLTE": true, "tRNS": true, "bKGD": true, "hIST": true, "pHYs": true,
+		"sPLT": true, "eXIf": true, "acTL": true,
+	}
+)
+
+// fixedLengths holds the length of chunks that always have the same
+// length.
+var fixedLengths = map[string]int{
+	"IHDR": 13, "IEND": 0, "gAMA": 4, "cHRM": 32, "sRGB": 1, "pHYs": 9,
+	"tIME": 7, "cICP": 4, "mDCv": 24, "cLLi": 8, "acTL": 8,
+}
+
+// linter holds the state of a Lint call.
+type linter struct {
+	findings []Finding
+	seen     map[string]int
+	last     string
+
+	// The IHDR values, if the IHDR chunk was valid.
+	cb                   int
+	width, height, depth int
+	ct, interlace        int
+	paletteLen           int
+
+	// idat receives the contents of the IDAT chunks, which are
+	// decompressed as they're read. idatDone receives the findings
+	// once it's closed.
+	idat     *io.PipeWriter
+	idatDone chan []Finding
+}
+
+func (l *linter) add(off int64, chunk string, sev Severity, format string, args ...interface{}) {
+	l.findings = append(l.findings, Finding{off, chunk, sev, fmt.Sprintf(format, args...)})
+}
+
+// Lint reads a PNG file from r chunk by chunk and returns every
+// problem it finds, rather than stopping at the first one as the
+// decoder does. It checks the chunk order, CRCs, repeated chunks, the
+// IHDR, PLTE, tRNS and other chunks' contents, text keywords, the
+// compressed data in the iCCP, zTXt, iTXt and IDAT chunks, and data
+// after the IEND chunk. Reading stops at a problem that makes the rest
+// of the file unreadable, such as a truncated chunk. The error is only
+// set if r returns an error or ctx is done.
+func Lint(ctx context.Context, r io.Reader) ([]Finding, error) {
+	l := &linter{seen: make(map[string]int), cb: cbInvalid}
+	defer l.endIDAT()
+
+	var tmp [8]byte
+	if n, err := io.ReadFull(r, tmp[:len(pngHeader)]); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	} else if n < len(pngHeader) || string(tmp[:len(pngHeader)]) != pngHeader {
+		l.add(0, "", SeverityError, "not a PNG file")
+		return l.findings, nil
+	}
+
+	off := int64(len(pngHeader))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		if l.seen["IEND"] > 0 {
+			n, err := io.Copy(ioutil.Discard, r)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				l.add(off, "", SeverityWarning, "%d bytes of data after IEND", n)
+			}
+			break
+		}
+
+		n, err := io.ReadFull(r, tmp[:8])
+		if err == io.EOF {
+			l.add(off, "", SeverityError, "missing IEND chunk")
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			l.add(off, "", SeverityError, "truncated chunk header: %d bytes", n)
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(tmp[:4])
+		typ := string(tmp[4:8])
+		if !validChunkType(typ) {
+			l.add(off, "", SeverityError, "invalid chunk type %q", typ)
+			break
+		}
+		if length > 0x7fffffff {
+			l.add(off, typ, SeverityError, "chunk length %d is too large", length)
+			break
+		}
+
+		// IDAT data goes straight to the decompressor, since it can be
+		// too large to hold in memory.
+		crc := crc32.NewIEEE()
+		crc.Write(tmp[4:8])
+		var data []byte
+		var got int64
+		if typ == "IDAT" && l.startIDAT(off) {
+			got, err = io.CopyN(io.MultiWriter(crc, l.idat), r, int64(length))
+		} else {
+			if typ != "IDAT" {
+				l.endIDAT()
+			}
+			data, err = ioutil.ReadAll(io.LimitReader(r, int64(length)))
+			crc.Write(data)
+			got = int64(len(data))
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if got < int64(length) {
+			l.add(off, typ, SeverityError, "truncated chunk: %d of %d bytes", got, length)
+			break
+		}
+		if n, err := io.ReadFull(r, tmp[:4]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			l.add(off, typ, SeverityError, "truncated CRC: %d bytes", n)
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if want := binary.BigEndian.Uint32(tmp[:4]); want != crc.Sum32() {
+			l.add(off, typ, SeverityError, "CRC is %08x, want %08x", want, crc.Sum32())
+		}
+
+		l.checkOrder(off, typ)
+		l.checkChunk(off, typ, length, data)
+		l.seen[typ]++
+		l.last = typ
+		off += 12 + int64(length)
+	}
+
+	l.endIDAT()
+	if l.seen["IHDR"] == 0 {
+		l.add(0, "", SeverityError, "missing IHDR chunk")
+	}
+	if l.seen["IDAT"] == 0 {
+		l.add(0, "", SeverityError, "missing IDAT chunk")
+	}
+	if l.ct == ctPaletted && l.cb != cbInvalid && l.seen["PLTE"] == 0 {
+		l.add(0, "", SeverityError, "missing PLTE chunk for a paletted image")
+	}
+	return l.findings, nil
+}
+
+// checkOrder checks that a chunk of type typ is allowed where it is.
+func (l *linter) checkOrder(off int64, typ string) {
+	if len(l.seen) == 0 && typ != "IHDR" {
+		l.add(off, typ, SeverityError, "first chunk isn't IHDR")
+	}
+	if typ[0]&0x20 == 0 {
+		switch typ {
+		case "IHDR", "PLTE", "IDAT", "IEND":
+		default:
+			l.add(off, typ, SeverityError, "unknown critical chunk")
+		}
+	}
+	if typ[2]&0x20 != 0 {
+		l.add(off, typ, SeverityError, "reserved bit is set in chunk type")
+	}
+	if singularChunks[typ] && l.seen[typ] > 0 {
+		l.add(off, typ, SeverityError, "multiple %s chunks", typ)
+	}
+	if typ == "IDAT" && l.seen["IDAT"] > 0 && l.last != "IDAT" {
+		l.add(off, typ, SeverityError, "IDAT chunks aren't consecutive")
+	}
+	if beforePLTEChunks[typ] && (l.seen["PLTE"] > 0 || l.seen["IDAT"] > 0) {
+		l.add(off, typ, SeverityError, "%s chunk after PLTE or IDAT", typ)
+	}
+	if beforeIDATChunks[typ] && l.seen["IDAT"] > 0 {
+		l.add(off, typ, SeverityError, "%s chunk after IDAT", typ)
+	}
+	switch typ {
+	case "tRNS", "bKGD", "hIST":
+		if l.ct == ctPaletted && l.seen["PLTE"] == 0 {
+			l.add(off, typ, SeverityError, "%s chunk before PLTE", typ)
+		}
+	case "iCCP", "sRGB":
+		if l.seen["iCCP"]+l.seen["sRGB"] > 0 && l.seen[typ] == 0 {
+			l.add(off, typ, SeverityWarning, "both iCCP and sRGB chunks")
+		}
+	case "IDAT":
+		if l.ct == ctPaletted && l.seen["PLTE"] == 0 && l.seen["IDAT"] == 0 {
+			l.add(off, typ, SeverityError, "IDAT chunk before PLTE")
+		}
+	}
+}
+
+// checkChunk checks the contents of a chunk. The data of IDAT chunks
+// is checked separately, as it's decompressed.
+func (l *linter) checkChunk(off int64, typ string, length uint32, data []byte) {
+	if n, ok := fixedLengths[typ]; ok && int(length) != n {
+		l.add(off, typ, SeverityError, "length is %d, want %d", length, n)
+		return
+	}
+	switch typ {
+	case "IHDR":
+		l.checkIHDR(off, data)
+	case "PLTE":
+		n := len(data) / 3
+		switch {
+		case len(data)%3 != 0:
+			l.add(off, typ, SeverityError, "length %d isn't a multiple of 3", len(data))
+		case n == 0 || n > 256:
+			l.add(off, typ, SeverityError, "%d palette entries", n)
+		case l.ct == ctGrayscale || l.ct == ctGrayscaleAlpha:
+			l.add(off, typ, SeverityError, "palette in a grayscale image")
+		case l.ct == ctPaletted && n > 1<<uint(l.depth):
+			l.add(off, typ, SeverityError, "%d palette entries for a bit depth of %d", n, l.depth)
+		}
+		l.paletteLen = n
+	case "tRNS":
+		switch l.ct {
+		case ctGrayscale:
+			if len(data) != 2 {
+				l.add(off, typ, SeverityError, "length is %d, want 2", len(data))
+			}
+		case ctTrueColor:
+			if len(data) != 6 {
+				l.add(off, typ, SeverityError, "length is %d, want 6", len(data))
+			}
+		case ctPaletted:
+			if len(data) > l.paletteLen {
+				l.add(off, typ, SeverityError, "%d entries for %d palette entries", len(data), l.paletteLen)
+			}
+		case ctGrayscaleAlpha, ctTrueColorAlpha:
+			l.add(off, typ, SeverityError, "transparency in an image with an alpha channel")
+		}
+	case "IEND":
+	case "gAMA":
+		if binary.BigEndian.Uint32(data) == 0 {
+			l.add(off, typ, SeverityError, "gamma is zero")
+		}
+	case "sRGB":
+		if data[0] > 3 {
+			l.add(off, typ, SeverityError, "unknown rendering intent %d", data[0])
+		}
+	case "sBIT":
+		l.checkSBIT(off, data)
+	case "bKGD":
+		want := map[int]int{ctGrayscale: 2, ctGrayscaleAlpha: 2, ctTrueColor: 6, ctTrueColorAlpha: 6, ctPaletted: 1}[l.ct]
+		if l.cb != cbInvalid && len(data) != want {
+			l.add(off, typ, SeverityError, "length is %d, want %d", len(data), want)
+		} else if l.ct == ctPaletted && len(data) == 1 && int(data[0]) >= l.paletteLen {
+			l.add(off, typ, SeverityError, "palette index %d out of range", data[0])
+		}
+	case "hIST":
+		if l.seen["PLTE"] == 0 {
+			l.add(off, typ, SeverityError, "histogram without a palette")
+		} else if len(data) != 2*l.paletteLen {
+			l.add(off, typ, SeverityError, "length is %d, want %d", len(data), 2*l.paletteLen)
+		}
+	case "pHYs":
+		if data[8] > UnitMeter {
+			l.add(off, typ, SeverityWarning, "unknown unit %d", data[8])
+		}
+	case "tIME":
+		month, day, hour, minute, sec := data[2], data[3], data[4], data[5], data[6]
+		if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || sec > 60 {
+			l.add(off, typ, SeverityWarning, "invalid time %x", data)
+		}
+	case "cICP":
+		if data[2] != 0 {
+			l.add(off, typ, SeverityError, "matrix coefficients are %d, want 0", data[2])
+		}
+		if data[3] > 1 {
+			l.add(off, typ, SeverityError, "invalid full range flag %d", data[3])
+		}
+	case "eXIf":
+		if !validEXIFHeader(data) {
+			l.add(off, typ, SeverityError, "invalid EXIF header")
+		}
+	case "tEXt":
+		if key, rest, ok := l.keyword(off, typ, data); ok && bytes.IndexByte(rest, 0) >= 0 {
+			l.add(off, typ, SeverityError, "text for %q contains a null", key)
+		}
+	case "zTXt":
+		if _, rest, ok := l.keyword(off, typ, data); ok {
+			l.checkCompressed(off, typ, rest)
+		}
+	case "iCCP":
+		if _, rest, ok := l.keyword(off, typ, data); ok {
+			if p := l.checkCompressed(off, typ, rest); len(p) >= 4 && int(binary.BigEndian.Uint32(p)) != len(p) {
+				l.add(off, typ, SeverityWarning, "profile is %d bytes, but its header says %d", len(p), binary.BigEndian.Uint32(p))
+			}
+		}
+	case "iTXt":
+		l.checkITXT(off, data)
+	case "sPLT":
+		if _, rest, ok := l.keyword(off, typ, data); ok {
+			switch {
+			case len(rest) == 0:
+				l.add(off, typ, SeverityError, "missing sample depth")
+			case rest[0] != 8 && rest[0] != 16:
+				l.add(off, typ, SeverityError, "sample depth is %d", rest[0])
+			case (len(rest)-1)%(int(rest[0])*4/8+2) != 0:
+				l.add(off, typ, SeverityError, "length isn't a whole number of entries")
+			}
+		}
+	}
+}
+
+func (l *linter) checkIHDR(off int64, data []byte) {
+	w, h := binary.BigEndian.Uint32(data[0:4]), binary.BigEndian.Uint32(data[4:8])
+	depth, ct := int(data[8]), int(data[9])
+	if w == 0 || h == 0 || w > 0x7fffffff || h > 0x7fffffff {
+		l.add(off, "IHDR", SeverityError, "invalid size %dx%d", w, h)
+	}
+	cb := cbInvalid
+	for c := cbG1; c <= cbTCA16; c++ {
+		if d, t := cbDepthAndType(c); d == depth && t == ct {
+			cb = c
+		}
+	}
+	if cb == cbInvalid {
+		l.add(off, "IHDR", SeverityError, "invalid bit depth %d for color type %d", depth, ct)
+	}
+	if data[10] != 0 {
+		l.add(off, "IHDR", SeverityError, "unknown compression method %d", data[10])
+	}
+	if data[11] != 0 {
+		l.add(off, "IHDR", SeverityError, "unknown filter method %d", data[11])
+	}
+	if data[12] != itNone && data[12] != itAdam7 {
+		l.add(off, "IHDR", SeverityError, "unknown interlace method %d", data[12])
+	}
+	l.ct, l.depth = ct, depth
+	if cb != cbInvalid && w != 0 && h != 0 && w <= 0x7fffffff && h <= 0x7fffffff && data[12] <= itAdam7 {
+		l.cb, l.width, l.height, l.interlace = cb, int(w), int(h), int(data[12])
+	}
+}
+
+func (l *linter) checkSBIT(off int64, data []byte) {
+	want := map[int]int{ctGrayscale: 1, ctTrueColor: 3, ctPaletted: 3, ctGrayscaleAlpha: 2, ctTrueColorAlpha: 4}[l.ct]
+	if l.cb == cbInvalid {
+		return
+	}
+	if len(data) != want {
+		l.add(off, "sBIT", SeverityError, "length is %d, want %d", len(data), want)
+		return
+	}
+	max := l.depth
+	if l.ct == ctPaletted {
+		max = 8
+	}
+	for _, b := range data {
+		if b == 0 || int(b) > max {
+			l.add(off, "sBIT", SeverityError, "%d significant bits for a bit depth of %d", b, max)
+			return
+		}
+	}
+}
+
+// keyword checks the keyword at the start of a chunk, and returns it
+// and the data after its null separator.
+func (l *linter) keyword(off int64, typ string, data []byte) (string, []byte, bool) {
+	sep := bytes.IndexByte(data, 0)
+	if sep < 0 {
+		l.add(off, typ, SeverityError, "missing keyword separator")
+		return "", nil, false
+	}
+	key := data[:sep]
+	switch {
+	case len(key) == 0 || len(key) > 79:
+		l.add(off, typ, SeverityError, "keyword %q is %d bytes long", key, len(key))
+	case key[0] == ' ' || key[len(key)-1] == ' ':
+		l.add(off, typ, SeverityError, "keyword %q has leading or trailing spaces", key)
+	case bytes.Contains(key, []byte("  ")):
+		l.add(off, typ, SeverityError, "keyword %q has consecutive spaces", key)
+	}
+	for _, c := range key {
+		if c < 32 || (c > 126 && c < 161) {
+			l.add(off, typ, SeverityError, "keyword %q has invalid character 0x%02x", key, c)
+			break
+		}
+	}
+	return string(key), data[sep+1:], true
+}
+
+// checkCompressed checks data that starts with a compression method
+// byte, and returns the decompressed data.
+func (l *linter) checkCompressed(off int64, typ string, data []byte) []byte {
+	if len(data) == 0 {
+		l.add(off, typ, SeverityError, "missing compression method")
+		return nil
+	}
+	if data[0] != 0 {
+		l.add(off, typ, SeverityError, "unknown compression method %d", data[0])
+		return nil
+	}
+	return l.decompress(off, typ, data[1:])
+}
+
+// maxLintDecompressed is the most data an iCCP, zTXt or iTXt chunk is
+// decompressed to, so that a small chunk can't use up all the memory.
+const maxLintDecompressed = 1 << 24
+
+func (l *linter) decompress(off int64, typ string, data []byte) []byte {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err == nil {
+		defer r.Close()
+		var b []byte
+		if b, err = ioutil.ReadAll(io.LimitReader(r, maxLintDecompressed+1)); err == nil {
+			if len(b) > maxLintDecompressed {
+				l.add(off, typ, SeverityWarning, "decompressed data is larger than %d bytes, so it wasn't checked", maxLintDecompressed)
+				return nil
+			}
+			return b
+		}
+	}
+	l.add(off, typ, SeverityError, "can't decompress data: %v", err)
+	return nil
+}
+
+func (l *linter) checkITXT(off int64, data []byte) {
+	_, rest, ok := l.keyword(off, "iTXt", data)
+	if !ok {
+		return
+	}
+	if len(rest) < 2 {
+		l.add(off, "iTXt", SeverityError, "missing compression flag")
+		return
+	}
+	flag, method := rest[0], rest[1]
+	fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(fields) != 3 {
+		l.add(off, "iTXt", SeverityError, "missing language tag or translated keyword")
+		return
+	}
+	if !utf8.Valid(fields[1]) {
+		l.add(off, "iTXt", SeverityError, "translated keyword isn't UTF-8")
+	}
+	text := fields[2]
+	switch {
+	case flag > 1:
+		l.add(off, "iTXt", SeverityError, "invalid compression flag %d", flag)
+		return
+	case flag == 1 && method != 0:
+		l.add(off, "iTXt", SeverityError, "unknown compression method %d", method)
+		return
+	case flag == 1:
+		if text = l.decompress(off, "iTXt", text); text == nil {
+			return
+		}
+	}
+	if !utf8.Valid(text) {
+		l.add(off, "iTXt", SeverityError, "text isn't UTF-8")
+	}
+}
+
+// startIDAT starts decompressing the image data when the first IDAT
+// chunk is read, if the IHDR chunk was valid. It reports whether IDAT
+// data should be passed to l.idat.
+func (l *linter) startIDAT(off int64) bool {
+	if l.idat != nil {
+		return true
+	}
+	if l.seen["IDAT"] > 0 || l.cb == cbInvalid {
+		return false
+	}
+	// The expected size of the decompressed data, from the size of
+	// each pass.
+	bpp := int64(bitsPerPixel(l.cb))
+	var want int64
+	for pass := 0; pass < 7; pass++ {
+		w, h := int64(l.width), int64(l.height)
+		if l.interlace == itAdam7 {
+			p := interlacing[pass]
+			w = (w - int64(p.xOffset) + int64(p.xFactor) - 1) / int64(p.xFactor)
+			h = (h - int64(p.yOffset) + int64(p.yFactor) - 1) / int64(p.yFactor)
+		} else if pass > 0 {
+			break
+		}
+		if w > 0 && h > 0 {
+			want += h * (1 + (bpp*w+7)/8)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	l.idat, l.idatDone = pw, make(chan []Finding, 1)
+	go func() {
+		var fs []Finding
+		add := func(sev Severity, format string, args ...interface{}) {
+			fs = append(fs, Finding{off, "IDAT", sev, fmt.Sprintf(format, args...)})
+		}
+		var n countingWriter
+		zr, err := zlib.NewReader(pr)
+		if err == nil {
+			// Decompression stops a byte past the expected size, rather
+			// than inflating however much data there is.
+			if _, err = io.CopyN(&n, zr, want+1); err == io.EOF {
+				err = nil
+			}
+		}
+		if err != nil {
+			add(SeverityError, "can't decompress image data: %v", err)
+		} else if int64(n) < want {
+			add(SeverityError, "not enough image data: %d bytes, want %d", n, want)
+		} else if int64(n) > want {
+			add(SeverityError, "too much image data: more than %d bytes", want)
+		}
+		// Drain anything left so the writer doesn't block. Any left
+		// after too much image data is more of the same.
+		if extra, _ := io.Copy(ioutil.Discard, pr); err == nil && int64(n) <= want && extra > 0 {
+			add(SeverityWarning, "%d bytes of data after the compressed image data", extra)
+		}
+		l.idatDone <- fs
+	}()
+	return true
+}
+
+// endIDAT finishes decompressing the image data, if it was started.
+func (l *linter) endIDAT() {
+	if l.idat == nil {
+		return
+	}
+	l.idat.Close()
+	l.findings = append(l.findings, <-l.idatDone...)
+	l.idat = nil
+}
@@ -0,0 +1,124 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func zlibData(b []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestLintValid(t *testing.T) {
+	for _, fn := range append(filenames, filenamesPaletted...) {
+		b, err := ioutil.ReadFile("testdata/pngsuite/" + fn + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := Lint(context.Background(), bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		for _, f := range fs {
+			t.Errorf("%s: %v", fn, f)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	// A 2x2 8 bit paletted image.
+	ihdr := []byte{0, 0, 0, 2, 0, 0, 0, 2, 8, ctPaletted, 0, 0, 0}
+	idat := zlibData([]byte{0, 0, 1, 0, 1, 0})
+	plte := makeChunk("PLTE", []byte{0, 0, 0, 255, 255, 255})
+	head := append([]byte(pngHeader), makeChunk("IHDR", ihdr)...)
+	join := func(bs ...[]byte) []byte {
+		return bytes.Join(append([][]byte{head}, bs...), nil)
+	}
+	badCRC := makeChunk("gAMA", []byte{0, 0, 0xb1, 0x8f})
+	badCRC[len(badCRC)-1]++
+
+	testCases := []struct {
+		desc string
+		file []byte
+		want []string
+	}{
+		{"valid", join(plte, makeChunk("IDAT", idat), makeChunk("IEND", nil)), nil},
+		{"not PNG", []byte("GIF89a"), []string{"not a PNG file"}},
+		{"bad CRC", join(badCRC, plte, makeChunk("IDAT", idat), makeChunk("IEND", nil)), []string{"offset 33: gAMA: error: CRC is"}},
+		{"order", join(makeChunk("IDAT", idat), plte, makeChunk("gAMA", []byte{0, 0, 0, 1}), makeChunk("IEND", nil)),
+			[]string{"IDAT: error: IDAT chunk before PLTE", "PLTE: error: PLTE chunk after IDAT", "gAMA: error: gAMA chunk after PLTE or IDAT"}},
+		{"duplicates", join(plte, plte, makeChunk("IDAT", idat), makeChunk("tEXt", []byte("a\x00b")), makeChunk("IDAT", nil), makeChunk("IEND", nil), makeChunk("IEND", nil)),
+			[]string{"multiple PLTE chunks", "IDAT chunks aren't consecutive", "data after IEND"}},
+		{"text", join(plte,
+			makeChunk("tEXt", []byte(" key\x00value")),
+			makeChunk("tEXt", []byte("a  b\x00value")),
+			makeChunk("zTXt", []byte("key\x00\x00garbage")),
+			makeChunk("iTXt", []byte("key\x00\x01\x00en\x00\x00"+string(zlibData([]byte{0xff})))),
+			makeChunk("iCCP", []byte("name\x00\x01")),
+			makeChunk("IDAT", idat), makeChunk("IEND", nil)),
+			[]string{"leading or trailing spaces", "consecutive spaces", "zTXt: error: can't decompress", "text isn't UTF-8", "iCCP: error: unknown compression method 1"}},
+		{"palette and transparency", join(
+			makeChunk("PLTE", make([]byte, 3*257)),
+			makeChunk("tRNS", make([]byte, 258)),
+			makeChunk("hIST", make([]byte, 4)),
+			makeChunk("IDAT", idat), makeChunk("IEND", nil)),
+			[]string{"257 palette entries", "tRNS: error: 258 entries for 257 palette entries", "hIST: error: length is 4"}},
+		{"image data", join(plte, makeChunk("IDAT", zlibData([]byte{0, 0, 1})), makeChunk("IEND", nil)),
+			[]string{"not enough image data: 3 bytes, want 6"}},
+		{"too much image data", join(plte, makeChunk("IDAT", zlibData(make([]byte, 1<<20))), makeChunk("IEND", nil)),
+			[]string{"too much image data: more than 6 bytes"}},
+		{"large text", join(plte,
+			makeChunk("zTXt", append([]byte("key\x00\x00"), zlibData(make([]byte, maxLintDecompressed+1))...)),
+			makeChunk("IDAT", idat), makeChunk("IEND", nil)),
+			[]string{"zTXt: warning: decompressed data is larger than 16777216 bytes"}},
+		{"truncated", join(plte, makeChunk("IDAT", idat)[:20]),
+			[]string{"IDAT: error: truncated chunk", "missing IDAT chunk"}},
+	}
+	for _, tc := range testCases {
+		fs, err := Lint(context.Background(), bytes.NewReader(tc.file))
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		var got []string
+		for _, f := range fs {
+			got = append(got, f.String())
+		}
+		all := strings.Join(got, "\n")
+		for _, w := range tc.want {
+			if !strings.Contains(all, w) {
+				t.Errorf("%s: findings don't include %q:\n%s", tc.desc, w, all)
+			}
+		}
+		if tc.want == nil && len(fs) > 0 {
+			t.Errorf("%s: unexpected findings:\n%s", tc.desc, all)
+		}
+	}
+}
+
+func TestLintIHDR(t *testing.T) {
+	ihdr := []byte{0, 0, 0, 0, 0, 0, 0, 1, 3, ctTrueColor, 1, 0, 2}
+	file := append([]byte(pngHeader), makeChunk("IHDR", ihdr)...)
+	fs, err := Lint(context.Background(), bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fs {
+		got = append(got, f.Message)
+	}
+	all := strings.Join(got, "\n")
+	for _, w := range []string{"invalid size 0x1", "invalid bit depth 3 for color type 2", "unknown compression method 1", "unknown interlace method 2", "missing IEND chunk", "missing IDAT chunk"} {
+		if !strings.Contains(all, w) {
+			t.Errorf("findings don't include %q:\n%s", w, all)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 	"strings"
 	"time"
 
@@ -55,6 +56,12 @@ type Metadata struct {
 	// this cache.
 	rawIcc  []byte
 	iccName string
+	// depth and colorType hold the bit depth and color type of the
+	// image the metadata was read from, which the SignificantBits and
+	// Background values are relative to. A zero depth means they're
+	// relative to the image being written.
+	depth     int
+	colorType int
 
 	// Width holds the image width, in pixels
 	Width int
@@ -74,17 +81,36 @@ type Metadata struct {
 	Gamma *uint32
 	// SRGBIntent holds the SRGB rendering intent for the PNG file
 	SRGBIntent *SRGBIntent
+	// CodingPoints holds the color space signalled by the cICP chunk of
+	// the PNG file. When present it takes precedence over the iCCP,
+	// sRGB, gAMA and cHRM chunks.
+	CodingPoints *CodingPoints
+	// MasteringDisplay holds the mastering display color volume from
+	// the mDCv chunk of the PNG file.
+	MasteringDisplay *MasteringDisplay
+	// ContentLightLevel holds the content light level information from
+	// the cLLi chunk of the PNG file.
+	ContentLightLevel *ContentLightLevel
 	// SignificantBits holds the decoded significant bit data from the
-	// sBIT chunk of the PNG file.
+	// sBIT chunk of the PNG file. When writing, it's converted to the
+	// color type and bit depth the image is written with.
 	SignificantBits *SignificantBits
 	// Background holds the decoded background color from the bKGD chunk
-	// of the PNG file.
+	// of the PNG file. When writing, it's converted to the color type
+	// and bit depth the image is written with.
 	Background *Background
 	// Dimension holds the pixel size information from the pHYs chunk of
 	// the PNG file.
 	Dimension *Dimension
 	// Histogram holds the histogram data from the hIST chunk of the PNG file.
 	Histogram []uint16
+	// SuggestedPalettes holds the palettes from the sPLT chunks of the
+	// PNG file.
+	SuggestedPalettes []*SuggestedPalette
+	// UnknownChunks holds the chunks the decoder doesn't interpret,
+	// such as private and vendor specific chunks, in the order they
+	// appeared.
+	UnknownChunks []*UnknownChunk
 }
 
 // ImageMetadataFormat returns the type of image the associated
@@ -121,17 +147,12 @@ func (m *Metadata) EXIF(ctx context.Context, opt ...image.ReadOption) (*metadata
 		return nil, m.exifDecodeErr
 	}
 	if m.rawExif != nil {
-		var isBigEndian bool
-		switch string(m.rawExif[0:4]) {
-		case string([]byte{73, 73, 42, 0}):
-			isBigEndian = false
-		case string([]byte{77, 77, 0, 42}):
-			isBigEndian = true
-		default:
-			return nil, fmt.Errorf("Invalid exif prefix %v", m.rawExif[0:4])
+		isBigEndian, err := metadata.EXIFByteOrder(m.rawExif)
+		if err != nil {
+			m.exifDecodeErr = err
+			return nil, err
 		}
-
-		x, err := metadata.DecodeEXIF(ctx, m.rawExif[4:], isBigEndian, opt...)
+		x, err := metadata.DecodeEXIF(ctx, m.rawExif, isBigEndian, opt...)
 		if err != nil {
 			m.exifDecodeErr = err
 			return nil, err
@@ -150,6 +171,21 @@ func (m *Metadata) SetEXIF(e *metadata.EXIF) {
 	m.rawExif = nil
 }
 
+// RawEXIF returns the undecoded contents of the image's eXIf chunk, a
+// TIFF format EXIF block. It returns nil if the image has no EXIF
+// data, or if the data has already been decoded.
+func (m *Metadata) RawEXIF() []byte {
+	return m.rawExif
+}
+
+// SetRawEXIF replaces the image's EXIF data with b, a TIFF format EXIF
+// block, which is written out as it is. Passing nil removes it.
+func (m *Metadata) SetRawEXIF(b []byte) {
+	m.exif = nil
+	m.exifDecodeErr = nil
+	m.rawExif = b
+}
+
 // If we see an iTXt entry with this name we know it's an XMP entry.
 const xmpTextKey = "XML:com.adobe.xmp"
 
@@ -212,6 +248,48 @@ func (m *Metadata) SetIcc(i *metadata.ICC) {
 	m.rawIcc = nil
 }
 
+// RawICC returns the name and undecoded contents of the image's ICC
+// color profile. It returns a nil profile if the image has no ICC
+// profile, or if the profile has already been decoded.
+func (m *Metadata) RawICC() (string, []byte) {
+	return m.iccName, m.rawIcc
+}
+
+// SetRawICC replaces the ICC color profile associated with the
+// metadata object with the undecoded profile p, named name. Passing a
+// nil profile removes the ICC profile.
+func (m *Metadata) SetRawICC(name string, p []byte) {
+	m.icc = nil
+	m.iccDecodeErr = nil
+	m.rawIcc = p
+	m.iccName = name
+	if p == nil {
+		m.iccName = ""
+	}
+}
+
+// RawXMP returns the undecoded XMP packet associated with the
+// metadata object. It returns the empty string if there is no XMP
+// packet, or if the packet has already been decoded.
+func (m *Metadata) RawXMP() string {
+	if m.rawXmp == nil {
+		return ""
+	}
+	return *m.rawXmp
+}
+
+// SetRawXMP replaces the XMP information associated with the metadata
+// object with the undecoded XMP packet x. Passing the empty string
+// removes the XMP information.
+func (m *Metadata) SetRawXMP(x string) {
+	m.xmp = nil
+	m.xmpDecodeErr = nil
+	m.rawXmp = nil
+	if x != "" {
+		m.rawXmp = &x
+	}
+}
+
 type TextType int
 
 const (
@@ -273,24 +351,24 @@ const (
 )
 
 type Chroma struct {
-	WhiteX uint32
-	WhiteY uint32
-	RedX   uint32
-	RedY   uint32
-	GreenX uint32
-	GreenY uint32
-	BlueX  uint32
-	BlueY  uint32
+	WhiteX uint32 `json:"whiteX"`
+	WhiteY uint32 `json:"whiteY"`
+	RedX   uint32 `json:"redX"`
+	RedY   uint32 `json:"redY"`
+	GreenX uint32 `json:"greenX"`
+	GreenY uint32 `json:"greenY"`
+	BlueX  uint32 `json:"blueX"`
+	BlueY  uint32 `json:"blueY"`
 }
 
 // SignificantBits contains the number of significant bits for the
 // red, green, blue, grey, and alpha channels in an image.
 type SignificantBits struct {
-	Red   int
-	Green int
-	Blue  int
-	Gray  int
-	Alpha int
+	Red   int `json:"red"`
+	Green int `json:"green"`
+	Blue  int `json:"blue"`
+	Gray  int `json:"gray"`
+	Alpha int `json:"alpha"`
 }
 
 // SRGBIntent is the rendering intent as defined by the ICC.
@@ -322,11 +400,11 @@ func (s SRGBIntent) String() string {
 // Background holds the background color for an image. Not all fields
 // are relevant for an image.
 type Background struct {
-	Grey         int
-	Red          int
-	Green        int
-	Blue         int
-	PaletteIndex int
+	Grey         int `json:"grey"`
+	Red          int `json:"red"`
+	Green        int `json:"green"`
+	Blue         int `json:"blue"`
+	PaletteIndex int `json:"paletteIndex"`
 }
 
 // String generates a human readable version of the background color
@@ -335,10 +413,34 @@ func (b Background) String() string {
 	return fmt.Sprintf("Grey %v, RGB %v/%v/%v, PaletteIndex %v", b.Grey, b.Red, b.Green, b.Blue, b.PaletteIndex)
 }
 
+// backgroundColor returns the opaque background color, reading the
+// Background values with the bit depth and color type the metadata
+// was read with.
+func (m *Metadata) backgroundColor() (color.Color, error) {
+	bg := m.Background
+	max := 1<<uint(m.depth) - 1
+	scale := func(v int) uint16 {
+		return uint16(v * 0xffff / max)
+	}
+	switch m.colorType {
+	case ctGrayscale, ctGrayscaleAlpha:
+		return color.Gray16{scale(bg.Grey)}, nil
+	case ctTrueColor, ctTrueColorAlpha:
+		return color.RGBA64{scale(bg.Red), scale(bg.Green), scale(bg.Blue), 0xffff}, nil
+	case ctPaletted:
+		if pal, ok := m.ColorModel.(color.Palette); ok && bg.PaletteIndex >= 0 && bg.PaletteIndex < len(pal) {
+			c := color.NRGBA64Model.Convert(pal[bg.PaletteIndex]).(color.NRGBA64)
+			return color.RGBA64{c.R, c.G, c.B, 0xffff}, nil
+		}
+		return nil, fmt.Errorf("Invalid background palette index %d", bg.PaletteIndex)
+	}
+	return nil, fmt.Errorf("Unknown color type %d", m.colorType)
+}
+
 type Dimension struct {
-	X    int
-	Y    int
-	Unit int
+	X    int `json:"x"`
+	Y    int `json:"y"`
+	Unit int `json:"unit"`
 }
 
 // String generates a human readable version of the Dimension data.
@@ -351,6 +453,189 @@ func (d Dimension) String() string {
 	}
 }
 
+// CodingPoints holds the coding-independent code points for an
+// image's color space, as defined by ITU-T H.273.
+type CodingPoints struct {
+	ColorPrimaries   uint8 `json:"colorPrimaries"`
+	TransferFunction uint8 `json:"transferFunction"`
+	// MatrixCoefficients is always 0, for RGB, in a PNG file.
+	MatrixCoefficients uint8 `json:"matrixCoefficients"`
+	// FullRange is false if the samples use the narrow "video" range,
+	// such as 16 to 235 for 8 bit samples.
+	FullRange bool `json:"fullRange"`
+}
+
+// Common ColorPrimaries values.
+const (
+	PrimariesBT709     = 1
+	PrimariesBT2020    = 9
+	PrimariesDisplayP3 = 12
+)
+
+// Common TransferFunction values.
+const (
+	TransferBT709  = 1
+	TransferLinear = 8
+	TransferSRGB   = 13
+	TransferPQ     = 16
+	TransferHLG    = 18
+)
+
+// String generates a human readable version of the code points.
+func (c CodingPoints) String() string {
+	r := "narrow"
+	if c.FullRange {
+		r = "full"
+	}
+	return fmt.Sprintf("primaries %d, transfer %d, matrix %d, %s range", c.ColorPrimaries, c.TransferFunction, c.MatrixCoefficients, r)
+}
+
+// MasteringDisplay describes the display an image was mastered on.
+// Chromaticities are in units of 0.00002, and luminances in units of
+// 0.0001 cd/m².
+type MasteringDisplay struct {
+	RedX         uint16 `json:"redX"`
+	RedY         uint16 `json:"redY"`
+	GreenX       uint16 `json:"greenX"`
+	GreenY       uint16 `json:"greenY"`
+	BlueX        uint16 `json:"blueX"`
+	BlueY        uint16 `json:"blueY"`
+	WhiteX       uint16 `json:"whiteX"`
+	WhiteY       uint16 `json:"whiteY"`
+	MaxLuminance uint32 `json:"maxLuminance"`
+	MinLuminance uint32 `json:"minLuminance"`
+}
+
+// ContentLightLevel holds the brightest pixel (MaxCLL) and brightest
+// frame average (MaxFALL) of an image, in units of 0.0001 cd/m².
+type ContentLightLevel struct {
+	MaxCLL  uint32 `json:"maxCLL"`
+	MaxFALL uint32 `json:"maxFALL"`
+}
+
+// SuggestedPalette holds a palette suggested for displays that can
+// only show a limited number of colors, from an sPLT chunk.
+type SuggestedPalette struct {
+	// Name identifies the palette, and has to be unique in the file.
+	Name string
+	// SampleDepth is the number of bits used to store each color
+	// channel, either 8 or 16.
+	SampleDepth int
+	// Entries holds the colors in the palette.
+	Entries []SuggestedPaletteEntry
+}
+
+// SuggestedPaletteEntry is a single color in a suggested palette.
+type SuggestedPaletteEntry struct {
+	// Color holds the color. With a sample depth of 8 only the high
+	// byte of each channel is written.
+	Color color.NRGBA64
+	// Frequency is proportional to the fraction of the image's pixels
+	// closest to this color. Zero means the frequency isn't known.
+	Frequency uint16
+}
+
+// NewSuggestedPalette returns a suggested palette holding the colors
+// of pal, such as the output of a draw.Quantizer run over m. The
+// frequency of each color is found by mapping each pixel of m to its
+// closest color in pal, and the entries are sorted with the most
+// frequent first. The sample depth is 8 if that holds all the colors
+// exactly and 16 otherwise.
+func NewSuggestedPalette(name string, pal color.Palette, m image.Image) *SuggestedPalette {
+	counts := make([]int, len(pal))
+	if len(pal) > 0 {
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				counts[pal.Index(m.At(x, y))]++
+			}
+		}
+	}
+	max := 1
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+
+	p := &SuggestedPalette{Name: name, SampleDepth: 8}
+	for i, c := range pal {
+		nc := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		for _, v := range []uint16{nc.R, nc.G, nc.B, nc.A} {
+			if v>>8 != v&0xff {
+				p.SampleDepth = 16
+			}
+		}
+		p.Entries = append(p.Entries, SuggestedPaletteEntry{
+			Color:     nc,
+			Frequency: uint16(counts[i] * 0xffff / max),
+		})
+	}
+	sort.SliceStable(p.Entries, func(i, j int) bool {
+		return p.Entries[i].Frequency > p.Entries[j].Frequency
+	})
+	return p
+}
+
+// ChunkPosition says where a chunk appears in a PNG file, relative to
+// its PLTE and IDAT chunks.
+type ChunkPosition int
+
+const (
+	// ChunkBeforePLTE chunks come after the IHDR chunk and before the
+	// PLTE chunk, or before the IDAT chunks if there's no PLTE chunk.
+	ChunkBeforePLTE ChunkPosition = iota
+	// ChunkBeforeIDAT chunks come between the PLTE and IDAT chunks.
+	ChunkBeforeIDAT
+	// ChunkAfterIDAT chunks come between the IDAT and IEND chunks.
+	ChunkAfterIDAT
+)
+
+// String generates a human readable version of the chunk position.
+func (p ChunkPosition) String() string {
+	switch p {
+	case ChunkBeforePLTE:
+		return "before PLTE"
+	case ChunkBeforeIDAT:
+		return "before IDAT"
+	case ChunkAfterIDAT:
+		return "after IDAT"
+	default:
+		return "unknown position"
+	}
+}
+
+// UnknownChunk holds a chunk that the decoder doesn't interpret.
+type UnknownChunk struct {
+	// Type is the four letter chunk type, such as "iDOT".
+	Type string
+	// Data holds the chunk's contents, without its length and CRC.
+	Data []byte
+	// Position says where the chunk goes in the file.
+	Position ChunkPosition
+}
+
+// SafeToCopy reports whether the chunk's safe-to-copy bit is set. If
+// it isn't, the chunk depends on the image data and is dropped when an
+// image other than an unchanged Deferred image is written.
+func (c *UnknownChunk) SafeToCopy() bool {
+	return len(c.Type) == 4 && c.Type[3]&0x20 != 0
+}
+
+// validChunkType reports whether t is a well formed chunk type: four
+// ASCII letters.
+func validChunkType(t string) bool {
+	if len(t) != 4 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		if c := t[i] | 0x20; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *decoder) parseTEXT(ctx context.Context, length uint32) error {
 	if _, err := io.ReadFull(d.r, d.tmp[:length]); err != nil {
 		return err
@@ -483,6 +768,39 @@ func (d *decoder) parseICCP(ctx context.Context, length uint32) error {
 	return d.verifyChecksum()
 }
 
+// parseEXIF reads an eXIf chunk, which holds a TIFF format EXIF block
+// starting with its byte order mark.
+func (d *decoder) parseEXIF(ctx context.Context, length uint32) error {
+	if length < 8 {
+		return FormatError("invalid eXIf length")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return err
+	}
+	d.crc.Write(buf)
+	if !validEXIFHeader(buf) {
+		return FormatError("invalid eXIf header")
+	}
+
+	d.metadata.rawExif = buf
+
+	return d.verifyChecksum()
+}
+
+// validEXIFHeader reports whether b starts with a little or big endian
+// TIFF header.
+func validEXIFHeader(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	switch string(b[0:4]) {
+	case "II*\x00", "MM\x00*":
+		return true
+	}
+	return false
+}
+
 func (d *decoder) parseSRGB(ctx context.Context, length uint32) error {
 	if length != 1 {
 		return FormatError("invalid sRGB length")
@@ -588,6 +906,64 @@ func (d *decoder) parsePHYS(ctx context.Context, length uint32) error {
 	return d.verifyChecksum()
 }
 
+func (d *decoder) parseCICP(ctx context.Context, length uint32) error {
+	if length != 4 {
+		return FormatError("invalid cICP length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:4])
+
+	d.metadata.CodingPoints = &CodingPoints{
+		ColorPrimaries:     d.tmp[0],
+		TransferFunction:   d.tmp[1],
+		MatrixCoefficients: d.tmp[2],
+		FullRange:          d.tmp[3] != 0,
+	}
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parseMDCV(ctx context.Context, length uint32) error {
+	if length != 24 {
+		return FormatError("invalid mDCv length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:24]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:24])
+
+	d.metadata.MasteringDisplay = &MasteringDisplay{
+		RedX:         binary.BigEndian.Uint16(d.tmp[0:2]),
+		RedY:         binary.BigEndian.Uint16(d.tmp[2:4]),
+		GreenX:       binary.BigEndian.Uint16(d.tmp[4:6]),
+		GreenY:       binary.BigEndian.Uint16(d.tmp[6:8]),
+		BlueX:        binary.BigEndian.Uint16(d.tmp[8:10]),
+		BlueY:        binary.BigEndian.Uint16(d.tmp[10:12]),
+		WhiteX:       binary.BigEndian.Uint16(d.tmp[12:14]),
+		WhiteY:       binary.BigEndian.Uint16(d.tmp[14:16]),
+		MaxLuminance: binary.BigEndian.Uint32(d.tmp[16:20]),
+		MinLuminance: binary.BigEndian.Uint32(d.tmp[20:24]),
+	}
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parseCLLI(ctx context.Context, length uint32) error {
+	if length != 8 {
+		return FormatError("invalid cLLi length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:8])
+
+	d.metadata.ContentLightLevel = &ContentLightLevel{
+		MaxCLL:  binary.BigEndian.Uint32(d.tmp[0:4]),
+		MaxFALL: binary.BigEndian.Uint32(d.tmp[4:8]),
+	}
+	return d.verifyChecksum()
+}
+
 func (d *decoder) parseHIST(ctx context.Context, length uint32) error {
 	if int(length) != d.paletteCount {
 		return FormatError("invalid hIST length")
@@ -701,6 +1077,74 @@ func decodeItxtEntry(ctx context.Context, blob []byte) (string, string, string,
 	return key, languageTag, translatedKeyword, value, nil
 }
 
+func (d *decoder) parseSPLT(ctx context.Context, length uint32) error {
+	b, err := readData(ctx, d, length, false)
+	if err != nil {
+		return err
+	}
+	i := bytes.IndexByte(b, 0)
+	if i < 1 || i > 79 || i+2 > len(b) {
+		return FormatError("invalid sPLT palette name")
+	}
+	p := &SuggestedPalette{Name: string(b[:i]), SampleDepth: int(b[i+1])}
+	b = b[i+2:]
+	size := 6
+	switch p.SampleDepth {
+	case 8:
+	case 16:
+		size = 10
+	default:
+		return FormatError("invalid sPLT sample depth")
+	}
+	if len(b)%size != 0 {
+		return FormatError("bad sPLT length")
+	}
+	for ; len(b) > 0; b = b[size:] {
+		var e SuggestedPaletteEntry
+		if p.SampleDepth == 8 {
+			e.Color = color.NRGBA64{
+				R: uint16(b[0]) * 0x101,
+				G: uint16(b[1]) * 0x101,
+				B: uint16(b[2]) * 0x101,
+				A: uint16(b[3]) * 0x101,
+			}
+		} else {
+			e.Color = color.NRGBA64{
+				R: binary.BigEndian.Uint16(b[0:2]),
+				G: binary.BigEndian.Uint16(b[2:4]),
+				B: binary.BigEndian.Uint16(b[4:6]),
+				A: binary.BigEndian.Uint16(b[6:8]),
+			}
+		}
+		e.Frequency = binary.BigEndian.Uint16(b[size-2 : size])
+		p.Entries = append(p.Entries, e)
+	}
+	d.metadata.SuggestedPalettes = append(d.metadata.SuggestedPalettes, p)
+	return d.verifyChecksum()
+}
+
+// parseUnknown records a chunk the decoder doesn't interpret, along
+// with where it appeared. Chunks with malformed types are skipped.
+func (d *decoder) parseUnknown(ctx context.Context, length uint32) error {
+	typ := string(d.tmp[4:8])
+	if !validChunkType(typ) {
+		return d.skipChunk(ctx, length)
+	}
+	b, err := readData(ctx, d, length, false)
+	if err != nil {
+		return err
+	}
+	c := &UnknownChunk{Type: typ, Data: b}
+	switch {
+	case d.stage >= dsSeenIDAT:
+		c.Position = ChunkAfterIDAT
+	case d.stage >= dsSeenPLTE:
+		c.Position = ChunkBeforeIDAT
+	}
+	d.metadata.UnknownChunks = append(d.metadata.UnknownChunks, c)
+	return d.verifyChecksum()
+}
+
 func readData(ctx context.Context, d *decoder, length uint32, ut bool) ([]byte, error) {
 	// Do we need to read less data than will fit in our buffer? If so
 	// use the buffer.
@@ -722,6 +1166,120 @@ func readData(ctx context.Context, d *decoder, length uint32, ut bool) ([]byte,
 	return tb, nil
 }
 
+// textCategories maps PNG text keywords to their metadata
+// category. Other keywords are in the MetadataOther category.
+var textCategories = map[string]image.MetadataCategory{
+	"Author":  image.MetadataOwner,
+	"Comment": image.MetadataComments,
+}
+
+// strip returns a copy of the metadata without the data that s says
+// should be removed, recording each removal in s.
+func (m *Metadata) strip(ctx context.Context, s *image.StripMetadata, opts ...image.WriteOption) (*Metadata, error) {
+	c := *m
+
+	if c.rawExif != nil {
+		c.rawExif = metadata.StripEXIF(c.rawExif, s)
+	}
+	if c.exif != nil {
+		c.exif = metadata.StripEXIFFields(c.exif, s)
+	}
+
+	// XMP is stripped as text, so a decoded packet has to be encoded
+	// first.
+	if c.xmp != nil && s.StripsAny() {
+		x, err := c.xmp.Encode(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		c.xmp = nil
+		c.rawXmp = &x
+	}
+	if c.rawXmp != nil {
+		x := metadata.StripXMP(*c.rawXmp, s)
+		c.rawXmp = nil
+		if x != "" {
+			c.rawXmp = &x
+		}
+	}
+
+	if s.Strips(image.MetadataColorProfile) {
+		if c.icc != nil || c.rawIcc != nil {
+			s.Record(image.MetadataColorProfile, "PNG iCCP chunk")
+		}
+		c.icc, c.rawIcc, c.iccName = nil, nil, ""
+		if c.Gamma != nil {
+			s.Record(image.MetadataColorProfile, "PNG gAMA chunk")
+			c.Gamma = nil
+		}
+		if c.Chroma != nil {
+			s.Record(image.MetadataColorProfile, "PNG cHRM chunk")
+			c.Chroma = nil
+		}
+		if c.SRGBIntent != nil {
+			s.Record(image.MetadataColorProfile, "PNG sRGB chunk")
+			c.SRGBIntent = nil
+		}
+		if c.CodingPoints != nil {
+			s.Record(image.MetadataColorProfile, "PNG cICP chunk")
+			c.CodingPoints = nil
+		}
+		if c.MasteringDisplay != nil {
+			s.Record(image.MetadataColorProfile, "PNG mDCv chunk")
+			c.MasteringDisplay = nil
+		}
+		if c.ContentLightLevel != nil {
+			s.Record(image.MetadataColorProfile, "PNG cLLi chunk")
+			c.ContentLightLevel = nil
+		}
+	}
+
+	c.Text = nil
+	for _, t := range m.Text {
+		tc, ok := textCategories[t.Key]
+		if !ok {
+			tc = image.MetadataOther
+		}
+		if s.Strips(tc) {
+			s.Record(tc, fmt.Sprintf("PNG text entry %q", t.Key))
+			continue
+		}
+		c.Text = append(c.Text, t)
+	}
+
+	if s.Strips(image.MetadataOther) {
+		if c.LastModified != nil {
+			s.Record(image.MetadataOther, "PNG tIME chunk")
+			c.LastModified = nil
+		}
+		if c.Dimension != nil {
+			s.Record(image.MetadataOther, "PNG pHYs chunk")
+			c.Dimension = nil
+		}
+		if c.SignificantBits != nil {
+			s.Record(image.MetadataOther, "PNG sBIT chunk")
+			c.SignificantBits = nil
+		}
+		if c.Background != nil {
+			s.Record(image.MetadataOther, "PNG bKGD chunk")
+			c.Background = nil
+		}
+		if c.Histogram != nil {
+			s.Record(image.MetadataOther, "PNG hIST chunk")
+			c.Histogram = nil
+		}
+		for _, p := range c.SuggestedPalettes {
+			s.Record(image.MetadataOther, fmt.Sprintf("PNG sPLT chunk %q", p.Name))
+		}
+		c.SuggestedPalettes = nil
+		for _, u := range c.UnknownChunks {
+			s.Record(image.MetadataOther, fmt.Sprintf("PNG %s chunk", u.Type))
+		}
+		c.UnknownChunks = nil
+	}
+	return &c, nil
+}
+
 // validate checks to make sure that the metadata struct conforms to the rules.
 func (m *Metadata) validate() error {
 	// Validate that the ICC profile name is valid.
@@ -750,6 +1308,10 @@ func (m *Metadata) validate() error {
 		}
 	}
 
+	if m.rawExif != nil && !validEXIFHeader(m.rawExif) {
+		return fmt.Errorf("Invalid EXIF header")
+	}
+
 	// Validate the text entries a little. Keys can't contain nulls and
 	// must be between 1 and 79 bytes long.
 	for _, v := range m.Text {
@@ -761,6 +1323,37 @@ func (m *Metadata) validate() error {
 		}
 	}
 
+	if m.CodingPoints != nil && m.CodingPoints.MatrixCoefficients != 0 {
+		return fmt.Errorf("Invalid cICP matrix coefficients %d", m.CodingPoints.MatrixCoefficients)
+	}
+
+	names := make(map[string]bool)
+	for _, p := range m.SuggestedPalettes {
+		if len(p.Name) == 0 || len(p.Name) > 79 || strings.Contains(p.Name, "\x00") {
+			return fmt.Errorf("Invalid suggested palette name %q", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("Multiple suggested palettes named %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.SampleDepth != 8 && p.SampleDepth != 16 {
+			return fmt.Errorf("Invalid sample depth %d for suggested palette %q", p.SampleDepth, p.Name)
+		}
+	}
+
+	for _, c := range m.UnknownChunks {
+		if !validChunkType(c.Type) {
+			return fmt.Errorf("Invalid chunk type %q", c.Type)
+		}
+		switch c.Type {
+		case "IHDR", "PLTE", "IDAT", "IEND":
+			return fmt.Errorf("Critical chunk %q can't be written as an unknown chunk", c.Type)
+		}
+		if c.Position < ChunkBeforePLTE || c.Position > ChunkAfterIDAT {
+			return fmt.Errorf("Invalid position %d for chunk %q", c.Position, c.Type)
+		}
+	}
+
 	// Possible future check -- the value for uncompressed and
 	// compressed-not-unicode text should be Latin-1, which means
 	// theoretically no nulls and no codepoints between 0x7F and
@@ -0,0 +1,99 @@
+package png
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/drswork/image"
+)
+
+// BitDepthPolicy selects how the encoder picks the color type and bit
+// depth an image is written with.
+type BitDepthPolicy int
+
+const (
+	// BitDepthAuto picks the color type and bit depth from the image's
+	// color model.
+	BitDepthAuto BitDepthPolicy = iota
+	// BitDepthReduce scans the pixels for the smallest color type and
+	// bit depth that holds every pixel exactly, as Encoder.Optimize
+	// does.
+	BitDepthReduce
+	// BitDepth8 picks the color type from the image's color model, but
+	// writes 16 bit samples with 8 bits, losing precision.
+	BitDepth8
+)
+
+// Options holds PNG encoding settings, and can be passed to
+// EncodeExtended and EncodeAll as a write option. When given, it
+// replaces all the matching settings of the Encoder.
+type Options struct {
+	CompressionLevel CompressionLevel
+	Filter           FilterStrategy
+	Interlace        bool
+	// ChunkSize is the maximum number of bytes of compressed image
+	// data written to each IDAT chunk, as for Encoder.ChunkSize.
+	ChunkSize int
+	BitDepth  BitDepthPolicy
+}
+
+// IsImageWriteOption lets PNG options be passed as a write option.
+func (_ *Options) IsImageWriteOption() {
+}
+
+// apply returns a copy of enc with the options' settings.
+func (o *Options) apply(enc *Encoder) (*Encoder, error) {
+	if o.BitDepth < BitDepthAuto || o.BitDepth > BitDepth8 {
+		return nil, fmt.Errorf("Invalid bit depth policy %d", o.BitDepth)
+	}
+	c := *enc
+	c.CompressionLevel = o.CompressionLevel
+	c.Filter = o.Filter
+	c.Interlace = o.Interlace
+	c.ChunkSize = o.ChunkSize
+	c.Optimize = o.BitDepth == BitDepthReduce
+	c.eightBit = o.BitDepth == BitDepth8
+	return &c, nil
+}
+
+// limitWriter fails writes that would take the output past n bytes.
+type limitWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, fmt.Errorf("png: encoded image larger than the byte limit")
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+// setWriter sets the writer the image is written to, capping the
+// output size if the encoder has a limit.
+func (e *encoder) setWriter(w io.Writer) {
+	e.w = w
+	if max := e.enc.limits.MaxImageSize; max > 0 {
+		e.w = &limitWriter{w, max}
+	}
+}
+
+// isMetadataChunk reports whether chunks of type name hold metadata,
+// and count towards the metadata size limit.
+func isMetadataChunk(name string) bool {
+	switch name {
+	case "tRNS", "acTL", "fcTL", "fdAT":
+		return false
+	}
+	// Critical chunks have an upper case first letter.
+	return name[0]&0x20 != 0
+}
+
+// checkLimits checks an image's write limits.
+func checkLimits(l image.LimitOptions) error {
+	if l.MaxImageSize < 0 || l.MaxMetadataSize < 0 || l.MaxFrames < 0 {
+		return fmt.Errorf("Invalid limits %+v", l)
+	}
+	return nil
+}
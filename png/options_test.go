@@ -0,0 +1,80 @@
+package png
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+func TestOptions(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewRGBA64(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+	}
+	for i := 6; i < len(m.Pix); i += 8 {
+		m.Pix[i], m.Pix[i+1] = 0xff, 0xff
+	}
+
+	var buf bytes.Buffer
+	o := &Options{Interlace: true, ChunkSize: 100, BitDepth: BitDepth8, Filter: FilterSub}
+	if err := EncodeExtended(ctx, &buf, m, o); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	ihdr := b[len(pngHeader)+8:]
+	if ihdr[8] != 8 || ihdr[9] != ctTrueColor || ihdr[12] != itAdam7 {
+		t.Errorf("got depth %d, color type %d, interlace %d", ihdr[8], ihdr[9], ihdr[12])
+	}
+	if n := strings.Count(strings.Join(chunkNames(b), " "), "IDAT"); n < 2 {
+		t.Errorf("got %d IDAT chunks, want chunks of 100 bytes", n)
+	}
+	got, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c0, c1 := m.At(3, 5).(color.RGBA64), got.At(3, 5).(color.RGBA); uint8(c0.R>>8) != c1.R || uint8(c0.B>>8) != c1.B {
+		t.Errorf("got color %v, want %v", c1, c0)
+	}
+
+	// The options replace the encoder's settings.
+	buf.Reset()
+	enc := &Encoder{Interlace: true}
+	if err := enc.EncodeExtended(ctx, &buf, m, &Options{BitDepth: BitDepthReduce}); err != nil {
+		t.Fatal(err)
+	}
+	if ihdr := buf.Bytes()[len(pngHeader)+8:]; ihdr[12] != itNone {
+		t.Error("got an interlaced image")
+	}
+
+	for _, tc := range []struct {
+		desc string
+		opts []image.WriteOption
+	}{
+		{"two options", []image.WriteOption{&Options{}, &Options{}}},
+		{"bad policy", []image.WriteOption{&Options{BitDepth: -1}}},
+		{"bad chunk size", []image.WriteOption{&Options{ChunkSize: -1}}},
+		{"image too large", []image.WriteOption{image.LimitOptions{MaxImageSize: 100}}},
+		{"metadata too large", []image.WriteOption{image.LimitOptions{MaxMetadataSize: 10}, &Metadata{Text: []*TextEntry{{Key: "Comment", Value: "a long enough comment", EntryType: EtText}}}}},
+	} {
+		if err := EncodeExtended(ctx, ioutil.Discard, m, tc.opts...); err == nil {
+			t.Errorf("%s: got nil error, want non-nil", tc.desc)
+		}
+	}
+	if err := EncodeExtended(ctx, ioutil.Discard, m, image.LimitOptions{MaxImageSize: 1 << 20, MaxMetadataSize: 10}); err != nil {
+		t.Errorf("within limits: %v", err)
+	}
+
+	a := &APNG{DefaultIsFrame: true}
+	for i := 0; i < 3; i++ {
+		a.Frames = append(a.Frames, &Frame{Image: image.NewGray(image.Rect(0, 0, 4, 4))})
+	}
+	if err := EncodeAll(ctx, ioutil.Discard, a, image.LimitOptions{MaxFrames: 2}); err == nil {
+		t.Error("too many frames: got nil error, want non-nil")
+	}
+}
@@ -0,0 +1,168 @@
+package png
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+
+	"github.com/drswork/image"
+)
+
+// minBandRows is the fewest rows of an image compressed by each
+// goroutine when Encoder.Concurrency is set. Smaller bands cost more
+// in lost compression than they save in time.
+const minBandRows = 32
+
+// band is a range of rows of an image, compressed on its own
+// goroutine.
+type band struct {
+	m      image.Image
+	y0, y1 int
+	last   bool
+
+	buf    bytes.Buffer
+	adler  uint32
+	length int64
+	err    error
+	done   chan struct{}
+}
+
+// bands splits each image in passes into up to e.enc.Concurrency bands
+// of rows, for compression in parallel.
+func (e *encoder) bands(passes []image.Image) []*band {
+	var bands []*band
+	for _, m := range passes {
+		b := m.Bounds()
+		n := e.enc.Concurrency
+		if rows := b.Dy() / minBandRows; n > rows {
+			n = rows
+		}
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			bands = append(bands, &band{
+				m:    m,
+				y0:   b.Min.Y + b.Dy()*i/n,
+				y1:   b.Min.Y + b.Dy()*(i+1)/n,
+				done: make(chan struct{}),
+			})
+		}
+	}
+	bands[len(bands)-1].last = true
+	return bands
+}
+
+// writeImageParallel writes the bands' image data to w as a single
+// zlib stream, filtering and compressing up to e.enc.Concurrency bands
+// at a time. Each band is compressed as a separate deflate stream
+// ending in a sync flush, so the bands can be joined, and the band
+// checksums are combined into the zlib stream's Adler-32 checksum.
+func (e *encoder) writeImageParallel(w io.Writer, bands []*band, cb int, level int) error {
+	sem := make(chan struct{}, e.enc.Concurrency)
+	go func() {
+		for _, bd := range bands {
+			sem <- struct{}{}
+			go func(bd *band) {
+				defer func() { <-sem }()
+				defer close(bd.done)
+				bd.err = e.compressBand(bd, cb, level)
+			}(bd)
+		}
+	}()
+
+	err := zlibHeader(w, level)
+	adler := uint32(1)
+	for _, bd := range bands {
+		<-bd.done
+		if err != nil {
+			continue
+		}
+		if err = bd.err; err != nil {
+			continue
+		}
+		if _, err = w.Write(bd.buf.Bytes()); err != nil {
+			continue
+		}
+		adler = adler32Combine(adler, bd.adler, bd.length)
+		// Let the compressed data be collected.
+		bd.buf = bytes.Buffer{}
+	}
+	if err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], adler)
+	_, err = w.Write(sum[:])
+	return err
+}
+
+// compressBand filters and compresses the band's rows into its
+// buffer. Only the last band ends the deflate stream.
+func (e *encoder) compressBand(bd *band, cb int, level int) error {
+	fw, err := flate.NewWriter(&bd.buf, level)
+	if err != nil {
+		return err
+	}
+	sum := adler32.New()
+	cw := new(countingWriter)
+	// Each band needs its own row buffers.
+	be := &encoder{enc: e.enc}
+	if err := be.writeRows(io.MultiWriter(fw, sum, cw), bd.m, cb, level, bd.y0, bd.y1); err != nil {
+		return err
+	}
+	if bd.last {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	bd.adler, bd.length = sum.Sum32(), int64(*cw)
+	return err
+}
+
+// zlibHeader writes the two byte zlib stream header for a deflate
+// stream compressed at level, as compress/zlib does.
+func zlibHeader(w io.Writer, level int) error {
+	var h [2]byte
+	h[0] = 0x78 // Deflate with a 32KB window.
+	switch level {
+	case flate.HuffmanOnly, flate.NoCompression, flate.BestSpeed:
+		h[1] = 0 << 6
+	case 2, 3, 4, 5:
+		h[1] = 1 << 6
+	case 6, flate.DefaultCompression:
+		h[1] = 2 << 6
+	default:
+		h[1] = 3 << 6
+	}
+	h[1] += uint8(31 - (uint16(h[0])<<8+uint16(h[1]))%31)
+	_, err := w.Write(h[:])
+	return err
+}
+
+// adler32Combine returns the Adler-32 checksum of two byte sequences
+// joined together, given the checksums of each and the length of the
+// second, as zlib's adler32_combine does.
+func adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	const base = 65521
+	rem := uint32(len2 % base)
+	sum1 := adler1 & 0xffff
+	sum2 := (rem * sum1) % base
+	sum1 += (adler2 & 0xffff) + base - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + base - rem
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum2 >= base<<1 {
+		sum2 -= base << 1
+	}
+	if sum2 >= base {
+		sum2 -= base
+	}
+	return sum1 | sum2<<16
+}
@@ -0,0 +1,78 @@
+package png
+
+import (
+	"bytes"
+	"hash/adler32"
+	stdpng "image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+func TestAdler32Combine(t *testing.T) {
+	a := bytes.Repeat([]byte("the quick brown fox "), 5000)
+	b := bytes.Repeat([]byte{0xff, 0x00, 0x7f}, 30000)
+	want := adler32.Checksum(append(append([]byte(nil), a...), b...))
+	if got := adler32Combine(adler32.Checksum(a), adler32.Checksum(b), int64(len(b))); got != want {
+		t.Errorf("got %#08x, want %#08x", got, want)
+	}
+}
+
+func TestParallelEncode(t *testing.T) {
+	const w, h = 91, 203
+	nrgba := image.NewNRGBA(image.Rect(0, 0, w, h))
+	gray16 := image.NewGray16(image.Rect(0, 0, w, h))
+	paletted := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White, color.Gray{0x40}, color.Gray{0xc0}})
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			nrgba.Set(x, y, color.NRGBA{uint8(x ^ y), uint8(x * y), uint8(y), uint8(x + 128)})
+			gray16.SetGray16(x, y, color.Gray16{uint16(x * y * 31)})
+			paletted.SetColorIndex(x, y, uint8((x+y)%4))
+		}
+	}
+
+	for _, m := range []image.Image{nrgba, gray16, paletted} {
+		for _, level := range []CompressionLevel{DefaultCompression, NoCompression, BestSpeed} {
+			for _, n := range []int{2, 5, 1000} {
+				var buf bytes.Buffer
+				enc := &Encoder{CompressionLevel: level, Concurrency: n}
+				if err := enc.Encode(&buf, m); err != nil {
+					t.Errorf("%T, level %d, concurrency %d: %v", m, level, n, err)
+					continue
+				}
+				// The standard library decoder checks the zlib checksum.
+				if _, err := stdpng.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+					t.Errorf("%T, level %d, concurrency %d: image/png: %v", m, level, n, err)
+				}
+				got, err := Decode(&buf)
+				if err != nil {
+					t.Errorf("%T, level %d, concurrency %d: %v", m, level, n, err)
+					continue
+				}
+				if err := diff(m, got); err != nil {
+					t.Errorf("%T, level %d, concurrency %d: %v", m, level, n, err)
+				}
+			}
+		}
+	}
+
+	if err := (&Encoder{Concurrency: -1}).Encode(&bytes.Buffer{}, nrgba); err == nil {
+		t.Error("negative concurrency was accepted")
+	}
+}
+
+func BenchmarkEncodeParallel(b *testing.B) {
+	m := image.NewNRGBA(image.Rect(0, 0, 1920, 1080))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7 / 5)
+	}
+	enc := &Encoder{Concurrency: 4}
+	b.SetBytes(int64(len(m.Pix)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.Encode(ioutil.Discard, m)
+	}
+}
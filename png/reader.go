@@ -21,6 +21,7 @@ import (
 
 	"github.com/drswork/image"
 	"github.com/drswork/image/color"
+	"github.com/drswork/image/metadata"
 )
 
 // Color type, as per the PNG spec.
@@ -125,9 +126,20 @@ type decoder struct {
 	useTransparent   bool
 	transparent      [6]byte
 	seenColorProfile bool
+	seenEXIF         bool
 	metadata         *Metadata
 	paletteCount     int // number of entries in the PLTE chunk
-
+	// inIDAT is set when the most recently read chunk was an IDAT
+	// chunk.
+	inIDAT bool
+	// apng is set when DecodeAll is reading an animated PNG, and
+	// inFDAT is set while the image data is read from fdAT chunks
+	// rather than IDAT chunks.
+	apng   *apngDecoder
+	inFDAT bool
+	// streamRows is set when a RowReader is reading the image, and
+	// stops parseChunk at the start of the image data.
+	streamRows bool
 }
 
 // A FormatError reports that the input is not a valid PNG.
@@ -239,6 +251,7 @@ func (d *decoder) parseIHDR(ctx context.Context, length uint32) error {
 	}
 	d.width, d.height = int(w), int(h)
 	d.metadata.Width, d.metadata.Height = int(w), int(h)
+	d.metadata.depth, d.metadata.colorType = d.depth, d.ct
 	return d.verifyChecksum()
 }
 
@@ -358,6 +371,17 @@ func (d *decoder) Read(p []byte) (int, error) {
 			return 0, err
 		}
 		d.idatLength = binary.BigEndian.Uint32(d.tmp[:4])
+		if d.inFDAT {
+			if string(d.tmp[4:8]) != "fdAT" {
+				return 0, FormatError("not enough frame data")
+			}
+			d.crc.Reset()
+			d.crc.Write(d.tmp[4:8])
+			if err := d.readSequence(); err != nil {
+				return 0, err
+			}
+			continue
+		}
 		if string(d.tmp[4:8]) != "IDAT" {
 			return 0, FormatError("not enough pixel data")
 		}
@@ -403,22 +427,62 @@ func (d *decoder) decode(ctx context.Context) (image.Image, error) {
 		}
 	}
 
-	// Check for EOF, to verify the zlib checksum.
+	if err := d.checkPixelDataEnd(r); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// checkPixelDataEnd checks that r, the decompressed image data, has no
+// more data in it, which also verifies the zlib checksum.
+func (d *decoder) checkPixelDataEnd(r io.Reader) error {
 	n := 0
+	var err error
 	for i := 0; n == 0 && err == nil; i++ {
 		if i == 100 {
-			return nil, io.ErrNoProgress
+			return io.ErrNoProgress
 		}
 		n, err = r.Read(d.tmp[:1])
 	}
 	if err != nil && err != io.EOF {
-		return nil, FormatError(err.Error())
+		return FormatError(err.Error())
 	}
 	if n != 0 || d.idatLength != 0 {
-		return nil, FormatError("too much pixel data")
+		return FormatError("too much pixel data")
 	}
+	return nil
+}
 
-	return img, nil
+// unfilter reverses the filter of type ft applied to cdat, the bytes of
+// the current row. pdat holds the unfiltered bytes of the previous row.
+func unfilter(ft byte, cdat, pdat []byte, bytesPerPixel int) error {
+	switch ft {
+	case ftNone:
+		// No-op.
+	case ftSub:
+		for i := bytesPerPixel; i < len(cdat); i++ {
+			cdat[i] += cdat[i-bytesPerPixel]
+		}
+	case ftUp:
+		for i, p := range pdat {
+			cdat[i] += p
+		}
+	case ftAverage:
+		// The first column has no column to the left of it, so it is a
+		// special case. We know that the first column exists because
+		// rows are never empty, and so len(cdat) != 0.
+		for i := 0; i < bytesPerPixel; i++ {
+			cdat[i] += pdat[i] / 2
+		}
+		for i := bytesPerPixel; i < len(cdat); i++ {
+			cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
+		}
+	case ftPaeth:
+		filterPaeth(cdat, pdat, bytesPerPixel)
+	default:
+		return FormatError("bad filter type")
+	}
+	return nil
 }
 
 // readImagePass reads a single image pass, sized according to the pass number.
@@ -530,31 +594,8 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 		// Apply the filter.
 		cdat := cr[1:]
 		pdat := pr[1:]
-		switch cr[0] {
-		case ftNone:
-			// No-op.
-		case ftSub:
-			for i := bytesPerPixel; i < len(cdat); i++ {
-				cdat[i] += cdat[i-bytesPerPixel]
-			}
-		case ftUp:
-			for i, p := range pdat {
-				cdat[i] += p
-			}
-		case ftAverage:
-			// The first column has no column to the left of it, so it is a
-			// special case. We know that the first column exists because we
-			// check above that width != 0, and so len(cdat) != 0.
-			for i := 0; i < bytesPerPixel; i++ {
-				cdat[i] += pdat[i] / 2
-			}
-			for i := bytesPerPixel; i < len(cdat); i++ {
-				cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
-			}
-		case ftPaeth:
-			filterPaeth(cdat, pdat, bytesPerPixel)
-		default:
-			return nil, FormatError("bad filter type")
+		if err := unfilter(cr[0], cdat, pdat, bytesPerPixel); err != nil {
+			return nil, err
 		}
 
 		// Convert from bytes to colors.
@@ -854,6 +895,40 @@ func (d *decoder) mergePassInto(dst image.Image, src image.Image, pass int) {
 	}
 }
 
+// imageColorModel returns the color model of the image that decoding
+// the image data will produce.
+func (d *decoder) imageColorModel() color.Model {
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8:
+		if d.useTransparent {
+			return color.NRGBAModel
+		}
+		return color.GrayModel
+	case cbGA8, cbTCA8:
+		return color.NRGBAModel
+	case cbTC8:
+		if d.useTransparent {
+			return color.NRGBAModel
+		}
+		return color.RGBAModel
+	case cbP1, cbP2, cbP4, cbP8:
+		return d.palette
+	case cbG16:
+		if d.useTransparent {
+			return color.NRGBA64Model
+		}
+		return color.Gray16Model
+	case cbGA16, cbTCA16:
+		return color.NRGBA64Model
+	case cbTC16:
+		if d.useTransparent {
+			return color.NRGBA64Model
+		}
+		return color.RGBA64Model
+	}
+	return nil
+}
+
 func (d *decoder) parseIDAT(ctx context.Context, length uint32) (err error) {
 	d.idatLength = length
 	d.img, err = d.decode(ctx)
@@ -892,6 +967,8 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 	length := binary.BigEndian.Uint32(d.tmp[:4])
 	d.crc.Reset()
 	d.crc.Write(d.tmp[4:8])
+	prevIDAT := d.inIDAT
+	d.inIDAT = string(d.tmp[4:8]) == "IDAT"
 
 	// Read the chunk data.
 	switch string(d.tmp[4:8]) {
@@ -974,6 +1051,11 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT || (d.stage == dsSeenIHDR && cbPaletted(d.cb)) {
 			return chunkOrderError
 		} else if d.stage == dsSeenIDAT {
+			// A deferred image caches the IDAT chunks one at a time, so
+			// keep any that immediately follow the first one.
+			if parseImage == image.DeferData && prevIDAT {
+				return d.deferIDAT(ctx, length)
+			}
 			// Ignore trailing zero-length or garbage IDAT chunks.
 			//
 			// This does not affect valid PNG images that contain multiple IDAT
@@ -982,16 +1064,21 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 			break
 		}
 		d.stage = dsSeenIDAT
+		if d.streamRows {
+			// A RowReader reads the image data itself, a row at a time.
+			d.idatLength = length
+			return nil
+		}
 		switch parseImage {
 		case image.DiscardData:
 			return d.skipChunk(ctx, length)
 		case image.DeferData:
-			d.img.(*Deferred).idat, err = readData(ctx, d, length+4, false)
-			if err != nil {
+			return d.deferIDAT(ctx, length)
+		}
+		if d.apng != nil {
+			if err := d.apng.reserve(d, d.width, d.height); err != nil {
 				return err
 			}
-			fixChecksum(d.img.(*Deferred).idat)
-			return nil
 		}
 		return d.parseIDAT(ctx, length)
 	case "IEND":
@@ -1011,6 +1098,45 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 			return d.skipChunk(ctx, length)
 		}
 		return d.parseICCP(ctx, length)
+	case "acTL":
+		// Animation chunks are only read by DecodeAll. A deferred
+		// image keeps them as unknown chunks, so that writing it back
+		// out unchanged keeps the animation.
+		if d.apng == nil {
+			return d.keepAnimationChunk(ctx, length, parseImage, parseMetadata)
+		}
+		if d.stage >= dsSeenIDAT {
+			return chunkOrderError
+		}
+		return d.parseACTL(ctx, length)
+	case "fcTL":
+		if d.apng == nil {
+			return d.keepAnimationChunk(ctx, length, parseImage, parseMetadata)
+		}
+		if d.apng.numFrames == 0 {
+			return d.skipChunk(ctx, length)
+		}
+		return d.parseFCTL(ctx, length)
+	case "fdAT":
+		if d.apng == nil {
+			return d.keepAnimationChunk(ctx, length, parseImage, parseMetadata)
+		}
+		if d.apng.numFrames == 0 {
+			return d.skipChunk(ctx, length)
+		}
+		if d.stage != dsSeenIDAT {
+			return chunkOrderError
+		}
+		return d.parseFDAT(ctx, length)
+	case "eXIf":
+		if d.seenEXIF {
+			return FormatError("multiple eXIf chunks")
+		}
+		d.seenEXIF = true
+		if !parseMetadata {
+			return d.skipChunk(ctx, length)
+		}
+		return d.parseEXIF(ctx, length)
 	case "sRGB":
 		if d.seenColorProfile {
 			return multipleColorProfileError
@@ -1020,6 +1146,30 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 			return d.skipChunk(ctx, length)
 		}
 		return d.parseSRGB(ctx, length)
+	case "cICP":
+		if d.stage >= dsSeenPLTE {
+			return chunkOrderError
+		}
+		if !parseMetadata {
+			return d.skipChunk(ctx, length)
+		}
+		return d.parseCICP(ctx, length)
+	case "mDCv":
+		if d.stage >= dsSeenPLTE {
+			return chunkOrderError
+		}
+		if !parseMetadata {
+			return d.skipChunk(ctx, length)
+		}
+		return d.parseMDCV(ctx, length)
+	case "cLLi":
+		if d.stage >= dsSeenPLTE {
+			return chunkOrderError
+		}
+		if !parseMetadata {
+			return d.skipChunk(ctx, length)
+		}
+		return d.parseCLLI(ctx, length)
 	case "sBIT":
 		if !parseMetadata {
 			return d.skipChunk(ctx, length)
@@ -1040,6 +1190,14 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 			return d.skipChunk(ctx, length)
 		}
 		return d.parseTIME(ctx, length)
+	case "sPLT":
+		if d.stage >= dsSeenIDAT {
+			return chunkOrderError
+		}
+		if !parseMetadata {
+			return d.skipChunk(ctx, length)
+		}
+		return d.parseSPLT(ctx, length)
 	case "tEXt":
 		if !parseMetadata {
 			return d.skipChunk(ctx, length)
@@ -1075,9 +1233,22 @@ func (d *decoder) parseChunk(ctx context.Context, parseImage image.DecodingOptio
 	if length > 0x7fffffff {
 		return FormatError(fmt.Sprintf("Bad chunk length: %d", length))
 	}
+	// Trailing IDAT chunks end up here too, but aren't worth keeping.
+	if parseMetadata && !d.inIDAT {
+		return d.parseUnknown(ctx, length)
+	}
 	return d.skipChunk(ctx, length)
 }
 
+// keepAnimationChunk records an APNG chunk as an unknown chunk when
+// the image data is deferred, and skips it otherwise.
+func (d *decoder) keepAnimationChunk(ctx context.Context, length uint32, parseImage image.DecodingOption, parseMetadata bool) error {
+	if parseImage != image.DeferData || !parseMetadata {
+		return d.skipChunk(ctx, length)
+	}
+	return d.parseUnknown(ctx, length)
+}
+
 func (d *decoder) skipChunk(ctx context.Context, length uint32) error {
 	// Ignore this chunk (of a known length).
 	var ignored [4096]byte
@@ -1113,17 +1284,56 @@ func (d *decoder) checkHeader(ctx context.Context) error {
 	return nil
 }
 
-func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption) (image.Image, image.Metadata, error) {
-	if len(opts) > 1 {
-		return nil, nil, errors.New("Too many read options provided")
+// setMetadataColorModel sets the color model recorded in the metadata
+// from the image header.
+func (d *decoder) setMetadataColorModel() {
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8:
+		d.metadata.ColorModel = color.GrayModel
+	case cbGA8:
+		d.metadata.ColorModel = color.NRGBAModel
+	case cbTC8:
+		d.metadata.ColorModel = color.RGBAModel
+	case cbP1, cbP2, cbP4, cbP8:
+		d.metadata.ColorModel = d.palette
+	case cbTCA8:
+		d.metadata.ColorModel = color.NRGBAModel
+	case cbG16:
+		d.metadata.ColorModel = color.Gray16Model
+	case cbGA16:
+		d.metadata.ColorModel = color.NRGBA64Model
+	case cbTC16:
+		d.metadata.ColorModel = color.RGBA64Model
+	case cbTCA16:
+		d.metadata.ColorModel = color.NRGBA64Model
 	}
+}
+
+// DecodeExtended reads a PNG image and its metadata from r. It
+// accepts an image.DataDecodeOptions, and an image.ImageTransformOptions
+// whose ColorTransform converts an image with a cICP chunk to sRGB, or
+// from sRGB to the chunk's color space. A transform is an error if the
+// image data is deferred, or if the chunk's color primaries or
+// transfer function aren't supported. When metadata is decoded, an
+// eXIf chunk is decoded if an EXIF decoder is registered, and an error
+// decoding it is returned. When the image data is deferred, an APNG's
+// acTL, fcTL and fdAT chunks are kept in the metadata's UnknownChunks.
+func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption) (image.Image, image.Metadata, error) {
 	opt := image.DataDecodeOptions{}
-	if len(opts) == 1 {
-		o, ok := opts[0].(image.DataDecodeOptions)
-		if !ok {
+	var transform image.ImageTransformOptions
+	seen := false
+	for _, o := range opts {
+		switch o := o.(type) {
+		case image.DataDecodeOptions:
+			if seen {
+				return nil, nil, errors.New("Too many read options provided")
+			}
+			opt, seen = o, true
+		case image.ImageTransformOptions:
+			transform = o
+		default:
 			return nil, nil, errors.New("Unknown read option type provided")
 		}
-		opt = o
 	}
 
 	// If they ask for nothing then return nothing. This is currently
@@ -1171,43 +1381,46 @@ func DecodeExtended(ctx context.Context, r io.Reader, opts ...image.ReadOption)
 		}
 	}
 
-	switch d.cb {
-	case cbG1, cbG2, cbG4, cbG8:
-		d.metadata.ColorModel = color.GrayModel
-	case cbGA8:
-		d.metadata.ColorModel = color.NRGBAModel
-	case cbTC8:
-		d.metadata.ColorModel = color.RGBAModel
-	case cbP1, cbP2, cbP4, cbP8:
-		d.metadata.ColorModel = d.palette
-	case cbTCA8:
-		d.metadata.ColorModel = color.NRGBAModel
-	case cbG16:
-		d.metadata.ColorModel = color.Gray16Model
-	case cbGA16:
-		d.metadata.ColorModel = color.NRGBA64Model
-	case cbTC16:
-		d.metadata.ColorModel = color.RGBA64Model
-	case cbTCA16:
-		d.metadata.ColorModel = color.NRGBA64Model
+	if di, ok := d.img.(*Deferred); ok {
+		di.bounds = image.Rect(0, 0, d.width, d.height)
+		di.model = d.imageColorModel()
 	}
 
+	d.setMetadataColorModel()
+
 	// We read in all the metadata without decoding the expensive
 	// stuff. If the user wanted it decoded now then go decode it.
 	if opt.DecodeMetadata == image.DecodeData {
-		_, err := d.metadata.EXIF(ctx, opts...)
-		if err != nil {
-			return nil, nil, err
+		// EXIF is only decoded if there's a decoder to do it. Without
+		// one the raw block is kept, and is available from RawEXIF.
+		if metadata.EXIFDecoderRegistered() {
+			if _, err := d.metadata.EXIF(ctx, opts...); err != nil {
+				return nil, nil, err
+			}
 		}
 		// Right now we don't decode XMP by default because we can't
 		// _, err = d.metadata.XMP(ctx, opts...)
 		// if err != nil {
 		// 	return nil, nil, err
 		// }
-		_, err = d.metadata.ICC(ctx, opts...)
+		_, err := d.metadata.ICC(ctx, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Only the cICP chunk's color space is applied at present. Deferred
+	// image data is written back out as it was read, so it can't be
+	// transformed.
+	if transform.ColorTransform != image.NoImageTransform && d.metadata.CodingPoints != nil && d.img != nil {
+		if _, deferred := d.img.(*Deferred); deferred {
+			return nil, nil, UnsupportedError("color transform of deferred image data")
+		}
+		img, err := d.metadata.transformColors(d.img, transform.ColorTransform == image.ReverseImageTransform)
 		if err != nil {
 			return nil, nil, err
 		}
+		d.img = img
 	}
 
 	return d.img, d.metadata, nil
@@ -1239,4 +1452,6 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 
 func init() {
 	image.RegisterFormatExtended("png", pngHeader, DecodeExtended)
+	image.RegisterMIMEType("png", "image/png", ".png")
+	image.RegisterEncoder("png", EncodeExtended)
 }
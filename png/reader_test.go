@@ -8,7 +8,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
@@ -677,6 +679,63 @@ func TestMultipletRNSChunks(t *testing.T) {
 	}
 }
 
+// makeChunk returns a PNG chunk with the given type and data.
+func makeChunk(name string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], name)
+	b = append(b, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc[:]...)
+}
+
+func TestEXIFChunk(t *testing.T) {
+	// The 1x1 paletted image from TestMultipletRNSChunks.
+	const (
+		ihdr = "\x00\x00\x00\x0dIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x03\x00\x00\x00\x28\xcb\x34\xbb"
+		plte = "\x00\x00\x00\x03PLTE\xff\x00\x00\x19\xe2\x09\x37"
+		idat = "\x00\x00\x00\x0eIDAT\x78\x9c\x62\x62\x00\x04\x00\x00\xff\xff\x00\x06\x00\x03\xfa\xd0\x59\xae"
+		iend = "\x00\x00\x00\x00IEND\xae\x42\x60\x82"
+	)
+	for _, tc := range []struct {
+		desc    string
+		exif    []string
+		wantErr bool
+	}{
+		{"big endian", []string{"MM\x00*\x00\x00\x00\x08\x00\x00"}, false},
+		{"little endian", []string{"II*\x00\x08\x00\x00\x00\x00\x00"}, false},
+		{"bad header", []string{"Exif\x00\x00MM\x00*"}, true},
+		{"too short", []string{"MM\x00*"}, true},
+		{"two chunks", []string{"MM\x00*\x00\x00\x00\x08", "MM\x00*\x00\x00\x00\x08"}, true},
+	} {
+		var b []byte
+		b = append(b, pngHeader...)
+		b = append(b, ihdr...)
+		for _, x := range tc.exif {
+			b = append(b, makeChunk("eXIf", []byte(x))...)
+		}
+		b = append(b, plte...)
+		b = append(b, idat...)
+		b = append(b, iend...)
+
+		_, md, err := DecodeExtended(context.TODO(), bytes.NewReader(b), image.DataDecodeOptions{image.DecodeData, image.DeferData})
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got nil error, want non-nil", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got := md.(*Metadata).rawExif; string(got) != tc.exif[0] {
+			t.Errorf("%s: got EXIF %q, want %q", tc.desc, got, tc.exif[0])
+		}
+	}
+}
+
 func TestUnknownChunkLengthUnderflow(t *testing.T) {
 	data := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0xff, 0xff,
 		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x06, 0xf4, 0x7c, 0x55, 0x04, 0x1a,
@@ -0,0 +1,320 @@
+package png
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// grayScales maps a grayscale bit depth to the factor the decoder
+// multiplies samples by to expand them to 8 bits.
+var grayScales = map[int]uint8{1: 0xff, 2: 0x55, 4: 0x11, 8: 1}
+
+// reduction describes the pixels of a set of images, as they'd be
+// written with the color type picked by setColorType.
+type reduction struct {
+	// opaque is set if every pixel is opaque, and binaryAlpha if
+	// every pixel is either opaque or fully transparent.
+	opaque      bool
+	binaryAlpha bool
+	// key is the color of the first fully transparent pixel, and
+	// sameKey is set if every fully transparent pixel has that color.
+	key     *color.NRGBA64
+	sameKey bool
+	// gray is set if every pixel is a shade of gray, and eightBit if
+	// every sample fits in 8 bits.
+	gray     bool
+	eightBit bool
+	// grayDepth is the fewest bits that hold every gray level, if the
+	// pixels are gray and fit in 8 bits.
+	grayDepth int
+	// colors holds the distinct colors, or nil if there are more than
+	// 256 of them.
+	colors map[color.NRGBA64]bool
+}
+
+func (r *reduction) add(c color.NRGBA64) {
+	if c.A != 0xffff {
+		r.opaque = false
+		if c.A != 0 {
+			r.binaryAlpha = false
+		} else if r.key == nil {
+			r.key = &c
+		} else if c != *r.key {
+			r.sameKey = false
+		}
+	}
+	if c.R != c.G || c.G != c.B {
+		r.gray = false
+	}
+	for _, v := range [4]uint16{c.R, c.G, c.B, c.A} {
+		if v>>8 != v&0xff {
+			r.eightBit = false
+		}
+	}
+	if r.gray && r.eightBit {
+		for r.grayDepth < 8 && uint8(c.R)%grayScales[r.grayDepth] != 0 {
+			r.grayDepth *= 2
+		}
+	}
+	if r.colors != nil {
+		r.colors[c] = true
+		if len(r.colors) > 256 {
+			r.colors = nil
+		}
+	}
+}
+
+// writtenColor returns the color of the pixel at (x, y) in m as it's
+// written with color type and bit depth cb, with 8 bit samples scaled
+// to 16 bits.
+func writtenColor(m image.Image, cb int, x, y int) color.NRGBA64 {
+	switch cb {
+	case cbG8:
+		v := uint16(color.GrayModel.Convert(m.At(x, y)).(color.Gray).Y) * 0x101
+		return color.NRGBA64{v, v, v, 0xffff}
+	case cbG16:
+		v := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16).Y
+		return color.NRGBA64{v, v, v, 0xffff}
+	case cbTC8:
+		r, g, b, _ := m.At(x, y).RGBA()
+		return color.NRGBA64{uint16(r>>8) * 0x101, uint16(g>>8) * 0x101, uint16(b>>8) * 0x101, 0xffff}
+	case cbTC16:
+		r, g, b, _ := m.At(x, y).RGBA()
+		return color.NRGBA64{uint16(r), uint16(g), uint16(b), 0xffff}
+	case cbTCA16:
+		return color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+	}
+	// Truecolor with alpha and paletted images are written with 8 bit
+	// non-premultiplied samples.
+	c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+	return color.NRGBA64{uint16(c.R) * 0x101, uint16(c.G) * 0x101, uint16(c.B) * 0x101, uint16(c.A) * 0x101}
+}
+
+// usesColor reports whether any pixel of ms is written as c.
+func usesColor(ms []image.Image, cb int, c color.NRGBA64) bool {
+	for _, m := range ms {
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if writtenColor(m, cb, x, y) == c {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// paletteDepth returns the bit depth needed for a palette of n colors.
+func paletteDepth(n int) int {
+	switch {
+	case n <= 2:
+		return 1
+	case n <= 4:
+		return 2
+	case n <= 16:
+		return 4
+	}
+	return 8
+}
+
+// reduce scans the pixels of ms, which e.cb was picked for, and picks
+// the smallest color type and bit depth that holds every pixel
+// exactly. It sets e.cb and e.key, and returns the images converted to
+// a form writeImage can write with the new color type, along with the
+// palette if there is one.
+func (e *encoder) reduce(ms []image.Image) ([]image.Image, color.Palette) {
+	r := &reduction{
+		opaque:      true,
+		binaryAlpha: true,
+		sameKey:     true,
+		gray:        true,
+		eightBit:    true,
+		grayDepth:   1,
+		colors:      make(map[color.NRGBA64]bool),
+	}
+	for _, m := range ms {
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r.add(writtenColor(m, e.cb, x, y))
+			}
+		}
+	}
+
+	// A color key can stand in for an alpha channel if the transparent
+	// pixels all have the same color, and no opaque pixel has it.
+	useKey := false
+	if !r.opaque && r.binaryAlpha && r.sameKey {
+		k := *r.key
+		k.A = 0xffff
+		useKey = !usesColor(ms, e.cb, k)
+	}
+	usePalette := r.colors != nil && r.eightBit
+
+	cb := e.cb
+	switch {
+	case r.gray && (r.opaque || useKey) && usePalette && paletteDepth(len(r.colors)) < r.grayDepth:
+		cb = cbP8
+	case r.gray && (r.opaque || useKey):
+		cb = map[int]int{1: cbG1, 2: cbG2, 4: cbG4, 8: cbG8}[r.grayDepth]
+		if !r.eightBit {
+			cb = cbG16
+		}
+	case usePalette:
+		cb = cbP8
+	case r.gray && r.eightBit:
+		cb = cbGA8
+	case r.gray:
+		cb = cbGA16
+	case (r.opaque || useKey) && r.eightBit:
+		cb = cbTC8
+	case r.opaque || useKey:
+		cb = cbTC16
+	case r.eightBit:
+		cb = cbTCA8
+	default:
+		cb = cbTCA16
+	}
+
+	var pal color.Palette
+	index := make(map[color.NRGBA64]uint8)
+	if cb == cbP8 {
+		colors := make([]color.NRGBA64, 0, len(r.colors))
+		for c := range r.colors {
+			colors = append(colors, c)
+		}
+		// Transparent colors go first, so the tRNS chunk is short.
+		sort.Slice(colors, func(i, j int) bool {
+			a, b := colors[i], colors[j]
+			if (a.A == 0xffff) != (b.A == 0xffff) {
+				return b.A == 0xffff
+			}
+			if a.R != b.R {
+				return a.R < b.R
+			}
+			if a.G != b.G {
+				return a.G < b.G
+			}
+			if a.B != b.B {
+				return a.B < b.B
+			}
+			return a.A < b.A
+		})
+		for i, c := range colors {
+			pal = append(pal, color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)})
+			index[c] = uint8(i)
+		}
+		cb = map[int]int{1: cbP1, 2: cbP2, 4: cbP4, 8: cbP8}[paletteDepth(len(pal))]
+	}
+
+	out := make([]image.Image, len(ms))
+	for i, m := range ms {
+		b := m.Bounds()
+		var set func(x, y int, c color.NRGBA64)
+		switch cb {
+		case cbP1, cbP2, cbP4, cbP8:
+			p := image.NewPaletted(b, pal)
+			set = func(x, y int, c color.NRGBA64) { p.SetColorIndex(x, y, index[c]) }
+			out[i] = p
+		case cbG1, cbG2, cbG4, cbG8:
+			g := image.NewGray(b)
+			set = func(x, y int, c color.NRGBA64) { g.SetGray(x, y, color.Gray{uint8(c.R >> 8)}) }
+			out[i] = g
+		case cbG16:
+			g := image.NewGray16(b)
+			set = func(x, y int, c color.NRGBA64) { g.SetGray16(x, y, color.Gray16{c.R}) }
+			out[i] = g
+		case cbGA8, cbTC8, cbTCA8:
+			n := image.NewNRGBA(b)
+			set = func(x, y int, c color.NRGBA64) {
+				n.SetNRGBA(x, y, color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)})
+			}
+			out[i] = n
+		default:
+			n := image.NewNRGBA64(b)
+			set = func(x, y int, c color.NRGBA64) { n.SetNRGBA64(x, y, c) }
+			out[i] = n
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				set(x, y, writtenColor(m, e.cb, x, y))
+			}
+		}
+	}
+
+	e.key = nil
+	if useKey && !cbPaletted(cb) {
+		k := *r.key
+		switch cb {
+		case cbG1, cbG2, cbG4, cbG8:
+			e.key = make([]byte, 2)
+			e.key[1] = uint8(k.R>>8) / grayScales[r.grayDepth]
+		case cbG16:
+			e.key = make([]byte, 2)
+			binary.BigEndian.PutUint16(e.key, k.R)
+		case cbTC8:
+			e.key = []byte{0, uint8(k.R >> 8), 0, uint8(k.G >> 8), 0, uint8(k.B >> 8)}
+		case cbTC16:
+			e.key = make([]byte, 6)
+			binary.BigEndian.PutUint16(e.key[0:], k.R)
+			binary.BigEndian.PutUint16(e.key[2:], k.G)
+			binary.BigEndian.PutUint16(e.key[4:], k.B)
+		}
+	}
+	e.cb = cb
+	return out, pal
+}
+
+// optimize lowers the bit depth the images in ms are written with to
+// 8 bits, or reduces their color type and bit depth, if the encoder is
+// set to. It returns the images to write, the palette, and the
+// metadata to write. A histogram in the metadata is dropped if the
+// palette changes, since it counts the entries of the original
+// palette.
+func (e *encoder) optimize(ms []image.Image, pal color.Palette, metadata *Metadata) ([]image.Image, color.Palette, *Metadata) {
+	e.key = nil
+	if e.enc.eightBit {
+		switch e.cb {
+		case cbG16:
+			e.cb = cbG8
+		case cbTC16:
+			e.cb = cbTC8
+		case cbTCA16:
+			e.cb = cbTCA8
+		}
+	}
+	if !e.enc.Optimize {
+		return ms, pal, metadata
+	}
+	depth, ct := cbDepthAndType(e.cb)
+	out, newPal := e.reduce(ms)
+	if metadata != nil {
+		c := *metadata
+		// Significant bits and background colors not read from an
+		// image are relative to the color type picked before reducing.
+		if c.depth == 0 {
+			c.depth, c.colorType = depth, ct
+			if pal != nil {
+				c.ColorModel = pal
+			}
+		}
+		if c.Histogram != nil && (pal == nil || newPal == nil || !samePalette(pal, newPal)) {
+			c.Histogram = nil
+		}
+		metadata = &c
+	}
+	return out, newPal, metadata
+}
+
+// writeTRNSKey writes out a tRNS chunk holding the transparent color
+// key of a grayscale or truecolor image, if it has one.
+func (e *encoder) writeTRNSKey() {
+	if e.key == nil || e.err != nil {
+		return
+	}
+	e.writeChunk(e.key, "tRNS")
+}
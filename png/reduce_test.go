@@ -0,0 +1,145 @@
+package png
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+func TestOptimize(t *testing.T) {
+	r := image.Rect(0, 0, 40, 30)
+	newImage := func(f func(x, y int) color.Color) image.Image {
+		m := image.NewNRGBA64(r)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.Set(x, y, f(x, y))
+			}
+		}
+		return m
+	}
+	gray := func(v uint8) color.Color { return color.NRGBA{v, v, v, 0xff} }
+
+	for _, tc := range []struct {
+		desc      string
+		m         image.Image
+		depth, ct int
+		trns      bool
+	}{
+		{"1 bit gray", newImage(func(x, y int) color.Color { return gray(uint8((x + y) % 2 * 0xff)) }), 1, ctGrayscale, false},
+		{"2 bit gray", newImage(func(x, y int) color.Color { return gray(uint8(x % 4 * 0x55)) }), 2, ctGrayscale, false},
+		{"4 bit gray", newImage(func(x, y int) color.Color { return gray(uint8(x % 16 * 0x11)) }), 4, ctGrayscale, false},
+		{"8 bit gray", newImage(func(x, y int) color.Color { return gray(uint8(x*3 + y)) }), 8, ctGrayscale, false},
+		{"16 bit gray", newImage(func(x, y int) color.Color { return color.Gray16{uint16(x*y*31 + 1)} }), 16, ctGrayscale, false},
+		{"few grays", newImage(func(x, y int) color.Color { return gray([]uint8{3, 70, 200}[x%3]) }), 2, ctPaletted, false},
+		{"gray color key", newImage(func(x, y int) color.Color {
+			if x == y {
+				return color.Transparent
+			}
+			return gray(uint8(x*3 + y + 1))
+		}), 8, ctGrayscale, true},
+		{"gray alpha", newImage(func(x, y int) color.Color {
+			v := uint16(x*5) * 0x101
+			return color.NRGBA64{v, v, v, uint16(y*8) * 0x101}
+		}), 8, ctGrayscaleAlpha, false},
+		{"palette", newImage(func(x, y int) color.Color {
+			return []color.Color{color.Black, color.Transparent, color.NRGBA{0xff, 0, 0, 0x80}}[(x+y)%3]
+		}), 2, ctPaletted, true},
+		{"truecolor", newImage(func(x, y int) color.Color { return color.NRGBA{uint8(x), uint8(y), 7, 0xff} }), 8, ctTrueColor, false},
+		{"truecolor color key", newImage(func(x, y int) color.Color {
+			if x == y {
+				return color.Transparent
+			}
+			return color.NRGBA{uint8(x), uint8(y), 7, 0xff}
+		}), 8, ctTrueColor, true},
+		{"truecolor key in use", newImage(func(x, y int) color.Color {
+			if x == y+1 {
+				return color.Transparent
+			}
+			return color.NRGBA{uint8(x), uint8(y), 0, 0xff}
+		}), 8, ctTrueColorAlpha, false},
+		{"16 bit truecolor", newImage(func(x, y int) color.Color { return color.NRGBA64{uint16(x * 1001), uint16(y), 7, 0xffff} }), 16, ctTrueColor, false},
+		{"16 bit alpha", newImage(func(x, y int) color.Color { return color.NRGBA64{uint16(x * 1001), uint16(y), 7, uint16(x * y)} }), 16, ctTrueColorAlpha, false},
+	} {
+		var buf bytes.Buffer
+		enc := &Encoder{Optimize: true}
+		if err := enc.Encode(&buf, tc.m); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		b := buf.Bytes()
+		ihdr := b[len(pngHeader)+8:]
+		if depth, ct := int(ihdr[8]), int(ihdr[9]); depth != tc.depth || ct != tc.ct {
+			t.Errorf("%s: got depth %d, color type %d, want %d, %d", tc.desc, depth, ct, tc.depth, tc.ct)
+		}
+		if trns := strings.Contains(strings.Join(chunkNames(b), " "), "tRNS"); trns != tc.trns {
+			t.Errorf("%s: got tRNS chunk %t, want %t", tc.desc, trns, tc.trns)
+		}
+		got, err := Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if err := diff(tc.m, got); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestOptimizeMetadata(t *testing.T) {
+	ctx := context.TODO()
+	m := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+	md := &Metadata{
+		SignificantBits: &SignificantBits{Red: 8, Green: 8, Blue: 8},
+		Background:      &Background{Red: 0xff, Green: 0xff, Blue: 0xff},
+	}
+	var buf bytes.Buffer
+	if err := (&Encoder{Optimize: true}).EncodeExtended(ctx, &buf, m, md); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{image.DecodeData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := got.(*Metadata)
+	if want := (SignificantBits{Gray: 1}); *meta.SignificantBits != want {
+		t.Errorf("got significant bits %v, want %v", *meta.SignificantBits, want)
+	}
+	if want := (Background{Grey: 1}); *meta.Background != want {
+		t.Errorf("got background %v, want %v", *meta.Background, want)
+	}
+}
+
+func TestOptimizeAnimation(t *testing.T) {
+	ctx := context.TODO()
+	a := &APNG{DefaultIsFrame: true}
+	for i := 0; i < 3; i++ {
+		m := image.NewRGBA64(image.Rect(0, 0, 16, 16))
+		for j := range m.Pix {
+			m.Pix[j] = uint8(j/8%2*0xff + i*0)
+		}
+		a.Frames = append(a.Frames, &Frame{Image: m, DelayNum: 1, DelayDen: 10})
+	}
+	var buf bytes.Buffer
+	if err := (&Encoder{Optimize: true}).EncodeAll(ctx, &buf, a); err != nil {
+		t.Fatal(err)
+	}
+	if ihdr := buf.Bytes()[len(pngHeader)+8:]; ihdr[8] != 1 || ihdr[9] != ctGrayscale {
+		t.Errorf("got depth %d, color type %d, want 1 bit grayscale", ihdr[8], ihdr[9])
+	}
+	got, err := DecodeAll(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range got.Frames {
+		if err := diff(a.Frames[i].Image, f.Image); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+}
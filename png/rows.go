@@ -0,0 +1,676 @@
+package png
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// RowOptions are the png specific options for NewRowReader.
+type RowOptions struct {
+	// Deinterlace makes a RowReader return the rows of an interlaced
+	// image in order, top to bottom, rather than as the rows of each
+	// Adam7 pass. Doing so means holding the even numbered rows, about
+	// half the image, in memory.
+	Deinterlace bool
+}
+
+// IsImageReadOption is a no-op function which exists to satisfy the
+// ReadOption interface.
+func (RowOptions) IsImageReadOption() {
+}
+
+// RowReader reads the rows of a PNG image one at a time, so images
+// too large to hold in memory can be processed. Its use is similar to
+// bufio.Scanner:
+//
+//	rr, err := png.NewRowReader(ctx, f)
+//	if err != nil {
+//		return err
+//	}
+//	for rr.Next() {
+//		process(rr.Y(), rr.Row())
+//	}
+//	if err := rr.Err(); err != nil {
+//		return err
+//	}
+//
+// Rows are the unfiltered image data, in the PNG's own sample layout:
+// samples are BitDepth bits, big endian, with pixels of less than
+// eight bits packed into bytes starting from the most significant
+// bit. Paletted images hold palette indices.
+type RowReader struct {
+	ctx         context.Context
+	d           *decoder
+	z           io.ReadCloser
+	deinterlace bool
+
+	bitsPerPixel int
+	// cr and pr are the current and previous rows, including the
+	// filter type byte, sized for a full width row.
+	cr, pr []byte
+
+	// pass is the index into interlacing of the pass being read, and
+	// passY the number of rows of it read so far.
+	pass, passY int
+	// even holds the even numbered rows of a deinterlaced image, and
+	// nextY the next row of it to return.
+	even  [][]byte
+	nextY int
+
+	row  []byte
+	y    int
+	err  error
+	done bool
+}
+
+// NewRowReader reads the PNG header and the chunks before the image
+// data from r, and returns a RowReader for the image's rows. It
+// accepts image.LimitOptions, whose MaxImageSize limits the memory
+// used to hold rows, and RowOptions.
+func NewRowReader(ctx context.Context, r io.Reader, opts ...image.ReadOption) (*RowReader, error) {
+	var limits image.LimitOptions
+	var ro RowOptions
+	for _, o := range opts {
+		switch o := o.(type) {
+		case image.LimitOptions:
+			limits = o
+		case RowOptions:
+			ro = o
+		default:
+			return nil, errors.New("Unknown read option type provided")
+		}
+	}
+
+	d := &decoder{
+		r:          r,
+		crc:        crc32.NewIEEE(),
+		metadata:   &Metadata{},
+		streamRows: true,
+	}
+	if err := d.checkHeader(ctx); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	for d.stage != dsSeenIDAT {
+		if err := d.parseChunk(ctx, image.DecodeData, true); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	d.setMetadataColorModel()
+
+	rr := &RowReader{
+		ctx:          ctx,
+		d:            d,
+		deinterlace:  ro.Deinterlace && d.interlace == itAdam7,
+		bitsPerPixel: bitsPerPixel(d.cb),
+	}
+	rowSize := 1 + (rr.bitsPerPixel*d.width+7)/8
+	size := 2 * rowSize
+	if rr.deinterlace {
+		size += (d.height + 1) / 2 * (rowSize - 1)
+	}
+	if limits.MaxImageSize > 0 && size > limits.MaxImageSize {
+		return nil, fmt.Errorf("png: rows need more than %d bytes", limits.MaxImageSize)
+	}
+	rr.cr = make([]byte, rowSize)
+	rr.pr = make([]byte, rowSize)
+
+	z, err := zlib.NewReader(d)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rr.z = z
+	return rr, nil
+}
+
+// Metadata returns the image's metadata. Chunks that come after the
+// image data are only included once Next has returned false.
+func (rr *RowReader) Metadata() *Metadata {
+	return rr.d.metadata
+}
+
+// Width returns the width of the image.
+func (rr *RowReader) Width() int {
+	return rr.d.width
+}
+
+// Height returns the height of the image.
+func (rr *RowReader) Height() int {
+	return rr.d.height
+}
+
+// BitDepth returns the number of bits in each sample, or in each
+// palette index for a paletted image.
+func (rr *RowReader) BitDepth() int {
+	return rr.d.depth
+}
+
+// ColorType returns the image's color type.
+func (rr *RowReader) ColorType() ColorType {
+	return ColorType(rr.d.ct)
+}
+
+// Format returns the format of the image's rows, which can be passed
+// to NewRowWriter to write an image in the same format.
+func (rr *RowReader) Format() RowFormat {
+	return RowFormat{
+		Width:       rr.Width(),
+		Height:      rr.Height(),
+		ColorType:   rr.ColorType(),
+		BitDepth:    rr.BitDepth(),
+		Palette:     rr.Palette(),
+		Transparent: rr.transparent(),
+	}
+}
+
+// transparent returns the image's tRNS chunk data if it's a grayscale
+// or truecolor image with a transparent color.
+func (rr *RowReader) transparent() []byte {
+	d := rr.d
+	if !d.useTransparent {
+		return nil
+	}
+	if d.ct == ctTrueColor {
+		return append([]byte(nil), d.transparent[:6]...)
+	}
+	if d.depth < 8 {
+		// The decoder scales low bit depth gray up to 8 bits.
+		return []byte{0, d.transparent[1] / grayScales[d.depth]}
+	}
+	return append([]byte(nil), d.transparent[:2]...)
+}
+
+// Channels returns the number of samples in each pixel.
+func (rr *RowReader) Channels() int {
+	switch rr.d.ct {
+	case ctGrayscaleAlpha:
+		return 2
+	case ctTrueColor:
+		return 3
+	case ctTrueColorAlpha:
+		return 4
+	}
+	return 1
+}
+
+// Palette returns the palette of a paletted image, including any
+// transparency from a tRNS chunk, and nil for other images.
+func (rr *RowReader) Palette() color.Palette {
+	if !cbPaletted(rr.d.cb) {
+		return nil
+	}
+	return rr.d.palette
+}
+
+// Interlaced reports whether the image is Adam7 interlaced.
+func (rr *RowReader) Interlaced() bool {
+	return rr.d.interlace == itAdam7
+}
+
+// Next reads the next row, which is then available through Row. It
+// returns false once there are no more rows or there's an error.
+func (rr *RowReader) Next() bool {
+	if rr.done {
+		return false
+	}
+	select {
+	case <-rr.ctx.Done():
+		return rr.fail(rr.ctx.Err())
+	default:
+	}
+
+	if rr.deinterlace {
+		return rr.nextDeinterlaced()
+	}
+	for rr.passY >= rr.passHeight(rr.pass) {
+		rr.pass++
+		rr.passY = 0
+		if rr.pass >= rr.passes() {
+			return rr.finish()
+		}
+	}
+	row, err := rr.readRow(rr.pass, rr.passY)
+	if err != nil {
+		return rr.fail(err)
+	}
+	rr.row = row
+	rr.y = rr.passY
+	if rr.d.interlace == itAdam7 {
+		p := interlacing[rr.pass]
+		rr.y = p.yOffset + rr.passY*p.yFactor
+	}
+	rr.passY++
+	return true
+}
+
+// nextDeinterlaced reads the next row of an interlaced image in
+// order. All of the even rows are in passes one to six, and the odd
+// rows are the rows of pass seven, in order.
+func (rr *RowReader) nextDeinterlaced() bool {
+	if rr.even == nil {
+		if err := rr.readEvenRows(); err != nil {
+			return rr.fail(err)
+		}
+	}
+	if rr.nextY >= rr.d.height {
+		return rr.finish()
+	}
+	if rr.nextY%2 == 0 {
+		rr.row = rr.even[rr.nextY/2]
+		rr.even[rr.nextY/2] = nil
+	} else {
+		row, err := rr.readRow(6, rr.nextY/2)
+		if err != nil {
+			return rr.fail(err)
+		}
+		rr.row = row
+	}
+	rr.y = rr.nextY
+	rr.nextY++
+	return true
+}
+
+// readEvenRows reads passes one to six into rr.even.
+func (rr *RowReader) readEvenRows() error {
+	rowSize := (rr.bitsPerPixel*rr.d.width + 7) / 8
+	rr.even = make([][]byte, (rr.d.height+1)/2)
+	for i := range rr.even {
+		rr.even[i] = make([]byte, rowSize)
+	}
+	for pass := 0; pass < 6; pass++ {
+		p := interlacing[pass]
+		w := rr.passWidth(pass)
+		for y := 0; y < rr.passHeight(pass); y++ {
+			select {
+			case <-rr.ctx.Done():
+				return rr.ctx.Err()
+			default:
+			}
+			row, err := rr.readRow(pass, y)
+			if err != nil {
+				return err
+			}
+			dst := rr.even[(p.yOffset+y*p.yFactor)/2]
+			setPixels(dst, row, rr.bitsPerPixel, p.xOffset, p.xFactor, w)
+		}
+	}
+	return nil
+}
+
+// setPixels copies the n pixels in src into dst, at x0, x0+dx and so
+// on.
+func setPixels(dst, src []byte, bitsPerPixel, x0, dx, n int) {
+	if bitsPerPixel >= 8 {
+		b := bitsPerPixel / 8
+		for i := 0; i < n; i++ {
+			x := x0 + i*dx
+			copy(dst[x*b:(x+1)*b], src[i*b:(i+1)*b])
+		}
+		return
+	}
+	mask := byte(1<<uint(bitsPerPixel) - 1)
+	for i := 0; i < n; i++ {
+		s := i * bitsPerPixel
+		v := src[s/8] >> uint(8-bitsPerPixel-s%8) & mask
+		t := (x0 + i*dx) * bitsPerPixel
+		shift := uint(8 - bitsPerPixel - t%8)
+		dst[t/8] = dst[t/8]&^(mask<<shift) | v<<shift
+	}
+}
+
+// readRow reads and unfilters row y of a pass. The returned slice is
+// only valid until the next call.
+func (rr *RowReader) readRow(pass, y int) ([]byte, error) {
+	n := 1 + (rr.bitsPerPixel*rr.passWidth(pass)+7)/8
+	cr, pr := rr.cr[:n], rr.pr[:n]
+	if y == 0 {
+		for i := range pr {
+			pr[i] = 0
+		}
+	}
+	if _, err := io.ReadFull(rr.z, cr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, FormatError("not enough pixel data")
+		}
+		return nil, err
+	}
+	if err := unfilter(cr[0], cr[1:], pr[1:], (rr.bitsPerPixel+7)/8); err != nil {
+		return nil, err
+	}
+	rr.cr, rr.pr = rr.pr, rr.cr
+	return cr[1:], nil
+}
+
+// passes returns the number of passes in the image data.
+func (rr *RowReader) passes() int {
+	if rr.d.interlace == itAdam7 {
+		return len(interlacing)
+	}
+	return 1
+}
+
+// passWidth returns the width of a pass, in pixels.
+func (rr *RowReader) passWidth(pass int) int {
+	if rr.d.interlace != itAdam7 {
+		return rr.d.width
+	}
+	p := interlacing[pass]
+	return (rr.d.width - p.xOffset + p.xFactor - 1) / p.xFactor
+}
+
+// passHeight returns the number of rows in a pass. A pass with no
+// columns has no rows either.
+func (rr *RowReader) passHeight(pass int) int {
+	if rr.d.interlace != itAdam7 {
+		return rr.d.height
+	}
+	if rr.passWidth(pass) == 0 {
+		return 0
+	}
+	p := interlacing[pass]
+	return (rr.d.height - p.yOffset + p.yFactor - 1) / p.yFactor
+}
+
+// finish checks the end of the image data and reads the rest of the
+// chunks.
+func (rr *RowReader) finish() bool {
+	rr.done = true
+	rr.row = nil
+	d := rr.d
+	err := d.checkPixelDataEnd(rr.z)
+	if err == nil {
+		err = d.verifyChecksum()
+	}
+	for err == nil && d.stage != dsSeenIEND {
+		err = d.parseChunk(rr.ctx, image.DecodeData, true)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	rr.err = err
+	return false
+}
+
+func (rr *RowReader) fail(err error) bool {
+	rr.done = true
+	rr.row = nil
+	rr.err = err
+	return false
+}
+
+// Row returns the row read by the last call to Next. It is only valid
+// until the next call to Next.
+func (rr *RowReader) Row() []byte {
+	return rr.row
+}
+
+// Y returns the y coordinate of the row read by the last call to Next.
+func (rr *RowReader) Y() int {
+	return rr.y
+}
+
+// Pass returns the Adam7 pass, from one to seven, of the row read by
+// the last call to Next. It is zero for images that aren't interlaced
+// and for deinterlaced rows.
+func (rr *RowReader) Pass() int {
+	if rr.d.interlace != itAdam7 || rr.deinterlace {
+		return 0
+	}
+	return rr.pass + 1
+}
+
+// Columns returns the x coordinates of the pixels in the row read by
+// the last call to Next: pixel i is at x0 + i*dx. dx is only greater
+// than one for the rows of an Adam7 pass.
+func (rr *RowReader) Columns() (x0, dx int) {
+	if rr.Pass() == 0 {
+		return 0, 1
+	}
+	p := interlacing[rr.pass]
+	return p.xOffset, p.xFactor
+}
+
+// Err returns the error, if any, that stopped Next. It is nil once all
+// the rows and the chunks after them have been read.
+func (rr *RowReader) Err() error {
+	return rr.err
+}
+
+// ColorType is a PNG color type, which says which samples each pixel
+// has.
+type ColorType int
+
+const (
+	Grayscale      ColorType = ctGrayscale
+	TrueColor      ColorType = ctTrueColor
+	Paletted       ColorType = ctPaletted
+	GrayscaleAlpha ColorType = ctGrayscaleAlpha
+	TrueColorAlpha ColorType = ctTrueColorAlpha
+)
+
+// RowFormat describes the rows of an image written by a RowWriter.
+type RowFormat struct {
+	Width, Height int
+	ColorType     ColorType
+	// BitDepth is the number of bits in each sample, or in each
+	// palette index for a paletted image.
+	BitDepth int
+	// Palette is the palette of a Paletted image. Colors that aren't
+	// opaque are written to a tRNS chunk.
+	Palette color.Palette
+	// Transparent optionally holds the transparent color of a
+	// Grayscale or TrueColor image, as the contents of its tRNS chunk:
+	// the gray, or red, green and blue, samples as two byte big endian
+	// values.
+	Transparent []byte
+}
+
+// cb returns the color type and bit depth combination of the format,
+// or cbInvalid if PNG doesn't have it.
+func (f RowFormat) cb() int {
+	for cb := cbG1; cb <= cbTCA16; cb++ {
+		if depth, ct := cbDepthAndType(cb); depth == f.BitDepth && ct == int(f.ColorType) {
+			return cb
+		}
+	}
+	return cbInvalid
+}
+
+// RowWriter writes a PNG image one row at a time, so images too large
+// to hold in memory can be written. Only a few rows and the
+// compressor's state are kept in memory, and the image data is written
+// out in IDAT chunks as it fills them.
+type RowWriter struct {
+	ctx      context.Context
+	enc      *Encoder
+	e        *encoder
+	metadata *Metadata
+	format   RowFormat
+
+	cb           int
+	bitsPerPixel int
+	level        int
+	zw           *zlib.Writer
+	cr           [nFilter][]byte
+	pr           []byte
+
+	y      int
+	err    error
+	closed bool
+}
+
+// NewRowWriter starts writing a PNG image in the given format to w. See
+// Encoder.NewRowWriter.
+func NewRowWriter(ctx context.Context, w io.Writer, f RowFormat, opts ...image.WriteOption) (*RowWriter, error) {
+	var enc Encoder
+	return enc.NewRowWriter(ctx, w, f, opts...)
+}
+
+// NewRowWriter starts writing a PNG image in the given format to w,
+// and writes the chunks that come before the image data. It accepts
+// the same options as EncodeExtended, although the bit depth is always
+// the one in f. Rows are written with WriteRow, and the image is
+// finished with Close. Interlaced images can't be written row by row,
+// and the image data is always compressed on one goroutine.
+func (enc *Encoder) NewRowWriter(ctx context.Context, w io.Writer, f RowFormat, opts ...image.WriteOption) (*RowWriter, error) {
+	enc, metadata, err := enc.parseWriteOptions(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if enc.Interlace {
+		return nil, errors.New("png: interlaced images can't be written by a RowWriter")
+	}
+	cb := f.cb()
+	if cb == cbInvalid {
+		return nil, UnsupportedError(fmt.Sprintf("bit depth %d, color type %d", f.BitDepth, f.ColorType))
+	}
+	b := image.Rect(0, 0, f.Width, f.Height)
+	if f.Width <= 0 || f.Height <= 0 || int64(f.Width) >= 1<<31 || int64(f.Height) >= 1<<31 {
+		return nil, FormatError(fmt.Sprintf("invalid image size: %dx%d", f.Width, f.Height))
+	}
+	if n := len(f.Transparent); n != 0 && !(f.ColorType == Grayscale && n == 2) && !(f.ColorType == TrueColor && n == 6) {
+		return nil, FormatError(fmt.Sprintf("bad transparent color length: %d", n))
+	}
+	if cbPaletted(cb) && (len(f.Palette) == 0 || len(f.Palette) > 1<<uint(f.BitDepth)) {
+		return nil, FormatError(fmt.Sprintf("bad palette length: %d", len(f.Palette)))
+	}
+
+	e := enc.getEncoder()
+	e.setWriter(w)
+	e.cb = cb
+	if f.Transparent != nil {
+		e.key = append([]byte(nil), f.Transparent...)
+	}
+	rw := &RowWriter{
+		ctx:          ctx,
+		enc:          enc,
+		e:            e,
+		metadata:     metadata,
+		format:       f,
+		cb:           cb,
+		bitsPerPixel: bitsPerPixel(cb),
+		level:        levelToZlib(enc.CompressionLevel),
+	}
+
+	var pal color.Palette
+	if cbPaletted(cb) {
+		pal = f.Palette
+	}
+	_, e.err = io.WriteString(e.w, pngHeader)
+	e.writeIHDR(b)
+	e.writeMetadata(ctx, metadata, opts...)
+	e.writeUnknownChunks(metadata, ChunkBeforePLTE, true)
+	if pal != nil {
+		e.writePLTEAndTRNS(pal)
+	}
+	e.writeTRNSKey()
+	e.maybeWriteBKGD(metadata, pal)
+	e.maybeWriteHIST(metadata)
+	e.writeUnknownChunks(metadata, ChunkBeforeIDAT, true)
+	if e.err != nil {
+		enc.putEncoder(e)
+		return nil, e.err
+	}
+
+	size := enc.ChunkSize
+	if size <= 0 {
+		size = 1 << 15
+	}
+	if e.bw == nil || e.bw.Size() != size {
+		e.bw = bufio.NewWriterSize(e, size)
+	} else {
+		e.bw.Reset(e)
+	}
+	if rw.zw, err = zlib.NewWriterLevel(e.bw, rw.level); err != nil {
+		enc.putEncoder(e)
+		return nil, err
+	}
+	sz := 1 + (rw.bitsPerPixel*f.Width+7)/8
+	for i := range rw.cr {
+		rw.cr[i] = make([]byte, sz)
+		rw.cr[i][0] = uint8(i)
+	}
+	rw.pr = make([]byte, sz)
+	return rw, nil
+}
+
+// WriteRow filters, compresses and writes the next row of the image.
+// The row is in the layout returned by RowReader.Row: samples are
+// BitDepth bits, big endian, and pixels of less than eight bits are
+// packed into bytes starting from the most significant bit.
+func (rw *RowWriter) WriteRow(row []byte) error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.closed {
+		return errors.New("png: WriteRow called after Close")
+	}
+	select {
+	case <-rw.ctx.Done():
+		rw.err = rw.ctx.Err()
+		return rw.err
+	default:
+	}
+	if rw.y >= rw.format.Height {
+		return fmt.Errorf("png: more than %d rows written", rw.format.Height)
+	}
+	if len(row) != len(rw.pr)-1 {
+		return fmt.Errorf("png: row is %d bytes, want %d", len(row), len(rw.pr)-1)
+	}
+
+	cr := &rw.cr
+	copy(cr[0][1:], row)
+	f, err := rw.e.applyFilter(cr, rw.pr, rw.cb, rw.bitsPerPixel, rw.level)
+	if err == nil {
+		_, err = rw.zw.Write(cr[f])
+	}
+	if err != nil {
+		rw.err = err
+		return err
+	}
+	rw.pr, cr[0] = cr[0], rw.pr
+	rw.y++
+	return nil
+}
+
+// Close finishes the image data and writes the chunks that come after
+// it. It's an error to close a RowWriter before all the rows have been
+// written. Close doesn't close the underlying writer.
+func (rw *RowWriter) Close() error {
+	if rw.closed {
+		return rw.err
+	}
+	rw.closed = true
+	e := rw.e
+	defer rw.enc.putEncoder(e)
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.y != rw.format.Height {
+		rw.err = fmt.Errorf("png: %d of %d rows written", rw.y, rw.format.Height)
+		return rw.err
+	}
+	if e.err = rw.zw.Close(); e.err == nil {
+		e.err = e.bw.Flush()
+	}
+	e.writeUnknownChunks(rw.metadata, ChunkAfterIDAT, true)
+	e.writeIEND()
+	rw.err = e.err
+	return rw.err
+}
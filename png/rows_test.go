@@ -0,0 +1,252 @@
+package png
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/drswork/image"
+	"github.com/drswork/image/color"
+)
+
+// readRows reads all the rows of a PNG, putting the pixels of pass rows
+// back in their place in the image.
+func readRows(t *testing.T, b []byte, opts ...image.ReadOption) [][]byte {
+	rr, err := NewRowReader(context.Background(), bytes.NewReader(b), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitsPerPixel := rr.BitDepth() * rr.Channels()
+	rows := make([][]byte, rr.Height())
+	for i := range rows {
+		rows[i] = make([]byte, (bitsPerPixel*rr.Width()+7)/8)
+	}
+	for rr.Next() {
+		x0, dx := rr.Columns()
+		n := (rr.Width() - x0 + dx - 1) / dx
+		setPixels(rows[rr.Y()], rr.Row(), bitsPerPixel, x0, dx, n)
+	}
+	if err := rr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestRowReader(t *testing.T) {
+	var ms []image.Image
+	for _, fn := range filenames {
+		f, err := os.Open("testdata/pngsuite/" + fn + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		ms = append(ms, m)
+	}
+	// Small images, with empty passes.
+	p := image.NewPaletted(image.Rect(0, 0, 7, 5), color.Palette{color.Black, color.White})
+	for i := range p.Pix {
+		p.Pix[i] = uint8(i % 3 % 2)
+	}
+	ms = append(ms, p, p.SubImage(image.Rect(0, 0, 1, 1)), p.SubImage(image.Rect(0, 0, 3, 2)))
+
+	for i, m := range ms {
+		var plain, interlaced bytes.Buffer
+		if err := Encode(&plain, m); err != nil {
+			t.Fatal(err)
+		}
+		enc := Encoder{Interlace: true}
+		if err := enc.Encode(&interlaced, m); err != nil {
+			t.Fatal(err)
+		}
+		want := readRows(t, plain.Bytes())
+		for _, opts := range [][]image.ReadOption{nil, {RowOptions{Deinterlace: true}}} {
+			got := readRows(t, interlaced.Bytes(), opts...)
+			for y := range want {
+				if !bytes.Equal(got[y], want[y]) {
+					t.Errorf("image %d, options %v: row %d is %x, want %x", i, opts, y, got[y], want[y])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestRowReaderOrder(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 9, 9))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	var b bytes.Buffer
+	enc := Encoder{Interlace: true}
+	if err := enc.Encode(&b, m); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := NewRowReader(context.Background(), bytes.NewReader(b.Bytes()), RowOptions{Deinterlace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	y := 0
+	for rr.Next() {
+		if rr.Y() != y || rr.Pass() != 0 || !bytes.Equal(rr.Row(), m.Pix[y*9:y*9+9]) {
+			t.Fatalf("got row %d %x in pass %d, want row %d %x", rr.Y(), rr.Row(), rr.Pass(), y, m.Pix[y*9:y*9+9])
+		}
+		y++
+	}
+	if err := rr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if y != 9 {
+		t.Errorf("got %d rows, want 9", y)
+	}
+}
+
+func TestRowReaderMetadata(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 4, 4))
+	var b bytes.Buffer
+	gamma := uint32(45455)
+	md := &Metadata{
+		Gamma: &gamma,
+		Text:  []*TextEntry{{Key: "Comment", Value: "after", EntryType: EtText}},
+	}
+	if err := EncodeExtended(context.Background(), &b, m, md); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := NewRowReader(context.Background(), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := rr.Metadata().Gamma; g == nil || *g != gamma {
+		t.Errorf("gamma is %v before the first row, want %d", g, gamma)
+	}
+	if rr.Metadata().ColorModel != color.GrayModel {
+		t.Errorf("color model is %v, want gray", rr.Metadata().ColorModel)
+	}
+	for rr.Next() {
+	}
+	if err := rr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rr.Metadata().Text) != 1 {
+		t.Errorf("got %d text entries, want 1", len(rr.Metadata().Text))
+	}
+}
+
+func TestRowReaderErrors(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 64, 64))
+	var b bytes.Buffer
+	enc := Encoder{Interlace: true}
+	if err := enc.Encode(&b, m); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rr, err := NewRowReader(ctx, bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.Next()
+	cancel()
+	if rr.Next() {
+		t.Error("Next returned a row after cancellation")
+	}
+	if rr.Err() != context.Canceled {
+		t.Errorf("got error %v, want %v", rr.Err(), context.Canceled)
+	}
+
+	opts := []image.ReadOption{image.LimitOptions{MaxImageSize: 1000}, RowOptions{Deinterlace: true}}
+	if _, err := NewRowReader(context.Background(), bytes.NewReader(b.Bytes()), opts...); err == nil {
+		t.Error("deinterlacing beyond MaxImageSize succeeded")
+	}
+	if _, err := NewRowReader(context.Background(), bytes.NewReader(b.Bytes()), opts[0]); err != nil {
+		t.Errorf("streaming within MaxImageSize failed: %v", err)
+	}
+
+	rr, err = NewRowReader(context.Background(), bytes.NewReader(b.Bytes()[:b.Len()-40]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rr.Next() {
+	}
+	if rr.Err() == nil {
+		t.Error("truncated image data was accepted")
+	}
+}
+
+func TestRowWriter(t *testing.T) {
+	ctx := context.Background()
+	for _, fn := range append(filenames, filenamesPaletted...) {
+		b, err := ioutil.ReadFile("testdata/pngsuite/" + fn + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr, err := NewRowReader(ctx, bytes.NewReader(b), RowOptions{Deinterlace: true})
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		var out bytes.Buffer
+		rw, err := NewRowWriter(ctx, &out, rr.Format(), rr.Metadata(), &Options{ChunkSize: 100})
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		for rr.Next() {
+			if err := rw.WriteRow(rr.Row()); err != nil {
+				t.Fatal(fn, err)
+			}
+		}
+		if err := rr.Err(); err != nil {
+			t.Fatal(fn, err)
+		}
+		if err := rw.Close(); err != nil {
+			t.Fatal(fn, err)
+		}
+
+		want, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		got, err := Decode(&out)
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		if err := diff(got, want); err != nil {
+			t.Errorf("%s: %v", fn, err)
+		}
+	}
+}
+
+func TestRowWriterErrors(t *testing.T) {
+	ctx := context.Background()
+	f := RowFormat{Width: 3, Height: 2, ColorType: Grayscale, BitDepth: 8}
+	for _, bad := range []RowFormat{
+		{Width: 3, Height: 2, ColorType: Grayscale, BitDepth: 3},
+		{Width: 3, Height: 2, ColorType: Paletted, BitDepth: 8},
+		{Width: 0, Height: 2, ColorType: Grayscale, BitDepth: 8},
+	} {
+		if _, err := NewRowWriter(ctx, ioutil.Discard, bad); err == nil {
+			t.Errorf("format %+v was accepted", bad)
+		}
+	}
+	if _, err := NewRowWriter(ctx, ioutil.Discard, f, &Options{Interlace: true}); err == nil {
+		t.Error("interlacing was accepted")
+	}
+
+	rw, err := NewRowWriter(ctx, ioutil.Discard, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.WriteRow(make([]byte, 4)); err == nil {
+		t.Error("a row of the wrong length was accepted")
+	}
+	if err := rw.WriteRow(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Close(); err == nil {
+		t.Error("closing with a missing row succeeded")
+	}
+}
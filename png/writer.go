@@ -7,12 +7,15 @@ package png
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/zlib"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
 	"strconv"
 
 	"github.com/drswork/image"
@@ -23,9 +26,45 @@ import (
 type Encoder struct {
 	CompressionLevel CompressionLevel
 
+	// ChunkSize is the maximum number of bytes of compressed image
+	// data written to each IDAT chunk. If zero, image data is written
+	// in 32KB chunks, and deferred images keep the IDAT chunk
+	// boundaries they were read with.
+	ChunkSize int
+
 	// BufferPool optionally specifies a buffer pool to get temporary
 	// EncoderBuffers when encoding an image.
 	BufferPool EncoderBufferPool
+
+	// Filter selects how the filter applied to each row of image data
+	// is picked. The zero value is FilterDefault.
+	Filter FilterStrategy
+
+	// Concurrency is the number of goroutines used to filter and
+	// compress image data. If zero or one the image data is compressed
+	// on the calling goroutine. Otherwise large images are split into
+	// up to that many bands of rows, which are compressed in parallel
+	// and joined into one zlib stream. The output is slightly larger
+	// than with a single goroutine.
+	Concurrency int
+
+	// Interlace selects Adam7 interlacing, which lets decoders show
+	// a low resolution version of the image before all of it has
+	// been read. Interlaced images are usually larger. Deferred images
+	// keep the interlacing they were read with.
+	Interlace bool
+
+	// Optimize makes the encoder scan the image's pixels and write it
+	// with the smallest color type and bit depth that holds every
+	// pixel exactly, such as a palette, low bit depth grayscale, or a
+	// transparent color key in place of an alpha channel. It's slower,
+	// and deferred images are always written as they were read.
+	Optimize bool
+
+	// eightBit and limits are set from the Options and LimitOptions
+	// passed to EncodeExtended or EncodeAll.
+	eightBit bool
+	limits   image.LimitOptions
 }
 
 // EncoderBufferPool is an interface for getting and returning temporary
@@ -44,6 +83,8 @@ type encoder struct {
 	w       io.Writer
 	m       image.Image
 	cb      int
+	depth   int
+	ct      int
 	err     error
 	header  [8]byte
 	footer  [4]byte
@@ -53,6 +94,23 @@ type encoder struct {
 	zw      *zlib.Writer
 	zwLevel int
 	bw      *bufio.Writer
+
+	// fw compresses trial rows for FilterBruteForce.
+	fw      *flate.Writer
+	fwLevel int
+
+	// When fdat is set image data is written to fdAT chunks rather
+	// than IDAT chunks. seq is the next APNG sequence number.
+	fdat bool
+	seq  uint32
+	fbuf []byte
+
+	// key holds the tRNS chunk data for a grayscale or truecolor image
+	// written with a transparent color key.
+	key []byte
+
+	// metaSize is the number of bytes of metadata chunks written.
+	metaSize int
 }
 
 type CompressionLevel int
@@ -67,6 +125,34 @@ const (
 	// compression level, although that is not implemented yet.
 )
 
+// FilterStrategy selects how the encoder picks the filter applied to
+// each row of image data. Strategies that try more filters can give
+// smaller files at the cost of encoding time.
+type FilterStrategy int
+
+const (
+	// FilterDefault uses FilterAdaptive, except for paletted images
+	// and images written with NoCompression, which use FilterNone.
+	FilterDefault FilterStrategy = iota
+	// FilterNone, FilterSub, FilterUp, FilterAverage and FilterPaeth
+	// apply the same filter to every row.
+	FilterNone
+	FilterSub
+	FilterUp
+	FilterAverage
+	FilterPaeth
+	// FilterAdaptive picks the filter for each row that minimizes the
+	// sum of absolute differences, as libpng does.
+	FilterAdaptive
+	// FilterEntropy picks the filter for each row that minimizes the
+	// entropy of the filtered bytes.
+	FilterEntropy
+	// FilterBruteForce compresses each row with every filter and picks
+	// the one giving the smallest output. It's much slower than the
+	// other strategies.
+	FilterBruteForce
+)
+
 type opaquer interface {
 	Opaque() bool
 }
@@ -105,6 +191,13 @@ func (e *encoder) writeChunk(b []byte, name string) {
 		e.err = UnsupportedError(name + " chunk is too large: " + strconv.Itoa(len(b)))
 		return
 	}
+	if max := e.enc.limits.MaxMetadataSize; max > 0 && isMetadataChunk(name) {
+		e.metaSize += len(b)
+		if e.metaSize > max {
+			e.err = fmt.Errorf("png: metadata larger than %d bytes", max)
+			return
+		}
+	}
 	binary.BigEndian.PutUint32(e.header[:4], n)
 	e.header[4] = name[0]
 	e.header[5] = name[1]
@@ -126,46 +219,58 @@ func (e *encoder) writeChunk(b []byte, name string) {
 	_, e.err = e.w.Write(e.footer[:4])
 }
 
-func (e *encoder) writeIHDR() {
-	b := e.m.Bounds()
-	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(b.Dx()))
-	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(b.Dy()))
-	// Set bit depth and color type.
-	switch e.cb {
+// cbDepthAndType returns the bit depth and PNG color type for the
+// color type and bit depth combination cb.
+func cbDepthAndType(cb int) (depth, ct int) {
+	switch cb {
+	case cbG1:
+		return 1, ctGrayscale
+	case cbG2:
+		return 2, ctGrayscale
+	case cbG4:
+		return 4, ctGrayscale
 	case cbG8:
-		e.tmp[8] = 8
-		e.tmp[9] = ctGrayscale
+		return 8, ctGrayscale
+	case cbG16:
+		return 16, ctGrayscale
+	case cbGA8:
+		return 8, ctGrayscaleAlpha
+	case cbGA16:
+		return 16, ctGrayscaleAlpha
 	case cbTC8:
-		e.tmp[8] = 8
-		e.tmp[9] = ctTrueColor
-	case cbP8:
-		e.tmp[8] = 8
-		e.tmp[9] = ctPaletted
-	case cbP4:
-		e.tmp[8] = 4
-		e.tmp[9] = ctPaletted
-	case cbP2:
-		e.tmp[8] = 2
-		e.tmp[9] = ctPaletted
+		return 8, ctTrueColor
+	case cbTC16:
+		return 16, ctTrueColor
 	case cbP1:
-		e.tmp[8] = 1
-		e.tmp[9] = ctPaletted
+		return 1, ctPaletted
+	case cbP2:
+		return 2, ctPaletted
+	case cbP4:
+		return 4, ctPaletted
+	case cbP8:
+		return 8, ctPaletted
 	case cbTCA8:
-		e.tmp[8] = 8
-		e.tmp[9] = ctTrueColorAlpha
-	case cbG16:
-		e.tmp[8] = 16
-		e.tmp[9] = ctGrayscale
-	case cbTC16:
-		e.tmp[8] = 16
-		e.tmp[9] = ctTrueColor
+		return 8, ctTrueColorAlpha
 	case cbTCA16:
-		e.tmp[8] = 16
-		e.tmp[9] = ctTrueColorAlpha
+		return 16, ctTrueColorAlpha
 	}
+	return 0, 0
+}
+
+// writeIHDR writes the IHDR chunk for an image with bounds b.
+func (e *encoder) writeIHDR(b image.Rectangle) {
+	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(b.Dy()))
+	// Set bit depth and color type.
+	depth, ct := cbDepthAndType(e.cb)
+	e.tmp[8], e.tmp[9] = uint8(depth), uint8(ct)
 	e.tmp[10] = 0 // default compression method
 	e.tmp[11] = 0 // default filter method
-	e.tmp[12] = 0 // non-interlaced
+	e.tmp[12] = itNone
+	if e.enc.Interlace {
+		e.tmp[12] = itAdam7
+	}
+	e.depth, e.ct = int(e.tmp[8]), int(e.tmp[9])
 	e.writeChunk(e.tmp[:13], "IHDR")
 }
 
@@ -198,7 +303,15 @@ func (e *encoder) writePLTEAndTRNS(p color.Palette) {
 // This method should only be called from writeIDATs (via writeImage).
 // No other code should treat an encoder as an io.Writer.
 func (e *encoder) Write(b []byte) (int, error) {
-	e.writeChunk(b, "IDAT")
+	if e.fdat {
+		e.fbuf = append(e.fbuf[:0], 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(e.fbuf, e.seq)
+		e.seq++
+		e.fbuf = append(e.fbuf, b...)
+		e.writeChunk(e.fbuf, "fdAT")
+	} else {
+		e.writeChunk(b, "IDAT")
+	}
 	if e.err != nil {
 		return 0, e.err
 	}
@@ -298,6 +411,106 @@ func filter(cr *[nFilter][]byte, pr []byte, bpp int) int {
 	return filter
 }
 
+// filterRow fills cr[f] with the current row, cr[0], filtered with
+// filter type f.
+func filterRow(cr *[nFilter][]byte, pr []byte, bpp int, f int) {
+	cdat0 := cr[0][1:]
+	cdat := cr[f][1:]
+	pdat := pr[1:]
+	n := len(cdat0)
+
+	switch f {
+	case ftSub:
+		for i := 0; i < bpp; i++ {
+			cdat[i] = cdat0[i]
+		}
+		for i := bpp; i < n; i++ {
+			cdat[i] = cdat0[i] - cdat0[i-bpp]
+		}
+	case ftUp:
+		for i := 0; i < n; i++ {
+			cdat[i] = cdat0[i] - pdat[i]
+		}
+	case ftAverage:
+		for i := 0; i < bpp; i++ {
+			cdat[i] = cdat0[i] - pdat[i]/2
+		}
+		for i := bpp; i < n; i++ {
+			cdat[i] = cdat0[i] - uint8((int(cdat0[i-bpp])+int(pdat[i]))/2)
+		}
+	case ftPaeth:
+		for i := 0; i < bpp; i++ {
+			cdat[i] = cdat0[i] - pdat[i]
+		}
+		for i := bpp; i < n; i++ {
+			cdat[i] = cdat0[i] - paeth(cdat0[i-bpp], pdat[i], pdat[i-bpp])
+		}
+	}
+}
+
+// entropyFilter applies every filter to the current row and returns
+// the one whose filtered bytes have the lowest entropy.
+func entropyFilter(cr *[nFilter][]byte, pr []byte, bpp int) int {
+	best, filter := 0.0, ftNone
+	for f := 0; f < nFilter; f++ {
+		filterRow(cr, pr, bpp, f)
+		var counts [256]int
+		for _, b := range cr[f][1:] {
+			counts[b]++
+		}
+		// The entropy is lowest where the sum of c*log(c) is highest,
+		// as each filter gives the same number of bytes.
+		sum := 0.0
+		for _, c := range counts {
+			if c > 1 {
+				sum += float64(c) * math.Log2(float64(c))
+			}
+		}
+		if f == ftNone || sum > best {
+			best, filter = sum, f
+		}
+	}
+	return filter
+}
+
+// bruteForceFilter applies every filter to the current row, compresses
+// each result on its own, and returns the filter giving the fewest
+// bytes.
+func (e *encoder) bruteForceFilter(cr *[nFilter][]byte, pr []byte, bpp int, level int) (int, error) {
+	if e.fw == nil || e.fwLevel != level {
+		fw, err := flate.NewWriter(ioutil.Discard, level)
+		if err != nil {
+			return 0, err
+		}
+		e.fw = fw
+		e.fwLevel = level
+	}
+	best, filter := 0, ftNone
+	for f := 0; f < nFilter; f++ {
+		filterRow(cr, pr, bpp, f)
+		var c countingWriter
+		e.fw.Reset(&c)
+		if _, err := e.fw.Write(cr[f]); err != nil {
+			return 0, err
+		}
+		if err := e.fw.Close(); err != nil {
+			return 0, err
+		}
+		if f == ftNone || int(c) < best {
+			best, filter = int(c), f
+		}
+	}
+	return filter, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
 func zeroMemory(v []uint8) {
 	for i := range v {
 		v[i] = 0
@@ -305,6 +518,15 @@ func zeroMemory(v []uint8) {
 }
 
 func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) error {
+	passes := []image.Image{m}
+	if e.enc.Interlace {
+		passes = adam7Passes(m)
+	}
+	if e.enc.Concurrency > 1 {
+		if bands := e.bands(passes); len(bands) > 1 {
+			return e.writeImageParallel(w, bands, cb, level)
+		}
+	}
 	if e.zw == nil || e.zwLevel != level {
 		zw, err := zlib.NewWriterLevel(w, level)
 		if err != nil {
@@ -317,30 +539,47 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) erro
 	}
 	defer e.zw.Close()
 
-	bitsPerPixel := 0
+	for _, p := range passes {
+		b := p.Bounds()
+		if err := e.writeRows(e.zw, p, cb, level, b.Min.Y, b.Max.Y); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// bitsPerPixel returns the number of bits used for each pixel with
+// the color type and bit depth cb.
+func bitsPerPixel(cb int) int {
 	switch cb {
-	case cbG8:
-		bitsPerPixel = 8
+	case cbG1, cbP1:
+		return 1
+	case cbG2, cbP2:
+		return 2
+	case cbG4, cbP4:
+		return 4
+	case cbG8, cbP8:
+		return 8
+	case cbG16, cbGA8:
+		return 16
+	case cbGA16:
+		return 32
 	case cbTC8:
-		bitsPerPixel = 24
-	case cbP8:
-		bitsPerPixel = 8
-	case cbP4:
-		bitsPerPixel = 4
-	case cbP2:
-		bitsPerPixel = 2
-	case cbP1:
-		bitsPerPixel = 1
+		return 24
 	case cbTCA8:
-		bitsPerPixel = 32
+		return 32
 	case cbTC16:
-		bitsPerPixel = 48
+		return 48
 	case cbTCA16:
-		bitsPerPixel = 64
-	case cbG16:
-		bitsPerPixel = 16
+		return 64
 	}
+	return 0
+}
+
+// writeRows filters the rows of m from y0 up to but not including y1,
+// and writes them to w.
+func (e *encoder) writeRows(w io.Writer, m image.Image, cb int, level int, y0, y1 int) error {
+	bitsPerPixel := bitsPerPixel(cb)
 
 	// cr[*] and pr are the bytes for the current and previous row.
 	// cr[0] is unfiltered (or equivalently, filtered with the ftNone filter).
@@ -366,159 +605,232 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) erro
 	}
 	pr := e.pr
 
+	// Rows not at the top of the image are filtered against the row
+	// above them, even when that row isn't written here.
+	if y0 > b.Min.Y {
+		fillRow(pr, m, cb, bitsPerPixel, y0-1)
+	}
+
+	for y := y0; y < y1; y++ {
+		fillRow(cr[0], m, cb, bitsPerPixel, y)
+
+		// Apply the filter.
+		f, err := e.applyFilter(&cr, pr, cb, bitsPerPixel, level)
+		if err != nil {
+			return err
+		}
+
+		// Write the compressed bytes.
+		if _, err := w.Write(cr[f]); err != nil {
+			return err
+		}
+
+		// The current row for y is the previous row for y+1.
+		pr, cr[0] = cr[0], pr
+	}
+	return nil
+}
+
+// applyFilter picks the filter for the row in cr[0], using the
+// encoder's filter strategy, and applies it. It returns the index of
+// the filter, which is also the index of the filtered row in cr.
+func (e *encoder) applyFilter(cr *[nFilter][]byte, pr []byte, cb int, bitsPerPixel int, level int) (int, error) {
+	// Skip filter for NoCompression and paletted images (cbP8) as
+	// "filters are rarely useful on palette images" and will result
+	// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
+	f := ftNone
+	// Filters work on whole bytes, so images with fewer than 8
+	// bits per pixel use a bpp of 1.
+	bpp := (bitsPerPixel + 7) / 8
+	switch s := e.enc.Filter; s {
+	case FilterDefault:
+		if level != zlib.NoCompression && !cbPaletted(cb) {
+			f = filter(cr, pr, bpp)
+		}
+	case FilterNone, FilterSub, FilterUp, FilterAverage, FilterPaeth:
+		f = int(s-FilterNone) + ftNone
+		filterRow(cr, pr, bpp, f)
+	case FilterAdaptive:
+		f = filter(cr, pr, bpp)
+	case FilterEntropy:
+		f = entropyFilter(cr, pr, bpp)
+	case FilterBruteForce:
+		return e.bruteForceFilter(cr, pr, bpp, level)
+	}
+	return f, nil
+}
+
+// fillRow converts row y of m to bytes, and stores them after the
+// filter type byte at the start of row.
+func fillRow(row []byte, m image.Image, cb int, bitsPerPixel int, y int) {
+	b := m.Bounds()
 	gray, _ := m.(*image.Gray)
 	rgba, _ := m.(*image.RGBA)
 	paletted, _ := m.(*image.Paletted)
 	nrgba, _ := m.(*image.NRGBA)
+	nrgba64, _ := m.(*image.NRGBA64)
 
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		// Convert from colors to bytes.
-		i := 1
-		switch cb {
-		case cbG8:
-			if gray != nil {
-				offset := (y - b.Min.Y) * gray.Stride
-				copy(cr[0][1:], gray.Pix[offset:offset+b.Dx()])
-			} else {
-				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.GrayModel.Convert(m.At(x, y)).(color.Gray)
-					cr[0][i] = c.Y
-					i++
-				}
-			}
-		case cbTC8:
-			// We have previously verified that the alpha value is fully opaque.
-			cr0 := cr[0]
-			stride, pix := 0, []byte(nil)
-			if rgba != nil {
-				stride, pix = rgba.Stride, rgba.Pix
-			} else if nrgba != nil {
-				stride, pix = nrgba.Stride, nrgba.Pix
+	i := 1
+	switch cb {
+	case cbG8:
+		if gray != nil {
+			offset := (y - b.Min.Y) * gray.Stride
+			copy(row[1:], gray.Pix[offset:offset+b.Dx()])
+		} else {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.GrayModel.Convert(m.At(x, y)).(color.Gray)
+				row[i] = c.Y
+				i++
 			}
-			if stride != 0 {
-				j0 := (y - b.Min.Y) * stride
-				j1 := j0 + b.Dx()*4
-				for j := j0; j < j1; j += 4 {
-					cr0[i+0] = pix[j+0]
-					cr0[i+1] = pix[j+1]
-					cr0[i+2] = pix[j+2]
-					i += 3
-				}
-			} else {
-				for x := b.Min.X; x < b.Max.X; x++ {
-					r, g, b, _ := m.At(x, y).RGBA()
-					cr0[i+0] = uint8(r >> 8)
-					cr0[i+1] = uint8(g >> 8)
-					cr0[i+2] = uint8(b >> 8)
-					i += 3
-				}
+		}
+	case cbTC8:
+		// We have previously verified that the alpha value is fully opaque.
+		stride, pix := 0, []byte(nil)
+		if rgba != nil {
+			stride, pix = rgba.Stride, rgba.Pix
+		} else if nrgba != nil {
+			stride, pix = nrgba.Stride, nrgba.Pix
+		}
+		if stride != 0 {
+			j0 := (y - b.Min.Y) * stride
+			j1 := j0 + b.Dx()*4
+			for j := j0; j < j1; j += 4 {
+				row[i+0] = pix[j+0]
+				row[i+1] = pix[j+1]
+				row[i+2] = pix[j+2]
+				i += 3
 			}
-		case cbP8:
-			if paletted != nil {
-				offset := (y - b.Min.Y) * paletted.Stride
-				copy(cr[0][1:], paletted.Pix[offset:offset+b.Dx()])
-			} else {
-				pi := m.(image.PalettedImage)
-				for x := b.Min.X; x < b.Max.X; x++ {
-					cr[0][i] = pi.ColorIndexAt(x, y)
-					i += 1
-				}
+		} else {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, b, _ := m.At(x, y).RGBA()
+				row[i+0] = uint8(r >> 8)
+				row[i+1] = uint8(g >> 8)
+				row[i+2] = uint8(b >> 8)
+				i += 3
 			}
-
-		case cbP4, cbP2, cbP1:
+		}
+	case cbP8:
+		if paletted != nil {
+			offset := (y - b.Min.Y) * paletted.Stride
+			copy(row[1:], paletted.Pix[offset:offset+b.Dx()])
+		} else {
 			pi := m.(image.PalettedImage)
-
-			var a uint8
-			var c int
 			for x := b.Min.X; x < b.Max.X; x++ {
-				a = a<<uint(bitsPerPixel) | pi.ColorIndexAt(x, y)
-				c++
-				if c == 8/bitsPerPixel {
-					cr[0][i] = a
-					i += 1
-					a = 0
-					c = 0
-				}
-			}
-			if c != 0 {
-				for c != 8/bitsPerPixel {
-					a = a << uint(bitsPerPixel)
-					c++
-				}
-				cr[0][i] = a
+				row[i] = pi.ColorIndexAt(x, y)
+				i += 1
 			}
+		}
+
+	case cbP4, cbP2, cbP1, cbG4, cbG2, cbG1:
+		var pi image.PalettedImage
+		if cbPaletted(cb) {
+			pi = m.(image.PalettedImage)
+		}
 
-		case cbTCA8:
-			if nrgba != nil {
-				offset := (y - b.Min.Y) * nrgba.Stride
-				copy(cr[0][1:], nrgba.Pix[offset:offset+b.Dx()*4])
+		var a uint8
+		var c int
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var v uint8
+			if pi != nil {
+				v = pi.ColorIndexAt(x, y)
 			} else {
-				// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
-				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
-					cr[0][i+0] = c.R
-					cr[0][i+1] = c.G
-					cr[0][i+2] = c.B
-					cr[0][i+3] = c.A
-					i += 4
-				}
+				// Gray levels that fit in fewer bits repeat their bit
+				// pattern, so the top bits hold the level.
+				v = color.GrayModel.Convert(m.At(x, y)).(color.Gray).Y >> uint(8-bitsPerPixel)
 			}
-		case cbG16:
-			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
-				cr[0][i+0] = uint8(c.Y >> 8)
-				cr[0][i+1] = uint8(c.Y)
-				i += 2
+			a = a<<uint(bitsPerPixel) | v
+			c++
+			if c == 8/bitsPerPixel {
+				row[i] = a
+				i += 1
+				a = 0
+				c = 0
 			}
-		case cbTC16:
-			// We have previously verified that the alpha value is fully opaque.
-			for x := b.Min.X; x < b.Max.X; x++ {
-				r, g, b, _ := m.At(x, y).RGBA()
-				cr[0][i+0] = uint8(r >> 8)
-				cr[0][i+1] = uint8(r)
-				cr[0][i+2] = uint8(g >> 8)
-				cr[0][i+3] = uint8(g)
-				cr[0][i+4] = uint8(b >> 8)
-				cr[0][i+5] = uint8(b)
-				i += 6
+		}
+		if c != 0 {
+			for c != 8/bitsPerPixel {
+				a = a << uint(bitsPerPixel)
+				c++
 			}
-		case cbTCA16:
+			row[i] = a
+		}
+
+	case cbTCA8:
+		if nrgba != nil {
+			offset := (y - b.Min.Y) * nrgba.Stride
+			copy(row[1:], nrgba.Pix[offset:offset+b.Dx()*4])
+		} else {
 			// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
 			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
-				cr[0][i+0] = uint8(c.R >> 8)
-				cr[0][i+1] = uint8(c.R)
-				cr[0][i+2] = uint8(c.G >> 8)
-				cr[0][i+3] = uint8(c.G)
-				cr[0][i+4] = uint8(c.B >> 8)
-				cr[0][i+5] = uint8(c.B)
-				cr[0][i+6] = uint8(c.A >> 8)
-				cr[0][i+7] = uint8(c.A)
-				i += 8
+				c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+				row[i+0] = c.R
+				row[i+1] = c.G
+				row[i+2] = c.B
+				row[i+3] = c.A
+				i += 4
 			}
 		}
-
-		// Apply the filter.
-		// Skip filter for NoCompression and paletted images (cbP8) as
-		// "filters are rarely useful on palette images" and will result
-		// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
-		f := ftNone
-		if level != zlib.NoCompression && cb != cbP8 && cb != cbP4 && cb != cbP2 && cb != cbP1 {
-			// Since we skip paletted images we don't have to worry about
-			// bitsPerPixel not being a multiple of 8
-			bpp := bitsPerPixel / 8
-			f = filter(&cr, pr, bpp)
+	case cbGA8:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			row[i+0] = c.R
+			row[i+1] = c.A
+			i += 2
 		}
-
-		// Write the compressed bytes.
-		if _, err := e.zw.Write(cr[f]); err != nil {
-			return err
+	case cbGA16:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+			row[i+0] = uint8(c.R >> 8)
+			row[i+1] = uint8(c.R)
+			row[i+2] = uint8(c.A >> 8)
+			row[i+3] = uint8(c.A)
+			i += 4
+		}
+	case cbG16:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
+			row[i+0] = uint8(c.Y >> 8)
+			row[i+1] = uint8(c.Y)
+			i += 2
+		}
+	case cbTC16:
+		// We have previously verified that the alpha value is fully
+		// opaque, or that transparent pixels match the color key.
+		if nrgba64 != nil {
+			j0 := (y - b.Min.Y) * nrgba64.Stride
+			j1 := j0 + b.Dx()*8
+			for j := j0; j < j1; j += 8 {
+				copy(row[i:i+6], nrgba64.Pix[j:j+6])
+				i += 6
+			}
+			break
+		}
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			row[i+0] = uint8(r >> 8)
+			row[i+1] = uint8(r)
+			row[i+2] = uint8(g >> 8)
+			row[i+3] = uint8(g)
+			row[i+4] = uint8(b >> 8)
+			row[i+5] = uint8(b)
+			i += 6
+		}
+	case cbTCA16:
+		// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+			row[i+0] = uint8(c.R >> 8)
+			row[i+1] = uint8(c.R)
+			row[i+2] = uint8(c.G >> 8)
+			row[i+3] = uint8(c.G)
+			row[i+4] = uint8(c.B >> 8)
+			row[i+5] = uint8(c.B)
+			row[i+6] = uint8(c.A >> 8)
+			row[i+7] = uint8(c.A)
+			i += 8
 		}
-
-		// The current row for y is the previous row for y+1.
-		pr, cr[0] = cr[0], pr
 	}
-	return nil
+
 }
 
 // maybeWriteGAMA will write out a gAMA chunk if the metadata has
@@ -627,6 +939,29 @@ func (e *encoder) maybeWriteTEXT(t *TextEntry) {
 	return
 }
 
+// maybeWriteSPLT will write out an sPLT entry.
+func (e *encoder) maybeWriteSPLT(p *SuggestedPalette) {
+	if e.err != nil {
+		return
+	}
+
+	buf := make([]byte, 0, len(p.Name)+2+len(p.Entries)*10)
+	buf = append(buf, p.Name...)
+	buf = append(buf, 0, byte(p.SampleDepth))
+	for _, v := range p.Entries {
+		c := v.Color
+		if p.SampleDepth == 8 {
+			buf = append(buf, byte(c.R>>8), byte(c.G>>8), byte(c.B>>8), byte(c.A>>8))
+		} else {
+			buf = append(buf, byte(c.R>>8), byte(c.R), byte(c.G>>8), byte(c.G),
+				byte(c.B>>8), byte(c.B), byte(c.A>>8), byte(c.A))
+		}
+		buf = append(buf, byte(v.Frequency>>8), byte(v.Frequency))
+	}
+
+	e.writeChunk(buf, "sPLT")
+}
+
 // maybeWriteZTXT will write out a zTXt entry.
 func (e *encoder) maybeWriteZTXT(t *TextEntry) {
 	if e.err != nil {
@@ -721,6 +1056,132 @@ func (e *encoder) maybeWriteHIST(m *Metadata) {
 	return
 }
 
+// maybeWriteSBIT will write out an sBIT chunk if the metadata has
+// significant bit information. If the metadata was read from an image
+// with a different color type the bits are converted, and they're
+// capped at the bit depth being written.
+func (e *encoder) maybeWriteSBIT(m *Metadata) {
+	if m == nil || m.SignificantBits == nil {
+		return
+	}
+	if e.err != nil {
+		return
+	}
+
+	sb := *m.SignificantBits
+	max := e.depth
+	if e.ct == ctPaletted {
+		max = 8
+	}
+	if m.depth != 0 {
+		srcColor := m.colorType == ctTrueColor || m.colorType == ctPaletted || m.colorType == ctTrueColorAlpha
+		srcAlpha := m.colorType == ctGrayscaleAlpha || m.colorType == ctTrueColorAlpha
+		switch {
+		case srcColor && (e.ct == ctGrayscale || e.ct == ctGrayscaleAlpha):
+			sb.Gray = sb.Red
+			if sb.Green > sb.Gray {
+				sb.Gray = sb.Green
+			}
+			if sb.Blue > sb.Gray {
+				sb.Gray = sb.Blue
+			}
+		case !srcColor && e.ct != ctGrayscale && e.ct != ctGrayscaleAlpha:
+			sb.Red, sb.Green, sb.Blue = sb.Gray, sb.Gray, sb.Gray
+		}
+		if !srcAlpha {
+			sb.Alpha = max
+		}
+		for _, v := range []*int{&sb.Red, &sb.Green, &sb.Blue, &sb.Gray, &sb.Alpha} {
+			if *v > max {
+				*v = max
+			}
+		}
+	}
+
+	var bits []int
+	switch e.ct {
+	case ctGrayscale:
+		bits = []int{sb.Gray}
+	case ctTrueColor, ctPaletted:
+		bits = []int{sb.Red, sb.Green, sb.Blue}
+	case ctGrayscaleAlpha:
+		bits = []int{sb.Gray, sb.Alpha}
+	case ctTrueColorAlpha:
+		bits = []int{sb.Red, sb.Green, sb.Blue, sb.Alpha}
+	}
+	for i, v := range bits {
+		if v < 1 || v > max {
+			e.err = fmt.Errorf("Invalid significant bits %d for %d bit samples", v, max)
+			return
+		}
+		e.tmp[i] = byte(v)
+	}
+	e.writeChunk(e.tmp[:len(bits)], "sBIT")
+}
+
+// maybeWriteBKGD will write out a bKGD chunk if the metadata has a
+// background color. If the metadata was read from an image with a
+// different color type or bit depth the color is converted, using the
+// closest palette entry for paletted images.
+func (e *encoder) maybeWriteBKGD(m *Metadata, pal color.Palette) {
+	if m == nil || m.Background == nil {
+		return
+	}
+	if e.err != nil {
+		return
+	}
+
+	bg := *m.Background
+	if m.depth != 0 && (m.depth != e.depth || m.colorType != e.ct) {
+		c, err := m.backgroundColor()
+		if err != nil {
+			e.err = err
+			return
+		}
+		shift := uint(16 - e.depth)
+		switch e.ct {
+		case ctGrayscale, ctGrayscaleAlpha:
+			bg.Grey = int(color.Gray16Model.Convert(c).(color.Gray16).Y >> shift)
+		case ctTrueColor, ctTrueColorAlpha:
+			r, g, b, _ := c.RGBA()
+			bg.Red, bg.Green, bg.Blue = int(r>>shift), int(g>>shift), int(b>>shift)
+		case ctPaletted:
+			if src, ok := m.ColorModel.(color.Palette); !ok || m.colorType != ctPaletted || !samePalette(src, pal) {
+				bg.PaletteIndex = pal.Index(c)
+			}
+		}
+	}
+
+	max := 1<<uint(e.depth) - 1
+	var n int
+	switch e.ct {
+	case ctGrayscale, ctGrayscaleAlpha:
+		if bg.Grey < 0 || bg.Grey > max {
+			e.err = fmt.Errorf("Invalid background gray level %d for %d bit samples", bg.Grey, e.depth)
+			return
+		}
+		binary.BigEndian.PutUint16(e.tmp[0:2], uint16(bg.Grey))
+		n = 2
+	case ctTrueColor, ctTrueColorAlpha:
+		for i, v := range []int{bg.Red, bg.Green, bg.Blue} {
+			if v < 0 || v > max {
+				e.err = fmt.Errorf("Invalid background color %d/%d/%d for %d bit samples", bg.Red, bg.Green, bg.Blue, e.depth)
+				return
+			}
+			binary.BigEndian.PutUint16(e.tmp[2*i:2*i+2], uint16(v))
+		}
+		n = 6
+	case ctPaletted:
+		if bg.PaletteIndex < 0 || bg.PaletteIndex >= len(pal) {
+			e.err = fmt.Errorf("Invalid background palette index %d for a %d color palette", bg.PaletteIndex, len(pal))
+			return
+		}
+		e.tmp[0] = byte(bg.PaletteIndex)
+		n = 1
+	}
+	e.writeChunk(e.tmp[:n], "bKGD")
+}
+
 // maybeWriteSRGB will write out a sRGB chunk if the metadata has
 // sRGB information.
 func (e *encoder) maybeWriteSRGB(m *Metadata) {
@@ -738,6 +1199,63 @@ func (e *encoder) maybeWriteSRGB(m *Metadata) {
 	return
 }
 
+// maybeWriteCICP will write out a cICP chunk if the metadata has
+// coding-independent code points.
+func (e *encoder) maybeWriteCICP(m *Metadata) {
+	if m == nil || m.CodingPoints == nil {
+		return
+	}
+	if e.err != nil {
+		return
+	}
+
+	c := m.CodingPoints
+	e.tmp[0], e.tmp[1], e.tmp[2], e.tmp[3] = c.ColorPrimaries, c.TransferFunction, c.MatrixCoefficients, 0
+	if c.FullRange {
+		e.tmp[3] = 1
+	}
+	e.writeChunk(e.tmp[:4], "cICP")
+}
+
+// maybeWriteMDCV will write out an mDCv chunk if the metadata has
+// mastering display information.
+func (e *encoder) maybeWriteMDCV(m *Metadata) {
+	if m == nil || m.MasteringDisplay == nil {
+		return
+	}
+	if e.err != nil {
+		return
+	}
+
+	md := m.MasteringDisplay
+	binary.BigEndian.PutUint16(e.tmp[0:2], md.RedX)
+	binary.BigEndian.PutUint16(e.tmp[2:4], md.RedY)
+	binary.BigEndian.PutUint16(e.tmp[4:6], md.GreenX)
+	binary.BigEndian.PutUint16(e.tmp[6:8], md.GreenY)
+	binary.BigEndian.PutUint16(e.tmp[8:10], md.BlueX)
+	binary.BigEndian.PutUint16(e.tmp[10:12], md.BlueY)
+	binary.BigEndian.PutUint16(e.tmp[12:14], md.WhiteX)
+	binary.BigEndian.PutUint16(e.tmp[14:16], md.WhiteY)
+	binary.BigEndian.PutUint32(e.tmp[16:20], md.MaxLuminance)
+	binary.BigEndian.PutUint32(e.tmp[20:24], md.MinLuminance)
+	e.writeChunk(e.tmp[:24], "mDCv")
+}
+
+// maybeWriteCLLI will write out a cLLi chunk if the metadata has
+// content light level information.
+func (e *encoder) maybeWriteCLLI(m *Metadata) {
+	if m == nil || m.ContentLightLevel == nil {
+		return
+	}
+	if e.err != nil {
+		return
+	}
+
+	binary.BigEndian.PutUint32(e.tmp[0:4], m.ContentLightLevel.MaxCLL)
+	binary.BigEndian.PutUint32(e.tmp[4:8], m.ContentLightLevel.MaxFALL)
+	e.writeChunk(e.tmp[:8], "cLLi")
+}
+
 // pngCompress will compress a byte slice. Returns the compressed
 // slice, the compression type (0==no compression, 1 == deflate) and
 // an error if something went wrong.
@@ -801,22 +1319,44 @@ func (e *encoder) maybeWriteICCP(ctx context.Context, m *Metadata, opts ...image
 			e.err = err
 			return
 		}
+	}
+
+	chunk, compression, err := e.pngCompress(chunk)
+	if err != nil {
+		e.err = err
+		return
+	}
 
-		chunk, compression, err := e.pngCompress(chunk)
+	var icc []byte
+	icc = []byte(m.iccName)
+	icc = append(icc, 0)
+	icc = append(icc, byte(compression))
+	icc = append(icc, chunk...)
+	e.writeChunk(icc, "iCCP")
+}
+
+// maybeWriteEXIF will write out an eXIf chunk if the metadata has
+// EXIF information.
+func (e *encoder) maybeWriteEXIF(ctx context.Context, m *Metadata, opts ...image.WriteOption) {
+	if m == nil || e.err != nil {
+		return
+	}
+	if m.exif == nil && len(m.rawExif) == 0 {
+		return
+	}
+
+	// Use the undecoded data we read if there is any, otherwise encode
+	// the decoded EXIF. Both are whole TIFF blocks, header included.
+	chunk := m.rawExif
+	if m.exif != nil {
+		b, err := m.exif.Encode(ctx, true, opts...)
 		if err != nil {
 			e.err = err
 			return
 		}
-
-		var icc []byte
-		icc = []byte(m.iccName)
-		icc = append(icc, 0)
-		icc = append(icc, byte(compression))
-		icc = append(icc, chunk...)
-		e.writeChunk(icc, "iCCP")
+		chunk = b
 	}
-
-	return
+	e.writeChunk(chunk, "eXIf")
 }
 
 // maybeWriteCHRM will write out a cHRM chunk if the metadata has
@@ -843,13 +1383,47 @@ func (e *encoder) maybeWriteCHRM(m *Metadata) {
 	return
 }
 
+// writeUnknownChunks writes out the unknown chunks in the metadata
+// that go at position pos. If the image data has changed then chunks
+// that aren't safe to copy are left out.
+func (e *encoder) writeUnknownChunks(m *Metadata, pos ChunkPosition, changed bool) {
+	if m == nil {
+		return
+	}
+	for _, c := range m.UnknownChunks {
+		if c.Position != pos || (changed && !c.SafeToCopy()) {
+			continue
+		}
+		e.writeChunk(c.Data, c.Type)
+	}
+}
+
+// hasAnimationChunks reports whether m holds APNG chunks, which a
+// deferred decode keeps as unknown chunks.
+func hasAnimationChunks(m *Metadata) bool {
+	if m == nil {
+		return false
+	}
+	for _, c := range m.UnknownChunks {
+		switch c.Type {
+		case "acTL", "fcTL", "fdAT":
+			return true
+		}
+	}
+	return false
+}
+
 // Write the actual image data to one or more IDAT chunks.
 func (e *encoder) writeIDATs() {
 	if e.err != nil {
 		return
 	}
-	if e.bw == nil {
-		e.bw = bufio.NewWriterSize(e, 1<<15)
+	size := e.enc.ChunkSize
+	if size <= 0 {
+		size = 1 << 15
+	}
+	if e.bw == nil || e.bw.Size() != size {
+		e.bw = bufio.NewWriterSize(e, size)
 	} else {
 		e.bw.Reset(e)
 	}
@@ -860,6 +1434,25 @@ func (e *encoder) writeIDATs() {
 	e.err = e.bw.Flush()
 }
 
+// writeDeferredIDATs writes a deferred image's cached image data to
+// one or more IDAT chunks. The original chunk boundaries are kept
+// unless the encoder's ChunkSize is set, in which case the data is
+// split into chunks of that size.
+func (e *encoder) writeDeferredIDATs(di *Deferred) {
+	if e.enc.ChunkSize <= 0 {
+		for _, b := range di.idat {
+			e.writeChunk(b, "IDAT")
+		}
+		return
+	}
+	data := bytes.Join(di.idat, nil)
+	for len(data) > 0 {
+		n := min(len(data), e.enc.ChunkSize)
+		e.writeChunk(data[:n], "IDAT")
+		data = data[n:]
+	}
+}
+
 // This function is required because we want the zero value of
 // Encoder.CompressionLevel to map to zlib.DefaultCompression.
 func levelToZlib(l CompressionLevel) int {
@@ -896,42 +1489,182 @@ func (enc *Encoder) Encode(w io.Writer, m image.Image) error {
 	return enc.EncodeExtended(context.TODO(), w, m)
 }
 
-// EncodeExtended writes the Image m to w in PNG format
+// EncodeExtended writes the Image m to w in PNG format. It accepts a
+// *Metadata to write, an *image.StripMetadata to filter it, an
+// *Options to replace the encoder's settings, and an
+// image.LimitOptions, whose MaxImageSize caps the size of the output
+// and MaxMetadataSize the size of the metadata chunks. The acTL, fcTL
+// and fdAT chunks kept by a deferred decode of an APNG can only be
+// written with that unchanged Deferred image; animations are
+// otherwise written by EncodeAll.
 func (enc *Encoder) EncodeExtended(ctx context.Context, w io.Writer, m image.Image, opts ...image.WriteOption) error {
+	enc, metadata, err := enc.parseWriteOptions(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Check to see if we have a deferred image.
+	di, deferred := m.(*Deferred)
+	if !deferred && hasAnimationChunks(metadata) {
+		return UnsupportedError("APNG chunks without an unchanged Deferred image")
+	}
+
+	// If this isn't deferred then do some size validation. If it is
+	// then we assume that the file's OK since we read it.
+	if !deferred {
+		if err := checkImageSize(m); err != nil {
+			return err
+		}
+	}
+
+	e := enc.getEncoder()
+	defer enc.putEncoder(e)
+	e.setWriter(w)
+	e.m = m
+
+	var pal color.Palette
+
+	// Skip palette checking if this is a deferred image, since we're
+	// just splatting out whatever we read.
+	if !deferred {
+		pal = e.setColorType(m)
+		var ms []image.Image
+		ms, pal, metadata = e.optimize([]image.Image{m}, pal, metadata)
+		e.m = ms[0]
+	}
+
+	_, e.err = io.WriteString(e.w, pngHeader)
+	switch deferred {
+	case true:
+		e.writeChunk(di.ihdr[:len(di.ihdr)-4], "IHDR")
+		e.depth, e.ct = int(di.ihdr[8]), int(di.ihdr[9])
+		pal, _ = di.model.(color.Palette)
+	case false:
+		e.writeIHDR(e.m.Bounds())
+	}
+
+	e.writeMetadata(ctx, metadata, opts...)
+	e.writeUnknownChunks(metadata, ChunkBeforePLTE, !deferred)
+
+	switch deferred {
+	case true:
+		if di.plte != nil {
+			e.writeChunk(di.plte[:len(di.plte)-4], "PLTE")
+		}
+		if di.trns != nil {
+			e.writeChunk(di.trns[:len(di.trns)-4], "tRNS")
+		}
+	case false:
+		if pal != nil {
+			e.writePLTEAndTRNS(pal)
+		}
+		e.writeTRNSKey()
+	}
+	e.maybeWriteBKGD(metadata, pal)
+	e.maybeWriteHIST(metadata)
+	e.writeUnknownChunks(metadata, ChunkBeforeIDAT, !deferred)
+
+	switch deferred {
+	case true:
+		e.writeDeferredIDATs(di)
+	case false:
+		e.writeIDATs()
+	}
+
+	e.writeUnknownChunks(metadata, ChunkAfterIDAT, !deferred)
+	e.writeIEND()
+	return e.err
+}
+
+// parseWriteOptions checks the encoder settings and the write options
+// passed to EncodeExtended or EncodeAll, and returns the encoder with
+// any Options and LimitOptions applied and the metadata to write, if
+// any.
+func (enc *Encoder) parseWriteOptions(ctx context.Context, opts ...image.WriteOption) (*Encoder, *Metadata, error) {
 	var metadata *Metadata
+	var strip *image.StripMetadata
+	var options *Options
+	var limits *image.LimitOptions
 
 	//  Run through all the opts.
 	for _, o := range opts {
 		switch lo := o.(type) {
 		case *Metadata:
 			if metadata != nil {
-				return fmt.Errorf("Multiple metadata passed")
+				return nil, nil, fmt.Errorf("Multiple metadata passed")
 			}
 			metadata = lo
 			// Make sure the metadata is OK.
 			if err := metadata.validate(); err != nil {
-				return err
+				return nil, nil, err
+			}
+		case *image.StripMetadata:
+			strip = lo
+		case *Options:
+			if options != nil {
+				return nil, nil, fmt.Errorf("Multiple options passed")
+			}
+			options = lo
+		case image.LimitOptions:
+			if limits != nil {
+				return nil, nil, fmt.Errorf("Multiple limits passed")
 			}
+			limits = &lo
 		default:
-			return fmt.Errorf("Unknown write option of type %T given", o)
+			return nil, nil, fmt.Errorf("Unknown write option of type %T given", o)
 		}
 	}
 
-	// Check to see if we have a deferred image.
-	di, deferred := m.(*Deferred)
+	if options != nil {
+		var err error
+		if enc, err = options.apply(enc); err != nil {
+			return nil, nil, err
+		}
+	}
+	if limits != nil {
+		if err := checkLimits(*limits); err != nil {
+			return nil, nil, err
+		}
+		c := *enc
+		c.limits = *limits
+		enc = &c
+	}
 
-	// If this isn't deferred then do some size validation. If it is
-	// then we assume that the file's OK since we read it.
-	if !deferred {
-		// Obviously, negative widths and heights are
-		// invalid. Furthermore, the PNG spec section 11.2.2 says that
-		// zero is invalid. Excessively large images are also rejected.
-		mw, mh := int64(m.Bounds().Dx()), int64(m.Bounds().Dy())
-		if mw <= 0 || mh <= 0 || mw >= 1<<32 || mh >= 1<<32 {
-			return FormatError("invalid image size: " + strconv.FormatInt(mw, 10) + "x" + strconv.FormatInt(mh, 10))
+	if metadata != nil && strip != nil {
+		var err error
+		if metadata, err = metadata.strip(ctx, strip, opts...); err != nil {
+			return nil, nil, err
 		}
 	}
 
+	if enc.ChunkSize < 0 || int64(enc.ChunkSize) > 0x7fffffff {
+		return nil, nil, fmt.Errorf("Invalid chunk size %d", enc.ChunkSize)
+	}
+	if enc.Concurrency < 0 {
+		return nil, nil, fmt.Errorf("Invalid concurrency %d", enc.Concurrency)
+	}
+	if enc.Filter < FilterDefault || enc.Filter > FilterBruteForce {
+		return nil, nil, fmt.Errorf("Invalid filter strategy %d", enc.Filter)
+	}
+	return enc, metadata, nil
+}
+
+// checkImageSize checks that m has a size that can be written to a
+// PNG.
+func checkImageSize(m image.Image) error {
+	// Obviously, negative widths and heights are
+	// invalid. Furthermore, the PNG spec section 11.2.2 says that
+	// zero is invalid. Excessively large images are also rejected.
+	mw, mh := int64(m.Bounds().Dx()), int64(m.Bounds().Dy())
+	if mw <= 0 || mh <= 0 || mw >= 1<<32 || mh >= 1<<32 {
+		return FormatError("invalid image size: " + strconv.FormatInt(mw, 10) + "x" + strconv.FormatInt(mh, 10))
+	}
+	return nil
+}
+
+// getEncoder returns an encoder, from the buffer pool if there is
+// one. It should be handed back with putEncoder when done.
+func (enc *Encoder) getEncoder() *encoder {
 	var e *encoder
 	if enc.BufferPool != nil {
 		buffer := enc.BufferPool.Get()
@@ -941,109 +1674,160 @@ func (enc *Encoder) EncodeExtended(ctx context.Context, w io.Writer, m image.Ima
 	if e == nil {
 		e = &encoder{}
 	}
+	e.enc = enc
+	e.fdat, e.seq = false, 0
+	e.key = nil
+	e.metaSize = 0
+	return e
+}
+
+// putEncoder returns an encoder to the buffer pool, if there is one.
+func (enc *Encoder) putEncoder(e *encoder) {
 	if enc.BufferPool != nil {
-		defer enc.BufferPool.Put((*EncoderBuffer)(e))
+		enc.BufferPool.Put((*EncoderBuffer)(e))
 	}
+}
 
-	e.enc = enc
-	e.w = w
-	e.m = m
+// setColorType picks the color type used to write the images in ms,
+// which all have to be written with the same one, and returns the
+// palette if they're paletted.
+func (e *encoder) setColorType(ms ...image.Image) color.Palette {
+	allOpaque := func() bool {
+		for _, m := range ms {
+			if !opaque(m) {
+				return false
+			}
+		}
+		return true
+	}
 
+	// cbP8 encoding needs PalettedImage's ColorIndexAt method.
 	var pal color.Palette
-
-	// Skip palette checking if this is a deferred image, since we're
-	// just splatting out whatever we read.
-	if !deferred {
-		// cbP8 encoding needs PalettedImage's ColorIndexAt method.
-		if _, ok := m.(image.PalettedImage); ok {
-			pal, _ = m.ColorModel().(color.Palette)
+	if _, ok := ms[0].(image.PalettedImage); ok {
+		pal, _ = ms[0].ColorModel().(color.Palette)
+	}
+	for _, m := range ms[1:] {
+		if p, ok := m.ColorModel().(color.Palette); !ok || !samePalette(p, pal) {
+			pal = nil
+		} else if _, ok := m.(image.PalettedImage); !ok {
+			pal = nil
 		}
-		if pal != nil {
-			if len(pal) <= 2 {
-				e.cb = cbP1
-			} else if len(pal) <= 4 {
-				e.cb = cbP2
-			} else if len(pal) <= 16 {
-				e.cb = cbP4
-			} else {
-				e.cb = cbP8
-			}
+	}
+	if pal != nil {
+		if len(pal) <= 2 {
+			e.cb = cbP1
+		} else if len(pal) <= 4 {
+			e.cb = cbP2
+		} else if len(pal) <= 16 {
+			e.cb = cbP4
 		} else {
-			switch m.ColorModel() {
-			case color.GrayModel:
-				e.cb = cbG8
-			case color.Gray16Model:
-				e.cb = cbG16
-			case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
-				if opaque(m) {
-					e.cb = cbTC8
-				} else {
-					e.cb = cbTCA8
-				}
-			default:
-				if opaque(m) {
-					e.cb = cbTC16
-				} else {
-					e.cb = cbTCA16
-				}
-			}
+			e.cb = cbP8
 		}
+		return pal
 	}
 
-	_, e.err = io.WriteString(w, pngHeader)
-	switch deferred {
-	case true:
-		e.writeChunk(di.ihdr[:len(di.ihdr)-4], "IHDR")
-	case false:
-		e.writeIHDR()
-	}
-
-	// If we have a gAMA chunk then it needs to be written now.
-	if metadata != nil {
-		e.maybeWriteGAMA(metadata)
-		e.maybeWriteCHRM(metadata)
-		e.maybeWriteSRGB(metadata)
-		e.maybeWriteTIME(metadata)
-		e.maybeWriteICCP(ctx, metadata, opts...)
-		e.maybeWritePHYS(metadata)
-
-		e.maybeWriteXMP(ctx, metadata, opts...)
-		for _, v := range metadata.Text {
-			switch v.EntryType {
-			case EtText:
-				e.maybeWriteTEXT(v)
-			case EtZtext:
-				e.maybeWriteZTXT(v)
-			case EtItext:
-				e.maybeWriteITXT(v)
+	model := ms[0].ColorModel()
+	for _, m := range ms[1:] {
+		if !sameModel(m.ColorModel(), model) {
+			// Images with different color models are written as
+			// truecolor, with 8 bits per channel if that's enough.
+			model = color.RGBA64Model
+			if all8Bit(ms) {
+				model = color.RGBAModel
 			}
+			break
 		}
 	}
-
-	switch deferred {
-	case true:
-		if di.plte != nil {
-			e.writeChunk(di.plte[:len(di.plte)-4], "PLTE")
+	switch model {
+	case color.GrayModel:
+		e.cb = cbG8
+	case color.Gray16Model:
+		e.cb = cbG16
+	case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
+		if allOpaque() {
+			e.cb = cbTC8
+		} else {
+			e.cb = cbTCA8
 		}
-		if di.trns != nil {
-			e.writeChunk(di.trns[:len(di.trns)-4], "tRNS")
+	default:
+		if allOpaque() {
+			e.cb = cbTC16
+		} else {
+			e.cb = cbTCA16
 		}
-	case false:
-		if pal != nil {
-			e.writePLTEAndTRNS(pal)
+	}
+	return nil
+}
+
+// samePalette reports whether two palettes hold the same colors.
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
-	e.maybeWriteHIST(metadata)
+	return true
+}
 
-	switch deferred {
-	case true:
-		if di.idat != nil {
-			e.writeChunk(di.idat[:len(di.idat)-4], "IDAT")
+// sameModel reports whether two color models are the same. Palettes
+// can't be compared with ==, so they're compared by color.
+func sameModel(a, b color.Model) bool {
+	pa, aok := a.(color.Palette)
+	pb, bok := b.(color.Palette)
+	if aok || bok {
+		return aok && bok && samePalette(pa, pb)
+	}
+	return a == b
+}
+
+// all8Bit reports whether all the images in ms have at most 8 bits
+// per channel.
+func all8Bit(ms []image.Image) bool {
+	for _, m := range ms {
+		switch cm := m.ColorModel(); cm {
+		case color.GrayModel, color.RGBAModel, color.NRGBAModel, color.AlphaModel:
+		default:
+			if _, ok := cm.(color.Palette); !ok {
+				return false
+			}
 		}
-	case false:
-		e.writeIDATs()
 	}
+	return true
+}
 
-	e.writeIEND()
-	return e.err
+// writeMetadata writes out the metadata chunks that go before the
+// palette.
+func (e *encoder) writeMetadata(ctx context.Context, metadata *Metadata, opts ...image.WriteOption) {
+	if metadata == nil {
+		return
+	}
+	e.maybeWriteGAMA(metadata)
+	e.maybeWriteCHRM(metadata)
+	e.maybeWriteSRGB(metadata)
+	e.maybeWriteCICP(metadata)
+	e.maybeWriteMDCV(metadata)
+	e.maybeWriteCLLI(metadata)
+	e.maybeWriteSBIT(metadata)
+	e.maybeWriteTIME(metadata)
+	e.maybeWriteICCP(ctx, metadata, opts...)
+	e.maybeWritePHYS(metadata)
+	e.maybeWriteEXIF(ctx, metadata, opts...)
+
+	e.maybeWriteXMP(ctx, metadata, opts...)
+	for _, v := range metadata.Text {
+		switch v.EntryType {
+		case EtText:
+			e.maybeWriteTEXT(v)
+		case EtZtext:
+			e.maybeWriteZTXT(v)
+		case EtItext:
+			e.maybeWriteITXT(v)
+		}
+	}
+	for _, p := range metadata.SuggestedPalettes {
+		e.maybeWriteSPLT(p)
+	}
 }
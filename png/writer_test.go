@@ -14,6 +14,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -91,15 +92,33 @@ func diffMetadata(m0, m1 *Metadata) error {
 		if (mc0.Gamma != nil || mc1.Gamma != nil) && !reflect.DeepEqual(mc0.Gamma, mc1.Gamma) {
 			return fmt.Errorf("Gamma different: %v vs %v", mc0.Gamma, mc1.Gamma)
 		}
-		if (mc0.SRGBIntent != nil || mc1.SRGBIntent != nil) && reflect.DeepEqual(mc0.SRGBIntent, mc1.SRGBIntent) {
+		if (mc0.SRGBIntent != nil || mc1.SRGBIntent != nil) && !reflect.DeepEqual(mc0.SRGBIntent, mc1.SRGBIntent) {
 			return fmt.Errorf("SRGBIntent different: %v vs %v", mc0.SRGBIntent, mc1.SRGBIntent)
 		}
-		if (mc0.SignificantBits != nil || mc1.SignificantBits != nil) && reflect.DeepEqual(mc0.SignificantBits, mc1.SignificantBits) {
+		if !reflect.DeepEqual(mc0.CodingPoints, mc1.CodingPoints) {
+			return fmt.Errorf("CodingPoints different: %v vs %v", mc0.CodingPoints, mc1.CodingPoints)
+		}
+		if !reflect.DeepEqual(mc0.MasteringDisplay, mc1.MasteringDisplay) {
+			return fmt.Errorf("MasteringDisplay different: %v vs %v", mc0.MasteringDisplay, mc1.MasteringDisplay)
+		}
+		if !reflect.DeepEqual(mc0.ContentLightLevel, mc1.ContentLightLevel) {
+			return fmt.Errorf("ContentLightLevel different: %v vs %v", mc0.ContentLightLevel, mc1.ContentLightLevel)
+		}
+		if (mc0.SignificantBits != nil || mc1.SignificantBits != nil) && !reflect.DeepEqual(mc0.SignificantBits, mc1.SignificantBits) {
 			return fmt.Errorf("SignificantBits different: %v vs %v", mc0.SignificantBits, mc1.SignificantBits)
 		}
-		if (mc0.Background != nil || mc1.Background != nil) && reflect.DeepEqual(mc0.Background, mc1.Background) {
+		if (mc0.Background == nil) != (mc1.Background == nil) {
 			return fmt.Errorf("Background different: %v vs %v", mc0.Background, mc1.Background)
 		}
+		if mc0.Background != nil {
+			// The encoder may write the image with a different color
+			// type, so compare the colors rather than the values.
+			c0, err0 := mc0.backgroundColor()
+			c1, err1 := mc1.backgroundColor()
+			if err0 != nil || err1 != nil || color.RGBA64Model.Convert(c0) != color.RGBA64Model.Convert(c1) {
+				return fmt.Errorf("Background different: %v vs %v", mc0.Background, mc1.Background)
+			}
+		}
 
 		if (mc0.Dimension != nil || mc1.Dimension != nil) && reflect.DeepEqual(mc0.Dimension, mc1.Dimension) {
 			return fmt.Errorf("Dimension different: %v vs %v", mc0.Dimension, mc1.Dimension)
@@ -684,3 +703,605 @@ func BenchmarkEncodeRGBA(b *testing.B) {
 		Encode(ioutil.Discard, img)
 	}
 }
+
+// countIDATs returns the number of IDAT chunks in an encoded PNG.
+func countIDATs(b []byte) int {
+	n := 0
+	for b = b[len(pngHeader):]; len(b) >= 8; {
+		length := int(binary.BigEndian.Uint32(b[:4]))
+		if string(b[4:8]) == "IDAT" {
+			n++
+		}
+		b = b[12+length:]
+	}
+	return n
+}
+
+// chunkNames returns the types of the chunks in an encoded PNG.
+func chunkNames(b []byte) []string {
+	var names []string
+	for b = b[len(pngHeader):]; len(b) >= 8; {
+		length := int(binary.BigEndian.Uint32(b[:4]))
+		names = append(names, string(b[4:8]))
+		b = b[12+length:]
+	}
+	return names
+}
+
+func TestWriteDeferredMultipleIDATs(t *testing.T) {
+	ctx := context.TODO()
+	m0, err := readPNG(ctx, "testdata/pngsuite/basn6a08.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encode the image with lots of small IDAT chunks.
+	var b0 bytes.Buffer
+	enc := &Encoder{ChunkSize: 100}
+	if err := enc.Encode(&b0, m0); err != nil {
+		t.Fatal(err)
+	}
+	n0 := countIDATs(b0.Bytes())
+	if n0 < 2 {
+		t.Fatalf("got %d IDAT chunks, want several", n0)
+	}
+
+	m1, _, err := DecodeExtended(ctx, bytes.NewReader(b0.Bytes()), image.DataDecodeOptions{image.DeferData, image.DecodeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(m1.(*Deferred).idat); got != n0 {
+		t.Errorf("deferred image holds %d IDAT chunks, want %d", got, n0)
+	}
+
+	for _, tc := range []struct {
+		chunkSize int
+		want      int
+	}{
+		{0, n0},
+		{1 << 20, 1},
+	} {
+		var b1 bytes.Buffer
+		enc := &Encoder{ChunkSize: tc.chunkSize}
+		if err := enc.EncodeExtended(ctx, &b1, m1); err != nil {
+			t.Errorf("chunk size %d: %v", tc.chunkSize, err)
+			continue
+		}
+		if got := countIDATs(b1.Bytes()); got != tc.want {
+			t.Errorf("chunk size %d: got %d IDAT chunks, want %d", tc.chunkSize, got, tc.want)
+		}
+		m2, _, err := DecodeExtended(ctx, &b1, image.OptionDecodeImage)
+		if err != nil {
+			t.Errorf("chunk size %d: %v", tc.chunkSize, err)
+			continue
+		}
+		if err := diff(m0, m2); err != nil {
+			t.Errorf("chunk size %d: %v", tc.chunkSize, err)
+		}
+	}
+
+	// Instantiating must decode all the chunks as a single stream.
+	m3, err := m1.(*Deferred).Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff(m0, m3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteRawICCAndXMP(t *testing.T) {
+	ctx := context.TODO()
+	m0, md, err := readPNGDeferred(ctx, "testdata/pngsuite/basn6a08.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := bytes.Repeat([]byte("not really an icc profile "), 40)
+	const xmp = `<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`
+	meta := md.(*Metadata)
+	meta.SetRawICC("Test Profile", profile)
+	meta.SetRawXMP(xmp)
+
+	var b bytes.Buffer
+	if err := EncodeExtended(ctx, &b, m0, meta); err != nil {
+		t.Fatal(err)
+	}
+	_, md1, err := DecodeExtended(ctx, bytes.NewReader(b.Bytes()), image.DataDecodeOptions{image.DeferData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta1 := md1.(*Metadata)
+	if name, got := meta1.RawICC(); name != "Test Profile" || !bytes.Equal(got, profile) {
+		t.Errorf("got ICC profile %q with %d bytes, want %q with %d bytes", name, len(got), "Test Profile", len(profile))
+	}
+	if got := meta1.RawXMP(); got != xmp {
+		t.Errorf("got XMP %q, want %q", got, xmp)
+	}
+
+	// Removing them must drop the chunks.
+	meta1.SetRawICC("", nil)
+	meta1.SetRawXMP("")
+	b.Reset()
+	if err := EncodeExtended(ctx, &b, m0, meta1); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b.Bytes(), []byte("iCCP")) || bytes.Contains(b.Bytes(), []byte(xmpTextKey)) {
+		t.Error("ICC or XMP chunk written after being removed")
+	}
+}
+
+func TestWriteStripMetadata(t *testing.T) {
+	ctx := context.TODO()
+	f, err := os.Open("../testdata/kauaii_1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, md, err := DecodeExtended(ctx, f, image.DataDecodeOptions{image.DeferData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	meta.Text = []*TextEntry{
+		{Key: "Author", Value: "Someone", EntryType: EtText},
+		{Key: "Comment", Value: "A comment", EntryType: EtZtext},
+		{Key: "Title", Value: "A title", EntryType: EtText},
+	}
+
+	for _, tc := range []struct {
+		s        *image.StripMetadata
+		wantText []string
+		wantXMP  bool
+		wantICC  bool
+	}{
+		{&image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataOwner, image.MetadataComments}}, []string{"Title"}, true, true},
+		// The XMP packet's exif:ColorSpace property is kept.
+		{&image.StripMetadata{Allow: []image.MetadataCategory{image.MetadataColorProfile}}, nil, true, true},
+		{&image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataColorProfile}}, []string{"Author", "Comment", "Title"}, true, false},
+	} {
+		removed := 0
+		tc.s.Report = func(image.StrippedMetadata) { removed++ }
+		var b bytes.Buffer
+		if err := EncodeExtended(ctx, &b, m, meta, tc.s); err != nil {
+			t.Errorf("%+v: %v", tc.s, err)
+			continue
+		}
+		_, md1, err := DecodeExtended(ctx, &b, image.DataDecodeOptions{image.DeferData, image.DeferData})
+		if err != nil {
+			t.Errorf("%+v: %v", tc.s, err)
+			continue
+		}
+		got := md1.(*Metadata)
+		var keys []string
+		for _, e := range got.Text {
+			keys = append(keys, e.Key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(tc.wantText) {
+			t.Errorf("%+v: got text keys %v, want %v", tc.s, keys, tc.wantText)
+		}
+		if gotXMP := got.RawXMP() != ""; gotXMP != tc.wantXMP {
+			t.Errorf("%+v: got XMP %v, want %v", tc.s, gotXMP, tc.wantXMP)
+		}
+		if tc.s.Strips(image.MetadataGPS) && strings.Contains(got.RawXMP(), "GPS") {
+			t.Errorf("%+v: XMP still holds GPS data", tc.s)
+		}
+		if _, icc := got.RawICC(); (icc != nil) != tc.wantICC {
+			t.Errorf("%+v: got ICC %v, want %v", tc.s, icc != nil, tc.wantICC)
+		}
+		if removed == 0 {
+			t.Errorf("%+v: nothing reported as removed", tc.s)
+		}
+	}
+	if len(meta.Text) != 3 {
+		t.Error("the metadata passed in was modified")
+	}
+}
+
+func TestWriteEXIF(t *testing.T) {
+	ctx := context.TODO()
+	m, md, err := readPNGDeferred(ctx, "testdata/glep.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	if !validEXIFHeader(meta.rawExif) {
+		t.Fatalf("got EXIF %q, want a TIFF header", meta.rawExif)
+	}
+
+	var b bytes.Buffer
+	if err := EncodeExtended(ctx, &b, m, meta); err != nil {
+		t.Fatal(err)
+	}
+	names := strings.Join(chunkNames(b.Bytes()), " ")
+	if i := strings.Index(names, "eXIf"); i < 0 || i > strings.Index(names, "IDAT") {
+		t.Errorf("eXIf chunk missing or after IDAT: %s", names)
+	}
+	_, md1, err := DecodeExtended(ctx, &b, image.DataDecodeOptions{image.DeferData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md1.(*Metadata).rawExif; !bytes.Equal(got, meta.rawExif) {
+		t.Errorf("EXIF changed after a round trip: got %d bytes, want %d", len(got), len(meta.rawExif))
+	}
+
+	meta.SetEXIF(nil)
+	b.Reset()
+	if err := EncodeExtended(ctx, &b, m, meta); err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(chunkNames(b.Bytes()), " "); strings.Contains(names, "eXIf") {
+		t.Errorf("eXIf chunk written after being removed: %s", names)
+	}
+}
+
+func TestUnknownChunks(t *testing.T) {
+	ctx := context.TODO()
+	// The 1x1 paletted image from TestMultipletRNSChunks, with an
+	// unsafe to copy chunk before PLTE and safe to copy chunks after
+	// PLTE and IDAT.
+	const (
+		ihdr = "\x00\x00\x00\x0dIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x03\x00\x00\x00\x28\xcb\x34\xbb"
+		plte = "\x00\x00\x00\x03PLTE\xff\x00\x00\x19\xe2\x09\x37"
+		idat = "\x00\x00\x00\x0eIDAT\x78\x9c\x62\x62\x00\x04\x00\x00\xff\xff\x00\x06\x00\x03\xfa\xd0\x59\xae"
+		iend = "\x00\x00\x00\x00IEND\xae\x42\x60\x82"
+	)
+	var b []byte
+	b = append(b, pngHeader...)
+	b = append(b, ihdr...)
+	b = append(b, makeChunk("iDOT", []byte("dot"))...)
+	b = append(b, plte...)
+	b = append(b, makeChunk("prIv", []byte("private"))...)
+	b = append(b, idat...)
+	b = append(b, makeChunk("abCd", nil)...)
+	b = append(b, iend...)
+
+	m, md, err := DecodeExtended(ctx, bytes.NewReader(b), image.DataDecodeOptions{image.DeferData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := md.(*Metadata)
+	var got []string
+	for _, c := range meta.UnknownChunks {
+		got = append(got, fmt.Sprintf("%s %q %v", c.Type, c.Data, c.Position))
+	}
+	want := `[iDOT "dot" before PLTE prIv "private" before IDAT abCd "" after IDAT]`
+	if fmt.Sprint(got) != want {
+		t.Fatalf("got chunks %v, want %s", got, want)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		m    image.Image
+		opts []image.WriteOption
+		want string
+	}{
+		{"deferred image", m, nil, "IHDR iDOT PLTE prIv IDAT abCd IEND"},
+		{"changed image", image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}), nil, "IHDR PLTE prIv IDAT abCd IEND"},
+		{"stripped", m, []image.WriteOption{&image.StripMetadata{Deny: []image.MetadataCategory{image.MetadataOther}}}, "IHDR PLTE IDAT IEND"},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, tc.m, append(tc.opts, meta)...); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got := strings.Join(chunkNames(buf.Bytes()), " "); got != tc.want {
+			t.Errorf("%s: got chunks %s, want %s", tc.desc, got, tc.want)
+		}
+	}
+
+	for _, typ := range []string{"IDAT", "ab1d", "abc"} {
+		bad := &Metadata{UnknownChunks: []*UnknownChunk{{Type: typ}}}
+		if err := EncodeExtended(ctx, ioutil.Discard, m, bad); err == nil {
+			t.Errorf("chunk type %q was accepted", typ)
+		}
+	}
+}
+
+func TestSuggestedPalettes(t *testing.T) {
+	ctx := context.TODO()
+	want := []*SuggestedPalette{
+		{
+			Name:        "eight",
+			SampleDepth: 8,
+			Entries: []SuggestedPaletteEntry{
+				{color.NRGBA64{0xffff, 0, 0, 0xffff}, 0xffff},
+				{color.NRGBA64{0, 0x8080, 0, 0x4040}, 12},
+			},
+		},
+		{
+			Name:        "sixteen",
+			SampleDepth: 16,
+			Entries: []SuggestedPaletteEntry{
+				{color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xdef0}, 0},
+			},
+		},
+	}
+	m := image.NewGray(image.Rect(0, 0, 1, 1))
+	var buf bytes.Buffer
+	if err := EncodeExtended(ctx, &buf, m, &Metadata{SuggestedPalettes: want}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(chunkNames(buf.Bytes()), " "); got != "IHDR sPLT sPLT IDAT IEND" {
+		t.Errorf("got chunks %s", got)
+	}
+	_, md, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{image.DecodeData, image.DeferData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md.(*Metadata).SuggestedPalettes; !reflect.DeepEqual(got, want) {
+		t.Errorf("got palettes %v, want %v", got, want)
+	}
+
+	for _, p := range []*SuggestedPalette{
+		{Name: "", SampleDepth: 8},
+		{Name: "bad depth", SampleDepth: 4},
+	} {
+		if err := EncodeExtended(ctx, ioutil.Discard, m, &Metadata{SuggestedPalettes: []*SuggestedPalette{p}}); err == nil {
+			t.Errorf("palette %q with depth %d was accepted", p.Name, p.SampleDepth)
+		}
+	}
+	dup := &Metadata{SuggestedPalettes: []*SuggestedPalette{want[0], want[0]}}
+	if err := EncodeExtended(ctx, ioutil.Discard, m, dup); err == nil {
+		t.Error("duplicate palette names were accepted")
+	}
+}
+
+func TestNewSuggestedPalette(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 4, 1))
+	m.Pix = []byte{0x00, 0xf0, 0xff, 0xff}
+	p := NewSuggestedPalette("grays", color.Palette{color.Black, color.White}, m)
+	want := &SuggestedPalette{
+		Name:        "grays",
+		SampleDepth: 8,
+		Entries: []SuggestedPaletteEntry{
+			{color.NRGBA64{0xffff, 0xffff, 0xffff, 0xffff}, 0xffff},
+			{color.NRGBA64{0, 0, 0, 0xffff}, 0x5555},
+		},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %v, want %v", p, want)
+	}
+
+	p = NewSuggestedPalette("fine", color.Palette{color.Gray16{0x1234}}, m)
+	if p.SampleDepth != 16 {
+		t.Errorf("got sample depth %d, want 16", p.SampleDepth)
+	}
+}
+
+func TestWriteSBITAndBKGD(t *testing.T) {
+	ctx := context.TODO()
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	rgba.Pix[3] = 0xff
+	paletted := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White})
+	// oneBit is metadata read from a 1 bit grayscale image.
+	oneBit := func() *Metadata {
+		return &Metadata{
+			depth:           1,
+			colorType:       ctGrayscale,
+			SignificantBits: &SignificantBits{Gray: 1},
+			Background:      &Background{Grey: 1},
+		}
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		m        image.Image
+		md       *Metadata
+		wantSBIT SignificantBits
+		wantBKGD Background
+	}{
+		{
+			"gray",
+			gray,
+			&Metadata{SignificantBits: &SignificantBits{Gray: 5}, Background: &Background{Grey: 200}},
+			SignificantBits{Gray: 5},
+			Background{Grey: 200},
+		},
+		{
+			"gray to gray",
+			gray,
+			oneBit(),
+			SignificantBits{Gray: 1},
+			Background{Grey: 255},
+		},
+		{
+			"gray to truecolor",
+			rgba,
+			oneBit(),
+			SignificantBits{Red: 1, Green: 1, Blue: 1},
+			Background{Red: 255, Green: 255, Blue: 255},
+		},
+		{
+			"gray to paletted",
+			paletted,
+			oneBit(),
+			SignificantBits{Red: 1, Green: 1, Blue: 1},
+			Background{PaletteIndex: 1},
+		},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeExtended(ctx, &buf, tc.m, tc.md); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got := strings.Join(chunkNames(buf.Bytes()), " "); !strings.Contains(got, "sBIT") || !strings.Contains(got, "bKGD IDAT") {
+			t.Errorf("%s: got chunks %s", tc.desc, got)
+		}
+		_, md, err := DecodeExtended(ctx, &buf, image.DataDecodeOptions{image.DecodeData, image.DeferData})
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		meta := md.(*Metadata)
+		if got := *meta.SignificantBits; got != tc.wantSBIT {
+			t.Errorf("%s: got significant bits %v, want %v", tc.desc, got, tc.wantSBIT)
+		}
+		if got := *meta.Background; got != tc.wantBKGD {
+			t.Errorf("%s: got background %v, want %v", tc.desc, got, tc.wantBKGD)
+		}
+	}
+
+	for _, tc := range []struct {
+		desc string
+		m    image.Image
+		md   *Metadata
+	}{
+		{"too many bits", gray, &Metadata{SignificantBits: &SignificantBits{Gray: 9}}},
+		{"no bits", rgba, &Metadata{SignificantBits: &SignificantBits{Red: 8, Green: 8}}},
+		{"gray out of range", gray, &Metadata{Background: &Background{Grey: 256}}},
+		{"index out of range", paletted, &Metadata{Background: &Background{PaletteIndex: 2}}},
+	} {
+		if err := EncodeExtended(ctx, ioutil.Discard, tc.m, tc.md); err == nil {
+			t.Errorf("%s: got nil error, want non-nil", tc.desc)
+		}
+	}
+}
+
+// rowFilters returns the filter type of each row of a non-interlaced
+// PNG image.
+func rowFilters(b []byte) ([]byte, error) {
+	var idat []byte
+	var rowSize int
+	for b = b[len(pngHeader):]; len(b) >= 8; {
+		length := int(binary.BigEndian.Uint32(b[:4]))
+		data := b[8 : 8+length]
+		switch string(b[4:8]) {
+		case "IHDR":
+			bits := map[byte]int{ctGrayscale: 1, ctTrueColor: 3, ctPaletted: 1, ctTrueColorAlpha: 4}[data[9]] * int(data[8])
+			rowSize = 1 + (int(binary.BigEndian.Uint32(data[:4]))*bits+7)/8
+		case "IDAT":
+			idat = append(idat, data...)
+		}
+		b = b[12+length:]
+	}
+	r, err := zlib.NewReader(bytes.NewReader(idat))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var filters []byte
+	for ; len(raw) >= rowSize; raw = raw[rowSize:] {
+		filters = append(filters, raw[0])
+	}
+	return filters, nil
+}
+
+func TestFilterStrategies(t *testing.T) {
+	rgba := image.NewNRGBA(image.Rect(0, 0, 37, 19))
+	for y := 0; y < 19; y++ {
+		for x := 0; x < 37; x++ {
+			rgba.Set(x, y, color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x * y), uint8(255 - x)})
+		}
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 37, 19), color.Palette{color.Black, color.White, color.Gray{0x80}})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+
+	for _, m := range []image.Image{rgba, paletted} {
+		for s := FilterDefault; s <= FilterBruteForce; s++ {
+			var buf bytes.Buffer
+			enc := &Encoder{Filter: s}
+			if err := enc.Encode(&buf, m); err != nil {
+				t.Errorf("strategy %d: %v", s, err)
+				continue
+			}
+			filters, err := rowFilters(buf.Bytes())
+			if err != nil {
+				t.Errorf("strategy %d: %v", s, err)
+				continue
+			}
+			if len(filters) != m.Bounds().Dy() {
+				t.Errorf("strategy %d: got %d rows, want %d", s, len(filters), m.Bounds().Dy())
+			}
+			for _, f := range filters {
+				if FilterNone <= s && s <= FilterPaeth && int(f) != int(s-FilterNone) {
+					t.Errorf("strategy %d: got filter %d", s, f)
+					break
+				}
+			}
+			got, err := Decode(&buf)
+			if err != nil {
+				t.Errorf("strategy %d: %v", s, err)
+				continue
+			}
+			if err := diff(m, got); err != nil {
+				t.Errorf("strategy %d: %v", s, err)
+			}
+		}
+	}
+
+	if err := (&Encoder{Filter: FilterBruteForce + 1}).Encode(ioutil.Discard, rgba); err == nil {
+		t.Error("invalid filter strategy was accepted")
+	}
+}
+
+func TestWriteInterlaced(t *testing.T) {
+	var images []image.Image
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 1, 1),
+		image.Rect(0, 0, 3, 5),
+		image.Rect(2, 3, 41, 70),
+	} {
+		gray := image.NewGray(r)
+		gray16 := image.NewGray16(r)
+		rgba := image.NewRGBA(r)
+		nrgba := image.NewNRGBA(r)
+		rgba64 := image.NewRGBA64(r)
+		nrgba64 := image.NewNRGBA64(r)
+		var paletted []*image.Paletted
+		for _, n := range []int{2, 4, 16, 256} {
+			pal := make(color.Palette, n)
+			for i := range pal {
+				pal[i] = color.NRGBA{uint8(i), uint8(i * 3), uint8(255 - i), 0xff}
+			}
+			paletted = append(paletted, image.NewPaletted(r, pal))
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				v := uint8(x*7 + y*13)
+				gray.SetGray(x, y, color.Gray{v})
+				gray16.SetGray16(x, y, color.Gray16{uint16(x * y * 257)})
+				rgba.SetRGBA(x, y, color.RGBA{v, uint8(x), uint8(y), 0xff})
+				nrgba.SetNRGBA(x, y, color.NRGBA{v, uint8(x), uint8(y), uint8(x * y)})
+				rgba64.SetRGBA64(x, y, color.RGBA64{uint16(x * 999), uint16(y * 777), 7, 0xffff})
+				nrgba64.SetNRGBA64(x, y, color.NRGBA64{uint16(x * 999), uint16(y * 777), 7, uint16(x * y * 301)})
+				for _, p := range paletted {
+					p.SetColorIndex(x, y, uint8(int(v)%len(p.Palette)))
+				}
+			}
+		}
+		images = append(images, gray, gray16, rgba, nrgba, rgba64, nrgba64)
+		for _, p := range paletted {
+			images = append(images, p)
+		}
+	}
+
+	for _, m := range images {
+		for _, n := range []int{0, 3} {
+			desc := fmt.Sprintf("%T %v, concurrency %d", m, m.Bounds(), n)
+			var buf bytes.Buffer
+			enc := &Encoder{Interlace: true, Concurrency: n}
+			if err := enc.Encode(&buf, m); err != nil {
+				t.Errorf("%s: %v", desc, err)
+				continue
+			}
+			// The interlace method is the last byte of the IHDR data.
+			if b := buf.Bytes(); b[len(pngHeader)+8+12] != itAdam7 {
+				t.Errorf("%s: image isn't interlaced", desc)
+			}
+			got, err := Decode(&buf)
+			if err != nil {
+				t.Errorf("%s: %v", desc, err)
+				continue
+			}
+			if err := diff(m, got); err != nil {
+				t.Errorf("%s: %v", desc, err)
+			}
+		}
+	}
+}
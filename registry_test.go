@@ -0,0 +1,117 @@
+package image_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/drswork/image"
+
+	_ "github.com/drswork/image/gif"
+	_ "github.com/drswork/image/jpeg"
+	_ "github.com/drswork/image/png"
+)
+
+func TestRegistrySubset(t *testing.T) {
+	ctx := context.TODO()
+	r := image.DefaultRegistry.Subset("png", "jpeg")
+	got := r.Formats()
+	sort.Strings(got)
+	if want := []string{"jpeg", "png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got formats %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		filename string
+		format   string
+		err      error
+	}{
+		{"testdata/video-001.png", "png", nil},
+		{"testdata/video-001.jpeg", "jpeg", nil},
+		{"testdata/video-001.gif", "", image.ErrFormat},
+	} {
+		b, err := ioutil.ReadFile(tc.filename)
+		if err != nil {
+			t.Fatalf("Unable to read %s: %v", tc.filename, err)
+		}
+		_, name, err := r.DecodeImage(ctx, bytes.NewReader(b))
+		if err != tc.err || name != tc.format {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tc.filename, name, err, tc.format, tc.err)
+		}
+
+		// The default registry must be unaffected by the subset.
+		if _, _, err := image.DecodeImage(ctx, bytes.NewReader(b)); err != nil {
+			t.Errorf("%s: default registry decode failed: %v", tc.filename, err)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := r.EncodeWithOptions(ctx, &b, "gif", image.NewGray(image.Rect(0, 0, 1, 1))); err != image.ErrFormat {
+		t.Errorf("gif encode: got error %v, want %v", err, image.ErrFormat)
+	}
+}
+
+func TestRegistryEmpty(t *testing.T) {
+	r := image.NewRegistry()
+	b, err := ioutil.ReadFile("testdata/video-001.png")
+	if err != nil {
+		t.Fatalf("Unable to read test image: %v", err)
+	}
+	if _, _, _, err := r.DecodeWithOptions(context.TODO(), bytes.NewReader(b)); err != image.ErrFormat {
+		t.Errorf("DecodeWithOptions: got error %v, want %v", err, image.ErrFormat)
+	}
+	if _, _, err := r.DecodeConfig(bytes.NewReader(b)); err != image.ErrFormat {
+		t.Errorf("DecodeConfig: got error %v, want %v", err, image.ErrFormat)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		mimeType string
+		ext      string
+	}{
+		{"testdata/video-001.png", "image/png", ".png"},
+		{"testdata/video-001.jpeg", "image/jpeg", ".jpg"},
+		{"testdata/video-001.gif", "image/gif", ".gif"},
+	} {
+		b, err := ioutil.ReadFile(tc.filename)
+		if err != nil {
+			t.Fatalf("Unable to read %s: %v", tc.filename, err)
+		}
+		fi, r, err := image.DetectFormat(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: DetectFormat failed: %v", tc.filename, err)
+			continue
+		}
+		if fi.MIMEType != tc.mimeType || len(fi.Extensions) == 0 || fi.Extensions[0] != tc.ext {
+			t.Errorf("%s: got %+v, want MIME type %q and extension %q", tc.filename, fi, tc.mimeType, tc.ext)
+		}
+		// The returned reader must still yield the whole stream.
+		_, name, err := image.DecodeImage(context.TODO(), r)
+		if err != nil || name != fi.Name {
+			t.Errorf("%s: decode after detect got (%q, %v), want (%q, nil)", tc.filename, name, err, fi.Name)
+		}
+
+		if got, ok := image.FormatByMIMEType(tc.mimeType); !ok || got.Name != fi.Name {
+			t.Errorf("FormatByMIMEType(%q) = %+v, %v", tc.mimeType, got, ok)
+		}
+		if got, ok := image.FormatByExtension(strings.ToUpper(tc.ext[1:])); !ok || got.Name != fi.Name {
+			t.Errorf("FormatByExtension(%q) = %+v, %v", tc.ext, got, ok)
+		}
+	}
+
+	if _, _, err := image.DetectFormat(strings.NewReader("not an image")); err != image.ErrFormat {
+		t.Errorf("DetectFormat: got error %v, want %v", err, image.ErrFormat)
+	}
+	if _, ok := image.FormatByMIMEType("image/jpeg; q=0.9"); !ok {
+		t.Errorf("FormatByMIMEType did not ignore parameters")
+	}
+	if _, ok := image.FormatByExtension(".bmp"); ok {
+		t.Errorf("FormatByExtension(.bmp) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,140 @@
+package image
+
+import "fmt"
+
+// MetadataCategory identifies a kind of metadata, for use in a
+// StripMetadata policy.
+type MetadataCategory int
+
+const (
+	// MetadataGPS covers GPS coordinates and other location data, such
+	// as the EXIF GPS IFD and XMP location properties.
+	MetadataGPS MetadataCategory = iota
+	// MetadataMakerNotes covers camera manufacturer specific data, such
+	// as the EXIF MakerNote tag.
+	MetadataMakerNotes
+	// MetadataSerialNumbers covers camera and lens serial numbers.
+	MetadataSerialNumbers
+	// MetadataOwner covers the names of the image's owner, author or
+	// artist.
+	MetadataOwner
+	// MetadataThumbnail covers embedded thumbnail images.
+	MetadataThumbnail
+	// MetadataComments covers free-form comments, such as GIF comments
+	// and JPEG COM segments.
+	MetadataComments
+	// MetadataOrientation covers the image orientation.
+	MetadataOrientation
+	// MetadataColorProfile covers ICC color profiles and other color
+	// space information.
+	MetadataColorProfile
+	// MetadataOther covers all metadata that isn't in another
+	// category. This includes opaque data, such as IPTC blocks and
+	// unknown application segments, that may hold anything at all.
+	MetadataOther
+)
+
+// String returns a human readable name for the category.
+func (c MetadataCategory) String() string {
+	switch c {
+	case MetadataGPS:
+		return "GPS"
+	case MetadataMakerNotes:
+		return "maker notes"
+	case MetadataSerialNumbers:
+		return "serial numbers"
+	case MetadataOwner:
+		return "owner"
+	case MetadataThumbnail:
+		return "thumbnail"
+	case MetadataComments:
+		return "comments"
+	case MetadataOrientation:
+		return "orientation"
+	case MetadataColorProfile:
+		return "color profile"
+	case MetadataOther:
+		return "other"
+	default:
+		return fmt.Sprintf("MetadataCategory(%d)", int(c))
+	}
+}
+
+// StripMetadata is a write option that removes metadata from an
+// image as it's written. A category of metadata is removed if it's
+// listed in Deny, or if Allow is non-empty and the category isn't
+// listed in it. Deny takes precedence over Allow.
+//
+// For example, to remove everything but the orientation and color
+// profile:
+//
+//	s := &image.StripMetadata{
+//		Allow: []image.MetadataCategory{image.MetadataOrientation, image.MetadataColorProfile},
+//	}
+//
+// The metadata passed to the encoder isn't modified. Metadata that's
+// needed to decode the image correctly, such as image dimensions, is
+// never removed.
+//
+// Encoders don't modify the policy, so one policy can be used for any
+// number of images, including concurrently as long as its Report
+// function is safe to call concurrently.
+type StripMetadata struct {
+	// Allow lists the categories of metadata to keep.
+	Allow []MetadataCategory
+	// Deny lists the categories of metadata to remove.
+	Deny []MetadataCategory
+
+	// Report, if set, is called by the encoder with a description of
+	// each piece of metadata it removes.
+	Report func(StrippedMetadata)
+}
+
+// StrippedMetadata describes a piece of metadata that was removed by
+// a StripMetadata policy.
+type StrippedMetadata struct {
+	Category MetadataCategory
+	// Description says what was removed, for example "EXIF GPS IFD".
+	Description string
+}
+
+// IsImageWriteOption is a no-op function which exists to satisfy the
+// WriteOption interface.
+func (_ *StripMetadata) IsImageWriteOption() {
+}
+
+// Strips reports whether metadata in category c should be removed. It
+// returns false for a nil policy.
+func (s *StripMetadata) Strips(c MetadataCategory) bool {
+	if s == nil {
+		return false
+	}
+	for _, d := range s.Deny {
+		if d == c {
+			return true
+		}
+	}
+	if len(s.Allow) == 0 {
+		return false
+	}
+	for _, a := range s.Allow {
+		if a == c {
+			return false
+		}
+	}
+	return true
+}
+
+// StripsAny reports whether metadata in any category should be
+// removed.
+func (s *StripMetadata) StripsAny() bool {
+	return s != nil && (len(s.Deny) > 0 || len(s.Allow) > 0)
+}
+
+// Record reports that the metadata described by desc, in category c,
+// was removed. It's called by image encoders.
+func (s *StripMetadata) Record(c MetadataCategory, desc string) {
+	if s.Report != nil {
+		s.Report(StrippedMetadata{Category: c, Description: desc})
+	}
+}
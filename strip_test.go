@@ -0,0 +1,35 @@
+package image
+
+import "testing"
+
+func TestStripMetadataStrips(t *testing.T) {
+	for _, tc := range []struct {
+		s    *StripMetadata
+		c    MetadataCategory
+		want bool
+	}{
+		{nil, MetadataGPS, false},
+		{&StripMetadata{}, MetadataGPS, false},
+		{&StripMetadata{Deny: []MetadataCategory{MetadataGPS}}, MetadataGPS, true},
+		{&StripMetadata{Deny: []MetadataCategory{MetadataGPS}}, MetadataOwner, false},
+		{&StripMetadata{Allow: []MetadataCategory{MetadataOrientation}}, MetadataOrientation, false},
+		{&StripMetadata{Allow: []MetadataCategory{MetadataOrientation}}, MetadataOther, true},
+		{&StripMetadata{Allow: []MetadataCategory{MetadataGPS}, Deny: []MetadataCategory{MetadataGPS}}, MetadataGPS, true},
+	} {
+		if got := tc.s.Strips(tc.c); got != tc.want {
+			t.Errorf("%+v: Strips(%v) = %v, want %v", tc.s, tc.c, got, tc.want)
+		}
+	}
+}
+
+func TestStripMetadataRecord(t *testing.T) {
+	s := &StripMetadata{Deny: []MetadataCategory{MetadataGPS}}
+	s.Record(MetadataGPS, "no report function")
+
+	var got []StrippedMetadata
+	s.Report = func(r StrippedMetadata) { got = append(got, r) }
+	s.Record(MetadataGPS, "GPS data")
+	if len(got) != 1 || got[0] != (StrippedMetadata{MetadataGPS, "GPS data"}) {
+		t.Errorf("got reports %v", got)
+	}
+}